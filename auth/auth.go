@@ -0,0 +1,36 @@
+// Package auth implements MQTT 5 enhanced authentication, ie the
+// challenge/response exchange carried in the Authentication Method and
+// Authentication Data properties of the CONNECT, CONNACK and AUTH
+// packets. The broker runs the exchange through a Mechanism named by the
+// Authentication Method the client sets, so that no password need be
+// sent over the wire. SCRAM-SHA-256 is provided, other mechanisms can be
+// plugged in by implementing Mechanism.
+package auth
+
+import "errors"
+
+// ErrFailed is returned by an Exchange when the client fails to
+// authenticate, whether its credentials are wrong or its data malformed
+var ErrFailed = errors.New("auth: authentication failed")
+
+// Mechanism implements an enhanced authentication method
+type Mechanism interface {
+	// Name returns the Authentication Method clients set to use the
+	// mechanism, eg SCRAM-SHA-256
+	Name() string
+	// Start begins an exchange with a client, either on connecting or
+	// re-authenticating. The client ID is empty if the client left it to
+	// the broker to assign one. Start is called concurrently for clients
+	// authenticating at the same time
+	Start(clientID string) Exchange
+}
+
+// Exchange runs a single authentication exchange with a client
+type Exchange interface {
+	// Step is given the Authentication Data sent by the client and
+	// returns the data to send back. done is true once the client is
+	// authenticated, the data then being sent along with the outcome.
+	// Otherwise the exchange continues with the client's reply. An error
+	// ends the exchange with the client refused
+	Step(data []byte) (resp []byte, done bool, err error)
+}
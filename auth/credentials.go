@@ -0,0 +1,179 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultIterations is the number of PBKDF2 iterations applied to
+// passwords by default, the minimum recommended by RFC 7677
+const DefaultIterations = 4096
+
+const saltLen = 16
+
+// Credentials are what's kept to verify a SCRAM-SHA-256 client: keys
+// derived from its password, never the password itself
+type Credentials struct {
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+// NewCredentials derives the credentials of a user from its password
+// with a random salt. Iterations below DefaultIterations are raised to it
+func NewCredentials(password string, iterations int) (Credentials, error) {
+	if iterations < DefaultIterations {
+		iterations = DefaultIterations
+	}
+	salt := make([]byte, saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return Credentials{}, err
+	}
+	return deriveCredentials(password, salt, iterations), nil
+}
+
+// deriveCredentials derives credentials as per RFC 5802. Passwords are
+// used as given, without SASLprep
+func deriveCredentials(password string, salt []byte, iterations int) Credentials {
+	salted := hi([]byte(password), salt, iterations)
+	clientKey := hmacSum(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	return Credentials{
+		Salt:       salt,
+		Iterations: iterations,
+		StoredKey:  storedKey[:],
+		ServerKey:  hmacSum(salted, "Server Key"),
+	}
+}
+
+// String encodes the credentials as iterations:salt:storedKey:serverKey,
+// keys and salt in base64, as held in credentials files
+func (c Credentials) String() string {
+	enc := base64.StdEncoding.EncodeToString
+	return fmt.Sprintf("%d:%s:%s:%s", c.Iterations, enc(c.Salt), enc(c.StoredKey), enc(c.ServerKey))
+}
+
+// ParseCredentials parses credentials encoded by Credentials.String
+func ParseCredentials(s string) (Credentials, error) {
+	fields := strings.Split(s, ":")
+	if len(fields) != 4 {
+		return Credentials{}, errors.New("auth: malformed credentials")
+	}
+	var c Credentials
+	var err error
+	if c.Iterations, err = strconv.Atoi(fields[0]); err != nil || c.Iterations <= 0 {
+		return Credentials{}, errors.New("auth: malformed credentials iterations")
+	}
+	for i, dst := range []*[]byte{&c.Salt, &c.StoredKey, &c.ServerKey} {
+		if *dst, err = base64.StdEncoding.DecodeString(fields[i+1]); err != nil {
+			return Credentials{}, fmt.Errorf("auth: malformed credentials: %w", err)
+		}
+	}
+	if len(c.StoredKey) != sha256.Size || len(c.ServerKey) != sha256.Size {
+		return Credentials{}, errors.New("auth: malformed credentials keys")
+	}
+	return c, nil
+}
+
+// CredentialStore looks up the credentials of users. Lookup is called
+// concurrently for clients authenticating at the same time
+type CredentialStore interface {
+	Lookup(username string) (Credentials, bool)
+}
+
+// MemoryCredentials is a CredentialStore held in memory. It's safe for
+// concurrent use
+type MemoryCredentials struct {
+	mu    sync.RWMutex
+	users map[string]Credentials
+}
+
+// NewMemoryCredentials returns an empty MemoryCredentials
+func NewMemoryCredentials() *MemoryCredentials {
+	return &MemoryCredentials{users: make(map[string]Credentials)}
+}
+
+// Set sets the credentials of a user, replacing any it had
+func (m *MemoryCredentials) Set(username string, c Credentials) {
+	m.mu.Lock()
+	m.users[username] = c
+	m.mu.Unlock()
+}
+
+// Delete removes a user
+func (m *MemoryCredentials) Delete(username string) {
+	m.mu.Lock()
+	delete(m.users, username)
+	m.mu.Unlock()
+}
+
+// Lookup implements CredentialStore
+func (m *MemoryCredentials) Lookup(username string) (Credentials, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	c, ok := m.users[username]
+	return c, ok
+}
+
+// ReadCredentials reads a credentials file holding a user per line as
+// username:credentials, credentials as encoded by Credentials.String.
+// Blank lines and lines starting with # are skipped
+func ReadCredentials(r io.Reader) (*MemoryCredentials, error) {
+	m := NewMemoryCredentials()
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// usernames may hold colons, credentials don't
+		fields := strings.Split(line, ":")
+		if len(fields) < 5 {
+			return nil, fmt.Errorf("auth: line %d: malformed credentials", n)
+		}
+		split := len(fields) - 4
+		c, err := ParseCredentials(strings.Join(fields[split:], ":"))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		m.Set(strings.Join(fields[:split], ":"), c)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// hi is PBKDF2 with HMAC-SHA-256 yielding a single block, as per RFC 5802
+func hi(password, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, password)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	out := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range out {
+			out[j] ^= u[j]
+		}
+	}
+	return out
+}
+
+func hmacSum(key []byte, msg string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(msg))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,47 @@
+package auth
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCredentialsEncoding(t *testing.T) {
+	c, err := NewCredentials("secret", 5000)
+	require.NoError(t, err)
+	require.Equal(t, 5000, c.Iterations)
+	parsed, err := ParseCredentials(c.String())
+	require.NoError(t, err)
+	require.Equal(t, c, parsed)
+
+	for _, s := range []string{"", "4096:a:b", "x:AA==:AA==:AA==", "4096:AA==:AA==:AA=="} {
+		_, err := ParseCredentials(s)
+		require.Error(t, err, s)
+	}
+}
+
+func TestReadCredentials(t *testing.T) {
+	a, err := NewCredentials("a", 0)
+	require.NoError(t, err)
+	b, err := NewCredentials("b", 0)
+	require.NoError(t, err)
+	creds, err := ReadCredentials(strings.NewReader(
+		"# users\n\nalice:" + a.String() + "\n  b:o:b:" + b.String() + "\n"))
+	require.NoError(t, err)
+	got, ok := creds.Lookup("alice")
+	require.True(t, ok)
+	require.Equal(t, a, got)
+	got, ok = creds.Lookup("b:o:b")
+	require.True(t, ok)
+	require.Equal(t, b, got)
+	_, ok = creds.Lookup("carol")
+	require.False(t, ok)
+
+	creds.Delete("alice")
+	_, ok = creds.Lookup("alice")
+	require.False(t, ok)
+
+	_, err = ReadCredentials(strings.NewReader("alice:" + a.String() + "\nbob\n"))
+	require.EqualError(t, err, "auth: line 2: malformed credentials")
+}
@@ -0,0 +1,238 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// SCRAMSHA256 is the Authentication Method of the SCRAM-SHA-256 mechanism
+const SCRAMSHA256 = "SCRAM-SHA-256"
+
+// SCRAM implements the SCRAM-SHA-256 mechanism of RFC 7677, verifying
+// clients against a CredentialStore. The client sends its client-first
+// message in the CONNECT's Authentication Data, the broker replies with
+// its server-first message in an AUTH packet, the client sends its
+// client-final message in an AUTH packet and the broker sends its
+// server-final message along with the outcome. Channel binding is not
+// supported
+type SCRAM struct {
+	creds CredentialStore
+	nonce func() string
+	// fakeKey makes up the salt of unknown users, so that they can't be
+	// told apart from known ones
+	fakeKey []byte
+}
+
+// NewSCRAM returns a SCRAM-SHA-256 mechanism verifying clients against
+// the given credentials
+func NewSCRAM(creds CredentialStore) *SCRAM {
+	fakeKey := make([]byte, sha256.Size)
+	rand.Read(fakeKey)
+	return &SCRAM{creds: creds, nonce: newNonce, fakeKey: fakeKey}
+}
+
+// Name implements Mechanism
+func (s *SCRAM) Name() string {
+	return SCRAMSHA256
+}
+
+// Start implements Mechanism
+func (s *SCRAM) Start(clientID string) Exchange {
+	return &scramExchange{scram: s}
+}
+
+// scramExchange runs the server side of a SCRAM exchange
+type scramExchange struct {
+	scram     *SCRAM
+	step      int
+	creds     Credentials
+	known     bool
+	gs2Header string
+	nonce     string
+	authMsg   string // client-first-bare plus server-first so far
+}
+
+// Step implements Exchange
+func (e *scramExchange) Step(data []byte) ([]byte, bool, error) {
+	e.step++
+	switch e.step {
+	case 1:
+		resp, err := e.serverFirst(string(data))
+		return resp, false, err
+	case 2:
+		resp, err := e.serverFinal(string(data))
+		return resp, err == nil, err
+	}
+	return nil, false, ErrFailed
+}
+
+// serverFirst handles the client-first message: gs2-header followed by
+// n=username,r=client-nonce
+func (e *scramExchange) serverFirst(msg string) ([]byte, error) {
+	if !strings.HasPrefix(msg, "n,") && !strings.HasPrefix(msg, "y,") {
+		return nil, fmt.Errorf("%w: unsupported channel binding", ErrFailed)
+	}
+	i := strings.IndexByte(msg[2:], ',')
+	if i < 0 {
+		return nil, fmt.Errorf("%w: malformed client-first message", ErrFailed)
+	}
+	e.gs2Header = msg[:2+i+1]
+	bare := msg[2+i+1:]
+	attrs := strings.Split(bare, ",")
+	if len(attrs) < 2 || !strings.HasPrefix(attrs[0], "n=") || !strings.HasPrefix(attrs[1], "r=") || len(attrs[1]) == 2 {
+		return nil, fmt.Errorf("%w: malformed client-first message", ErrFailed)
+	}
+	username, ok := unescapeUsername(attrs[0][2:])
+	if !ok {
+		return nil, fmt.Errorf("%w: malformed username", ErrFailed)
+	}
+
+	e.creds, e.known = e.scram.creds.Lookup(username)
+	if !e.known {
+		e.creds = Credentials{
+			Salt:       hmacSum(e.scram.fakeKey, username)[:saltLen],
+			Iterations: DefaultIterations,
+		}
+	}
+	e.nonce = attrs[1][2:] + e.scram.nonce()
+	first := fmt.Sprintf("r=%s,s=%s,i=%d",
+		e.nonce, base64.StdEncoding.EncodeToString(e.creds.Salt), e.creds.Iterations)
+	e.authMsg = bare + "," + first
+	return []byte(first), nil
+}
+
+// serverFinal verifies the client-final message, c=channel-binding,
+// r=nonce,p=proof, returning v=server-signature
+func (e *scramExchange) serverFinal(msg string) ([]byte, error) {
+	i := strings.LastIndex(msg, ",p=")
+	if i < 0 {
+		return nil, fmt.Errorf("%w: malformed client-final message", ErrFailed)
+	}
+	withoutProof := msg[:i]
+	attrs := strings.Split(withoutProof, ",")
+	if len(attrs) < 2 ||
+		attrs[0] != "c="+base64.StdEncoding.EncodeToString([]byte(e.gs2Header)) ||
+		attrs[1] != "r="+e.nonce {
+		return nil, fmt.Errorf("%w: client-final message doesn't match", ErrFailed)
+	}
+	proof, err := base64.StdEncoding.DecodeString(msg[i+3:])
+	if err != nil || len(proof) != sha256.Size {
+		return nil, fmt.Errorf("%w: malformed proof", ErrFailed)
+	}
+
+	authMsg := e.authMsg + "," + withoutProof
+	clientKey := hmacSum(e.creds.StoredKey, authMsg)
+	for j := range clientKey {
+		clientKey[j] ^= proof[j]
+	}
+	storedKey := sha256.Sum256(clientKey)
+	if subtle.ConstantTimeCompare(storedKey[:], e.creds.StoredKey) != 1 || !e.known {
+		return nil, fmt.Errorf("%w: invalid proof", ErrFailed)
+	}
+	sig := hmacSum(e.creds.ServerKey, authMsg)
+	return []byte("v=" + base64.StdEncoding.EncodeToString(sig)), nil
+}
+
+// SCRAMClient runs the client side of a SCRAM-SHA-256 exchange
+type SCRAMClient struct {
+	username string
+	password string
+	nonce    string
+	authMsg  string
+	salted   []byte
+}
+
+// NewSCRAMClient returns a client authenticating with the given username
+// and password
+func NewSCRAMClient(username, password string) *SCRAMClient {
+	return &SCRAMClient{username: username, password: password, nonce: newNonce()}
+}
+
+// First returns the client-first message, sent in the CONNECT's
+// Authentication Data or the AUTH packet re-authenticating the client
+func (c *SCRAMClient) First() []byte {
+	c.authMsg = "n=" + escapeUsername(c.username) + ",r=" + c.nonce
+	return []byte("n,," + c.authMsg)
+}
+
+// Final returns the client-final message in reply to the broker's
+// server-first message
+func (c *SCRAMClient) Final(serverFirst []byte) ([]byte, error) {
+	attrs := strings.Split(string(serverFirst), ",")
+	if len(attrs) < 3 || !strings.HasPrefix(attrs[0], "r="+c.nonce) ||
+		!strings.HasPrefix(attrs[1], "s=") || !strings.HasPrefix(attrs[2], "i=") {
+		return nil, fmt.Errorf("%w: malformed server-first message", ErrFailed)
+	}
+	salt, err := base64.StdEncoding.DecodeString(attrs[1][2:])
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed salt", ErrFailed)
+	}
+	iterations, err := strconv.Atoi(attrs[2][2:])
+	if err != nil || iterations <= 0 {
+		return nil, fmt.Errorf("%w: malformed iteration count", ErrFailed)
+	}
+
+	withoutProof := "c=biws," + attrs[0] // biws is n,, in base64
+	c.authMsg += "," + string(serverFirst) + "," + withoutProof
+	c.salted = hi([]byte(c.password), salt, iterations)
+	clientKey := hmacSum(c.salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	proof := hmacSum(storedKey[:], c.authMsg)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	return []byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+// Verify checks the broker's server-final message, ie that the broker
+// holds the client's credentials
+func (c *SCRAMClient) Verify(serverFinal []byte) error {
+	if c.salted == nil {
+		return fmt.Errorf("%w: exchange not complete", ErrFailed)
+	}
+	sig := hmacSum(hmacSum(c.salted, "Server Key"), c.authMsg)
+	want := "v=" + base64.StdEncoding.EncodeToString(sig)
+	if !hmac.Equal([]byte(want), serverFinal) {
+		return fmt.Errorf("%w: invalid server signature", ErrFailed)
+	}
+	return nil
+}
+
+// newNonce returns a random printable nonce without commas
+func newNonce() string {
+	b := make([]byte, 18)
+	rand.Read(b)
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// escapeUsername escapes the commas and equal signs of a username
+func escapeUsername(s string) string {
+	return strings.NewReplacer("=", "=3D", ",", "=2C").Replace(s)
+}
+
+// unescapeUsername reverses escapeUsername, rejecting stray equal signs
+func unescapeUsername(s string) (string, bool) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '=' {
+			b.WriteByte(s[i])
+			continue
+		}
+		switch {
+		case strings.HasPrefix(s[i:], "=2C"):
+			b.WriteByte(',')
+		case strings.HasPrefix(s[i:], "=3D"):
+			b.WriteByte('=')
+		default:
+			return "", false
+		}
+		i += 2
+	}
+	return b.String(), true
+}
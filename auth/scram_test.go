@@ -0,0 +1,97 @@
+package auth
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSCRAMRFC7677(t *testing.T) {
+	salt, err := base64.StdEncoding.DecodeString("W22ZaJ0SNY7soEsUEjb6gQ==")
+	require.NoError(t, err)
+	creds := NewMemoryCredentials()
+	creds.Set("user", deriveCredentials("pencil", salt, 4096))
+	s := NewSCRAM(creds)
+	s.nonce = func() string { return "%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0" }
+	c := NewSCRAMClient("user", "pencil")
+	c.nonce = "rOprNGfwEbeRWgbNEkqO"
+
+	ex := s.Start("")
+	first := c.First()
+	require.Equal(t, "n,,n=user,r=rOprNGfwEbeRWgbNEkqO", string(first))
+	serverFirst, done, err := ex.Step(first)
+	require.NoError(t, err)
+	require.False(t, done)
+	require.Equal(t, "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096", string(serverFirst))
+	final, err := c.Final(serverFirst)
+	require.NoError(t, err)
+	require.Equal(t, "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=", string(final))
+	serverFinal, done, err := ex.Step(final)
+	require.NoError(t, err)
+	require.True(t, done)
+	require.Equal(t, "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=", string(serverFinal))
+	require.NoError(t, c.Verify(serverFinal))
+
+	// the exchange is over
+	_, _, err = ex.Step(final)
+	require.Equal(t, ErrFailed, err)
+}
+
+func TestSCRAMRefusesClients(t *testing.T) {
+	creds := NewMemoryCredentials()
+	c, err := NewCredentials("secret", 0)
+	require.NoError(t, err)
+	require.Equal(t, DefaultIterations, c.Iterations)
+	creds.Set("a,b=c", c)
+	s := NewSCRAM(creds)
+
+	run := func(username, password string) error {
+		c := NewSCRAMClient(username, password)
+		ex := s.Start("id")
+		serverFirst, _, err := ex.Step(c.First())
+		if err != nil {
+			return err
+		}
+		final, err := c.Final(serverFirst)
+		require.NoError(t, err)
+		serverFinal, done, err := ex.Step(final)
+		if err != nil {
+			return err
+		}
+		require.True(t, done)
+		return c.Verify(serverFinal)
+	}
+	require.NoError(t, run("a,b=c", "secret"))
+	require.True(t, errors.Is(run("a,b=c", "wrong"), ErrFailed))
+	require.True(t, errors.Is(run("unknown", "secret"), ErrFailed))
+
+	// unknown users get the same salt each time, like known ones
+	salt := func(username string) string {
+		resp, _, err := s.Start("").Step(NewSCRAMClient(username, "").First())
+		require.NoError(t, err)
+		return strings.Split(string(resp), ",")[1]
+	}
+	require.Equal(t, salt("unknown"), salt("unknown"))
+	require.NotEqual(t, salt("unknown"), salt("other"))
+
+	for _, msg := range []string{
+		"",
+		"p=tls-unique,,n=a,r=x",
+		"n,,n=a",
+		"n,,r=x,n=a",
+		"n,,n=a=,r=x",
+	} {
+		_, _, err := s.Start("").Step([]byte(msg))
+		require.True(t, errors.Is(err, ErrFailed), msg)
+	}
+
+	// the client-final message must carry the nonce and gs2 header
+	ex := s.Start("")
+	_, _, err = ex.Step([]byte("n,,n=a,r=x"))
+	require.NoError(t, err)
+	_, _, err = ex.Step([]byte("c=biws,r=x,p=" + base64.StdEncoding.EncodeToString(make([]byte, 32))))
+	require.True(t, errors.Is(err, ErrFailed))
+}
@@ -0,0 +1,343 @@
+// Package broker provides an MQTT broker that can be embedded in Go
+// programs. The broker serves MQTT clients over any number of listeners
+// while the host program can publish and subscribe in-process:
+//
+//	b, err := broker.New(broker.WithDataDir("data"))
+//	if err != nil {
+//		return err
+//	}
+//	unsubscribe, err := b.Subscribe("sensors/+/temp", func(msg broker.Message) {
+//		log.Printf("%s: %s", msg.Topic, msg.Payload)
+//	})
+//	...
+//	l, err := net.Listen("tcp", ":1883")
+//	...
+//	go b.Serve(l)
+//	...
+//	b.Shutdown(ctx)
+package broker
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/nagamocha3000/go-mqtt-broker/auth"
+	ib "github.com/nagamocha3000/go-mqtt-broker/internal/broker"
+	"github.com/nagamocha3000/go-mqtt-broker/internal/logging"
+	"github.com/nagamocha3000/go-mqtt-broker/internal/server"
+	"github.com/nagamocha3000/go-mqtt-broker/internal/store"
+)
+
+// ErrClosed is returned by Serve once the broker is shut down and
+// when using a broker that's already shut down
+var ErrClosed = errors.New("broker: closed")
+
+// ErrInvalidTopic is returned when publishing to a topic name that is
+// invalid or has wildcards, or subscribing to an invalid topic filter
+var ErrInvalidTopic = errors.New("broker: invalid topic")
+
+// ErrInvalidQoS is returned when a QoS other than 0, 1 or 2 is given
+var ErrInvalidQoS = errors.New("broker: invalid QoS")
+
+// Message holds an MQTT application message
+type Message struct {
+	Topic   string
+	Payload []byte
+	QoS     byte
+	Retain  bool
+}
+
+// Broker is an MQTT broker. It's safe for concurrent use
+type Broker struct {
+	broker *ib.Broker
+	store  store.Store
+	logger logging.Logger
+
+	serverOpts []server.Option
+
+	mu      sync.Mutex
+	servers map[*server.Server]struct{}
+	closed  bool
+}
+
+type config struct {
+	logger        logging.Logger
+	dataDir       string
+	authenticator Authenticator
+	mechanisms    []auth.Mechanism
+	stamps        PropertyStamps
+	hooks         []Hook
+	maxConns      int
+	maxConnsPerIP int
+	err           error
+}
+
+// Option configures an optional setting on the Broker
+type Option func(*config)
+
+// WithLogOutput writes the broker's logs to w in JSON at the given
+// level: debug, info, warn or error. By default nothing is logged
+func WithLogOutput(w io.Writer, level string) Option {
+	return func(c *config) {
+		l, err := logging.ParseLevel(level)
+		if err != nil {
+			c.err = err
+			return
+		}
+		c.logger = logging.New(w, logging.JSONFormat, l)
+	}
+}
+
+// WithDataDir persists sessions and retained messages in the given
+// directory so that they survive restarts. By default they're only
+// held in memory
+func WithDataDir(dir string) Option {
+	return func(c *config) {
+		c.dataDir = dir
+	}
+}
+
+// WithAuthenticator sets the authenticator clients are checked against
+// on connecting. By default, all clients are let in
+func WithAuthenticator(a Authenticator) Option {
+	return func(c *config) {
+		c.authenticator = a
+	}
+}
+
+// WithAuthMechanism lets MQTT 5 clients authenticate through the given
+// enhanced authentication mechanism, eg auth.NewSCRAM for SCRAM-SHA-256,
+// rather than send a password. Once a mechanism is set, clients that
+// don't use one are refused unless an Authenticator is set too
+func WithAuthMechanism(m auth.Mechanism) Option {
+	return func(c *config) {
+		c.mechanisms = append(c.mechanisms, m)
+	}
+}
+
+// PropertyStamps names the MQTT 5 User Properties the broker adds to
+// the messages clients publish before routing them, eg for tracing.
+// Stamps with an empty name aren't added. User Properties the publisher
+// set with the same names are dropped
+type PropertyStamps struct {
+	// ReceivedAt is set to when the broker received the message, in
+	// RFC 3339 format with nanoseconds, in UTC
+	ReceivedAt string
+	// Publisher is set to the publisher's client ID
+	Publisher string
+	// Listener is set to the address of the listener the publisher
+	// connected through, empty for connections from Dial
+	Listener string
+}
+
+// WithPropertyStamps sets the User Properties the broker adds to the
+// messages clients publish. By default none are added
+func WithPropertyStamps(s PropertyStamps) Option {
+	return func(c *config) {
+		c.stamps = s
+	}
+}
+
+// WithHook adds a hook to be notified of client activity. Hooks are
+// called in the order they're added
+func WithHook(h Hook) Option {
+	return func(c *config) {
+		c.hooks = append(c.hooks, h)
+	}
+}
+
+// WithMaxConns caps the number of connections that can be open on
+// each listener at any given time. A value of 0 means no cap
+func WithMaxConns(n int) Option {
+	return func(c *config) {
+		c.maxConns = n
+	}
+}
+
+// WithMaxConnsPerIP caps the number of connections that can be open
+// on each listener from a single source IP. A value of 0 means no cap
+func WithMaxConnsPerIP(n int) Option {
+	return func(c *config) {
+		c.maxConnsPerIP = n
+	}
+}
+
+// New returns a broker ready to serve clients. If a data directory is
+// set, the broker's state is rebuilt from it
+func New(opts ...Option) (*Broker, error) {
+	c := &config{logger: logging.Nop()}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	var st store.Store = store.NewMemoryStore()
+	if c.dataDir != "" {
+		fs, err := store.Open(c.dataDir)
+		if err != nil {
+			return nil, err
+		}
+		st = fs
+	}
+	brokerOpts := []ib.Option{
+		ib.WithLogger(c.logger),
+		ib.WithStore(st),
+		ib.WithPropertyStamps(ib.PropertyStamps(c.stamps)),
+	}
+	if c.authenticator != nil {
+		brokerOpts = append(brokerOpts, ib.WithAuthenticator(authenticator{c.authenticator}))
+	}
+	for _, m := range c.mechanisms {
+		brokerOpts = append(brokerOpts, ib.WithAuthMechanism(m))
+	}
+	for _, h := range c.hooks {
+		brokerOpts = append(brokerOpts, ib.WithHook(hook{h}))
+	}
+	return &Broker{
+		broker: ib.NewBroker(brokerOpts...),
+		store:  st,
+		logger: c.logger,
+		serverOpts: []server.Option{
+			server.WithLogger(c.logger),
+			server.WithMaxConns(c.maxConns),
+			server.WithMaxConnsPerIP(c.maxConnsPerIP),
+		},
+		servers: make(map[*server.Server]struct{}),
+	}, nil
+}
+
+// connHandler hands connections to the broker. Closing a server
+// shouldn't close the broker since it might be serving other listeners
+type connHandler struct {
+	broker   *ib.Broker
+	listener string
+}
+
+func (h connHandler) OnConn(conn net.Conn) { h.broker.OnListenerConn(conn, h.listener) }
+func (h connHandler) Close()               {}
+
+// Serve accepts MQTT clients on the given listener, blocking until the
+// listener fails or the broker is shut down in which case ErrClosed is
+// returned. Transient accept errors, eg running out of file descriptors,
+// are retried with a backoff while others, eg the listener being closed,
+// are returned. The listener is closed once Serve returns. Serve can be
+// called with several listeners, eg one for TCP and another for TLS
+func (b *Broker) Serve(l net.Listener) error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		l.Close()
+		return ErrClosed
+	}
+	s := server.NewServerWithListener(l, connHandler{b.broker, l.Addr().String()}, b.serverOpts...)
+	b.servers[s] = struct{}{}
+	b.mu.Unlock()
+
+	err := s.Wait()
+	s.Stop()
+	b.mu.Lock()
+	delete(b.servers, s)
+	closed := b.closed
+	b.mu.Unlock()
+	if closed {
+		return ErrClosed
+	}
+	return err
+}
+
+// Dial returns a connection to the broker within the same process, without
+// going through the network. The broker handles the connection like any
+// other client's: the client should start off by sending CONNECT and gets
+// the full MQTT semantics, eg QoS 1 & 2, retained and will messages.
+// Connection limits don't apply since no listener is involved. The
+// connection is synchronous, with no buffering, hence the client should
+// keep reading while writing, as it would over TCP
+func (b *Broker) Dial() (net.Conn, error) {
+	if b.isClosed() {
+		return nil, ErrClosed
+	}
+	serverSide, clientSide := net.Pipe()
+	b.broker.OnConn(serverSide)
+	return clientSide, nil
+}
+
+// Shutdown stops accepting clients on all listeners, disconnects all
+// clients then persists the broker's state. If ctx expires first, its
+// error is returned and shutting down carries on in the background
+func (b *Broker) Shutdown(ctx context.Context) error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return ErrClosed
+	}
+	b.closed = true
+	servers := make([]*server.Server, 0, len(b.servers))
+	for s := range b.servers {
+		servers = append(servers, s)
+	}
+	b.mu.Unlock()
+
+	doneCh := make(chan error, 1)
+	go func() {
+		for _, s := range servers {
+			s.Stop()
+		}
+		b.broker.Close()
+		doneCh <- b.store.Close()
+	}()
+	select {
+	case err := <-doneCh:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Publish publishes a message to all clients and in-process subscribers
+// whose subscriptions match the topic, as if it were published by a
+// client. The topic should be a valid topic name, ie without wildcards
+func (b *Broker) Publish(topic string, payload []byte, qos byte, retain bool) error {
+	if b.isClosed() {
+		return ErrClosed
+	}
+	return publicErr(b.broker.Publish(topic, payload, qos, retain))
+}
+
+// Subscribe calls handler with every message published on topics that
+// match the given topic filter, starting with matching retained messages.
+// handler is called from a single goroutine per subscription in the order
+// messages are published, and should not block for long since that holds
+// up publishers. The returned function unsubscribes the handler
+func (b *Broker) Subscribe(filter string, handler func(Message)) (unsubscribe func(), err error) {
+	if b.isClosed() {
+		return nil, ErrClosed
+	}
+	unsubscribe, err = b.broker.Subscribe(filter, func(topic string, payload []byte, qos byte, retain bool) {
+		handler(Message{Topic: topic, Payload: payload, QoS: qos, Retain: retain})
+	})
+	return unsubscribe, publicErr(err)
+}
+
+func (b *Broker) isClosed() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.closed
+}
+
+// publicErr maps errors of the internal broker to the package's own
+func publicErr(err error) error {
+	switch err {
+	case ib.ErrInvalidTopicName:
+		return ErrInvalidTopic
+	case ib.ErrInvalidQoS:
+		return ErrInvalidQoS
+	case ib.ErrClosed:
+		return ErrClosed
+	}
+	return err
+}
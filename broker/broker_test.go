@@ -0,0 +1,285 @@
+package broker
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nagamocha3000/go-mqtt-broker/internal/protocol"
+	"github.com/stretchr/testify/require"
+)
+
+// testConn is a bare-bones MQTT client over TCP
+type testConn struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dial(t *testing.T, addr net.Addr, cfg *protocol.ConnectPacketConfig) (*testConn, protocol.ConnectReturnCode) {
+	conn, err := net.Dial("tcp", addr.String())
+	require.NoError(t, err)
+	return connect(t, conn, cfg)
+}
+
+// connect sends CONNECT over conn, returning the code the broker responds with
+func connect(t *testing.T, conn net.Conn, cfg *protocol.ConnectPacketConfig) (*testConn, protocol.ConnectReturnCode) {
+	c := &testConn{t: t, conn: conn, r: bufio.NewReader(conn)}
+	pkt, err := protocol.NewConnectPacket(cfg)
+	require.NoError(t, err)
+	c.send(pkt)
+	f, payload := c.read()
+	require.Equal(t, protocol.Connack, f.PktType)
+	connack, err := protocol.DeserializeConnackPktPayload(f, payload)
+	require.NoError(t, err)
+	return c, connack.Code
+}
+
+func (c *testConn) send(pkt protocol.Packet) {
+	buf, err := pkt.Serialize(nil)
+	require.NoError(c.t, err)
+	_, err = c.conn.Write(buf)
+	require.NoError(c.t, err)
+}
+
+func (c *testConn) read() (protocol.FixedHeader, []byte) {
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	f, err := protocol.ReadFixedHeader(c.r)
+	require.NoError(c.t, err)
+	payload := make([]byte, f.PayloadSize)
+	_, err = io.ReadFull(c.r, payload)
+	require.NoError(c.t, err)
+	return f, payload
+}
+
+// recordingHook records the activity it's notified of
+type recordingHook struct {
+	HookBase
+	mu     sync.Mutex
+	events []string
+}
+
+func (h *recordingHook) record(ev string) {
+	h.mu.Lock()
+	h.events = append(h.events, ev)
+	h.mu.Unlock()
+}
+
+func (h *recordingHook) OnConnect(client ClientInfo)    { h.record("connect " + client.ID) }
+func (h *recordingHook) OnDisconnect(clientID string)   { h.record("disconnect " + clientID) }
+func (h *recordingHook) OnPublish(id string, m Message) { h.record("publish " + id + " " + m.Topic) }
+
+func (h *recordingHook) get() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]string(nil), h.events...)
+}
+
+func TestEmbeddedBroker(t *testing.T) {
+	hook := &recordingHook{}
+	b, err := New(
+		WithAuthenticator(AuthenticatorFunc(func(clientID, username string, password []byte) bool {
+			return username == "user" && string(password) == "pass"
+		})),
+		WithHook(hook),
+	)
+	require.NoError(t, err)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	serveErrCh := make(chan error, 1)
+	go func() { serveErrCh <- b.Serve(l) }()
+
+	_, code := dial(t, l.Addr(), &protocol.ConnectPacketConfig{
+		ClientIdentifier:   []byte("intruder"),
+		Username:           []byte("user"),
+		Password:           []byte("guess"),
+		ShouldCleanSession: true,
+	})
+	require.Equal(t, protocol.ConnRefusedBadUsernamePass, code)
+
+	c, code := dial(t, l.Addr(), &protocol.ConnectPacketConfig{
+		ClientIdentifier:   []byte("c1"),
+		Username:           []byte("user"),
+		Password:           []byte("pass"),
+		ShouldCleanSession: true,
+	})
+	require.Equal(t, protocol.ConnAccepted, code)
+
+	// host to client
+	sub := &protocol.SubscribePacket{PacketIdentifier: 1}
+	require.NoError(t, sub.AddTopic([]byte("from-host/#"), 0))
+	c.send(sub)
+	f, _ := c.read()
+	require.Equal(t, protocol.Suback, f.PktType)
+	require.NoError(t, b.Publish("from-host/x", []byte("hi client"), 0, false))
+	f, payload := c.read()
+	require.Equal(t, protocol.Publish, f.PktType)
+	pub, err := protocol.DeserializePublishPktPayload(f, payload)
+	require.NoError(t, err)
+	require.Equal(t, "from-host/x", string(pub.TopicName))
+	require.Equal(t, []byte("hi client"), pub.Payload)
+
+	// client to host, retained messages are handed over first
+	require.NoError(t, b.Publish("from-client/retained", []byte("old"), 1, true))
+	received := make(chan Message, 2)
+	unsubscribe, err := b.Subscribe("from-client/+", func(msg Message) {
+		received <- msg
+	})
+	require.NoError(t, err)
+	require.Equal(t, Message{Topic: "from-client/retained", Payload: []byte("old"), QoS: 1, Retain: true}, <-received)
+	c.send(&protocol.PublishPacket{TopicName: []byte("from-client/x"), Payload: []byte("hi host")})
+	require.Equal(t, Message{Topic: "from-client/x", Payload: []byte("hi host")}, <-received)
+	unsubscribe()
+	unsubscribe()
+
+	_, err = b.Subscribe("a/#/b", func(Message) {})
+	require.Equal(t, ErrInvalidTopic, err)
+	require.Equal(t, ErrInvalidTopic, b.Publish("a/+", nil, 0, false))
+	require.Equal(t, ErrInvalidQoS, b.Publish("a", nil, 3, false))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	require.NoError(t, b.Shutdown(ctx))
+	require.Equal(t, ErrClosed, <-serveErrCh)
+	require.Equal(t, ErrClosed, b.Shutdown(ctx))
+	require.Equal(t, ErrClosed, b.Publish("a", nil, 0, false))
+
+	// the client is disconnected on shutdown
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = c.r.ReadByte()
+	require.Equal(t, io.EOF, err)
+
+	require.Equal(t, []string{
+		"connect c1",
+		"publish c1 from-client/x",
+		"disconnect c1",
+	}, hook.get())
+}
+
+func TestEmbeddedBrokerServesMultipleListeners(t *testing.T) {
+	b, err := New()
+	require.NoError(t, err)
+	var wg sync.WaitGroup
+	var addrs []net.Addr
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		addrs = append(addrs, l.Addr())
+		wg.Add(1)
+		go func(l net.Listener) {
+			defer wg.Done()
+			require.Equal(t, ErrClosed, b.Serve(l))
+		}(l)
+	}
+	for i, addr := range addrs {
+		_, code := dial(t, addr, &protocol.ConnectPacketConfig{
+			ClientIdentifier:   []byte{byte('a' + i)},
+			ShouldCleanSession: true,
+		})
+		require.Equal(t, protocol.ConnAccepted, code)
+	}
+	require.NoError(t, b.Shutdown(context.Background()))
+	wg.Wait()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.Equal(t, ErrClosed, b.Serve(l))
+}
+
+func TestEmbeddedBrokerServeReturnsOnClosedListener(t *testing.T) {
+	b, err := New()
+	require.NoError(t, err)
+	defer b.Shutdown(context.Background())
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	serveErrCh := make(chan error, 1)
+	go func() { serveErrCh <- b.Serve(l) }()
+	_, code := dial(t, l.Addr(), &protocol.ConnectPacketConfig{
+		ClientIdentifier:   []byte("c1"),
+		ShouldCleanSession: true,
+	})
+	require.Equal(t, protocol.ConnAccepted, code)
+
+	// the host closing the listener isn't retried
+	l.Close()
+	select {
+	case err := <-serveErrCh:
+		require.Error(t, err)
+		require.NotEqual(t, ErrClosed, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Serve didn't return once the listener was closed")
+	}
+}
+
+func TestEmbeddedBrokerInProcessConnections(t *testing.T) {
+	b, err := New()
+	require.NoError(t, err)
+	defer b.Shutdown(context.Background())
+
+	conn, err := b.Dial()
+	require.NoError(t, err)
+	pub, code := connect(t, conn, &protocol.ConnectPacketConfig{
+		ClientIdentifier:   []byte("pub"),
+		ShouldCleanSession: true,
+		WillTopic:          []byte("status/pub"),
+		WillMessage:        []byte("gone"),
+		WillQoS:            1,
+	})
+	require.Equal(t, protocol.ConnAccepted, code)
+
+	// retained message, published at QoS 2
+	pub.send(&protocol.PublishPacket{
+		QoS:              2,
+		Retain:           true,
+		TopicName:        []byte("a/b"),
+		Payload:          []byte("retained"),
+		PacketIdentifier: 1,
+	})
+	f, _ := pub.read()
+	require.Equal(t, protocol.Pubrec, f.PktType)
+	pub.send(&protocol.PubrelPacket{PacketIdentifier: 1})
+	f, _ = pub.read()
+	require.Equal(t, protocol.Pubcomp, f.PktType)
+
+	conn, err = b.Dial()
+	require.NoError(t, err)
+	sub, code := connect(t, conn, &protocol.ConnectPacketConfig{
+		ClientIdentifier:   []byte("sub"),
+		ShouldCleanSession: true,
+	})
+	require.Equal(t, protocol.ConnAccepted, code)
+	subscribe := &protocol.SubscribePacket{PacketIdentifier: 1}
+	require.NoError(t, subscribe.AddTopic([]byte("a/+"), 1))
+	require.NoError(t, subscribe.AddTopic([]byte("status/#"), 1))
+	sub.send(subscribe)
+	f, _ = sub.read()
+	require.Equal(t, protocol.Suback, f.PktType)
+	readPublish := func() *protocol.PublishPacket {
+		f, payload := sub.read()
+		require.Equal(t, protocol.Publish, f.PktType)
+		pkt, err := protocol.DeserializePublishPktPayload(f, payload)
+		require.NoError(t, err)
+		sub.send(&protocol.PubackPacket{PacketIdentifier: pkt.PacketIdentifier})
+		return pkt
+	}
+	retained := readPublish()
+	require.True(t, retained.Retain)
+	require.Equal(t, byte(1), retained.QoS, "downgraded to the QoS granted")
+	require.Equal(t, []byte("retained"), retained.Payload)
+
+	// will is published once the publisher's connection drops
+	pub.conn.Close()
+	will := readPublish()
+	require.Equal(t, "status/pub", string(will.TopicName))
+	require.Equal(t, []byte("gone"), will.Payload)
+
+	require.NoError(t, b.Shutdown(context.Background()))
+	_, err = b.Dial()
+	require.Equal(t, ErrClosed, err)
+}
@@ -0,0 +1,107 @@
+package broker
+
+import (
+	"time"
+
+	ib "github.com/nagamocha3000/go-mqtt-broker/internal/broker"
+)
+
+// Authenticator decides whether a client connecting with the given
+// credentials is let in, unless it uses enhanced authentication. The
+// client ID is empty if the client left it to the broker to assign one.
+// Authenticate is called concurrently for clients connecting at the same
+// time
+type Authenticator interface {
+	Authenticate(clientID, username string, password []byte) bool
+}
+
+// AuthenticatorFunc adapts a function into an Authenticator
+type AuthenticatorFunc func(clientID, username string, password []byte) bool
+
+// Authenticate calls f
+func (f AuthenticatorFunc) Authenticate(clientID, username string, password []byte) bool {
+	return f(clientID, username, password)
+}
+
+// ClientInfo holds details on a connected client
+type ClientInfo struct {
+	ID          string
+	RemoteAddr  string
+	ConnectedAt time.Time
+	KeepAlive   time.Duration
+}
+
+// Hook is notified of client activity. Hooks are called synchronously
+// from the client's session hence they should not block. Embed HookBase
+// to implement only some of the methods
+type Hook interface {
+	// OnConnect is called once a client's connection is accepted
+	OnConnect(client ClientInfo)
+	// OnDisconnect is called once a client's connection is closed
+	OnDisconnect(clientID string)
+	// OnSubscribe is called for every topic filter a client subscribes to
+	OnSubscribe(clientID, filter string, qos byte)
+	// OnUnsubscribe is called for every topic filter a client unsubscribes from
+	OnUnsubscribe(clientID, filter string)
+	// OnPublish is called for every message a client publishes, before
+	// it's routed to subscribers. Messages published via Broker.Publish
+	// are not included
+	OnPublish(clientID string, msg Message)
+}
+
+// HookBase implements Hook with methods that do nothing
+type HookBase struct{}
+
+// OnConnect implements Hook
+func (HookBase) OnConnect(ClientInfo) {}
+
+// OnDisconnect implements Hook
+func (HookBase) OnDisconnect(string) {}
+
+// OnSubscribe implements Hook
+func (HookBase) OnSubscribe(string, string, byte) {}
+
+// OnUnsubscribe implements Hook
+func (HookBase) OnUnsubscribe(string, string) {}
+
+// OnPublish implements Hook
+func (HookBase) OnPublish(string, Message) {}
+
+// authenticator adapts an Authenticator to the internal broker's
+type authenticator struct {
+	a Authenticator
+}
+
+func (a authenticator) Authenticate(clientID string, username, password []byte) bool {
+	return a.a.Authenticate(clientID, string(username), password)
+}
+
+// hook adapts a Hook to the internal broker's
+type hook struct {
+	h Hook
+}
+
+func (h hook) OnConnect(info ib.ClientInfo) {
+	h.h.OnConnect(ClientInfo{
+		ID:          info.ID,
+		RemoteAddr:  info.RemoteAddr,
+		ConnectedAt: info.ConnectedAt,
+		KeepAlive:   info.KeepAlive,
+	})
+}
+
+func (h hook) OnDisconnect(clientID string) {
+	h.h.OnDisconnect(clientID)
+}
+
+func (h hook) OnSubscribe(clientID, filter string, qos byte) {
+	h.h.OnSubscribe(clientID, filter, qos)
+}
+
+func (h hook) OnUnsubscribe(clientID, filter string) {
+	h.h.OnUnsubscribe(clientID, filter)
+}
+
+func (h hook) OnPublish(clientID, topic string, payload []byte, qos byte, retain bool) {
+	h.h.OnPublish(clientID, Message{Topic: topic, Payload: payload, QoS: qos, Retain: retain})
+}
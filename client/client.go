@@ -0,0 +1,696 @@
+// Package client provides an MQTT 3.1.1 client:
+//
+//	c, err := client.Connect(ctx, "localhost:1883", client.WithClientID("sensor-1"))
+//	if err != nil {
+//		return err
+//	}
+//	defer c.Disconnect()
+//	_, err = c.Subscribe(ctx, "commands/sensor-1/#", 1, func(msg client.Message) {
+//		log.Printf("%s: %s", msg.Topic, msg.Payload)
+//	})
+//	...
+//	err = c.Publish(ctx, "sensors/sensor-1/temp", []byte("21.5"), 1, false)
+//
+// A Client is safe for concurrent use.
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+
+	p "github.com/nagamocha3000/go-mqtt-broker/internal/protocol"
+	"github.com/nagamocha3000/go-mqtt-broker/internal/store"
+	"github.com/nagamocha3000/go-mqtt-broker/topic"
+)
+
+var (
+	// ErrClosed is returned once the client is disconnected via Disconnect
+	ErrClosed = errors.New("client: closed")
+	// ErrConnectionLost is returned once the connection to the broker
+	// is lost. Errors returned are wrapped, use errors.Is to check
+	ErrConnectionLost = errors.New("client: connection lost")
+	// ErrPingTimeout is returned if the broker does not respond to a ping
+	// in time, in which case the connection is closed
+	ErrPingTimeout = errors.New("client: ping timeout")
+	// ErrSubscriptionRefused is returned when the broker refuses a subscription
+	ErrSubscriptionRefused = errors.New("client: subscription refused")
+	// ErrNoPacketIDs is returned when all packet identifiers are in use
+	// by operations awaiting acknowledgement
+	ErrNoPacketIDs = errors.New("client: no packet identifiers available")
+	// ErrInvalidQoS is returned when a QoS other than 0, 1 or 2 is given
+	ErrInvalidQoS = errors.New("client: invalid QoS")
+	// ErrNotConnected is returned by operations that can't be carried out
+	// while the client is reconnecting
+	ErrNotConnected = errors.New("client: not connected")
+	// ErrOfflineQueueFull is returned when publishing while reconnecting
+	// and the offline queue is full
+	ErrOfflineQueueFull = errors.New("client: offline queue full")
+)
+
+// ConnectError is returned when the broker refuses the connection
+type ConnectError struct {
+	Code byte // CONNACK return code
+}
+
+func (e *ConnectError) Error() string {
+	return "client: connection refused: " + p.ConnectReturnCode(e.Code).String()
+}
+
+// Message holds an MQTT application message
+type Message struct {
+	Topic   string
+	Payload []byte
+	QoS     byte
+	Retain  bool
+}
+
+// Handler handles messages received on a subscription. Handlers are called
+// one at a time, in the order messages are received, from a goroutine
+// dedicated to the client. A handler may call the client's methods
+type Handler func(Message)
+
+// pending holds an operation awaiting acknowledgement from the broker
+type pending struct {
+	doneCh  chan struct{}
+	err     error
+	granted []byte // SUBACK return codes
+}
+
+// outMsg holds an outbound QoS 1 or 2 message until it's acknowledged
+type outMsg struct {
+	seq      uint64 // messages are sent in order of seq
+	pkt      *p.PublishPacket
+	sent     bool // whether it's been sent on any connection
+	released bool // PUBREC received
+}
+
+// Client is a connection to an MQTT broker
+type Client struct {
+	opts       options
+	connectPkt *p.ConnectPacket
+	store      *store.FileStore // nil unless an offline store is set
+	inbox      *queue           // Messages and callbacks for dispatch
+
+	// ctx is cancelled once the client is closed, to stop reconnecting
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// mu guards the state below
+	mu             sync.Mutex
+	cn             *connection // nil while reconnecting
+	sessionPresent bool
+	pending        map[uint16]*pending
+	outbox         map[uint16]*outMsg
+	nextSeq        uint64
+	nOffline       int // outbox messages yet to be sent
+	lastPktID      uint16
+	handlers       map[string]Handler
+	subs           map[string]byte // acknowledged subscriptions, for resubscribing
+	receivedQoS2   map[uint16]struct{}
+	doneCh         chan struct{}
+	err            error // set before doneCh is closed
+}
+
+// Connect connects to the broker at addr, host:port, returning once the
+// broker accepts the connection. ctx bounds the time taken to connect.
+// Connect doesn't retry, even with auto reconnect set, which only applies
+// once connected
+func Connect(ctx context.Context, addr string, opts ...Option) (*Client, error) {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	cfg := &p.ConnectPacketConfig{
+		ClientIdentifier:   []byte(o.clientID),
+		KeepAliveSeconds:   o.keepAliveSeconds(),
+		ShouldCleanSession: o.cleanSession,
+	}
+	if o.username != "" {
+		cfg.Username = []byte(o.username)
+		cfg.Password = o.password
+	}
+	if o.will != nil {
+		cfg.WillTopic = []byte(o.will.Topic)
+		cfg.WillMessage = o.will.Payload
+		cfg.WillQoS = o.will.QoS
+		cfg.WillRetain = o.will.Retain
+	}
+	connectPkt, err := p.NewConnectPacket(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("client: %w", err)
+	}
+	if o.dialer == nil {
+		o.dialer = func(ctx context.Context) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "tcp", addr)
+		}
+	}
+
+	c := &Client{
+		opts:         o,
+		connectPkt:   connectPkt,
+		inbox:        newQueue(),
+		pending:      make(map[uint16]*pending),
+		outbox:       make(map[uint16]*outMsg),
+		handlers:     make(map[string]Handler),
+		subs:         make(map[string]byte),
+		receivedQoS2: make(map[uint16]struct{}),
+		doneCh:       make(chan struct{}),
+	}
+	if o.storeDir != "" {
+		if err := c.openStore(); err != nil {
+			return nil, err
+		}
+	}
+	cn, sessionPresent, err := openConnection(ctx, &c.opts, connectPkt)
+	if err != nil {
+		if c.store != nil {
+			c.store.Close()
+		}
+		return nil, err
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	go c.dispatch()
+	c.start(cn, sessionPresent)
+	return c, nil
+}
+
+// SessionPresent reports whether the broker resumed a session from a
+// previous connection on the latest connection
+func (c *Client) SessionPresent() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sessionPresent
+}
+
+// IsConnected reports whether the client is currently connected, it's
+// false while the client is reconnecting and once it's closed
+func (c *Client) IsConnected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cn != nil
+}
+
+// Done returns a channel that's closed once the client is disconnected
+// for good, either via Disconnect or because the connection was lost
+// without auto reconnect set
+func (c *Client) Done() <-chan struct{} {
+	return c.doneCh
+}
+
+// Err returns why the client was disconnected, nil until Done is closed
+func (c *Client) Err() error {
+	select {
+	case <-c.doneCh:
+		return c.err
+	default:
+		return nil
+	}
+}
+
+// isDone reports whether the client is closed
+func (c *Client) isDone() bool {
+	select {
+	case <-c.doneCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// current returns the current connection, the caller should hold mu
+func (c *Client) current() (*connection, error) {
+	if c.isDone() {
+		return nil, c.err
+	}
+	if c.cn == nil {
+		return nil, ErrNotConnected
+	}
+	return c.cn, nil
+}
+
+// Publish publishes a message. For QoS 0, it returns once the message is
+// written to the connection. For QoS 1 and 2, it returns once the broker
+// acknowledges the message or ctx is done, in which case the message is
+// still delivered. While reconnecting, QoS 1 and 2 messages are queued
+// then sent in order once reconnected, whereas QoS 0 ones are refused
+// with ErrNotConnected
+func (c *Client) Publish(ctx context.Context, topicName string, payload []byte, qos byte, retain bool) error {
+	if err := topic.ValidateName(topicName); err != nil {
+		return fmt.Errorf("client: %w", err)
+	}
+	if qos > 2 {
+		return ErrInvalidQoS
+	}
+	pkt := &p.PublishPacket{
+		QoS:       qos,
+		Retain:    retain,
+		TopicName: []byte(topicName),
+		Payload:   payload,
+	}
+	if qos == 0 {
+		c.mu.Lock()
+		cn, err := c.current()
+		c.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		return cn.send(pkt)
+	}
+
+	c.mu.Lock()
+	if c.isDone() {
+		c.mu.Unlock()
+		return c.err
+	}
+	cn := c.cn
+	if cn == nil && c.nOffline >= c.opts.maxOffline {
+		c.mu.Unlock()
+		return ErrOfflineQueueFull
+	}
+	pktID, op, err := c.newPending()
+	if err != nil {
+		c.mu.Unlock()
+		return err
+	}
+	pkt.PacketIdentifier = pktID
+	m := &outMsg{seq: c.nextSeq, pkt: pkt, sent: cn != nil}
+	if err := c.persistQueued(m); err != nil {
+		delete(c.pending, pktID)
+		c.mu.Unlock()
+		return err
+	}
+	c.nextSeq++
+	c.outbox[pktID] = m
+	if cn == nil {
+		c.nOffline++
+	}
+	c.mu.Unlock()
+
+	if cn != nil {
+		// if sending fails, the message is resent once reconnected
+		cn.send(pkt)
+	}
+	_, err = c.wait(ctx, op)
+	return err
+}
+
+// Subscribe subscribes to the given topic filter, returning the QoS the
+// broker granted. handler is called with every message received on topics
+// that match the filter. Subscribing to a filter that's already
+// subscribed to replaces its handler. Subscriptions are made again on
+// reconnecting if the broker didn't keep the client's session
+func (c *Client) Subscribe(ctx context.Context, filter string, qos byte, handler Handler) (byte, error) {
+	if err := topic.ValidateFilter(filter); err != nil {
+		return 0, fmt.Errorf("client: %w", err)
+	}
+	if qos > 2 {
+		return 0, ErrInvalidQoS
+	}
+	pkt := &p.SubscribePacket{}
+	if err := pkt.AddTopic([]byte(filter), qos); err != nil {
+		return 0, fmt.Errorf("client: %w", err)
+	}
+
+	c.mu.Lock()
+	cn, err := c.current()
+	if err != nil {
+		c.mu.Unlock()
+		return 0, err
+	}
+	pktID, op, err := c.newPending()
+	if err != nil {
+		c.mu.Unlock()
+		return 0, err
+	}
+	pkt.PacketIdentifier = pktID
+	// registered beforehand since messages, eg retained ones, can
+	// arrive right after the broker acknowledges the subscription
+	prev, hadPrev := c.handlers[filter]
+	c.handlers[filter] = handler
+	c.mu.Unlock()
+
+	cn.send(pkt)
+	codes, err := c.wait(ctx, op)
+	if err == nil && (len(codes) != 1 || codes[0] > 2) {
+		err = ErrSubscriptionRefused
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		// if ctx is done, the broker might still subscribe the client
+		if err != ctx.Err() {
+			if hadPrev {
+				c.handlers[filter] = prev
+			} else {
+				delete(c.handlers, filter)
+			}
+		}
+		return 0, err
+	}
+	c.subs[filter] = codes[0]
+	return codes[0], nil
+}
+
+// Unsubscribe unsubscribes from the given topic filters, returning once
+// the broker acknowledges it or ctx is done. The filters' handlers are
+// removed straight away
+func (c *Client) Unsubscribe(ctx context.Context, filters ...string) error {
+	pkt := &p.UnsubscribePacket{}
+	for _, filter := range filters {
+		if err := pkt.AddTopic([]byte(filter)); err != nil {
+			return fmt.Errorf("client: %w", err)
+		}
+	}
+	c.mu.Lock()
+	cn, err := c.current()
+	if err != nil {
+		c.mu.Unlock()
+		return err
+	}
+	pktID, op, err := c.newPending()
+	if err != nil {
+		c.mu.Unlock()
+		return err
+	}
+	pkt.PacketIdentifier = pktID
+	for _, filter := range filters {
+		delete(c.handlers, filter)
+		delete(c.subs, filter)
+	}
+	c.mu.Unlock()
+
+	cn.send(pkt)
+	_, err = c.wait(ctx, op)
+	return err
+}
+
+// Disconnect sends DISCONNECT and closes the connection. The broker
+// discards the will message, if any. Operations still awaiting
+// acknowledgement fail with ErrClosed. Messages not yet acknowledged
+// are kept in the offline store, if set, to be sent on the next Connect
+func (c *Client) Disconnect() error {
+	var err error
+	closed := c.close(ErrClosed, func(cn *connection) {
+		// the broker closes the connection on reading DISCONNECT
+		err = cn.send(&p.DisconnectPacket{})
+	})
+	if !closed {
+		return c.Err()
+	}
+	return err
+}
+
+// newPending reserves a packet identifier for an operation that
+// awaits acknowledgement, the caller should hold mu
+func (c *Client) newPending() (uint16, *pending, error) {
+	for i := 0; i < 1<<16; i++ {
+		c.lastPktID++
+		if c.lastPktID == 0 {
+			continue
+		}
+		if _, inUse := c.pending[c.lastPktID]; !inUse {
+			op := &pending{doneCh: make(chan struct{})}
+			c.pending[c.lastPktID] = op
+			return c.lastPktID, op, nil
+		}
+	}
+	return 0, nil, ErrNoPacketIDs
+}
+
+// wait waits for the operation to be acknowledged. If ctx is done first,
+// the operation is left in place so that its packet identifier isn't
+// reused until the broker acknowledges it
+func (c *Client) wait(ctx context.Context, op *pending) ([]byte, error) {
+	select {
+	case <-op.doneCh:
+		return op.granted, op.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// complete marks the operation with the given packet identifier as done
+func (c *Client) complete(pktID uint16, granted []byte) {
+	c.mu.Lock()
+	op, ok := c.pending[pktID]
+	delete(c.pending, pktID)
+	if m, isMsg := c.outbox[pktID]; isMsg {
+		delete(c.outbox, pktID)
+		if !m.released {
+			c.unpersistQueued(m)
+		}
+	}
+	c.mu.Unlock()
+	if ok {
+		op.granted = granted
+		close(op.doneCh)
+	}
+}
+
+// release records that the broker received the QoS 2 message with the
+// given packet identifier, it's then up to the broker to deliver it
+func (c *Client) release(pktID uint16) {
+	c.mu.Lock()
+	if m, ok := c.outbox[pktID]; ok && !m.released {
+		m.released = true
+		c.unpersistQueued(m)
+	}
+	c.mu.Unlock()
+}
+
+func (c *Client) readLoop(cn *connection) {
+	defer close(cn.readDone)
+	for {
+		f, payload, err := cn.readPkt()
+		if err != nil {
+			cn.close(fmt.Errorf("%w: %v", ErrConnectionLost, err))
+			return
+		}
+		if err := c.handlePacket(cn, f, payload); err != nil {
+			cn.close(fmt.Errorf("%w: %v", ErrConnectionLost, err))
+			return
+		}
+	}
+}
+
+// handlePacket handles packets received from the broker, returning an
+// error on a protocol violation
+func (c *Client) handlePacket(cn *connection, f p.FixedHeader, payload []byte) error {
+	if !f.IsValidFlagsSet() {
+		return fmt.Errorf("invalid flags on %v", p.ControlPacketType(f.PktType))
+	}
+	switch f.PktType {
+	case p.Publish:
+		pkt, err := p.DeserializePublishPktPayload(f, payload)
+		if err != nil {
+			return err
+		}
+		c.handlePublish(cn, pkt)
+	case p.Puback:
+		pkt, err := p.DeserializePubackPktPayload(f, payload)
+		if err != nil {
+			return err
+		}
+		c.complete(pkt.PacketIdentifier, nil)
+	case p.Pubrec:
+		pkt, err := p.DeserializePubrecPktPayload(f, payload)
+		if err != nil {
+			return err
+		}
+		c.release(pkt.PacketIdentifier)
+		cn.acks.push(&p.PubrelPacket{PacketIdentifier: pkt.PacketIdentifier})
+	case p.Pubcomp:
+		pkt, err := p.DeserializePubcompPktPayload(f, payload)
+		if err != nil {
+			return err
+		}
+		c.complete(pkt.PacketIdentifier, nil)
+	case p.Pubrel:
+		pkt, err := p.DeserializePubrelPktPayload(f, payload)
+		if err != nil {
+			return err
+		}
+		c.mu.Lock()
+		delete(c.receivedQoS2, pkt.PacketIdentifier)
+		c.mu.Unlock()
+		cn.acks.push(&p.PubcompPacket{PacketIdentifier: pkt.PacketIdentifier})
+	case p.Suback:
+		pkt, err := p.DeserializeSubackPktPayload(f, payload)
+		if err != nil {
+			return err
+		}
+		c.complete(pkt.PacketIdentifier, pkt.ReturnCodes)
+	case p.Unsuback:
+		pkt, err := p.DeserializeUnsubackPktPayload(f, payload)
+		if err != nil {
+			return err
+		}
+		c.complete(pkt.PacketIdentifier, nil)
+	case p.Pingresp:
+		cn.pong()
+	default:
+		return fmt.Errorf("unexpected %v", p.ControlPacketType(f.PktType))
+	}
+	return nil
+}
+
+func (c *Client) handlePublish(cn *connection, pkt *p.PublishPacket) {
+	msg := Message{
+		Topic:   string(pkt.TopicName),
+		Payload: pkt.Payload,
+		QoS:     pkt.QoS,
+		Retain:  pkt.Retain,
+	}
+	switch pkt.QoS {
+	case 0:
+		c.inbox.push(msg)
+	case 1:
+		c.inbox.push(msg)
+		cn.acks.push(&p.PubackPacket{PacketIdentifier: pkt.PacketIdentifier})
+	case 2:
+		// the broker resends PUBLISH until it receives PUBREC, the message
+		// should only be handled once
+		c.mu.Lock()
+		_, seen := c.receivedQoS2[pkt.PacketIdentifier]
+		c.receivedQoS2[pkt.PacketIdentifier] = struct{}{}
+		c.mu.Unlock()
+		if !seen {
+			c.inbox.push(msg)
+		}
+		cn.acks.push(&p.PubrecPacket{PacketIdentifier: pkt.PacketIdentifier})
+	}
+}
+
+// dispatch hands received messages to the handlers of all subscriptions
+// whose filters match the message's topic. Connection state callbacks are
+// called from here too so that they're ordered with messages
+func (c *Client) dispatch() {
+	var handlers []Handler
+	for {
+		item, ok := c.inbox.pop()
+		if !ok {
+			return
+		}
+		if fn, isCallback := item.(func()); isCallback {
+			fn()
+			continue
+		}
+		msg := item.(Message)
+		handlers = handlers[:0]
+		c.mu.Lock()
+		for filter, h := range c.handlers {
+			if topic.Match(filter, msg.Topic) {
+				handlers = append(handlers, h)
+			}
+		}
+		c.mu.Unlock()
+		if len(handlers) == 0 && c.opts.defaultFn != nil {
+			handlers = append(handlers, c.opts.defaultFn)
+		}
+		for _, h := range handlers {
+			h(msg)
+		}
+	}
+}
+
+// close closes the client with the given error, calling beforeClose, if
+// set, with the current connection just before closing it. Returns false
+// if the client is already closed
+func (c *Client) close(err error, beforeClose func(cn *connection)) bool {
+	c.mu.Lock()
+	if c.isDone() {
+		c.mu.Unlock()
+		return false
+	}
+	c.err = err
+	close(c.doneCh)
+	cn := c.cn
+	c.cn = nil
+	ops := c.pending
+	c.pending = make(map[uint16]*pending)
+	c.outbox = make(map[uint16]*outMsg)
+	c.mu.Unlock()
+
+	c.cancel()
+	if cn != nil {
+		if beforeClose != nil {
+			beforeClose(cn)
+		}
+		cn.close(err)
+		<-cn.readDone
+	}
+	c.inbox.close()
+	for _, op := range ops {
+		op.err = err
+		close(op.doneCh)
+	}
+	if c.store != nil {
+		c.store.Close()
+	}
+	return true
+}
+
+// sortedOutbox returns the outbox's messages in the order they should be
+// sent, the caller should hold mu
+func (c *Client) sortedOutbox() []*outMsg {
+	msgs := make([]*outMsg, 0, len(c.outbox))
+	for _, m := range c.outbox {
+		msgs = append(msgs, m)
+	}
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].seq < msgs[j].seq })
+	return msgs
+}
+
+// queue is an unbounded FIFO queue. Received messages are queued for
+// dispatch so that reading off the connection isn't held up by handlers,
+// which might themselves be waiting on acknowledgements that have to be
+// read. Likewise for acknowledgements the client sends, since the broker
+// might not be reading while it's blocked writing to the client
+type queue struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	items  []interface{}
+	closed bool
+}
+
+func newQueue() *queue {
+	q := &queue{}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+func (q *queue) push(item interface{}) {
+	q.mu.Lock()
+	q.items = append(q.items, item)
+	q.mu.Unlock()
+	q.cond.Signal()
+}
+
+// pop blocks until an item is available, returns false once the
+// queue is closed and all items have been popped
+func (q *queue) pop() (interface{}, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.items) == 0 {
+		if q.closed {
+			return nil, false
+		}
+		q.cond.Wait()
+	}
+	item := q.items[0]
+	q.items[0] = nil // GC
+	q.items = q.items[1:]
+	return item, true
+}
+
+func (q *queue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
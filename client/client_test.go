@@ -0,0 +1,295 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nagamocha3000/go-mqtt-broker/broker"
+	p "github.com/nagamocha3000/go-mqtt-broker/internal/protocol"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestBroker returns an embedded broker, the caller should shut it down
+func newTestBroker(t *testing.T, opts ...broker.Option) *broker.Broker {
+	b, err := broker.New(opts...)
+	require.NoError(t, err)
+	return b
+}
+
+// connectTo connects a client to the embedded broker in-process, the
+// caller should disconnect it
+func connectTo(t *testing.T, b *broker.Broker, opts ...Option) *Client {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	opts = append(opts, WithDialer(func(context.Context) (net.Conn, error) {
+		return b.Dial()
+	}))
+	c, err := Connect(ctx, "", opts...)
+	require.NoError(t, err)
+	return c
+}
+
+func receive(t *testing.T, ch <-chan Message) Message {
+	select {
+	case msg := <-ch:
+		return msg
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for message")
+		return Message{}
+	}
+}
+
+func TestClientPublishSubscribe(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Shutdown(context.Background())
+	ctx := context.Background()
+	sub := connectTo(t, b, WithClientID("sub"))
+	defer sub.Disconnect()
+	pub := connectTo(t, b, WithClientID("pub"))
+	defer pub.Disconnect()
+
+	received := make(chan Message, 10)
+	for qos := byte(0); qos <= 2; qos++ {
+		granted, err := sub.Subscribe(ctx, fmt.Sprintf("qos%d/#", qos), qos, func(msg Message) {
+			received <- msg
+		})
+		require.NoError(t, err)
+		require.Equal(t, qos, granted)
+	}
+	for qos := byte(0); qos <= 2; qos++ {
+		topic := fmt.Sprintf("qos%d/a", qos)
+		require.NoError(t, pub.Publish(ctx, topic, []byte("hello"), qos, false))
+		require.Equal(t, Message{Topic: topic, Payload: []byte("hello"), QoS: qos}, receive(t, received))
+	}
+
+	// retained messages arrive once subscribed
+	require.NoError(t, pub.Publish(ctx, "retained/a", []byte("kept"), 1, true))
+	_, err := sub.Subscribe(ctx, "retained/+", 1, func(msg Message) {
+		received <- msg
+	})
+	require.NoError(t, err)
+	require.Equal(t, Message{Topic: "retained/a", Payload: []byte("kept"), QoS: 1, Retain: true}, receive(t, received))
+
+	require.Error(t, pub.Publish(ctx, "a/+", nil, 0, false))
+	require.Equal(t, ErrInvalidQoS, pub.Publish(ctx, "a", nil, 3, false))
+	_, err = sub.Subscribe(ctx, "a/#/b", 0, func(Message) {})
+	require.Error(t, err)
+}
+
+func TestClientDispatchesToMatchingHandlers(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Shutdown(context.Background())
+	ctx := context.Background()
+	fallback := make(chan Message, 10)
+	c := connectTo(t, b, WithDefaultHandler(func(msg Message) { fallback <- msg }))
+	defer c.Disconnect()
+
+	exact := make(chan Message, 10)
+	wildcard := make(chan Message, 10)
+	_, err := c.Subscribe(ctx, "a/b", 0, func(msg Message) { exact <- msg })
+	require.NoError(t, err)
+	_, err = c.Subscribe(ctx, "a/+", 0, func(msg Message) { wildcard <- msg })
+	require.NoError(t, err)
+
+	// the broker sends a single copy when subscriptions overlap, which
+	// is handed to all matching handlers
+	require.NoError(t, c.Publish(ctx, "a/b", []byte("1"), 0, false))
+	require.Equal(t, "a/b", receive(t, exact).Topic)
+	require.Equal(t, "a/b", receive(t, wildcard).Topic)
+	require.NoError(t, c.Publish(ctx, "a/c", []byte("2"), 0, false))
+	require.Equal(t, "a/c", receive(t, wildcard).Topic)
+
+	// messages for other topics go to the default handler, eg those
+	// published in-process to a subscription the client no longer handles
+	require.NoError(t, c.Unsubscribe(ctx, "a/+"))
+	require.NoError(t, b.Publish("a/c", []byte("3"), 0, false))
+	require.NoError(t, c.Publish(ctx, "a/b", []byte("4"), 0, false))
+	require.Equal(t, []byte("4"), receive(t, exact).Payload)
+	select {
+	case msg := <-wildcard:
+		t.Fatalf("unexpected message after unsubscribing: %v", msg)
+	case msg := <-fallback:
+		t.Fatalf("unexpected message for default handler: %v", msg)
+	default:
+	}
+}
+
+func TestClientHandlerCanPublish(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Shutdown(context.Background())
+	ctx := context.Background()
+	c := connectTo(t, b)
+	defer c.Disconnect()
+
+	replies := make(chan Message, 1)
+	_, err := c.Subscribe(ctx, "requests", 1, func(msg Message) {
+		// waits on PUBACK, which must be read while the handler runs
+		require.NoError(t, c.Publish(ctx, "replies", msg.Payload, 1, false))
+	})
+	require.NoError(t, err)
+	_, err = c.Subscribe(ctx, "replies", 1, func(msg Message) { replies <- msg })
+	require.NoError(t, err)
+	require.NoError(t, c.Publish(ctx, "requests", []byte("ping"), 1, false))
+	require.Equal(t, []byte("ping"), receive(t, replies).Payload)
+}
+
+func TestClientConcurrentUse(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Shutdown(context.Background())
+	ctx := context.Background()
+	c := connectTo(t, b)
+	defer c.Disconnect()
+
+	const publishers, perPublisher = 4, 25
+	var mu sync.Mutex
+	counts := make(map[string]int)
+	done := make(chan struct{})
+	_, err := c.Subscribe(ctx, "load/+", 2, func(msg Message) {
+		mu.Lock()
+		counts[msg.Topic]++
+		total := 0
+		for _, n := range counts {
+			total += n
+		}
+		mu.Unlock()
+		if total == publishers*perPublisher {
+			close(done)
+		}
+	})
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < publishers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			topic := fmt.Sprintf("load/%d", i)
+			for j := 0; j < perPublisher; j++ {
+				require.NoError(t, c.Publish(ctx, topic, []byte{byte(j)}, byte(j%3), false))
+			}
+		}(i)
+	}
+	wg.Wait()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for messages")
+	}
+	for i := 0; i < publishers; i++ {
+		require.Equal(t, perPublisher, counts[fmt.Sprintf("load/%d", i)])
+	}
+}
+
+func TestClientSessionAndWill(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Shutdown(context.Background())
+	ctx := context.Background()
+
+	c := connectTo(t, b, WithClientID("c1"), WithCleanSession(false))
+	defer c.Disconnect()
+	require.False(t, c.SessionPresent())
+	_, err := c.Subscribe(ctx, "queued", 1, func(Message) {})
+	require.NoError(t, err)
+	require.NoError(t, c.Disconnect())
+	require.Equal(t, ErrClosed, c.Err())
+	require.Equal(t, ErrClosed, c.Publish(ctx, "a", nil, 1, false))
+
+	require.NoError(t, b.Publish("queued", []byte("while away"), 1, false))
+	received := make(chan Message, 1)
+	c = connectTo(t, b, WithClientID("c1"), WithCleanSession(false),
+		WithDefaultHandler(func(msg Message) { received <- msg }),
+		WithWill("status/c1", []byte("gone"), 1, false))
+	defer c.Disconnect()
+	require.True(t, c.SessionPresent())
+	require.Equal(t, []byte("while away"), receive(t, received).Payload)
+
+	wills := make(chan broker.Message, 1)
+	unsubscribe, err := b.Subscribe("status/#", func(msg broker.Message) { wills <- msg })
+	require.NoError(t, err)
+	defer unsubscribe()
+	c.cn.conn.Close()
+	<-c.Done()
+	require.True(t, errors.Is(c.Err(), ErrConnectionLost))
+	select {
+	case msg := <-wills:
+		require.Equal(t, []byte("gone"), msg.Payload)
+	case <-time.After(2 * time.Second):
+		t.Fatal("will not published")
+	}
+}
+
+func TestClientKeepAlive(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Shutdown(context.Background())
+	c := connectTo(t, b, WithKeepAlive(time.Second))
+	defer c.Disconnect()
+	// the broker drops clients it hasn't heard from in 1.5 keep alive periods
+	select {
+	case <-c.Done():
+		t.Fatalf("disconnected: %v", c.Err())
+	case <-time.After(2500 * time.Millisecond):
+	}
+}
+
+func TestClientPingTimeout(t *testing.T) {
+	clientSide, serverSide := net.Pipe()
+	defer serverSide.Close()
+	// a broker that accepts the connection then stops responding
+	go func() {
+		buf := make([]byte, 1024)
+		serverSide.Read(buf)
+		connack, _ := (&p.ConnackPacket{Code: p.ConnAccepted}).Serialize(nil)
+		serverSide.Write(connack)
+		for {
+			if _, err := serverSide.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	c, err := Connect(context.Background(), "",
+		WithKeepAlive(time.Second),
+		WithPingTimeout(200*time.Millisecond),
+		WithDialer(func(context.Context) (net.Conn, error) { return clientSide, nil }))
+	require.NoError(t, err)
+	select {
+	case <-c.Done():
+		require.Equal(t, ErrPingTimeout, c.Err())
+	case <-time.After(3 * time.Second):
+		t.Fatal("expected ping timeout")
+	}
+}
+
+func TestClientConnectRefused(t *testing.T) {
+	b := newTestBroker(t, broker.WithAuthenticator(broker.AuthenticatorFunc(
+		func(clientID, username string, password []byte) bool {
+			return username == "user" && string(password) == "pass"
+		})))
+	defer b.Shutdown(context.Background())
+	dialer := WithDialer(func(context.Context) (net.Conn, error) { return b.Dial() })
+
+	_, err := Connect(context.Background(), "", dialer, WithCredentials("user", []byte("guess")))
+	var connErr *ConnectError
+	require.True(t, errors.As(err, &connErr))
+	require.Equal(t, byte(p.ConnRefusedBadUsernamePass), connErr.Code)
+
+	c, err := Connect(context.Background(), "", dialer, WithCredentials("user", []byte("pass")))
+	require.NoError(t, err)
+	require.NoError(t, c.Disconnect())
+
+	// handshake is abandoned once ctx is done
+	clientSide, serverSide := net.Pipe()
+	defer serverSide.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		serverSide.Read(buf)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = Connect(ctx, "", WithDialer(func(context.Context) (net.Conn, error) { return clientSide, nil }))
+	require.Equal(t, context.DeadlineExceeded, err)
+}
@@ -0,0 +1,204 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	p "github.com/nagamocha3000/go-mqtt-broker/internal/protocol"
+)
+
+// connection holds a single network connection to the broker. A client
+// goes through several connections if it reconnects
+type connection struct {
+	conn     net.Conn
+	reader   *bufio.Reader
+	writeMu  sync.Mutex
+	lastSent int64 // unix nanos, accessed atomically
+	acks     *queue
+
+	mu           sync.Mutex
+	awaitingPong bool
+	pingSentAt   time.Time
+
+	closeOnce sync.Once
+	doneCh    chan struct{}
+	readDone  chan struct{} // closed by the client's read loop
+	err       error         // set before doneCh is closed
+}
+
+// openConnection dials the broker and goes through the CONNECT handshake,
+// returning whether the broker has a session for the client
+func openConnection(ctx context.Context, o *options, connectPkt *p.ConnectPacket) (*connection, bool, error) {
+	conn, err := o.dialer(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	cn := &connection{
+		conn:     conn,
+		reader:   bufio.NewReader(conn),
+		acks:     newQueue(),
+		doneCh:   make(chan struct{}),
+		readDone: make(chan struct{}),
+	}
+	sessionPresent, err := cn.handshake(ctx, connectPkt)
+	if err != nil {
+		conn.Close()
+		return nil, false, err
+	}
+	return cn, sessionPresent, nil
+}
+
+// handshake sends CONNECT and waits for CONNACK, giving up once ctx is done
+func (cn *connection) handshake(ctx context.Context, connectPkt *p.ConnectPacket) (bool, error) {
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	defer func() {
+		close(stop)
+		<-stopped
+		cn.conn.SetDeadline(time.Time{})
+	}()
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			// unblocks any pending read or write
+			cn.conn.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+
+	if err := cn.send(connectPkt); err != nil {
+		return false, ctxErr(ctx, err)
+	}
+	f, payload, err := cn.readPkt()
+	if err != nil {
+		return false, ctxErr(ctx, err)
+	}
+	if f.PktType != p.Connack {
+		return false, fmt.Errorf("client: expected CONNACK, got %v", p.ControlPacketType(f.PktType))
+	}
+	connack, err := p.DeserializeConnackPktPayload(f, payload)
+	if err != nil {
+		return false, fmt.Errorf("client: %w", err)
+	}
+	if connack.Code != p.ConnAccepted {
+		return false, &ConnectError{Code: byte(connack.Code)}
+	}
+	return connack.SessionPresent, nil
+}
+
+// ctxErr returns ctx's error if it's done since that's what caused err
+func ctxErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+func (cn *connection) send(pkt p.Packet) error {
+	cn.writeMu.Lock()
+	defer cn.writeMu.Unlock()
+	return cn.write(pkt)
+}
+
+// write sends pkt, the caller should hold writeMu. The connection is
+// closed if writing fails
+func (cn *connection) write(pkt p.Packet) error {
+	b, err := pkt.Serialize(nil)
+	if err != nil {
+		return fmt.Errorf("client: %w", err)
+	}
+	if _, err := cn.conn.Write(b); err != nil {
+		select {
+		case <-cn.doneCh:
+			return cn.err
+		default:
+		}
+		err = fmt.Errorf("%w: %v", ErrConnectionLost, err)
+		cn.close(err)
+		return err
+	}
+	atomic.StoreInt64(&cn.lastSent, time.Now().UnixNano())
+	return nil
+}
+
+func (cn *connection) readPkt() (f p.FixedHeader, payload []byte, err error) {
+	f, err = p.ReadFixedHeader(cn.reader)
+	if err != nil {
+		return
+	}
+	if f.PayloadSize > 0 {
+		payload = make([]byte, f.PayloadSize)
+		_, err = io.ReadFull(cn.reader, payload)
+	}
+	return
+}
+
+// writeAcks sends the acknowledgements queued by the read loop
+func (cn *connection) writeAcks() {
+	for {
+		pkt, ok := cn.acks.pop()
+		if !ok {
+			return
+		}
+		if err := cn.send(pkt.(p.Packet)); err != nil {
+			return
+		}
+	}
+}
+
+// keepAlive sends a ping whenever nothing has been sent for half the keep
+// alive period so that the broker hears from the client at least once per
+// period. The connection is closed if the broker doesn't respond in time
+func (cn *connection) keepAlive(keepAlive, pingTimeout time.Duration) {
+	interval := keepAlive / 2
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-cn.doneCh:
+			return
+		case now := <-ticker.C:
+			cn.mu.Lock()
+			awaitingPong, pingSentAt := cn.awaitingPong, cn.pingSentAt
+			cn.mu.Unlock()
+			if awaitingPong {
+				if now.Sub(pingSentAt) > pingTimeout {
+					cn.close(ErrPingTimeout)
+					return
+				}
+				continue
+			}
+			lastSent := time.Unix(0, atomic.LoadInt64(&cn.lastSent))
+			if now.Sub(lastSent) < interval {
+				continue
+			}
+			cn.mu.Lock()
+			cn.awaitingPong, cn.pingSentAt = true, now
+			cn.mu.Unlock()
+			cn.send(&p.PingreqPacket{})
+		}
+	}
+}
+
+func (cn *connection) pong() {
+	cn.mu.Lock()
+	cn.awaitingPong = false
+	cn.mu.Unlock()
+}
+
+// close closes the connection, only the first error given is recorded
+func (cn *connection) close(err error) {
+	cn.closeOnce.Do(func() {
+		cn.err = err
+		close(cn.doneCh)
+		cn.conn.Close()
+		cn.acks.close()
+	})
+}
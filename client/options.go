@@ -0,0 +1,184 @@
+package client
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// Option configures an optional setting on the Client
+type Option func(*options)
+
+type options struct {
+	clientID         string
+	username         string
+	password         []byte
+	keepAlive        time.Duration
+	pingTimeout      time.Duration
+	cleanSession     bool
+	will             *Message
+	dialer           func(ctx context.Context) (net.Conn, error)
+	defaultFn        Handler
+	autoReconnect    bool
+	minBackoff       time.Duration
+	maxBackoff       time.Duration
+	maxOffline       int
+	storeDir         string
+	onConnect        func(sessionPresent bool)
+	onConnectionLost func(err error)
+	onReconnecting   func(attempt int)
+}
+
+func defaultOptions() options {
+	return options{
+		keepAlive:    60 * time.Second,
+		pingTimeout:  10 * time.Second,
+		cleanSession: true,
+		minBackoff:   time.Second,
+		maxBackoff:   2 * time.Minute,
+		maxOffline:   1000,
+	}
+}
+
+// keepAliveSeconds returns the keep alive period sent on connecting
+func (o *options) keepAliveSeconds() uint16 {
+	return uint16((o.keepAlive + time.Second - 1) / time.Second)
+}
+
+// WithClientID sets the client identifier. By default it's left empty
+// so that the broker assigns one, which requires a clean session
+func WithClientID(id string) Option {
+	return func(o *options) {
+		o.clientID = id
+	}
+}
+
+// WithCredentials sets the username and password sent on connecting
+func WithCredentials(username string, password []byte) Option {
+	return func(o *options) {
+		o.username = username
+		o.password = password
+	}
+}
+
+// WithKeepAlive sets the keep alive period, rounded up to the second.
+// If nothing is sent to the broker within the period, a ping is sent
+// instead. 0 disables keep alive. 60 seconds by default
+func WithKeepAlive(d time.Duration) Option {
+	return func(o *options) {
+		if d >= 0 {
+			o.keepAlive = d
+		}
+	}
+}
+
+// WithPingTimeout sets how long to wait for the broker to respond to a
+// ping before the connection is considered lost. 10 seconds by default
+func WithPingTimeout(d time.Duration) Option {
+	return func(o *options) {
+		if d > 0 {
+			o.pingTimeout = d
+		}
+	}
+}
+
+// WithCleanSession sets whether the broker should discard any previous
+// session of the client and not keep the new one once the client
+// disconnects. true by default
+func WithCleanSession(clean bool) Option {
+	return func(o *options) {
+		o.cleanSession = clean
+	}
+}
+
+// WithWill sets the message the broker publishes on the client's behalf
+// if the client disconnects without calling Disconnect
+func WithWill(topic string, payload []byte, qos byte, retain bool) Option {
+	return func(o *options) {
+		o.will = &Message{Topic: topic, Payload: payload, QoS: qos, Retain: retain}
+	}
+}
+
+// WithDialer sets the function used to open the connection to the broker
+// in place of dialing addr over TCP, eg to connect over TLS or to an
+// embedded broker in the same process
+func WithDialer(dial func(ctx context.Context) (net.Conn, error)) Option {
+	return func(o *options) {
+		o.dialer = dial
+	}
+}
+
+// WithDefaultHandler sets the handler for messages that match none of
+// the client's subscriptions, eg those the broker delivers for
+// subscriptions made in a previous session
+func WithDefaultHandler(h Handler) Option {
+	return func(o *options) {
+		o.defaultFn = h
+	}
+}
+
+// WithAutoReconnect sets the client to reconnect whenever the connection
+// is lost, waiting between attempts from min up to max, doubling the wait
+// after each failed attempt. Half the wait is randomised. Subscriptions
+// are made again if the broker didn't keep the client's session. By
+// default, the client is closed once the connection is lost
+func WithAutoReconnect(min, max time.Duration) Option {
+	return func(o *options) {
+		o.autoReconnect = true
+		if min > 0 {
+			o.minBackoff = min
+		}
+		if max >= o.minBackoff {
+			o.maxBackoff = max
+		} else {
+			o.maxBackoff = o.minBackoff
+		}
+	}
+}
+
+// WithOfflineQueueSize caps the number of QoS 1 and 2 messages that can
+// be published while reconnecting, to be sent once reconnected. 1000 by
+// default
+func WithOfflineQueueSize(n int) Option {
+	return func(o *options) {
+		if n >= 0 {
+			o.maxOffline = n
+		}
+	}
+}
+
+// WithOfflineStore persists QoS 1 and 2 messages in the given directory
+// until the broker acknowledges them, so that messages published while
+// reconnecting, or still unacknowledged once the client is disconnected,
+// are sent on the next Connect with the same client ID. The directory
+// should not be shared with other clients
+func WithOfflineStore(dir string) Option {
+	return func(o *options) {
+		o.storeDir = dir
+	}
+}
+
+// WithOnConnect sets a callback called every time the client connects,
+// including the first time. Connection state callbacks are called from
+// the same goroutine as handlers, in order with received messages
+func WithOnConnect(fn func(sessionPresent bool)) Option {
+	return func(o *options) {
+		o.onConnect = fn
+	}
+}
+
+// WithOnConnectionLost sets a callback called with the error the
+// connection was lost with, before reconnecting
+func WithOnConnectionLost(fn func(err error)) Option {
+	return func(o *options) {
+		o.onConnectionLost = fn
+	}
+}
+
+// WithOnReconnecting sets a callback called before every reconnect
+// attempt, starting from 1
+func WithOnReconnecting(fn func(attempt int)) Option {
+	return func(o *options) {
+		o.onReconnecting = fn
+	}
+}
@@ -0,0 +1,263 @@
+package client
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+
+	p "github.com/nagamocha3000/go-mqtt-broker/internal/protocol"
+	"github.com/nagamocha3000/go-mqtt-broker/internal/store"
+)
+
+// start takes on a newly opened connection: messages not yet acknowledged
+// are resent in order before any new message goes out. If the broker
+// didn't keep the client's session, subscriptions are made again. Returns
+// false if the client was closed in the meantime
+func (c *Client) start(cn *connection, sessionPresent bool) bool {
+	// held until resending is done so that new messages go out after
+	cn.writeMu.Lock()
+	c.mu.Lock()
+	if c.isDone() {
+		c.mu.Unlock()
+		cn.writeMu.Unlock()
+		cn.conn.Close()
+		return false
+	}
+	c.cn = cn
+	c.sessionPresent = sessionPresent
+	if !sessionPresent {
+		c.receivedQoS2 = make(map[uint16]struct{})
+	}
+
+	var resend []p.Packet
+	var completed []uint16
+	for _, m := range c.sortedOutbox() {
+		if m.released {
+			if sessionPresent {
+				resend = append(resend, &p.PubrelPacket{PacketIdentifier: m.pkt.PacketIdentifier})
+			} else {
+				// the broker took on the message before dropping the session
+				completed = append(completed, m.pkt.PacketIdentifier)
+			}
+			continue
+		}
+		pkt := *m.pkt
+		pkt.Dup = m.sent
+		m.sent = true
+		resend = append(resend, &pkt)
+	}
+	c.nOffline = 0
+
+	var resubOp *pending
+	var resubFilters []string
+	if !sessionPresent && len(c.subs) > 0 {
+		pkt := &p.SubscribePacket{}
+		for filter := range c.subs {
+			resubFilters = append(resubFilters, filter)
+		}
+		sort.Strings(resubFilters)
+		for _, filter := range resubFilters {
+			pkt.AddTopic([]byte(filter), c.subs[filter])
+		}
+		var err error
+		pkt.PacketIdentifier, resubOp, err = c.newPending()
+		if err == nil {
+			resend = append(resend, pkt)
+		}
+	}
+	c.mu.Unlock()
+
+	// the read loop has to be running while writing, the broker might
+	// block on writing to the client before reading any further
+	go c.readLoop(cn)
+	go cn.writeAcks()
+	if c.opts.keepAlive > 0 {
+		go cn.keepAlive(c.opts.keepAlive, c.opts.pingTimeout)
+	}
+	go c.monitor(cn)
+	for _, pkt := range resend {
+		if err := cn.write(pkt); err != nil {
+			break
+		}
+	}
+	cn.writeMu.Unlock()
+
+	for _, pktID := range completed {
+		c.complete(pktID, nil)
+	}
+	if resubOp != nil {
+		go c.awaitResubscribe(resubOp, resubFilters)
+	}
+	if fn := c.opts.onConnect; fn != nil {
+		c.inbox.push(func() { fn(sessionPresent) })
+	}
+	return true
+}
+
+// awaitResubscribe records the outcome of making subscriptions again,
+// subscriptions the broker now refuses are dropped along with their
+// handlers
+func (c *Client) awaitResubscribe(op *pending, filters []string) {
+	<-op.doneCh
+	if op.err != nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, filter := range filters {
+		if _, ok := c.subs[filter]; !ok || i >= len(op.granted) {
+			continue
+		}
+		if code := op.granted[i]; code <= 2 {
+			c.subs[filter] = code
+		} else {
+			delete(c.subs, filter)
+			delete(c.handlers, filter)
+		}
+	}
+}
+
+// monitor waits for the connection to be lost then, if auto reconnect is
+// set, reconnects. Otherwise the client is closed
+func (c *Client) monitor(cn *connection) {
+	<-cn.doneCh
+	c.mu.Lock()
+	if c.cn != cn {
+		// closed via Disconnect
+		c.mu.Unlock()
+		return
+	}
+	c.cn = nil
+	if !c.opts.autoReconnect {
+		c.mu.Unlock()
+		c.close(cn.err, nil)
+		return
+	}
+	// messages are kept to be resent, other operations fail
+	var failed []*pending
+	for pktID, op := range c.pending {
+		if _, isMsg := c.outbox[pktID]; !isMsg {
+			delete(c.pending, pktID)
+			failed = append(failed, op)
+		}
+	}
+	c.mu.Unlock()
+	for _, op := range failed {
+		op.err = cn.err
+		close(op.doneCh)
+	}
+	if fn := c.opts.onConnectionLost; fn != nil {
+		err := cn.err
+		c.inbox.push(func() { fn(err) })
+	}
+	c.reconnect()
+}
+
+// reconnect keeps trying to connect, backing off between attempts, until
+// it succeeds or the client is closed
+func (c *Client) reconnect() {
+	for attempt := 1; ; attempt++ {
+		if fn := c.opts.onReconnecting; fn != nil {
+			n := attempt
+			c.inbox.push(func() { fn(n) })
+		}
+		select {
+		case <-time.After(c.opts.backoff(attempt)):
+		case <-c.ctx.Done():
+			return
+		}
+		cn, sessionPresent, err := openConnection(c.ctx, &c.opts, c.connectPkt)
+		if err != nil {
+			if c.ctx.Err() != nil {
+				return
+			}
+			continue
+		}
+		c.start(cn, sessionPresent)
+		return
+	}
+}
+
+// backoff returns how long to wait before the given reconnect attempt.
+// The delay doubles with every attempt up to the max, with half of it
+// randomised so that clients that lose their connections at the same
+// time don't all reconnect at once
+func (o *options) backoff(attempt int) time.Duration {
+	d := o.minBackoff
+	for i := 1; i < attempt && d < o.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > o.maxBackoff {
+		d = o.maxBackoff
+	}
+	half := int64(d / 2)
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+// openStore opens the offline store and queues any messages left in it
+// by the client's previous run
+func (c *Client) openStore() error {
+	st, err := store.Open(c.opts.storeDir)
+	if err != nil {
+		return err
+	}
+	id := c.opts.clientID
+	if err := st.PutSession(id); err != nil {
+		st.Close()
+		return err
+	}
+	sessions, err := st.Sessions()
+	if err != nil {
+		st.Close()
+		return err
+	}
+	for _, sess := range sessions {
+		if sess.ClientID != id {
+			continue
+		}
+		for _, q := range sess.Queued {
+			pktID, _, err := c.newPending()
+			if err != nil {
+				st.Close()
+				return err
+			}
+			c.outbox[pktID] = &outMsg{
+				seq: q.Seq,
+				pkt: &p.PublishPacket{
+					QoS:              q.Message.QoS,
+					Retain:           q.Message.Retain,
+					TopicName:        []byte(q.Message.Topic),
+					PacketIdentifier: pktID,
+					Payload:          q.Message.Payload,
+				},
+			}
+			c.nextSeq = q.Seq + 1
+			c.nOffline++
+		}
+	}
+	c.store = st
+	return nil
+}
+
+// persistQueued stores a message until it's acknowledged, the caller
+// should hold mu
+func (c *Client) persistQueued(m *outMsg) error {
+	if c.store == nil {
+		return nil
+	}
+	return c.store.PutQueued(c.opts.clientID, m.seq, store.Message{
+		Topic:   string(m.pkt.TopicName),
+		Payload: m.pkt.Payload,
+		QoS:     m.pkt.QoS,
+		Retain:  m.pkt.Retain,
+	})
+}
+
+// unpersistQueued removes an acknowledged message from the store, the
+// caller should hold mu. On failure, the message is sent again on the
+// next run which QoS 1 and 2 allow for
+func (c *Client) unpersistQueued(m *outMsg) {
+	if c.store != nil {
+		c.store.DeleteQueued(c.opts.clientID, m.seq)
+	}
+}
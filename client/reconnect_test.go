@@ -0,0 +1,205 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nagamocha3000/go-mqtt-broker/broker"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyDialer dials the embedded broker unless it's set to be offline
+type flakyDialer struct {
+	b       *broker.Broker
+	offline int32
+}
+
+func (d *flakyDialer) dial(context.Context) (net.Conn, error) {
+	if atomic.LoadInt32(&d.offline) == 1 {
+		return nil, errors.New("network unreachable")
+	}
+	return d.b.Dial()
+}
+
+func (d *flakyDialer) setOffline(offline bool) {
+	var v int32
+	if offline {
+		v = 1
+	}
+	atomic.StoreInt32(&d.offline, v)
+}
+
+// dropConnection closes the client's connection from under it
+func dropConnection(c *Client) {
+	c.mu.Lock()
+	cn := c.cn
+	c.mu.Unlock()
+	cn.conn.Close()
+}
+
+func waitEvent(t *testing.T, events <-chan string, want string) {
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case ev := <-events:
+			if ev == want {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for %q", want)
+		}
+	}
+}
+
+func TestClientReconnects(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Shutdown(context.Background())
+	ctx := context.Background()
+	received := make(chan Message, 10)
+	sub := connectTo(t, b, WithClientID("sub"))
+	defer sub.Disconnect()
+	_, err := sub.Subscribe(ctx, "data/#", 1, func(msg Message) { received <- msg })
+	require.NoError(t, err)
+
+	d := &flakyDialer{b: b}
+	events := make(chan string, 100)
+	c, err := Connect(ctx, "",
+		WithClientID("gateway"),
+		WithDialer(d.dial),
+		WithAutoReconnect(5*time.Millisecond, 20*time.Millisecond),
+		WithOfflineQueueSize(3),
+		WithOnConnect(func(sessionPresent bool) { events <- fmt.Sprint("connected ", sessionPresent) }),
+		WithOnConnectionLost(func(err error) {
+			require.True(t, errors.Is(err, ErrConnectionLost))
+			events <- "lost"
+		}),
+		WithOnReconnecting(func(attempt int) { events <- fmt.Sprint("reconnecting ", attempt) }),
+	)
+	require.NoError(t, err)
+	defer c.Disconnect()
+	waitEvent(t, events, "connected false")
+	commands := make(chan Message, 10)
+	_, err = c.Subscribe(ctx, "commands/#", 1, func(msg Message) { commands <- msg })
+	require.NoError(t, err)
+
+	d.setOffline(true)
+	dropConnection(c)
+	waitEvent(t, events, "lost")
+	waitEvent(t, events, "reconnecting 2")
+	require.False(t, c.IsConnected())
+
+	// QoS 1 and 2 messages are queued, up to the offline queue's size
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	for i := 0; i < 3; i++ {
+		err := c.Publish(cancelled, "data/x", []byte{byte('a' + i)}, byte(1+i%2), false)
+		require.Equal(t, context.Canceled, err, "queued but not yet acknowledged")
+	}
+	require.Equal(t, ErrOfflineQueueFull, c.Publish(ctx, "data/x", nil, 1, false))
+	require.Equal(t, ErrNotConnected, c.Publish(ctx, "data/x", nil, 0, false))
+	_, err = c.Subscribe(ctx, "other", 0, func(Message) {})
+	require.Equal(t, ErrNotConnected, err)
+
+	// queued messages are sent in order once reconnected
+	d.setOffline(false)
+	waitEvent(t, events, "connected false")
+	require.True(t, c.IsConnected())
+	for i := 0; i < 3; i++ {
+		require.Equal(t, []byte{byte('a' + i)}, receive(t, received).Payload)
+	}
+	require.NoError(t, c.Publish(ctx, "data/x", []byte("d"), 1, false))
+	require.Equal(t, []byte("d"), receive(t, received).Payload)
+
+	// the broker didn't keep the session hence the client subscribed again
+	require.Eventually(t, func() bool {
+		return b.Publish("commands/reboot", []byte("now"), 1, false) == nil &&
+			len(commands) > 0
+	}, 2*time.Second, 20*time.Millisecond)
+	require.Equal(t, "commands/reboot", receive(t, commands).Topic)
+
+	require.NoError(t, c.Disconnect())
+	require.Equal(t, ErrClosed, c.Err())
+}
+
+func TestClientOfflineStore(t *testing.T) {
+	b := newTestBroker(t)
+	defer b.Shutdown(context.Background())
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "client")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	received := make(chan Message, 10)
+	sub := connectTo(t, b, WithClientID("sub"))
+	defer sub.Disconnect()
+	_, err = sub.Subscribe(ctx, "data", 2, func(msg Message) { received <- msg })
+	require.NoError(t, err)
+
+	d := &flakyDialer{b: b}
+	lost := make(chan string, 10)
+	c, err := Connect(ctx, "",
+		WithClientID("gateway"),
+		WithDialer(d.dial),
+		WithAutoReconnect(time.Hour, time.Hour),
+		WithOfflineStore(dir),
+		WithOnConnectionLost(func(error) { lost <- "lost" }),
+	)
+	require.NoError(t, err)
+	require.NoError(t, c.Publish(ctx, "data", []byte("sent"), 1, false))
+	require.Equal(t, []byte("sent"), receive(t, received).Payload)
+
+	d.setOffline(true)
+	dropConnection(c)
+	waitEvent(t, lost, "lost")
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	for i := 0; i < 3; i++ {
+		c.Publish(cancelled, "data", []byte{byte('a' + i)}, 2, false)
+	}
+	// messages stay in the store once the client is closed
+	require.NoError(t, c.Disconnect())
+
+	d.setOffline(false)
+	c, err = Connect(ctx, "", WithClientID("gateway"), WithDialer(d.dial), WithOfflineStore(dir))
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		require.Equal(t, []byte{byte('a' + i)}, receive(t, received).Payload)
+	}
+	require.NoError(t, c.Publish(ctx, "data", []byte("flushed"), 1, false))
+	require.Equal(t, []byte("flushed"), receive(t, received).Payload)
+	require.NoError(t, c.Disconnect())
+
+	// acknowledged messages are removed from the store
+	c, err = Connect(ctx, "", WithClientID("gateway"), WithDialer(d.dial), WithOfflineStore(dir))
+	require.NoError(t, err)
+	defer c.Disconnect()
+	select {
+	case msg := <-received:
+		t.Fatalf("unexpected message resent: %s", msg.Payload)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestClientBackoff(t *testing.T) {
+	o := defaultOptions()
+	WithAutoReconnect(100*time.Millisecond, time.Second)(&o)
+	for attempt, max := range []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		time.Second,
+		time.Second,
+	} {
+		for i := 0; i < 20; i++ {
+			d := o.backoff(attempt + 1)
+			require.True(t, d >= max/2 && d <= max, "attempt %d: %v", attempt+1, d)
+		}
+	}
+}
@@ -1,6 +1,166 @@
 package main
 
-// main
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/nagamocha3000/go-mqtt-broker/auth"
+	"github.com/nagamocha3000/go-mqtt-broker/internal/admin"
+	"github.com/nagamocha3000/go-mqtt-broker/internal/broker"
+	"github.com/nagamocha3000/go-mqtt-broker/internal/logging"
+	"github.com/nagamocha3000/go-mqtt-broker/internal/metrics"
+	"github.com/nagamocha3000/go-mqtt-broker/internal/server"
+	"github.com/nagamocha3000/go-mqtt-broker/internal/store"
+)
+
+// main runs the broker, unless given the export, import or passwd
+// subcommand in which case it runs the subcommand instead
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "export":
+			runExport(os.Args[2:])
+			return
+		case "import":
+			runImport(os.Args[2:])
+			return
+		case "passwd":
+			runPasswd(os.Args[2:])
+			return
+		}
+	}
+	serve()
+}
+
+func serve() {
+	addr := flag.String("addr", ":1883", "address to listen on for MQTT connections")
+	logLevel := flag.String("log-level", "info", "log level: debug, info, warn or error")
+	logFormat := flag.String("log-format", "console", "log format: json or console")
+	maxConns := flag.Int("max-conns", 0, "max number of open connections, 0 for no limit")
+	maxConnsPerIP := flag.Int("max-conns-per-ip", 0, "max number of open connections per source IP, 0 for no limit")
+	acceptRate := flag.Float64("accept-rate", 0, "max connections accepted per second, 0 for no limit")
+	acceptBurst := flag.Int("accept-burst", 10, "burst of connections allowed above the accept rate")
+	metricsAddr := flag.String("metrics-addr", "", "address to serve prometheus metrics on at /metrics, disabled if empty")
+	adminAddr := flag.String("admin-addr", "", "address to serve the admin HTTP API on, disabled if empty")
+	adminToken := flag.String("admin-token", "", "bearer token required by the admin HTTP API")
+	dataDir := flag.String("data-dir", "", "directory to persist sessions and retained messages in, kept in memory only if empty")
+	fsync := flag.String("fsync", "always", "when to fsync persisted state: always, batch or interval")
+	fsyncBatch := flag.Int("fsync-batch", 100, "number of writes between fsyncs with -fsync=batch")
+	fsyncInterval := flag.Duration("fsync-interval", time.Second, "interval between fsyncs with -fsync=interval")
+	stampReceivedAt := flag.String("stamp-received-at", "", "name of the user property holding when the broker received a message, not added if empty")
+	stampPublisher := flag.String("stamp-publisher", "", "name of the user property holding the client ID of a message's publisher, not added if empty")
+	stampListener := flag.String("stamp-listener", "", "name of the user property holding the address of the listener a message's publisher connected through, not added if empty")
+	scramCredentials := flag.String("scram-credentials", "", "file of SCRAM-SHA-256 credentials MQTT 5 clients authenticate against, as written by the passwd subcommand. Clients that don't authenticate with SCRAM-SHA-256 are refused if set")
+	flag.Parse()
+
+	level, err := logging.ParseLevel(*logLevel)
+	if err != nil {
+		fatal(err)
+	}
+	format, err := logging.ParseFormat(*logFormat)
+	if err != nil {
+		fatal(err)
+	}
+	logger := logging.New(os.Stderr, format, level)
+	if *adminAddr != "" && *adminToken == "" {
+		fatal(fmt.Errorf("-admin-token is required when -admin-addr is set"))
+	}
+
+	var st store.Store = store.NewMemoryStore()
+	if *dataDir != "" {
+		policy, err := store.ParseSyncPolicy(*fsync)
+		if err != nil {
+			fatal(err)
+		}
+		st, err = store.Open(*dataDir,
+			store.WithSyncPolicy(policy),
+			store.WithBatchSize(*fsyncBatch),
+			store.WithSyncInterval(*fsyncInterval),
+		)
+		if err != nil {
+			fatal(err)
+		}
+	}
+
+	reg := metrics.NewRegistry()
+	brokerOpts := []broker.Option{
+		broker.WithLogger(logger),
+		broker.WithMetrics(reg),
+		broker.WithStore(st),
+		broker.WithPropertyStamps(broker.PropertyStamps{
+			ReceivedAt: *stampReceivedAt,
+			Publisher:  *stampPublisher,
+			Listener:   *stampListener,
+		}),
+	}
+	if *scramCredentials != "" {
+		f, err := os.Open(*scramCredentials)
+		if err != nil {
+			fatal(err)
+		}
+		creds, err := auth.ReadCredentials(f)
+		f.Close()
+		if err != nil {
+			fatal(err)
+		}
+		brokerOpts = append(brokerOpts, broker.WithAuthMechanism(auth.NewSCRAM(creds)))
+	}
+	b := broker.NewBroker(brokerOpts...)
+	s, err := server.NewServer(*addr, listener{b, *addr},
+		server.WithLogger(logger),
+		server.WithMetrics(reg),
+		server.WithMaxConns(*maxConns),
+		server.WithMaxConnsPerIP(*maxConnsPerIP),
+		server.WithAcceptRate(*acceptRate, *acceptBurst),
+	)
+	if err != nil {
+		fatal(err)
+	}
+
+	if *metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", reg.Handler())
+		go func() {
+			if err := http.ListenAndServe(*metricsAddr, mux); err != nil {
+				logger.Error("metrics endpoint stopped", logging.Err(err))
+			}
+		}()
+	}
+
+	if *adminAddr != "" {
+		handler := admin.NewHandler(b, *adminToken)
+		go func() {
+			if err := http.ListenAndServe(*adminAddr, handler); err != nil {
+				logger.Error("admin endpoint stopped", logging.Err(err))
+			}
+		}()
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	<-sigCh
+	s.Stop()
+	if err := st.Close(); err != nil {
+		logger.Error("failed to close store", logging.Err(err))
+	}
+}
+
+// listener hands the broker the connections accepted on the named
+// listener. Closing it closes the broker
+type listener struct {
+	*broker.Broker
+	name string
+}
+
+func (l listener) OnConn(conn net.Conn) { l.OnListenerConn(conn, l.name) }
 
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
 }
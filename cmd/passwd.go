@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/nagamocha3000/go-mqtt-broker/auth"
+)
+
+// runPasswd prints the SCRAM-SHA-256 credentials file line of a user
+// whose password is read from stdin. Only keys derived from the password
+// end up in the file
+func runPasswd(args []string) {
+	fs := flag.NewFlagSet("passwd", flag.ExitOnError)
+	iterations := fs.Int("iterations", auth.DefaultIterations, "PBKDF2 iterations applied to the password")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fatal(fmt.Errorf("usage: passwd [-iterations n] username"))
+	}
+
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		fatal(err)
+	}
+	password = strings.TrimRight(password, "\r\n")
+	if password == "" {
+		fatal(fmt.Errorf("empty password"))
+	}
+	c, err := auth.NewCredentials(password, *iterations)
+	if err != nil {
+		fatal(err)
+	}
+	fmt.Printf("%s:%s\n", fs.Arg(0), c)
+}
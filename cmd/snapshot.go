@@ -0,0 +1,78 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/nagamocha3000/go-mqtt-broker/internal/broker"
+	"github.com/nagamocha3000/go-mqtt-broker/internal/store"
+)
+
+// runExport writes a snapshot of the state held in a data directory.
+// The broker using the data directory should be stopped beforehand
+func runExport(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	dataDir := fs.String("data-dir", "", "directory the broker persists its state in")
+	file := fs.String("file", "-", "file to write the snapshot to, - for stdout")
+	fs.Parse(args)
+
+	withBroker(*dataDir, func(b *broker.Broker) error {
+		if *file == "-" {
+			return b.ExportSnapshot(os.Stdout)
+		}
+		f, err := os.Create(*file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if err := b.ExportSnapshot(f); err != nil {
+			return err
+		}
+		return f.Sync()
+	})
+}
+
+// runImport loads a snapshot into the state held in a data directory.
+// The broker using the data directory should be stopped beforehand
+func runImport(args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	dataDir := fs.String("data-dir", "", "directory the broker persists its state in")
+	file := fs.String("file", "-", "file to read the snapshot from, - for stdin")
+	fs.Parse(args)
+
+	withBroker(*dataDir, func(b *broker.Broker) error {
+		var r io.Reader = os.Stdin
+		if *file != "-" {
+			f, err := os.Open(*file)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+		return b.ImportSnapshot(r)
+	})
+}
+
+// withBroker runs fn against a broker backed by the state in dataDir
+// without serving any connections
+func withBroker(dataDir string, fn func(*broker.Broker) error) {
+	if dataDir == "" {
+		fatal(fmt.Errorf("-data-dir is required"))
+	}
+	st, err := store.Open(dataDir)
+	if err != nil {
+		fatal(err)
+	}
+	b := broker.NewBroker(broker.WithStore(st))
+	err = fn(b)
+	b.Close()
+	if cerr := st.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		fatal(err)
+	}
+}
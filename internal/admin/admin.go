@@ -0,0 +1,296 @@
+// Package admin provides an authenticated HTTP API through which operators
+// can inspect and manage a running broker: list and kick clients, list
+// subscriptions, manage retained messages and publish messages.
+//
+// All requests must carry the configured token as a bearer token, ie
+//
+//	Authorization: Bearer <token>
+//
+// Routes:
+//
+//	GET    /api/clients              list connected clients
+//	GET    /api/clients/{id}         get a single client
+//	DELETE /api/clients/{id}         kick a client
+//	GET    /api/subscriptions        list subscribers per topic filter
+//	GET    /api/topics               list topic filters and topic tree stats
+//	GET    /api/retained             list retained messages
+//	GET    /api/retained?topic=t     get the retained message for topic t
+//	DELETE /api/retained?topic=t     delete the retained message for topic t
+//	POST   /api/publish              publish a message
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/nagamocha3000/go-mqtt-broker/internal/broker"
+)
+
+// Handler serves the admin API for a single broker
+type Handler struct {
+	broker *broker.Broker
+	token  []byte
+	mux    *http.ServeMux
+}
+
+// NewHandler returns a Handler for the given broker. Requests are only
+// served if they carry the given token, which must not be empty
+func NewHandler(b *broker.Broker, token string) *Handler {
+	h := &Handler{
+		broker: b,
+		token:  []byte(token),
+		mux:    http.NewServeMux(),
+	}
+	h.mux.HandleFunc("/api/clients", h.handleClients)
+	h.mux.HandleFunc("/api/clients/", h.handleClient)
+	h.mux.HandleFunc("/api/subscriptions", h.handleSubscriptions)
+	h.mux.HandleFunc("/api/topics", h.handleTopics)
+	h.mux.HandleFunc("/api/retained", h.handleRetained)
+	h.mux.HandleFunc("/api/publish", h.handlePublish)
+	return h
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="mqtt-broker"`)
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	h.mux.ServeHTTP(w, r)
+}
+
+func (h *Handler) authorized(r *http.Request) bool {
+	if len(h.token) == 0 {
+		return false
+	}
+	const prefix = "Bearer "
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, prefix) {
+		return false
+	}
+	given := []byte(strings.TrimPrefix(auth, prefix))
+	return subtle.ConstantTimeCompare(given, h.token) == 1
+}
+
+type subscriptionJSON struct {
+	Filter string `json:"filter"`
+	QoS    byte   `json:"qos"`
+}
+
+type clientJSON struct {
+	ID               string             `json:"id"`
+	RemoteAddr       string             `json:"remote_addr"`
+	ConnectedAt      time.Time          `json:"connected_at"`
+	KeepAliveSeconds float64            `json:"keep_alive_seconds"`
+	Subscriptions    []subscriptionJSON `json:"subscriptions"`
+}
+
+func toClientJSON(c broker.ClientInfo) clientJSON {
+	subs := make([]subscriptionJSON, 0, len(c.Subscriptions))
+	for _, s := range c.Subscriptions {
+		subs = append(subs, subscriptionJSON{Filter: s.Filter, QoS: s.QoS})
+	}
+	return clientJSON{
+		ID:               c.ID,
+		RemoteAddr:       c.RemoteAddr,
+		ConnectedAt:      c.ConnectedAt,
+		KeepAliveSeconds: c.KeepAlive.Seconds(),
+		Subscriptions:    subs,
+	}
+}
+
+func (h *Handler) handleClients(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	clients := h.broker.Clients()
+	resp := make([]clientJSON, 0, len(clients))
+	for _, c := range clients {
+		resp = append(resp, toClientJSON(c))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (h *Handler) handleClient(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/clients/")
+	if id == "" {
+		writeError(w, http.StatusNotFound, "client id required")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		c, err := h.broker.Client(id)
+		if err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, toClientJSON(c))
+	case http.MethodDelete:
+		if err := h.broker.KickClient(id); err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodDelete)
+	}
+}
+
+type subscriberJSON struct {
+	ClientID string `json:"client_id"`
+	QoS      byte   `json:"qos"`
+}
+
+type filterJSON struct {
+	Filter      string           `json:"filter"`
+	Subscribers []subscriberJSON `json:"subscribers"`
+}
+
+func (h *Handler) handleSubscriptions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	filters := h.broker.Subscriptions()
+	resp := make([]filterJSON, 0, len(filters))
+	for _, f := range filters {
+		subs := make([]subscriberJSON, 0, len(f.Subscribers))
+		for _, s := range f.Subscribers {
+			subs = append(subs, subscriberJSON{ClientID: s.ClientID, QoS: s.QoS})
+		}
+		resp = append(resp, filterJSON{Filter: f.Filter, Subscribers: subs})
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+type topicFilterJSON struct {
+	Filter      string `json:"filter"`
+	Subscribers int    `json:"subscribers"`
+	Depth       int    `json:"depth"`
+}
+
+type topicsJSON struct {
+	Nodes    int               `json:"nodes"`
+	Feeds    int               `json:"feeds"`
+	MaxDepth int               `json:"max_depth"`
+	Filters  []topicFilterJSON `json:"filters"`
+}
+
+func (h *Handler) handleTopics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	stats := h.broker.TopicStats()
+	resp := topicsJSON{
+		Nodes:    stats.Nodes,
+		Feeds:    stats.Feeds,
+		MaxDepth: stats.MaxDepth,
+		Filters:  []topicFilterJSON{},
+	}
+	for _, f := range h.broker.TopicFilters() {
+		resp.Filters = append(resp.Filters, topicFilterJSON{
+			Filter:      f.Filter,
+			Subscribers: f.Subscribers,
+			Depth:       f.Depth,
+		})
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// retainedJSON holds a retained message. The payload is base64 encoded
+// since it might be binary
+type retainedJSON struct {
+	Topic   string `json:"topic"`
+	QoS     byte   `json:"qos"`
+	Payload []byte `json:"payload_base64"`
+}
+
+func (h *Handler) handleRetained(w http.ResponseWriter, r *http.Request) {
+	topic := r.URL.Query().Get("topic")
+	switch r.Method {
+	case http.MethodGet:
+		msgs := h.broker.RetainedMessages()
+		if topic == "" {
+			resp := make([]retainedJSON, 0, len(msgs))
+			for _, m := range msgs {
+				resp = append(resp, retainedJSON{Topic: m.Topic, QoS: m.QoS, Payload: m.Payload})
+			}
+			writeJSON(w, http.StatusOK, resp)
+			return
+		}
+		for _, m := range msgs {
+			if m.Topic == topic {
+				writeJSON(w, http.StatusOK, retainedJSON{Topic: m.Topic, QoS: m.QoS, Payload: m.Payload})
+				return
+			}
+		}
+		writeError(w, http.StatusNotFound, "no retained message for topic")
+	case http.MethodDelete:
+		if topic == "" {
+			writeError(w, http.StatusBadRequest, "topic query parameter required")
+			return
+		}
+		if !h.broker.DeleteRetained(topic) {
+			writeError(w, http.StatusNotFound, "no retained message for topic")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodDelete)
+	}
+}
+
+// publishRequest holds a message to be published. The payload can be
+// given either as text or base64 encoded, but not both
+type publishRequest struct {
+	Topic         string `json:"topic"`
+	Payload       string `json:"payload"`
+	PayloadBase64 []byte `json:"payload_base64"`
+	QoS           byte   `json:"qos"`
+	Retain        bool   `json:"retain"`
+}
+
+func (h *Handler) handlePublish(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+	var req publishRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return
+	}
+	if req.Payload != "" && req.PayloadBase64 != nil {
+		writeError(w, http.StatusBadRequest, "only one of payload and payload_base64 should be set")
+		return
+	}
+	payload := req.PayloadBase64
+	if payload == nil {
+		payload = []byte(req.Payload)
+	}
+	if err := h.broker.Publish(req.Topic, payload, req.QoS, req.Retain); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func methodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,169 @@
+package admin
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nagamocha3000/go-mqtt-broker/internal/broker"
+	"github.com/nagamocha3000/go-mqtt-broker/internal/protocol"
+	"github.com/stretchr/testify/require"
+)
+
+const testToken = "secret"
+
+// connectClient connects a client with the given ID and subscribes it to
+// filter, the CONNACK and SUBACK are read but not inspected
+func connectClient(t *testing.T, b *broker.Broker, id, filter string) net.Conn {
+	serverSide, clientSide := net.Pipe()
+	b.OnConn(serverSide)
+	clientSide.SetDeadline(time.Now().Add(2 * time.Second))
+
+	connect, err := protocol.NewConnectPacket(&protocol.ConnectPacketConfig{
+		ClientIdentifier:   []byte(id),
+		ShouldCleanSession: true,
+	})
+	require.NoError(t, err)
+	write(t, clientSide, connect)
+	_, err = io.ReadFull(clientSide, make([]byte, 4)) // CONNACK
+	require.NoError(t, err)
+
+	sub := &protocol.SubscribePacket{PacketIdentifier: 1}
+	require.NoError(t, sub.AddTopic([]byte(filter), 1))
+	write(t, clientSide, sub)
+	_, err = io.ReadFull(clientSide, make([]byte, 5)) // SUBACK
+	require.NoError(t, err)
+	return clientSide
+}
+
+func write(t *testing.T, conn net.Conn, pkt protocol.Packet) {
+	buf, err := pkt.Serialize(nil)
+	require.NoError(t, err)
+	_, err = conn.Write(buf)
+	require.NoError(t, err)
+}
+
+func do(t *testing.T, h http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testToken)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAdminRequiresToken(t *testing.T) {
+	b := broker.NewBroker()
+	defer b.Close()
+	h := NewHandler(b, testToken)
+
+	for _, auth := range []string{"", "Bearer wrong", "secret", "Basic secret"} {
+		req := httptest.NewRequest(http.MethodGet, "/api/clients", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusUnauthorized, rec.Code, auth)
+	}
+
+	// an empty token never authorizes
+	h = NewHandler(b, "")
+	req := httptest.NewRequest(http.MethodGet, "/api/clients", nil)
+	req.Header.Set("Authorization", "Bearer ")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+}
+
+func TestAdminAPI(t *testing.T) {
+	b := broker.NewBroker()
+	defer b.Close()
+	h := NewHandler(b, testToken)
+
+	conn := connectClient(t, b, "client-1", "sensors/+")
+	defer conn.Close()
+
+	// clients
+	rec := do(t, h, http.MethodGet, "/api/clients", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var clients []clientJSON
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &clients))
+	require.Len(t, clients, 1)
+	require.Equal(t, "client-1", clients[0].ID)
+	require.Equal(t, []subscriptionJSON{{Filter: "sensors/+", QoS: 1}}, clients[0].Subscriptions)
+
+	rec = do(t, h, http.MethodGet, "/api/clients/client-1", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	rec = do(t, h, http.MethodGet, "/api/clients/unknown", "")
+	require.Equal(t, http.StatusNotFound, rec.Code)
+	rec = do(t, h, http.MethodPost, "/api/clients", "")
+	require.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+
+	// subscriptions
+	rec = do(t, h, http.MethodGet, "/api/subscriptions", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var filters []filterJSON
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &filters))
+	require.Equal(t, []filterJSON{{
+		Filter:      "sensors/+",
+		Subscribers: []subscriberJSON{{ClientID: "client-1", QoS: 1}},
+	}}, filters)
+
+	// topics
+	rec = do(t, h, http.MethodGet, "/api/topics", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var topics topicsJSON
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &topics))
+	require.Equal(t, topicsJSON{
+		Nodes:    2,
+		Feeds:    1,
+		MaxDepth: 2,
+		Filters:  []topicFilterJSON{{Filter: "sensors/+", Subscribers: 1, Depth: 2}},
+	}, topics)
+
+	// publish, subscriber receives it
+	rec = do(t, h, http.MethodPost, "/api/publish",
+		`{"topic":"sensors/temp","payload":"21","qos":0,"retain":true}`)
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	buf := make([]byte, 2+2+len("sensors/temp")+2)
+	_, err := io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	require.Equal(t, "21", string(buf[len(buf)-2:]))
+
+	rec = do(t, h, http.MethodPost, "/api/publish", `{"topic":"sensors/#"}`)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = do(t, h, http.MethodPost, "/api/publish", `{"topic":"a","payload":"x","payload_base64":"eA=="}`)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = do(t, h, http.MethodPost, "/api/publish", `not json`)
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+
+	// retained
+	rec = do(t, h, http.MethodGet, "/api/retained?topic=sensors/temp", "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	var retained retainedJSON
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &retained))
+	require.Equal(t, retainedJSON{Topic: "sensors/temp", Payload: []byte("21")}, retained)
+
+	rec = do(t, h, http.MethodDelete, "/api/retained?topic=sensors/temp", "")
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	rec = do(t, h, http.MethodDelete, "/api/retained?topic=sensors/temp", "")
+	require.Equal(t, http.StatusNotFound, rec.Code)
+	rec = do(t, h, http.MethodGet, "/api/retained", "")
+	require.Equal(t, "[]\n", rec.Body.String())
+
+	// kick
+	rec = do(t, h, http.MethodDelete, "/api/clients/client-1", "")
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	_, err = conn.Read(make([]byte, 1))
+	require.Error(t, err)
+	require.Eventually(t, func() bool {
+		return len(b.Clients()) == 0
+	}, time.Second, 5*time.Millisecond)
+	rec = do(t, h, http.MethodDelete, "/api/clients/client-1", "")
+	require.Equal(t, http.StatusNotFound, rec.Code)
+}
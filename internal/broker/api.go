@@ -0,0 +1,250 @@
+package broker
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nagamocha3000/go-mqtt-broker/internal/logging"
+	p "github.com/nagamocha3000/go-mqtt-broker/internal/protocol"
+)
+
+// ClientInfo holds details on a connected client
+type ClientInfo struct {
+	ID            string
+	RemoteAddr    string
+	ConnectedAt   time.Time
+	KeepAlive     time.Duration
+	Subscriptions []SubscriptionInfo
+}
+
+// SubscriptionInfo holds a client's subscription to a topic filter
+type SubscriptionInfo struct {
+	Filter string
+	QoS    byte
+}
+
+// FilterSubscribers holds all the clients subscribed to a topic filter
+type FilterSubscribers struct {
+	Filter      string
+	Subscribers []Subscriber
+}
+
+// Subscriber holds a client subscribed to a topic filter
+type Subscriber struct {
+	ClientID string
+	QoS      byte
+}
+
+// RetainedMessage holds a message retained by the broker
+type RetainedMessage struct {
+	Topic   string
+	QoS     byte
+	Payload []byte
+}
+
+// ErrClientNotFound is returned when no client with the given ID is connected
+var ErrClientNotFound = errors.New("client not found")
+
+// ErrInvalidQoS is returned when a QoS other than 0, 1 or 2 is given
+var ErrInvalidQoS = errors.New("invalid QoS")
+
+// ErrClosed is returned when subscribing once the broker is closed
+var ErrClosed = errors.New("broker closed")
+
+// Clients returns details on all connected clients sorted by ID
+func (b *Broker) Clients() []ClientInfo {
+	b.clientsMu.Lock()
+	sessions := make([]*clientSession, 0, len(b.clients))
+	for _, cs := range b.clients {
+		sessions = append(sessions, cs)
+	}
+	b.clientsMu.Unlock()
+
+	infos := make([]ClientInfo, 0, len(sessions))
+	for _, cs := range sessions {
+		infos = append(infos, cs.info())
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// Client returns details on the connected client with the given ID
+func (b *Broker) Client(id string) (ClientInfo, error) {
+	b.clientsMu.Lock()
+	cs, ok := b.clients[id]
+	b.clientsMu.Unlock()
+	if !ok {
+		return ClientInfo{}, ErrClientNotFound
+	}
+	return cs.info(), nil
+}
+
+// KickClient disconnects the client with the given ID. Since the client
+// does not disconnect gracefully, its will message, if any, is published
+func (b *Broker) KickClient(id string) error {
+	b.clientsMu.Lock()
+	cs, ok := b.clients[id]
+	b.clientsMu.Unlock()
+	if !ok {
+		return ErrClientNotFound
+	}
+	cs.close(reasonKicked)
+	return nil
+}
+
+// Subscriptions returns all the topic filters held in the topic map
+// together with the clients subscribed to each, sorted by filter
+func (b *Broker) Subscriptions() []FilterSubscribers {
+	byFilter := make(map[string][]Subscriber)
+	for _, f := range b.topicMap.Filters() {
+		byFilter[f.Filter] = nil
+	}
+	for _, client := range b.Clients() {
+		for _, s := range client.Subscriptions {
+			byFilter[s.Filter] = append(byFilter[s.Filter], Subscriber{
+				ClientID: client.ID,
+				QoS:      s.QoS,
+			})
+		}
+	}
+
+	filters := make([]FilterSubscribers, 0, len(byFilter))
+	for filter, subscribers := range byFilter {
+		filters = append(filters, FilterSubscribers{Filter: filter, Subscribers: subscribers})
+	}
+	sort.Slice(filters, func(i, j int) bool { return filters[i].Filter < filters[j].Filter })
+	return filters
+}
+
+// TopicFilters returns a snapshot of the topic filters held in the
+// topic map together with their subscriber counts, sorted by filter
+func (b *Broker) TopicFilters() []TopicFilterInfo {
+	return b.topicMap.Filters()
+}
+
+// TopicStats returns a snapshot of the size of the topic map
+func (b *Broker) TopicStats() TopicMapStats {
+	return b.topicMap.Stats()
+}
+
+// RetainedMessages returns all retained messages that are yet to expire
+// sorted by topic
+func (b *Broker) RetainedMessages() []RetainedMessage {
+	b.retained.mu.RLock()
+	msgs := make([]RetainedMessage, 0, len(b.retained.msgs))
+	for topic, msg := range b.retained.msgs {
+		if expired(msg.expiresAt) {
+			continue
+		}
+		msgs = append(msgs, RetainedMessage{
+			Topic:   topic,
+			QoS:     msg.pkt.QoS,
+			Payload: msg.pkt.Payload,
+		})
+	}
+	b.retained.mu.RUnlock()
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].Topic < msgs[j].Topic })
+	return msgs
+}
+
+// DeleteRetained removes the retained message for the given topic. Returns
+// false if there was no retained message for the topic
+func (b *Broker) DeleteRetained(topic string) bool {
+	ok, err := b.retained.remove(topic)
+	if err != nil {
+		b.logger.Error("failed to persist retained message",
+			logging.F("topic", topic), logging.Err(err))
+	}
+	return ok
+}
+
+// Publish publishes a message to all matching subscribers as if it came
+// from a client. The topic should be a valid topic name, ie without wildcards
+func (b *Broker) Publish(topic string, payload []byte, qos byte, retain bool) error {
+	if qos > 2 {
+		return ErrInvalidQoS
+	}
+	tokens, hasWildcard, err := ParseTopic([]byte(topic))
+	if err != nil || hasWildcard {
+		return ErrInvalidTopicName
+	}
+	b.publish(&p.PublishPacket{
+		QoS:       qos,
+		Retain:    retain,
+		TopicName: []byte(topic),
+		Payload:   payload,
+	}, tokens, "")
+	return nil
+}
+
+// Subscribe subscribes fn to all messages published on topics that match
+// the given topic filter, without going through a client session. Retained
+// messages that match the filter are passed to fn first. fn is called from
+// a single goroutine per subscription, in the order messages are routed,
+// and should not block for long since that holds up publishers. The
+// returned function unsubscribes fn and is safe to call multiple times,
+// including from within fn
+func (b *Broker) Subscribe(filter string, fn func(topic string, payload []byte, qos byte, retain bool)) (func(), error) {
+	tokens, _, err := ParseTopic([]byte(filter))
+	if err != nil {
+		return nil, ErrInvalidTopicName
+	}
+	b.clientsMu.Lock()
+	select {
+	case <-b.quitCh:
+		b.clientsMu.Unlock()
+		return nil, ErrClosed
+	default:
+		b.subsWg.Add(1)
+	}
+	b.clientsMu.Unlock()
+
+	ch := make(chan PublishEvent, messagesChSize)
+	retained := b.retained.matching(tokens)
+	sub := b.topicMap.SubscribeByTopic(filter, tokens, ch)
+	quitCh := make(chan struct{})
+	go func() {
+		defer b.subsWg.Done()
+		for _, r := range retained {
+			fn(string(r.pkt.TopicName), r.pkt.Payload, r.pkt.QoS, true)
+		}
+		for {
+			select {
+			case ev := <-ch:
+				fn(string(ev.RawPkt.TopicName), ev.RawPkt.Payload, ev.RawPkt.QoS, false)
+			case <-quitCh:
+				return
+			case <-b.quitCh:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			b.topicMap.UnsubscribeByTopic(sub, tokens)
+			close(quitCh)
+		})
+	}, nil
+}
+
+func (c *clientSession) info() ClientInfo {
+	info := ClientInfo{
+		ID:          c.id,
+		RemoteAddr:  c.conn.RemoteAddr().String(),
+		ConnectedAt: c.connectedAt,
+		KeepAlive:   c.keepAlive,
+	}
+	c.mu.Lock()
+	for filter, s := range c.subscriptions {
+		info.Subscriptions = append(info.Subscriptions, SubscriptionInfo{Filter: filter, QoS: s.qos})
+	}
+	c.mu.Unlock()
+	sort.Slice(info.Subscriptions, func(i, j int) bool {
+		return info.Subscriptions[i].Filter < info.Subscriptions[j].Filter
+	})
+	return info
+}
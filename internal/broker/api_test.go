@@ -0,0 +1,56 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nagamocha3000/go-mqtt-broker/internal/protocol"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBrokerIntrospection(t *testing.T) {
+	b := NewBroker()
+	defer b.Close()
+
+	c1 := newTestClient(t, b, "c1")
+	c1.subscribe(1, "a/+", 1)
+	c1.subscribe(2, "b", 0)
+	c2 := newTestClient(t, b, "c2")
+	c2.subscribe(1, "a/+", 2)
+
+	clients := b.Clients()
+	require.Len(t, clients, 2)
+	require.Equal(t, "c1", clients[0].ID)
+	require.Equal(t, "pipe", clients[0].RemoteAddr)
+	require.Equal(t, []SubscriptionInfo{{"a/+", 1}, {"b", 0}}, clients[0].Subscriptions)
+
+	_, err := b.Client("unknown")
+	require.Equal(t, ErrClientNotFound, err)
+
+	require.Equal(t, []FilterSubscribers{
+		{Filter: "a/+", Subscribers: []Subscriber{{"c1", 1}, {"c2", 2}}},
+		{Filter: "b", Subscribers: []Subscriber{{"c1", 0}}},
+	}, b.Subscriptions())
+
+	// publish from the broker itself
+	require.NoError(t, b.Publish("a/x", []byte("hello"), 0, true))
+	require.Equal(t, []byte("hello"), c1.readPublish().Payload)
+	require.Equal(t, []byte("hello"), c2.readPublish().Payload)
+	require.Equal(t, ErrInvalidTopicName, b.Publish("a/#", nil, 0, false))
+	require.Equal(t, ErrInvalidQoS, b.Publish("a/x", nil, 3, false))
+
+	require.Equal(t, []RetainedMessage{{Topic: "a/x", QoS: 0, Payload: []byte("hello")}}, b.RetainedMessages())
+	require.True(t, b.DeleteRetained("a/x"))
+	require.False(t, b.DeleteRetained("a/x"))
+	require.Empty(t, b.RetainedMessages())
+
+	// kicked clients are disconnected
+	require.NoError(t, b.KickClient("c2"))
+	c2.conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = c2.r.readPkt()
+	require.Error(t, err)
+	require.Eventually(t, func() bool { return b.numClients() == 1 }, time.Second, 5*time.Millisecond)
+	require.Equal(t, ErrClientNotFound, b.KickClient("c2"))
+
+	c1.send(&protocol.DisconnectPacket{})
+}
@@ -2,12 +2,17 @@ package broker
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"net"
 	"sync"
 	"time"
 
+	"github.com/nagamocha3000/go-mqtt-broker/auth"
+	"github.com/nagamocha3000/go-mqtt-broker/internal/logging"
+	"github.com/nagamocha3000/go-mqtt-broker/internal/metrics"
 	p "github.com/nagamocha3000/go-mqtt-broker/internal/protocol"
+	"github.com/nagamocha3000/go-mqtt-broker/internal/store"
 	"github.com/rs/xid"
 )
 
@@ -15,21 +20,200 @@ import (
 // rules. It also holds shared resources such as topics or client IDs
 // that've been issued
 type Broker struct {
-	clientIDs    map[string]bool
-	clientsWg    sync.WaitGroup
-	onceClose    sync.Once
-	quitCh       chan struct{}
-	connDeadline time.Duration
-	topicMap     TopicMap
+	clientsMu     sync.Mutex
+	clients       map[string]*clientSession
+	sessions      map[string]*session // persistent sessions, guarded by clientsMu
+	clientsWg     sync.WaitGroup
+	sessionsWg    sync.WaitGroup // offline sessions queuing messages
+	onceClose     sync.Once
+	quitCh        chan struct{}
+	ctx           context.Context // cancelled once broker is closed
+	cancel        context.CancelFunc
+	connDeadline  time.Duration
+	topicMap      TopicMap
+	retained      *retainedStore
+	store         store.Store
+	maxQueued     int
+	maxExpiry     uint32 // Session Expiry Interval cap for MQTT 5 clients
+	msgExpiry     time.Duration
+	maxMsgExpiry  time.Duration
+	maxTopicAlias uint16
+	receiveMax    uint16 // QoS 1 & 2 publishes MQTT 5 clients may leave unacknowledged
+	maxPacketSize uint32
+	authenticator Authenticator
+	stamps        PropertyStamps
+	// enhanced authentication mechanisms by name
+	authMechanisms map[string]auth.Mechanism
+	hooks          []Hook
+	subsWg         sync.WaitGroup // in-process subscriptions
+	logger         logging.Logger
+	registry       *metrics.Registry
+	metrics        *brokerMetrics
+}
+
+// Option configures an optional setting on the Broker
+type Option func(*Broker)
+
+// WithLogger sets the logger used by the broker and all client
+// sessions. By default nothing is logged
+func WithLogger(l logging.Logger) Option {
+	return func(b *Broker) {
+		b.logger = l
+	}
+}
+
+// WithMetrics registers the broker's metrics in the given registry
+// so that they can be exposed, eg over HTTP
+func WithMetrics(reg *metrics.Registry) Option {
+	return func(b *Broker) {
+		b.registry = reg
+	}
+}
+
+// WithStore sets the store in which persistent sessions and retained
+// messages are held. On creation, the broker rebuilds its state from the
+// store. The broker does not close the store, it should be closed once
+// the broker is closed. By default, an in-memory store is used
+func WithStore(st store.Store) Option {
+	return func(b *Broker) {
+		b.store = st
+	}
+}
+
+// WithMaxQueuedMessages sets the maximum number of QoS 1 & 2 messages
+// queued for each persistent session while its client is offline, 1000
+// by default. Any further messages are dropped
+func WithMaxQueuedMessages(n int) Option {
+	return func(b *Broker) {
+		if n > 0 {
+			b.maxQueued = n
+		}
+	}
+}
+
+// WithMaxSessionExpiry caps the Session Expiry Interval MQTT 5 clients
+// may request, ie for how long their sessions are kept once they
+// disconnect. By default, sessions are kept for as long as requested.
+// Sessions of MQTT 3.1.1 clients connecting with CleanSession set to 0
+// never expire
+func WithMaxSessionExpiry(d time.Duration) Option {
+	return func(b *Broker) {
+		if d >= 0 && d/time.Second < time.Duration(sessionNeverExpires) {
+			b.maxExpiry = uint32(d / time.Second)
+		}
+	}
+}
+
+// WithDefaultMessageExpiry sets for how long messages published without
+// a Message Expiry Interval, including all those published by MQTT 3.1.1
+// clients, are kept for delivery to subscribers. By default they never
+// expire
+func WithDefaultMessageExpiry(d time.Duration) Option {
+	return func(b *Broker) {
+		if d > 0 {
+			b.msgExpiry = d
+		}
+	}
+}
+
+// WithMaxMessageExpiry caps for how long messages are kept for delivery
+// to subscribers, whatever the Message Expiry Interval set by the
+// publisher. By default there's no cap
+func WithMaxMessageExpiry(d time.Duration) Option {
+	return func(b *Broker) {
+		if d > 0 {
+			b.maxMsgExpiry = d
+		}
+	}
+}
+
+// WithTopicAliasMaximum sets the highest topic alias MQTT 5 clients may
+// set on the publishes they send, 10 by default. 0 disables topic
+// aliases
+func WithTopicAliasMaximum(n uint16) Option {
+	return func(b *Broker) {
+		b.maxTopicAlias = n
+	}
+}
+
+// WithReceiveMaximum sets how many QoS 1 and 2 publishes MQTT 5 clients
+// may have unacknowledged at once, 65535 by default. Clients that exceed
+// it are disconnected. Since QoS 1 publishes are acknowledged as soon as
+// they're handled, it's the QoS 2 publishes awaiting PUBREL that add up
+func WithReceiveMaximum(n uint16) Option {
+	return func(b *Broker) {
+		if n > 0 {
+			b.receiveMax = n
+		}
+	}
+}
+
+// WithMaxPacketSize sets the size in bytes of the largest packet clients
+// may send. Clients that send a larger packet are disconnected. By
+// default there's no limit other than the protocol's
+func WithMaxPacketSize(n uint32) Option {
+	return func(b *Broker) {
+		b.maxPacketSize = n
+	}
 }
 
 // NewBroker returns a fresh instance of a Broker
-func NewBroker() *Broker {
-	return &Broker{
-		clientIDs:    make(map[string]bool),
-		quitCh:       make(chan struct{}),
-		connDeadline: 1 * time.Second,
-		topicMap:     NewTopicMap(),
+func NewBroker(opts ...Option) *Broker {
+	b := &Broker{
+		clients:       make(map[string]*clientSession),
+		sessions:      make(map[string]*session),
+		quitCh:        make(chan struct{}),
+		connDeadline:  1 * time.Second,
+		topicMap:      NewTopicMap(),
+		maxQueued:     1000,
+		maxExpiry:     sessionNeverExpires,
+		maxTopicAlias: 10,
+		receiveMax:    65535,
+		logger:        logging.Nop(),
+	}
+	b.ctx, b.cancel = context.WithCancel(context.Background())
+	for _, opt := range opts {
+		opt(b)
+	}
+	if b.registry == nil {
+		// metrics are still tracked, they just aren't exposed
+		b.registry = metrics.NewRegistry()
+	}
+	b.metrics = newBrokerMetrics(b, b.registry)
+	b.topicMap.fanoutLatency = b.metrics.fanoutLatency
+	if b.store == nil {
+		b.store = store.NewMemoryStore()
+	}
+	b.retained = newRetainedStore(b.store)
+	b.load()
+	return b
+}
+
+// load rebuilds the retained messages and persistent sessions held in the
+// store. Sessions are subscribed to the topic map afresh and start off
+// offline, queuing messages until their clients reconnect
+func (b *Broker) load() {
+	retained, err := b.store.Retained()
+	if err != nil {
+		b.logger.Error("failed to load retained messages", logging.Err(err))
+	}
+	b.retained.load(retained, b.logger)
+
+	sessions, err := b.store.Sessions()
+	if err != nil {
+		b.logger.Error("failed to load sessions", logging.Err(err))
+	}
+	b.clientsMu.Lock()
+	defer b.clientsMu.Unlock()
+	for _, stored := range sessions {
+		s := restoreSession(b, stored)
+		b.sessions[s.id] = s
+		s.goOffline()
+	}
+	if len(retained) > 0 || len(sessions) > 0 {
+		b.logger.Info("restored state from store",
+			logging.F("sessions", len(sessions)),
+			logging.F("retained", len(retained)))
 	}
 }
 
@@ -38,8 +222,16 @@ func NewBroker() *Broker {
 // is valid, it is elevated into a ClientSession. If it's invalid or an error
 // occurs such as a protocol violation, the connection is closed
 func (b *Broker) OnConn(conn net.Conn) {
+	b.OnListenerConn(conn, "")
+}
+
+// OnListenerConn is like OnConn for a connection accepted on the named
+// listener, the name being stamped on the messages its client publishes
+// if set up, see WithPropertyStamps
+func (b *Broker) OnListenerConn(conn net.Conn, listener string) {
 	select {
 	case <-b.quitCh:
+		conn.Close()
 		return
 	default:
 		b.clientsWg.Add(1) // add new client conn
@@ -48,77 +240,376 @@ func (b *Broker) OnConn(conn net.Conn) {
 				conn.Close()
 				b.clientsWg.Done() // indicate client done
 			}()
-			clientSession, err := b.handleNewClientConnection(conn)
+			logger := b.logger.With(logging.F("remote_addr", conn.RemoteAddr()))
+			clientSession, err := b.handleNewClientConnection(conn, listener, logger)
 			if err != nil {
 				// close connection
+				reason := reasonOf(err)
+				b.metrics.disconnect(reason)
+				logDisconnect(logger, reason, err)
 				return
 			}
-			clientSession.start()
-			// on end, remove client ID
+			clientSession.logger.Info("client connected",
+				logging.F("keep_alive", clientSession.keepAlive))
+			b.onConnect(clientSession)
+			reason := clientSession.start()
+			clientSession.end(reason)
+			b.unregisterClient(clientSession)
+			b.onDisconnect(clientSession.id)
+			b.metrics.disconnect(reason)
+			logDisconnect(clientSession.logger, reason, nil)
 		}()
 	}
 }
 
 var errConn = errors.New("Client connection error occured")
 
-func (b *Broker) handleNewClientConnection(conn net.Conn) (*clientSession, error) {
+func (b *Broker) handleNewClientConnection(conn net.Conn, listener string, logger logging.Logger) (*clientSession, error) {
 	// set deadline
 	//conn.SetDeadline(time.Now().Add(b.connDeadline))
 
 	// read first packet, should be connect
-	r := mqttPacketReader{bufio.NewReader(conn)}
+	r := mqttPacketReader{r: bufio.NewReader(conn), maxPacketSize: b.maxPacketSize}
 	f, payload, err := r.readPkt()
+	if err == errPacketTooLarge {
+		return nil, disconnectErr(reasonProtocolError, err)
+	}
 	if err != nil {
-		return nil, err
+		return nil, disconnectErr(reasonConnectionLost, err)
+	}
+	b.metrics.packet(f.PktType, directionIn, f.PacketLen())
+	if f.PktType != p.Connect {
+		return nil, disconnectErr(reasonProtocolError, errFirstPktNotConnect)
 	}
 
 	// deserialize
 	pkt, err := p.DeserializeConnectPktPayload(f, payload)
+	if err == p.ErrUnacceptableProtocol {
+		newClientSession(b, conn, r, logger).sendPacket(&p.ConnackPacket{Code: p.ConnRefusedUnacceptableProtocol})
+		return nil, disconnectErr(reasonProtocolError, err)
+	}
 	if err != nil {
-		return nil, err
+		return nil, disconnectErr(reasonProtocolError, err)
+	}
+	if len(pkt.ClientIdentifier) > 0 {
+		logger = logger.With(logging.F("client_id", string(pkt.ClientIdentifier)))
 	}
 
 	// instantiate client session
-	cs := newClientSession(string(pkt.ClientIdentifier), conn, b.topicMap)
+	cs := newClientSession(b, conn, r, logger)
+	cs.listener = listener
+	cs.keepAlive = time.Duration(pkt.KeepAlive) * time.Second
+	cs.protocolLevel = pkt.ProtocolLevel
+
+	// MQTT 3.1 requires a client identifier of 1 to 23 bytes
+	if pkt.ProtocolLevel == p.ProtocolLevel31 &&
+		(len(pkt.ClientIdentifier) == 0 || len(pkt.ClientIdentifier) > p.MaxClientIdentifierLen31) {
+		cs.sendPacket(&p.ConnackPacket{Code: p.ConnRefusedIdentifierRejected})
+		return nil, disconnectErr(reasonIdentifierRejected, errConn)
+	}
 
-	// authenticate
-	if ok := b.authenticate(pkt.Username, pkt.Password); !ok {
+	// authenticate, MQTT 5 clients may do so through an enhanced
+	// authentication exchange rather than with a username and password
+	var authData []byte
+	if cs.protocolLevel == p.ProtocolLevel5 && pkt.Properties != nil && len(pkt.Properties.AuthenticationMethod) > 0 {
+		authData, err = b.enhancedAuth(cs, pkt)
+		if err != nil {
+			return nil, err
+		}
+		cs.authMethod = string(pkt.Properties.AuthenticationMethod)
+	} else if ok := b.authenticate(string(pkt.ClientIdentifier), pkt.Username, pkt.Password); !ok {
 		cs.sendPacket(&p.ConnackPacket{Code: p.ConnRefusedBadUsernamePass})
-		return nil, errConn
+		return nil, disconnectErr(reasonAuthFailure, errConn)
 	}
 
-	// check given client identifier
+	// under MQTT 3.1.1, sessions either end with the connection or never
+	// expire. MQTT 5 clients set for how long their session is kept
+	// apart from whether it starts afresh
+	var connackProps *p.Properties
+	expiry := sessionNeverExpires
+	if pkt.CleanSession {
+		expiry = 0
+	}
+	if cs.protocolLevel == p.ProtocolLevel5 {
+		connackProps = &p.Properties{}
+		cs.inAliases = newInboundAliases(b.maxTopicAlias)
+		if b.maxTopicAlias > 0 {
+			connackProps.TopicAliasMaximum = p.Uint16(b.maxTopicAlias)
+		}
+		if pkt.Properties != nil && pkt.Properties.TopicAliasMaximum != nil {
+			cs.outAliases = newOutboundAliases(*pkt.Properties.TopicAliasMaximum)
+		}
+		// flow control: the client's Receive Maximum defaults to 65535
+		// while there's no limit on packet size unless set
+		connackProps.ReceiveMaximum = p.Uint16(b.receiveMax)
+		if b.maxPacketSize > 0 {
+			connackProps.MaximumPacketSize = p.Uint32(b.maxPacketSize)
+		}
+		cs.receiveMax = 65535
+		if pkt.Properties != nil && pkt.Properties.ReceiveMaximum != nil {
+			cs.receiveMax = *pkt.Properties.ReceiveMaximum
+		}
+		if pkt.Properties != nil && pkt.Properties.MaximumPacketSize != nil {
+			cs.maxPacketSize = *pkt.Properties.MaximumPacketSize
+		}
+		if cs.authMethod != "" {
+			connackProps.AuthenticationMethod = []byte(cs.authMethod)
+			connackProps.AuthenticationData = authData
+		}
+		expiry = 0
+		if pkt.Properties != nil && pkt.Properties.SessionExpiryInterval != nil {
+			expiry = *pkt.Properties.SessionExpiryInterval
+		}
+		cs.connectExpiry = expiry
+		if expiry > b.maxExpiry {
+			expiry = b.maxExpiry
+			connackProps.SessionExpiryInterval = p.Uint32(expiry)
+		}
+	}
+
+	// check given client identifier, then pick up the client's
+	// previous session unless it should be cleaned
+	var sessionPresent bool
 	if len(pkt.ClientIdentifier) > 0 {
-		if _, ok := b.clientIDs[string(pkt.ClientIdentifier)]; ok {
+		var ok bool
+		sessionPresent, ok = b.registerClient(cs, string(pkt.ClientIdentifier), pkt.CleanSession, expiry)
+		if !ok {
 			cs.sendPacket(&p.ConnackPacket{Code: p.ConnRefusedIdentifierRejected})
-			return nil, errConn
+			return nil, disconnectErr(reasonIdentifierRejected, errConn)
 		}
 	} else { // if no client identifier provided, assign one
-		for {
-			newID := xid.New().String()
-			if _, ok := b.clientIDs[newID]; !ok {
-				b.clientIDs[newID] = true
-				cs.id = newID
-				break
-			}
+		b.assignClientID(cs, expiry)
+		cs.logger = cs.logger.With(logging.F("client_id", cs.id))
+		// MQTT 5 clients are told which ID they were assigned
+		if cs.protocolLevel == p.ProtocolLevel5 {
+			connackProps.AssignedClientIdentifier = []byte(cs.id)
 		}
 	}
 
 	// unset deadline
 	// conn.SetDeadline(time.Time{})
 
-	// Check KeepAlive
+	// Check will message & topic
+	if pkt.WillFlag {
+		cs.will = &p.PublishPacket{
+			QoS:        pkt.WillQoS,
+			Retain:     pkt.WillRetain,
+			TopicName:  pkt.WillTopic,
+			Payload:    pkt.WillMessage,
+			Properties: willProperties(pkt.WillProperties),
+		}
+	}
+
+	// MQTT 3.1 has no session present flag, the byte is reserved
+	if cs.protocolLevel == p.ProtocolLevel31 {
+		sessionPresent = false
+	}
+	err = cs.sendPacket(&p.ConnackPacket{
+		Code:           p.ConnAccepted,
+		SessionPresent: sessionPresent,
+		Properties:     connackProps,
+	})
+	if err != nil {
+		b.unregisterClient(cs)
+		return nil, disconnectErr(reasonConnectionLost, err)
+	}
+	return cs, nil
+}
+
+// registerClient adds the client session to the set of connected clients
+// and attaches its session. If the client has a persistent session, it's
+// resumed, unless clean is set in which case it's discarded. The session
+// is kept for expiry seconds once the client disconnects, if 0 it ends
+// with the connection. Returns whether a session was resumed, plus false
+// if a client with the same ID is already connected
+func (b *Broker) registerClient(cs *clientSession, id string, clean bool, expiry uint32) (bool, bool) {
+	b.clientsMu.Lock()
+	defer b.clientsMu.Unlock()
+	if _, ok := b.clients[id]; ok {
+		return false, false
+	}
+	s, present := b.sessions[id]
+	if present {
+		s.goOnline()
+		if clean {
+			s.discard()
+			delete(b.sessions, id)
+			present = false
+		}
+	}
+	if !present {
+		s = b.newClientSessionState(id, expiry)
+	} else {
+		s.expiry = expiry
+		s.persist(func(st store.Store) error {
+			return st.PutSessionExpiry(id, s.storedExpiry(), time.Time{})
+		})
+	}
+	cs.session = s
+	b.clients[id] = cs
+	return present, true
+}
 
-	// Check if should clean Session
+// newClientSessionState creates a session that's kept for expiry seconds
+// once the client disconnects. Sessions that outlive the connection are
+// added to the persistent sessions. Should be called with clientsMu held
+func (b *Broker) newClientSessionState(id string, expiry uint32) *session {
+	s := newSession(b, id, expiry > 0)
+	s.expiry = expiry
+	if s.persistent {
+		b.sessions[id] = s
+		s.persist(func(st store.Store) error {
+			if err := st.PutSession(id); err != nil {
+				return err
+			}
+			return st.PutSessionExpiry(id, s.storedExpiry(), time.Time{})
+		})
+	}
+	return s
+}
 
-	// Check will message & topic
+// assignClientID assigns a unique ID to a client session and registers it
+func (b *Broker) assignClientID(cs *clientSession, expiry uint32) {
+	b.clientsMu.Lock()
+	defer b.clientsMu.Unlock()
+	for {
+		newID := xid.New().String()
+		if _, ok := b.clients[newID]; ok {
+			continue
+		}
+		if _, ok := b.sessions[newID]; ok {
+			continue
+		}
+		cs.session = b.newClientSessionState(newID, expiry)
+		b.clients[newID] = cs
+		return
+	}
+}
+
+// setSessionExpiry updates for how long the client's session is kept
+// once it disconnects, as set on an MQTT 5 DISCONNECT. A client that
+// connected with an expiry of 0 can't set one, even if it resumed a
+// session that was kept
+func (b *Broker) setSessionExpiry(cs *clientSession, expiry uint32) error {
+	b.clientsMu.Lock()
+	defer b.clientsMu.Unlock()
+	if cs.connectExpiry == 0 && expiry > 0 {
+		return errSessionExpiry
+	}
+	if expiry > b.maxExpiry {
+		expiry = b.maxExpiry
+	}
+	cs.expiry = expiry
+	return nil
+}
+
+// unregisterClient removes the client from the set of connected clients.
+// Its session, if persistent, is kept until it expires unless its
+// expiry was set to 0 on disconnecting
+func (b *Broker) unregisterClient(cs *clientSession) {
+	b.clientsMu.Lock()
+	defer b.clientsMu.Unlock()
+	if b.clients[cs.id] == cs {
+		delete(b.clients, cs.id)
+		if !cs.persistent {
+			return
+		}
+		if cs.expiry == 0 {
+			cs.discard()
+			delete(b.sessions, cs.id)
+			return
+		}
+		cs.goOffline()
+	}
+}
+
+func (b *Broker) numClients() int {
+	b.clientsMu.Lock()
+	defer b.clientsMu.Unlock()
+	return len(b.clients)
+}
+
+// numSessions returns the number of client sessions: persistent
+// sessions, whether the client is connected or not, plus the sessions
+// of connected clients that last only as long as the connection
+func (b *Broker) numSessions() int {
+	b.clientsMu.Lock()
+	defer b.clientsMu.Unlock()
+	n := len(b.sessions)
+	for _, cs := range b.clients {
+		if !cs.persistent {
+			n++
+		}
+	}
+	return n
+}
 
-	err = cs.sendPacket(&p.ConnackPacket{Code: p.ConnAccepted})
-	return cs, err
+// feedsPool holds slices for collecting matching feeds so that the
+// result of matching isn't allocated anew for every publish
+var feedsPool = sync.Pool{
+	New: func() interface{} {
+		feeds := make([]*Feed, 0, 16)
+		return &feeds
+	},
 }
 
-func (b *Broker) authenticate(username, password []byte) bool {
-	return true
+// publish routes a publish packet to the subscribers of all topic
+// filters that match the packet's topic name and retains the packet
+// if required. tokens should be the parsed topic name and publisher the
+// ID of the publishing client, if any. Each event carries all the matched
+// filters so that sessions with overlapping subscriptions deliver the
+// packet only once
+func (b *Broker) publish(pkt *p.PublishPacket, tokens []TopicToken, publisher string) {
+	ev := PublishEvent{
+		RawPkt:    pkt,
+		ExpiresAt: b.messageExpiresAt(pkt),
+		Publisher: publisher,
+	}
+	if pkt.Retain {
+		if err := b.retained.set(tokens, pkt, ev.ExpiresAt); err != nil {
+			b.logger.Error("failed to persist retained message",
+				logging.F("topic", string(pkt.TopicName)), logging.Err(err))
+		}
+	}
+	feedsBuf := feedsPool.Get().(*[]*Feed)
+	feeds := b.topicMap.AppendFeedsThatMatchTopic((*feedsBuf)[:0], tokens)
+	defer func() {
+		for i := range feeds {
+			feeds[i] = nil // GC
+		}
+		*feedsBuf = feeds[:0]
+		feedsPool.Put(feedsBuf)
+	}()
+	var sent map[chan<- PublishEvent]struct{}
+	if len(feeds) > 1 {
+		ev.Matched = make([]string, len(feeds))
+		for i, feed := range feeds {
+			ev.Matched[i] = feed.Topic()
+		}
+		// sessions subscribed via several of the feeds are sent the
+		// packet once
+		sent = make(map[chan<- PublishEvent]struct{})
+	}
+	for _, feed := range feeds {
+		feed.publish(b.ctx, ev, sent)
+	}
+}
+
+// messageExpiresAt returns when a message published now expires as per
+// its Message Expiry Interval and the broker's default and maximum
+// expiry. Returns the zero time if the message never expires
+func (b *Broker) messageExpiresAt(pkt *p.PublishPacket) time.Time {
+	d, ok := b.msgExpiry, b.msgExpiry > 0
+	if pkt.Properties != nil && pkt.Properties.MessageExpiryInterval != nil {
+		d, ok = time.Duration(*pkt.Properties.MessageExpiryInterval)*time.Second, true
+	}
+	if b.maxMsgExpiry > 0 && (!ok || d > b.maxMsgExpiry) {
+		d, ok = b.maxMsgExpiry, true
+	}
+	if !ok {
+		return time.Time{}
+	}
+	return time.Now().Add(d)
 }
 
 // Close is an implementation of the server's ConnHandler.Close. It's
@@ -128,7 +619,13 @@ func (b *Broker) authenticate(username, password []byte) bool {
 // will also gracefully shut down
 func (b *Broker) Close() {
 	b.onceClose.Do(func() {
+		// in-process subscriptions check quitCh with clientsMu held
+		b.clientsMu.Lock()
 		close(b.quitCh)
+		b.clientsMu.Unlock()
+		b.cancel()
 		b.clientsWg.Wait()
+		b.sessionsWg.Wait()
+		b.subsWg.Wait()
 	})
 }
@@ -2,10 +2,18 @@ package broker
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
 	"net"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
+	"github.com/nagamocha3000/go-mqtt-broker/internal/logging"
+	"github.com/nagamocha3000/go-mqtt-broker/internal/metrics"
 	"github.com/nagamocha3000/go-mqtt-broker/internal/protocol"
 	"github.com/stretchr/testify/require"
 )
@@ -37,7 +45,7 @@ func TestBroker(t *testing.T) {
 	require.Equal(t, len(buf), n)
 
 	// receive connack packet
-	clientSideRead := mqttPacketReader{bufio.NewReader(clientSide)}
+	clientSideRead := mqttPacketReader{r: bufio.NewReader(clientSide)}
 	f, p, err := clientSideRead.readPkt()
 	require.NoError(t, err)
 	require.Equal(t, protocol.Connack, f.PktType)
@@ -79,3 +87,763 @@ func TestBroker(t *testing.T) {
 	clientSide.Close()
 	wg.Wait()
 }
+
+func TestBrokerLogsDisconnectReason(t *testing.T) {
+	connect := func(t *testing.T, conn net.Conn, keepAlive uint16) {
+		connectPkt, err := protocol.NewConnectPacket(&protocol.ConnectPacketConfig{
+			ClientIdentifier:   []byte("abcde"),
+			KeepAliveSeconds:   keepAlive,
+			ShouldCleanSession: true,
+		})
+		require.NoError(t, err)
+		buf, err := connectPkt.Serialize(nil)
+		require.NoError(t, err)
+		_, err = conn.Write(buf)
+		require.NoError(t, err)
+		f, _, err := mqttPacketReader{r: bufio.NewReader(conn)}.readPkt()
+		require.NoError(t, err)
+		require.Equal(t, protocol.Connack, f.PktType)
+	}
+
+	cases := []struct {
+		description string
+		run         func(t *testing.T, conn net.Conn)
+		reason      string
+	}{
+		{
+			"client sends disconnect",
+			func(t *testing.T, conn net.Conn) {
+				connect(t, conn, 0)
+				buf, _ := (&protocol.DisconnectPacket{}).Serialize(nil)
+				conn.Write(buf)
+			},
+			"client disconnect",
+		},
+		{
+			"first packet is not connect",
+			func(t *testing.T, conn net.Conn) {
+				buf, _ := (&protocol.PingreqPacket{}).Serialize(nil)
+				conn.Write(buf)
+			},
+			"protocol error",
+		},
+		{
+			"client does not ping within keep alive",
+			func(t *testing.T, conn net.Conn) {
+				connect(t, conn, 1)
+				time.Sleep(2 * time.Second)
+			},
+			"keep alive timeout",
+		},
+		{
+			"client drops connection",
+			func(t *testing.T, conn net.Conn) {
+				connect(t, conn, 0)
+				conn.Close()
+			},
+			"connection lost",
+		},
+	}
+
+	for _, cs := range cases {
+		t.Run(cs.description, func(t *testing.T) {
+			var logs bytes.Buffer
+			broker := NewBroker(WithLogger(logging.New(&logs, logging.JSONFormat, logging.InfoLevel)))
+			serverSide, clientSide := net.Pipe()
+			broker.OnConn(serverSide)
+			cs.run(t, clientSide)
+			clientSide.Close()
+			require.Eventually(t, func() bool { return broker.numClients() == 0 },
+				time.Second, 5*time.Millisecond)
+			broker.Close()
+
+			var entry map[string]interface{}
+			lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+			require.NoError(t, json.Unmarshal([]byte(lines[len(lines)-1]), &entry))
+			require.Equal(t, "client disconnected", entry["msg"])
+			require.Equal(t, cs.reason, entry["reason"])
+			require.Equal(t, "pipe", entry["remote_addr"])
+		})
+	}
+}
+
+// testClient is a bare-bones MQTT client for driving a broker in tests
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    mqttPacketReader
+	// level is the protocol level packets are encoded with
+	level byte
+}
+
+func newTestClient(t *testing.T, b *Broker, clientID string) *testClient {
+	c, _ := connectTestClient(t, b, clientID, true)
+	return c
+}
+
+// connectTestClient connects a test client returning whether the
+// broker resumed a previous session
+func connectTestClient(t *testing.T, b *Broker, clientID string, clean bool) (*testClient, bool) {
+	c, connack := dialTestClient(t, b, &protocol.ConnectPacketConfig{
+		ClientIdentifier:   []byte(clientID),
+		ShouldCleanSession: clean,
+	})
+	require.Equal(t, protocol.ConnAccepted, connack.Code)
+	return c, connack.SessionPresent
+}
+
+// dialTestClient sends the given CONNECT, returning the broker's CONNACK
+func dialTestClient(t *testing.T, b *Broker, cfg *protocol.ConnectPacketConfig) (*testClient, *protocol.ConnackPacket) {
+	return dialListenerTestClient(t, b, "", cfg)
+}
+
+// dialListenerTestClient is like dialTestClient for a client connecting
+// through the named listener
+func dialListenerTestClient(t *testing.T, b *Broker, listener string, cfg *protocol.ConnectPacketConfig) (*testClient, *protocol.ConnackPacket) {
+	serverSide, clientSide := net.Pipe()
+	b.OnListenerConn(serverSide, listener)
+	c := &testClient{t: t, conn: clientSide, r: mqttPacketReader{r: bufio.NewReader(clientSide)}}
+	pkt, err := protocol.NewConnectPacket(cfg)
+	require.NoError(t, err)
+	c.level = pkt.ProtocolLevel
+	c.send(pkt)
+	f, payload := c.read()
+	require.Equal(t, protocol.Connack, f.PktType)
+	connack, err := protocol.DeserializePacket(f, payload, c.level)
+	require.NoError(t, err)
+	return c, connack.(*protocol.ConnackPacket)
+}
+
+// requireClosed checks that the broker closes the test client's connection
+func (c *testClient) requireClosed() {
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err := c.r.r.ReadByte()
+	require.Equal(c.t, io.EOF, err)
+}
+
+// requireDisconnected checks that the broker sends the MQTT 5 test client
+// a DISCONNECT with the given reason code then closes its connection
+func (c *testClient) requireDisconnected(code protocol.ReasonCode) {
+	pkt, ok := c.readPacket().(*protocol.DisconnectPacket)
+	require.True(c.t, ok)
+	require.Equal(c.t, code, pkt.ReasonCode)
+	c.requireClosed()
+}
+
+func (c *testClient) send(pkt protocol.Packet) {
+	buf, err := protocol.Versioned(pkt, c.level).Serialize(nil)
+	require.NoError(c.t, err)
+	_, err = c.conn.Write(buf)
+	require.NoError(c.t, err)
+}
+
+func (c *testClient) read() (protocol.FixedHeader, []byte) {
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	f, payload, err := c.r.readPkt()
+	require.NoError(c.t, err)
+	return f, payload
+}
+
+func (c *testClient) subscribe(pktID uint16, filter string, qos byte) *protocol.SubackPacket {
+	pkt := &protocol.SubscribePacket{PacketIdentifier: pktID}
+	require.NoError(c.t, pkt.AddTopic([]byte(filter), qos))
+	c.send(pkt)
+	f, payload := c.read()
+	require.Equal(c.t, protocol.Suback, f.PktType)
+	rcvd, err := protocol.DeserializePacket(f, payload, c.level)
+	require.NoError(c.t, err)
+	suback := rcvd.(*protocol.SubackPacket)
+	require.Equal(c.t, pktID, suback.PacketIdentifier)
+	return suback
+}
+
+func (c *testClient) readPublish() *protocol.PublishPacket {
+	f, payload := c.read()
+	require.Equal(c.t, protocol.Publish, f.PktType)
+	pkt, err := protocol.DeserializePacket(f, payload, c.level)
+	require.NoError(c.t, err)
+	return pkt.(*protocol.PublishPacket)
+}
+
+func (c *testClient) disconnect() {
+	c.send(&protocol.DisconnectPacket{})
+	c.conn.Close()
+}
+
+func TestBrokerRoutesPublishes(t *testing.T) {
+	reg := metrics.NewRegistry()
+	b := NewBroker(WithMetrics(reg))
+	defer b.Close()
+
+	// retained message published before anyone subscribes
+	pub := newTestClient(t, b, "pub")
+	pub.send(&protocol.PublishPacket{
+		QoS:              1,
+		PacketIdentifier: 1,
+		Retain:           true,
+		TopicName:        []byte("a/b"),
+		Payload:          []byte("retained"),
+	})
+	f, payload := pub.read()
+	require.Equal(t, protocol.Puback, f.PktType)
+	puback, err := protocol.DeserializePubackPktPayload(f, payload)
+	require.NoError(t, err)
+	require.Equal(t, uint16(1), puback.PacketIdentifier)
+
+	// subscriber receives retained message on subscribe, downgraded to QoS 0
+	sub := newTestClient(t, b, "sub")
+	suback := sub.subscribe(10, "a/+", 0)
+	require.Equal(t, []byte{0}, suback.ReturnCodes)
+	pkt := sub.readPublish()
+	require.True(t, pkt.Retain)
+	require.Equal(t, byte(0), pkt.QoS)
+	require.Equal(t, "retained", string(pkt.Payload))
+
+	// then live messages, not flagged as retained
+	pub.send(&protocol.PublishPacket{TopicName: []byte("a/c"), Payload: []byte("live")})
+	pkt = sub.readPublish()
+	require.False(t, pkt.Retain)
+	require.Equal(t, "a/c", string(pkt.TopicName))
+	require.Equal(t, "live", string(pkt.Payload))
+
+	// metrics are updated after a packet is written out, hence
+	// might lag slightly behind what the client has read
+	requireMetrics := func(lines ...string) {
+		require.Eventually(t, func() bool {
+			var buf bytes.Buffer
+			require.NoError(t, reg.WriteText(&buf))
+			for _, line := range lines {
+				if !strings.Contains(buf.String(), line+"\n") {
+					return false
+				}
+			}
+			return true
+		}, time.Second, 5*time.Millisecond)
+	}
+	requireMetrics(
+		"mqtt_connected_clients 2",
+		"mqtt_subscriptions 1",
+		"mqtt_retained_messages 1",
+		"mqtt_topic_feeds 1",
+		`mqtt_packets_total{type="PUBLISH",direction="in"} 2`,
+		`mqtt_packets_total{type="PUBLISH",direction="out"} 2`,
+		`mqtt_packets_total{type="CONNACK",direction="out"} 2`,
+		// first publish had no subscribers
+		"mqtt_publish_fanout_seconds_count 1",
+	)
+
+	// clearing the retained message
+	pub.send(&protocol.PublishPacket{TopicName: []byte("a/b"), Retain: true})
+	sub.readPublish()
+
+	pub.disconnect()
+	sub.conn.Close()
+	require.Eventually(t, func() bool { return b.numClients() == 0 }, time.Second, 5*time.Millisecond)
+
+	requireMetrics(
+		"mqtt_subscriptions 0",
+		"mqtt_retained_messages 0",
+		`mqtt_disconnects_total{reason="client disconnect"} 1`,
+		`mqtt_disconnects_total{reason="connection lost"} 1`,
+	)
+}
+
+func TestBrokerPublishesWillOnUngracefulDisconnect(t *testing.T) {
+	b := NewBroker()
+	defer b.Close()
+
+	sub := newTestClient(t, b, "sub")
+	sub.subscribe(1, "status/#", 1)
+
+	serverSide, clientSide := net.Pipe()
+	b.OnConn(serverSide)
+	pkt, err := protocol.NewConnectPacket(&protocol.ConnectPacketConfig{
+		ClientIdentifier:   []byte("device"),
+		ShouldCleanSession: true,
+		WillTopic:          []byte("status/device"),
+		WillMessage:        []byte("offline"),
+		WillQoS:            1,
+	})
+	require.NoError(t, err)
+	buf, _ := pkt.Serialize(nil)
+	clientSide.Write(buf)
+	f, _, err := mqttPacketReader{r: bufio.NewReader(clientSide)}.readPkt()
+	require.NoError(t, err)
+	require.Equal(t, protocol.Connack, f.PktType)
+	clientSide.Close()
+
+	will := sub.readPublish()
+	require.Equal(t, "status/device", string(will.TopicName))
+	require.Equal(t, "offline", string(will.Payload))
+	require.Equal(t, byte(1), will.QoS)
+	sub.disconnect()
+}
+
+func TestBrokerReservedTopics(t *testing.T) {
+	b := NewBroker()
+	defer b.Close()
+
+	sub := newTestClient(t, b, "sub")
+	sub.subscribe(1, "#", 1)
+	sub.subscribe(2, "$SYS/#", 1)
+
+	// client publishes to reserved topics are acknowledged but dropped
+	pub := newTestClient(t, b, "pub")
+	pub.send(&protocol.PublishPacket{
+		QoS:              1,
+		PacketIdentifier: 1,
+		Retain:           true,
+		TopicName:        []byte("$SYS/uptime"),
+		Payload:          []byte("spoofed"),
+	})
+	f, _ := pub.read()
+	require.Equal(t, protocol.Puback, f.PktType)
+	require.Empty(t, b.RetainedMessages())
+
+	// the broker itself can publish to them, only $SYS/# matches
+	require.NoError(t, b.Publish("$SYS/uptime", []byte("10"), 0, false))
+	pkt := sub.readPublish()
+	require.Equal(t, "$SYS/uptime", string(pkt.TopicName))
+	require.Equal(t, "10", string(pkt.Payload))
+
+	// # still matches other topics, hence the next message received
+	pub.send(&protocol.PublishPacket{TopicName: []byte("a"), Payload: []byte("b")})
+	pkt = sub.readPublish()
+	require.Equal(t, "a", string(pkt.TopicName))
+
+	pub.disconnect()
+	sub.disconnect()
+}
+
+func TestBrokerDeduplicatesOverlappingSubscriptions(t *testing.T) {
+	b := NewBroker()
+	defer b.Close()
+
+	pub := newTestClient(t, b, "pub")
+	pub.send(&protocol.PublishPacket{TopicName: []byte("a/b"), Payload: []byte("retained"), Retain: true})
+
+	// overlapping filters in a single packet, the retained message is sent once
+	sub := newTestClient(t, b, "sub")
+	subscribe := &protocol.SubscribePacket{PacketIdentifier: 1}
+	require.NoError(t, subscribe.AddTopic([]byte("a/+"), 0))
+	require.NoError(t, subscribe.AddTopic([]byte("a/#"), 1))
+	sub.send(subscribe)
+	f, _ := sub.read()
+	require.Equal(t, protocol.Suback, f.PktType)
+	pkt := sub.readPublish()
+	require.Equal(t, "retained", string(pkt.Payload))
+	require.Equal(t, byte(0), pkt.QoS) // downgraded to publish QoS
+
+	sub.subscribe(2, "a/b", 2)
+	pkt = sub.readPublish() // retained again, as per the spec, for the new filter
+	require.Equal(t, "retained", string(pkt.Payload))
+
+	cases := []struct {
+		publishQoS  byte
+		expectedQoS byte
+	}{
+		{0, 0},
+		{1, 1},
+		{2, 2},
+	}
+	for _, cs := range cases {
+		payload := fmt.Sprintf("qos %d", cs.publishQoS)
+		pub.send(&protocol.PublishPacket{
+			QoS:              cs.publishQoS,
+			PacketIdentifier: 10,
+			TopicName:        []byte("a/b"),
+			Payload:          []byte(payload),
+		})
+		pkt := sub.readPublish()
+		require.Equal(t, payload, string(pkt.Payload))
+		require.Equal(t, cs.expectedQoS, pkt.QoS)
+
+		// complete the publisher's side of the flow
+		switch cs.publishQoS {
+		case 1:
+			f, _ := pub.read()
+			require.Equal(t, protocol.Puback, f.PktType)
+		case 2:
+			f, _ := pub.read()
+			require.Equal(t, protocol.Pubrec, f.PktType)
+			pub.send(&protocol.PubrelPacket{PacketIdentifier: 10})
+			f, _ = pub.read()
+			require.Equal(t, protocol.Pubcomp, f.PktType)
+		}
+	}
+
+	// only a/# matches, so this is the next message rather than a duplicate
+	pub.send(&protocol.PublishPacket{TopicName: []byte("a/b/c"), Payload: []byte("last")})
+	pkt = sub.readPublish()
+	require.Equal(t, "last", string(pkt.Payload))
+	require.Equal(t, byte(0), pkt.QoS)
+
+	pub.conn.Close()
+	sub.conn.Close()
+}
+
+func TestBrokerMQTT31(t *testing.T) {
+	b := NewBroker()
+	defer b.Close()
+	cfg := func(clientID string, clean bool) *protocol.ConnectPacketConfig {
+		return &protocol.ConnectPacketConfig{
+			ClientIdentifier:   []byte(clientID),
+			ShouldCleanSession: clean,
+			ProtocolLevel:      protocol.ProtocolLevel31,
+		}
+	}
+
+	// client identifiers are limited to 23 bytes, and can't be left empty
+	c, connack := dialTestClient(t, b, cfg("abcdefghijklmnopqrstuvwx", true))
+	require.Equal(t, protocol.ConnRefusedIdentifierRejected, connack.Code)
+	c.requireClosed()
+	c, connack = dialTestClient(t, b, cfg("", true))
+	require.Equal(t, protocol.ConnRefusedIdentifierRejected, connack.Code)
+	c.requireClosed()
+
+	c, connack = dialTestClient(t, b, cfg("abcdefghijklmnopqrstuvw", false))
+	require.Equal(t, protocol.ConnAccepted, connack.Code)
+	require.Equal(t, byte(1), c.subscribe(1, "a/+", 1).ReturnCodes[0])
+
+	// 3.1 and 3.1.1 clients exchange messages
+	pub := newTestClient(t, b, "pub")
+	pub.send(&protocol.PublishPacket{QoS: 1, PacketIdentifier: 1, TopicName: []byte("a/b"), Payload: []byte("hi")})
+	msg := c.readPublish()
+	require.Equal(t, []byte("hi"), msg.Payload)
+	c.send(&protocol.PubackPacket{PacketIdentifier: msg.PacketIdentifier})
+	c.disconnect()
+	waitOffline(t, b, "abcdefghijklmnopqrstuvw", 0)
+
+	// there's no session present flag in 3.1
+	c, connack = dialTestClient(t, b, cfg("abcdefghijklmnopqrstuvw", false))
+	require.Equal(t, protocol.ConnAccepted, connack.Code)
+	require.False(t, connack.SessionPresent)
+
+	// nor a return code for refused subscriptions, the client is disconnected
+	sub := &protocol.SubscribePacket{PacketIdentifier: 2}
+	require.NoError(t, sub.AddTopic([]byte("a/#/b"), 0))
+	c.send(sub)
+	c.requireClosed()
+}
+
+func TestBrokerMQTT5Encoding(t *testing.T) {
+	b := NewBroker()
+	defer b.Close()
+
+	// the broker assigns an ID when none is given, and says so
+	c, connack := dialTestClient(t, b, &protocol.ConnectPacketConfig{
+		ProtocolLevel: protocol.ProtocolLevel5,
+		Properties:    &protocol.Properties{UserProperties: []protocol.UserProperty{{Key: []byte("k"), Value: []byte("v")}}},
+	})
+	require.Equal(t, protocol.ConnAccepted, connack.Code)
+	require.NotEmpty(t, connack.Properties.AssignedClientIdentifier)
+
+	// packets are exchanged as per MQTT 5 with 3.1.1 clients alike
+	sub := &protocol.SubscribePacket{PacketIdentifier: 1, Properties: &protocol.Properties{}}
+	require.NoError(t, sub.AddTopic([]byte("a/+"), 1))
+	require.NoError(t, sub.AddTopic([]byte("a/#/b"), 1))
+	c.send(sub)
+	f, payload := c.read()
+	suback, err := protocol.DeserializePacket(f, payload, protocol.ProtocolLevel5)
+	require.NoError(t, err)
+	require.Equal(t, []byte{1, 0x80}, suback.(*protocol.SubackPacket).ReturnCodes)
+
+	pub := newTestClient(t, b, "pub")
+	pub.send(&protocol.PublishPacket{QoS: 1, PacketIdentifier: 1, TopicName: []byte("a/b"), Payload: []byte("hi")})
+	msg := c.readPublish()
+	require.Equal(t, []byte("hi"), msg.Payload)
+	c.send(&protocol.PubackPacket{PacketIdentifier: msg.PacketIdentifier, ReasonCode: protocol.ReasonSuccess})
+	f, _ = pub.read()
+	require.Equal(t, protocol.Puback, f.PktType)
+
+	pub.subscribe(1, "a/c", 0)
+	c.send(&protocol.PublishPacket{TopicName: []byte("a/c"), Payload: []byte("from 5"), Properties: &protocol.Properties{
+		PayloadFormatIndicator: protocol.Byte(1),
+	}})
+	require.Equal(t, []byte("from 5"), pub.readPublish().Payload)
+	require.Equal(t, []byte("from 5"), c.readPublish().Payload)
+
+	// an UNSUBACK carries a reason code per topic filter, in order
+	unsub := &protocol.UnsubscribePacket{PacketIdentifier: 2, Properties: &protocol.Properties{}}
+	require.NoError(t, unsub.AddTopic([]byte("x")))
+	require.NoError(t, unsub.AddTopic([]byte("a/+")))
+	c.send(unsub)
+	unsuback, ok := c.readPacket().(*protocol.UnsubackPacket)
+	require.True(t, ok)
+	require.Equal(t, uint16(2), unsuback.PacketIdentifier)
+	require.Equal(t, []protocol.ReasonCode{protocol.ReasonNoSubscriptionExisted, protocol.ReasonSuccess}, unsuback.ReasonCodes)
+
+	// a DISCONNECT with a reason code
+	c.send(&protocol.DisconnectPacket{ReasonCode: protocol.ReasonNormalDisconnection, Properties: &protocol.Properties{
+		ReasonString: []byte("done"),
+	}})
+	c.requireClosed()
+}
+
+func TestBrokerRefusesUnsupportedProtocolLevel(t *testing.T) {
+	b := NewBroker()
+	defer b.Close()
+	pkt, err := protocol.NewConnectPacket(&protocol.ConnectPacketConfig{ShouldCleanSession: true})
+	require.NoError(t, err)
+	buf, err := pkt.Serialize(nil)
+	require.NoError(t, err)
+	// protocol level follows the fixed header and protocol name
+	require.Equal(t, protocol.ProtocolLevel311, buf[8])
+	buf[8] = 6
+
+	serverSide, clientSide := net.Pipe()
+	b.OnConn(serverSide)
+	c := &testClient{t: t, conn: clientSide, r: mqttPacketReader{r: bufio.NewReader(clientSide)}}
+	_, err = clientSide.Write(buf)
+	require.NoError(t, err)
+	f, payload := c.read()
+	require.Equal(t, protocol.Connack, f.PktType)
+	connack, err := protocol.DeserializeConnackPktPayload(f, payload)
+	require.NoError(t, err)
+	require.Equal(t, protocol.ConnRefusedUnacceptableProtocol, connack.Code)
+	c.requireClosed()
+}
+
+func TestBrokerTopicAliases(t *testing.T) {
+	b := NewBroker(WithTopicAliasMaximum(5))
+	defer b.Close()
+
+	dial := func(id string, aliasMax uint16) *testClient {
+		c, connack := dialTestClient(t, b, &protocol.ConnectPacketConfig{
+			ClientIdentifier:   []byte(id),
+			ShouldCleanSession: true,
+			ProtocolLevel:      protocol.ProtocolLevel5,
+			Properties:         &protocol.Properties{TopicAliasMaximum: protocol.Uint16(aliasMax)},
+		})
+		require.Equal(t, protocol.ConnAccepted, connack.Code)
+		require.Equal(t, protocol.Uint16(5), connack.Properties.TopicAliasMaximum)
+		return c
+	}
+	publish := func(c *testClient, topic string, alias uint16) {
+		pkt := &protocol.PublishPacket{TopicName: []byte(topic), Payload: []byte(topic)}
+		if alias > 0 {
+			pkt.Properties = &protocol.Properties{TopicAlias: protocol.Uint16(alias)}
+		}
+		c.send(pkt)
+	}
+	sub := dial("sub", 1)
+	sub.subscribe(1, "a/#", 0)
+	pub := dial("pub", 0)
+
+	// inbound aliases are resolved, outbound ones assigned
+	publish(pub, "a/long", 3)
+	publish(pub, "", 3)
+	publish(pub, "a/other", 0)
+	for i, want := range []struct{ topic, payload string }{
+		{"a/long", "a/long"},
+		{"", ""},
+		{"a/other", "a/other"},
+	} {
+		pkt := sub.readPublish()
+		require.Equal(t, want.topic, string(pkt.TopicName), i)
+		require.Equal(t, want.payload, string(pkt.Payload), i)
+		require.Equal(t, protocol.Uint16(1), pkt.Properties.TopicAlias, i)
+	}
+
+	// aliases that aren't set or above the maximum are protocol errors
+	publish(pub, "", 4)
+	pub.requireDisconnected(protocol.ReasonTopicAliasInvalid)
+	pub = dial("pub", 0)
+	publish(pub, "a/long", 6)
+	pub.requireDisconnected(protocol.ReasonTopicAliasInvalid)
+	sub.disconnect()
+}
+
+func TestBrokerSubscriptionOptions(t *testing.T) {
+	b := NewBroker()
+	defer b.Close()
+
+	c, _ := connectTestClient5(t, b, "c", true, 0)
+	pub, _ := connectTestClient5(t, b, "pub", true, 0)
+	subscribe := func(pktID uint16, opts protocol.TopicQoS) {
+		pkt := &protocol.SubscribePacket{PacketIdentifier: pktID}
+		require.NoError(t, pkt.AddSubscription(opts))
+		c.send(pkt)
+		f, _ := c.read()
+		require.Equal(t, protocol.Suback, f.PktType)
+	}
+	publish := func(from *testClient, topic string, retain bool) {
+		from.send(&protocol.PublishPacket{Retain: retain, TopicName: []byte(topic), Payload: []byte(topic)})
+	}
+	publish(pub, "r/1", true)
+	pub.ping()
+
+	// retained messages are sent unless the client opts out
+	subscribe(1, protocol.TopicQoS{
+		Topic:             []byte("r/#"),
+		RetainAsPublished: true,
+		RetainHandling:    protocol.RetainSendOnNewSubscription,
+	})
+	pkt := c.readPublish()
+	require.Equal(t, []byte("r/1"), pkt.Payload)
+	require.True(t, pkt.Retain)
+	subscribe(2, protocol.TopicQoS{
+		Topic:             []byte("r/#"),
+		RetainAsPublished: true,
+		RetainHandling:    protocol.RetainSendOnNewSubscription,
+	})
+	subscribe(3, protocol.TopicQoS{Topic: []byte("r/+"), RetainHandling: protocol.RetainDoNotSend})
+	c.ping()
+
+	// RETAIN is kept on forwarded publishes if any of the matching
+	// subscriptions is Retain As Published
+	publish(pub, "r/2", true)
+	pkt = c.readPublish()
+	require.Equal(t, []byte("r/2"), pkt.Payload)
+	require.True(t, pkt.Retain)
+
+	// the client's own publishes aren't forwarded to it via No Local
+	// subscriptions
+	subscribe(4, protocol.TopicQoS{Topic: []byte("a"), NoLocal: true})
+	publish(c, "a", false)
+	c.ping()
+	publish(pub, "a", false)
+	pkt = c.readPublish()
+	require.Equal(t, []byte("a"), pkt.Payload)
+	require.False(t, pkt.Retain)
+
+	c.disconnect()
+	pub.disconnect()
+}
+
+func TestBrokerSubscriptionIdentifiers(t *testing.T) {
+	b := NewBroker()
+	defer b.Close()
+
+	c, _ := connectTestClient5(t, b, "c", false, 60)
+	pub, _ := connectTestClient5(t, b, "pub", true, 0)
+	subscribe := func(pktID uint16, filter string, subID uint32) {
+		pkt := &protocol.SubscribePacket{PacketIdentifier: pktID}
+		if subID > 0 {
+			pkt.Properties = &protocol.Properties{SubscriptionIdentifiers: []uint32{subID}}
+		}
+		require.NoError(t, pkt.AddTopic([]byte(filter), 1))
+		c.send(pkt)
+		f, _ := c.read()
+		require.Equal(t, protocol.Suback, f.PktType)
+	}
+	publish := func(topic string, retain bool) {
+		pub.send(&protocol.PublishPacket{Retain: retain, TopicName: []byte(topic), Payload: []byte(topic)})
+	}
+	readSubIDs := func(payload string) []uint32 {
+		pkt := c.readPublish()
+		require.Equal(t, payload, string(pkt.Payload))
+		if pkt.QoS > 0 {
+			c.send(&protocol.PubackPacket{PacketIdentifier: pkt.PacketIdentifier})
+		}
+		if pkt.Properties == nil {
+			return nil
+		}
+		return pkt.Properties.SubscriptionIdentifiers
+	}
+
+	// all the identifiers of the matching subscriptions are sent
+	subscribe(1, "a/#", 2)
+	subscribe(2, "a/+", 1)
+	subscribe(3, "b", 0)
+	publish("a/b", false)
+	require.Equal(t, []uint32{1, 2}, readSubIDs("a/b"))
+	publish("b", false)
+	require.Nil(t, readSubIDs("b"))
+
+	// resubscribing without an identifier removes it
+	subscribe(4, "a/#", 0)
+	publish("a/b", false)
+	require.Equal(t, []uint32{1}, readSubIDs("a/b"))
+
+	// retained messages are sent with the new subscription's identifier
+	publish("r", true)
+	subscribe(5, "r", 5)
+	require.Equal(t, []uint32{5}, readSubIDs("r"))
+
+	// identifiers are kept on messages queued while the client is offline
+	pub.send(&protocol.PublishPacket{QoS: 1, TopicName: []byte("a/c"), Payload: []byte("a/c"), PacketIdentifier: 1})
+	pub.read() // PUBACK
+	readSubIDs("a/c")
+	c.disconnect()
+	waitOffline(t, b, "c", 0)
+	pub.send(&protocol.PublishPacket{QoS: 1, TopicName: []byte("a/c"), Payload: []byte("a/c"), PacketIdentifier: 2})
+	pub.read() // PUBACK
+	waitOffline(t, b, "c", 1)
+	c, _ = connectTestClient5(t, b, "c", false, 60)
+	require.Equal(t, []uint32{1}, readSubIDs("a/c"))
+
+	c.disconnect()
+
+	// clients can't set subscription identifiers on what they publish
+	pub.send(&protocol.PublishPacket{TopicName: []byte("a/b"), Properties: &protocol.Properties{
+		SubscriptionIdentifiers: []uint32{1},
+	}})
+	pub.requireDisconnected(protocol.ReasonProtocolError)
+}
+
+func TestBrokerFlowControl(t *testing.T) {
+	b := NewBroker(WithReceiveMaximum(1), WithMaxPacketSize(64))
+	defer b.Close()
+
+	sub, connack := dialTestClient(t, b, &protocol.ConnectPacketConfig{
+		ClientIdentifier:   []byte("sub"),
+		ShouldCleanSession: true,
+		ProtocolLevel:      protocol.ProtocolLevel5,
+		Properties: &protocol.Properties{
+			ReceiveMaximum:    protocol.Uint16(2),
+			MaximumPacketSize: protocol.Uint32(40),
+		},
+	})
+	require.Equal(t, protocol.ConnAccepted, connack.Code)
+	require.Equal(t, protocol.Uint16(1), connack.Properties.ReceiveMaximum)
+	require.Equal(t, protocol.Uint32(64), connack.Properties.MaximumPacketSize)
+	sub.subscribe(1, "a/#", 1)
+	pub, _ := connectTestClient5(t, b, "pub", true, 0)
+	var pktID uint16
+	publish := func(topic string, payload []byte) {
+		pktID++
+		pub.send(&protocol.PublishPacket{QoS: 1, TopicName: []byte(topic), Payload: payload, PacketIdentifier: pktID})
+		f, _ := pub.read()
+		require.Equal(t, protocol.Puback, f.PktType)
+	}
+	readPublish := func(topic string) uint16 {
+		pkt := sub.readPublish()
+		require.Equal(t, topic, string(pkt.TopicName))
+		return pkt.PacketIdentifier
+	}
+
+	// no more than the client's Receive Maximum are left unacknowledged,
+	// the rest are sent in order as acknowledgements come in
+	publish("a/1", []byte("x"))
+	publish("a/2", []byte("x"))
+	publish("a/3", []byte("x"))
+	first := readPublish("a/1")
+	second := readPublish("a/2")
+	sub.ping()
+	sub.send(&protocol.PubackPacket{PacketIdentifier: first})
+	third := readPublish("a/3")
+	sub.send(&protocol.PubackPacket{PacketIdentifier: second})
+	sub.send(&protocol.PubackPacket{PacketIdentifier: third})
+
+	// messages too large for the client are dropped as if delivered
+	publish("a/big", make([]byte, 40))
+	publish("a/4", []byte("x"))
+	publish("a/5", []byte("x"))
+	readPublish("a/4")
+	readPublish("a/5")
+	sub.ping()
+
+	// packets larger than the broker's maximum are protocol errors
+	pub.send(&protocol.PublishPacket{TopicName: []byte("a/big"), Payload: make([]byte, 64)})
+	pub.requireDisconnected(protocol.ReasonPacketTooLarge)
+
+	// as is exceeding the broker's Receive Maximum
+	pub, _ = connectTestClient5(t, b, "pub", true, 0)
+	pub.send(&protocol.PublishPacket{QoS: 2, TopicName: []byte("b"), PacketIdentifier: 1})
+	f, _ := pub.read()
+	require.Equal(t, protocol.Pubrec, f.PktType)
+	pub.send(&protocol.PublishPacket{QoS: 2, TopicName: []byte("b"), PacketIdentifier: 2})
+	pub.requireDisconnected(protocol.ReasonReceiveMaximumExceeded)
+	sub.disconnect()
+}
@@ -4,115 +4,680 @@ import (
 	"bufio"
 	"io"
 	"net"
+	"sort"
 	"sync"
+	"time"
 
+	"github.com/nagamocha3000/go-mqtt-broker/auth"
+	"github.com/nagamocha3000/go-mqtt-broker/internal/logging"
 	p "github.com/nagamocha3000/go-mqtt-broker/internal/protocol"
+	"github.com/nagamocha3000/go-mqtt-broker/internal/store"
 )
 
 type clientSession struct {
-	closeSigCh    chan struct{}
-	conn          net.Conn
-	id            string
-	subscriptions map[string]Subscription
-	topicMap      TopicMap
+	*session
+	broker      *Broker
+	closeSigCh  chan struct{}
+	conn        net.Conn
+	reader      mqttPacketReader
+	writeMu     sync.Mutex
+	connectedAt time.Time
+	keepAlive   time.Duration
+	logger      logging.Logger
+	// protocolLevel is the MQTT version the client connected with
+	protocolLevel byte
+	// connectExpiry is the Session Expiry Interval the client connected
+	// with, before it's capped by the broker's maximum
+	connectExpiry uint32
+	// listener is the name of the listener the client connected through
+	listener string
+	// topic aliases set by the client, only used while handling packets
+	inAliases *inboundAliases
+	// topic aliases set by the broker, guarded by writeMu
+	outAliases *outboundAliases
+	// limits set by an MQTT 5 client, 0 if there are none: how many QoS
+	// 1 & 2 publishes it accepts unacknowledged and how large a packet
+	receiveMax    uint16
+	maxPacketSize uint32
+	// signals the monitor there might be queued messages to send
+	queueSigCh chan struct{}
+	// Authentication Method of an MQTT 5 client that authenticated
+	// through enhanced authentication, plus the re-authentication
+	// exchange under way if any, only used while handling packets
+	authMethod string
+	reauth     auth.Exchange
 
-	willFlag  bool
-	onceClose sync.Once
+	will        *p.PublishPacket // guarded by mu
+	onceClose   sync.Once
+	closeReason disconnectReason
 }
 
-func newClientSession(id string, conn net.Conn, tm TopicMap) *clientSession {
+// newClientSession returns a client session for the given connection. Its
+// session is attached once the client is registered
+func newClientSession(b *Broker, conn net.Conn, r mqttPacketReader, logger logging.Logger) *clientSession {
 	return &clientSession{
-		closeSigCh: make(chan struct{}),
-		conn:       conn,
-		id:         id,
-		topicMap:   tm,
+		inAliases:   newInboundAliases(0),
+		broker:      b,
+		closeSigCh:  make(chan struct{}),
+		queueSigCh:  make(chan struct{}, 1),
+		conn:        conn,
+		reader:      r,
+		connectedAt: time.Now(),
+		logger:      logger,
 	}
 }
 
-func (c *clientSession) start() {
-
-	// channel for messages client has subscribed to
-	messagesCh := make(chan *p.PublishPacket)
-
-	// handler for incoming pkts
-	handlePacket := func(f p.FixedHeader, payload []byte) {
-		switch f.PktType {
-		case p.Pingreq:
-			c.sendPacket(&p.PingrespPacket{})
-		case p.Publish:
-			_, err := p.DeserializePublishPktPayload(f, payload)
-			if err != nil {
-				c.close()
-				return
-			}
-		case p.Subscribe:
-			_, err := p.DeserializeSubscribePktPayload(f, payload)
-			if err != nil {
-				c.close()
-				return
-			}
-			// send suback
-		case p.Unsubscribe:
-			pkt, err := p.DeserializeUnsubscribePktPayload(f, payload)
-			if err != nil {
-				c.close()
-				return
-			}
-			ackPkt := p.UnsubackPacket{PacketIdentifier: pkt.PacketIdentifier}
-			c.sendPacket(&ackPkt)
-		case p.Disconnect:
-			c.willFlag = false
-			c.close()
-		default:
-			c.close()
-		}
-	}
+// start runs the session until it is closed, returning
+// the reason the session was closed
+func (c *clientSession) start() disconnectReason {
 
 	// read incoming pkts
 	go func() {
-		r := mqttPacketReader{bufio.NewReader(c.conn)}
 		for {
 			select {
 			case <-c.closeSigCh:
 				return
 			default:
-				f, payload, err := r.readPkt()
-				if err != nil || !f.IsValidFlagsSet() {
+				// as per the spec, if the server does not receive a packet
+				// within one and a half times the keep alive period, it
+				// should disconnect the client
+				if c.keepAlive > 0 {
+					c.conn.SetReadDeadline(time.Now().Add(c.keepAlive * 3 / 2))
+				}
+				f, payload, err := c.reader.readPkt()
+				if err != nil {
+					if err == errPacketTooLarge {
+						c.protocolError(f, err)
+					} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+						c.close(reasonKeepAliveTimeout)
+					} else {
+						c.close(reasonConnectionLost)
+					}
 					return
 				}
-				handlePacket(f, payload)
+				c.broker.metrics.packet(f.PktType, directionIn, f.PacketLen())
+				if !f.IsValidFlagsSet() {
+					c.protocolError(f, errInvalidFlags)
+					return
+				}
+				c.handlePacket(f, payload)
 			}
 		}
 	}()
 
+	c.resume()
+
 	// monitor
 	for {
 		select {
-		case <-messagesCh:
+		case ev := <-c.messagesCh:
+			c.deliver(ev)
+		case <-c.queueSigCh:
+			c.sendQueued()
+		case <-c.broker.quitCh:
+			c.close(reasonServerShutdown)
 		case <-c.closeSigCh:
+			return c.closeReason
+		}
+	}
+
+}
+
+// handlePacket handles incoming pkts
+func (c *clientSession) handlePacket(f p.FixedHeader, payload []byte) {
+	c.logger.Debug("packet received",
+		logging.F("packet_type", p.ControlPacketType(f.PktType)),
+		logging.F("size", f.PayloadSize))
+	pkt, err := p.DeserializePacket(f, payload, c.protocolLevel)
+	if err != nil {
+		c.protocolError(f, err)
+		return
+	}
+	switch pkt := pkt.(type) {
+	case *p.PingreqPacket:
+		c.sendPacket(&p.PingrespPacket{})
+	case *p.PublishPacket:
+		c.handlePublish(f, pkt)
+	case *p.PubackPacket:
+		c.discardInflight(pkt.PacketIdentifier)
+	case *p.PubrecPacket:
+		// under MQTT 5 the client can refuse the message, which ends
+		// its delivery
+		if pkt.ReasonCode.IsError() {
+			c.discardInflight(pkt.PacketIdentifier)
+			return
+		}
+		c.mu.Lock()
+		msg, ok := c.inflight[pkt.PacketIdentifier]
+		// the PUBREC might be resent, eg after the client reconnects
+		_, released := c.awaitingComp[pkt.PacketIdentifier]
+		if ok {
+			delete(c.inflight, pkt.PacketIdentifier)
+			c.awaitingComp[pkt.PacketIdentifier] = struct{}{}
+		}
+		c.mu.Unlock()
+		if !ok && !released {
+			// a packet ID the broker isn't using is not recorded, lest
+			// the client ties up packet IDs
+			pubrel := &p.PubrelPacket{PacketIdentifier: pkt.PacketIdentifier}
+			if c.protocolLevel == p.ProtocolLevel5 {
+				pubrel.ReasonCode = p.ReasonPacketIdentifierNotFound
+			}
+			c.sendPacket(pubrel)
 			return
 		}
+		if ok {
+			c.persist(func(st store.Store) error {
+				return st.PutInflight(c.id, store.Message{
+					Topic:    string(msg.pkt.TopicName),
+					QoS:      msg.pkt.QoS,
+					PacketID: msg.pkt.PacketIdentifier,
+					Released: true,
+				})
+			})
+		}
+		c.sendPacket(&p.PubrelPacket{PacketIdentifier: pkt.PacketIdentifier})
+	case *p.PubrelPacket:
+		c.mu.Lock()
+		delete(c.receivedQoS2, pkt.PacketIdentifier)
+		c.mu.Unlock()
+		c.persist(func(st store.Store) error {
+			return st.DeleteReceived(c.id, pkt.PacketIdentifier)
+		})
+		c.sendPacket(&p.PubcompPacket{PacketIdentifier: pkt.PacketIdentifier})
+	case *p.PubcompPacket:
+		c.mu.Lock()
+		delete(c.awaitingComp, pkt.PacketIdentifier)
+		c.mu.Unlock()
+		c.persist(func(st store.Store) error {
+			return st.DeleteInflight(c.id, pkt.PacketIdentifier)
+		})
+		c.signalQueue()
+	case *p.AuthPacket:
+		c.handleAuth(f, pkt)
+	case *p.SubscribePacket:
+		c.handleSubscribe(f, pkt)
+	case *p.UnsubscribePacket:
+		c.handleUnsubscribe(pkt)
+	case *p.DisconnectPacket:
+		if pkt.Properties != nil && pkt.Properties.SessionExpiryInterval != nil {
+			err := c.broker.setSessionExpiry(c, *pkt.Properties.SessionExpiryInterval)
+			if err != nil {
+				c.protocolError(f, err)
+				return
+			}
+		}
+		// under MQTT 5 the client can ask for its will to be published
+		if pkt.ReasonCode != p.ReasonDisconnectWithWill {
+			c.mu.Lock()
+			c.will = nil
+			c.mu.Unlock()
+		}
+		c.close(reasonClientDisconnect)
+	default:
+		c.protocolError(f, errUnexpectedPacket)
 	}
+}
 
+func (c *clientSession) handlePublish(f p.FixedHeader, pkt *p.PublishPacket) {
+	// subscription identifiers are only ever set by the server
+	if pkt.Properties != nil && len(pkt.Properties.SubscriptionIdentifiers) > 0 {
+		c.protocolError(f, errSubscriptionIDSent)
+		return
+	}
+	if err := c.inAliases.resolve(pkt); err != nil {
+		c.protocolError(f, err)
+		return
+	}
+	tokens, hasWildcard, err := ParseTopic(pkt.TopicName)
+	if err != nil || hasWildcard {
+		c.protocolError(f, ErrInvalidTopicName)
+		return
+	}
+	// clients can't publish into the broker's reserved namespace. There's
+	// no way to reject a publish in 3.1.1 so it's acknowledged but dropped
+	route := !IsReservedTopic(tokens)
+	if !route {
+		c.logger.Debug("dropped publish to reserved topic",
+			logging.F("topic", string(pkt.TopicName)))
+	}
+	if route {
+		c.stamp(pkt)
+	}
+	publish := func() {
+		if route {
+			c.broker.onPublish(c.id, string(pkt.TopicName), pkt.Payload, pkt.QoS, pkt.Retain)
+			c.broker.publish(pkt, tokens, c.id)
+		}
+	}
+	switch pkt.QoS {
+	case 0:
+		publish()
+	case 1:
+		publish()
+		c.sendPacket(&p.PubackPacket{PacketIdentifier: pkt.PacketIdentifier})
+	case 2:
+		// a resent QoS 2 publish that's yet to be released should
+		// not be delivered twice
+		c.mu.Lock()
+		_, alreadyReceived := c.receivedQoS2[pkt.PacketIdentifier]
+		// MQTT 5 clients may only have as many QoS 2 publishes
+		// unreleased as the broker's Receive Maximum
+		exceeded := !alreadyReceived && c.protocolLevel == p.ProtocolLevel5 &&
+			len(c.receivedQoS2) >= int(c.broker.receiveMax)
+		if !exceeded {
+			c.receivedQoS2[pkt.PacketIdentifier] = struct{}{}
+		}
+		c.mu.Unlock()
+		if exceeded {
+			c.protocolError(f, errReceiveMaximumExceeded)
+			return
+		}
+		if !alreadyReceived {
+			c.persist(func(st store.Store) error {
+				return st.PutReceived(c.id, pkt.PacketIdentifier)
+			})
+			publish()
+		}
+		c.sendPacket(&p.PubrecPacket{PacketIdentifier: pkt.PacketIdentifier})
+	}
 }
 
-func (c *clientSession) close() {
+func (c *clientSession) handleSubscribe(f p.FixedHeader, pkt *p.SubscribePacket) {
+	// MQTT 3.1 has no return code for refusing a subscription, an
+	// invalid filter is treated as a protocol error
+	if c.protocolLevel == p.ProtocolLevel31 {
+		for _, t := range pkt.List {
+			if _, _, err := ParseTopic(t.Topic); err != nil {
+				c.protocolError(f, err)
+				return
+			}
+		}
+	}
+	// MQTT 5 clients may set an identifier on all the subscriptions made
+	var subID uint32
+	if pkt.Properties != nil && len(pkt.Properties.SubscriptionIdentifiers) > 0 {
+		subID = pkt.Properties.SubscriptionIdentifiers[0]
+	}
+	ack := &p.SubackPacket{PacketIdentifier: pkt.PacketIdentifier}
+	var retained []retainedMsg
+	var granted []byte
+	retainedIdx := make(map[*p.PublishPacket]int)
+	for _, t := range pkt.List {
+		tokens, _, err := ParseTopic(t.Topic)
+		if err != nil {
+			ack.AddFailure()
+			continue
+		}
+		filter := string(t.Topic)
+		c.mu.Lock()
+		existing, existed := c.subscriptions[filter]
+		if !existed {
+			existing = &sessionSubscription{
+				sub:    c.topicMap.SubscribeByTopic(filter, tokens, c.messagesCh),
+				tokens: tokens,
+			}
+			c.subscriptions[filter] = existing
+			c.broker.metrics.subscriptions.Inc()
+		}
+		// as per the spec, a subscription to an existing filter
+		// replaces the previous one
+		existing.setOptions(t)
+		existing.subID = subID
+		opts := existing.options()
+		c.mu.Unlock()
+		c.persist(func(st store.Store) error {
+			return st.PutSubscription(c.id, filter, opts, subID)
+		})
+		c.broker.onSubscribe(c.id, filter, t.Qos)
+		ack.AddQoSGranted(t.Qos)
+
+		// MQTT 5 clients may ask not to be sent retained messages, or
+		// only if the subscription is new
+		if t.RetainHandling == p.RetainDoNotSend ||
+			(t.RetainHandling == p.RetainSendOnNewSubscription && existed) {
+			continue
+		}
+
+		// filters within the same packet might overlap, each retained
+		// message is sent once at the highest QoS granted
+		for _, r := range c.broker.retained.matching(tokens) {
+			if i, ok := retainedIdx[r.pkt]; ok {
+				if t.Qos > granted[i] {
+					granted[i] = t.Qos
+				}
+				continue
+			}
+			retainedIdx[r.pkt] = len(retained)
+			retained = append(retained, r)
+			granted = append(granted, t.Qos)
+		}
+	}
+	c.sendPacket(ack)
+
+	// retained messages are sent once the subscription is acknowledged
+	var subIDs []uint32
+	if subID > 0 {
+		subIDs = []uint32{subID}
+	}
+	for i, r := range retained {
+		c.sendPublish(r.pkt, delivery{qos: granted[i], retain: true, subIDs: subIDs}, r.expiresAt)
+	}
+}
+
+func (c *clientSession) handleUnsubscribe(pkt *p.UnsubscribePacket) {
+	var removed []*sessionSubscription
+	var filters []string
+	ack := &p.UnsubackPacket{PacketIdentifier: pkt.PacketIdentifier}
+	c.mu.Lock()
+	for _, topic := range pkt.List {
+		s, ok := c.subscriptions[string(topic)]
+		if ok {
+			removed = append(removed, s)
+			filters = append(filters, string(topic))
+			delete(c.subscriptions, string(topic))
+		}
+		// MQTT 5 clients are sent a reason code per topic filter
+		if c.protocolLevel == p.ProtocolLevel5 {
+			code := p.ReasonNoSubscriptionExisted
+			if ok {
+				code = p.ReasonSuccess
+			}
+			ack.ReasonCodes = append(ack.ReasonCodes, code)
+		}
+	}
+	c.mu.Unlock()
+	// unsubscribing might have to wait for an ongoing publish
+	// on the feed hence done without holding the lock
+	for _, s := range removed {
+		c.topicMap.UnsubscribeByTopic(s.sub, s.tokens)
+		c.broker.metrics.subscriptions.Dec()
+	}
+	for _, filter := range filters {
+		filter := filter
+		c.persist(func(st store.Store) error {
+			return st.DeleteSubscription(c.id, filter)
+		})
+		c.broker.onUnsubscribe(c.id, filter)
+	}
+	c.sendPacket(ack)
+}
+
+// deliver sends a message received via one of the session's
+// subscriptions to the client
+func (c *clientSession) deliver(ev PublishEvent) {
+	if d, ok := c.delivery(ev); ok {
+		c.sendPublish(ev.RawPkt, d, ev.ExpiresAt)
+	}
+}
+
+// sendPublish sends a copy of the given publish packet to the client at the
+// lower of the packet's QoS and the QoS to deliver at, since the original
+// packet is shared across all subscribers. Messages that have expired are
+// dropped, otherwise the client is told how long the message has left.
+// QoS 1 & 2 messages are queued instead while the client's Receive
+// Maximum is reached or earlier messages are yet to be sent
+func (c *clientSession) sendPublish(pkt *p.PublishPacket, d delivery, expiresAt time.Time) {
+	if expired(expiresAt) {
+		return
+	}
+	out := &p.PublishPacket{
+		QoS:        pkt.QoS,
+		Retain:     d.retain,
+		TopicName:  pkt.TopicName,
+		Payload:    pkt.Payload,
+		Properties: publishProperties(pkt.Properties, expiresAt, d.subIDs),
+	}
+	if d.qos < out.QoS {
+		out.QoS = d.qos
+	}
+	if out.QoS > 0 {
+		c.mu.Lock()
+		if len(c.queue) > 0 || !c.hasQuota() {
+			c.mu.Unlock()
+			c.push(out, delivery{qos: out.QoS, retain: out.Retain, subIDs: d.subIDs}, expiresAt)
+			c.signalQueue()
+			return
+		}
+		c.addInflight(out, expiresAt, d.subIDs)
+		c.mu.Unlock()
+	}
+	c.sendInflight(out, expiresAt, d.subIDs)
+}
+
+// sendQueued sends the messages queued for the client in order, for as
+// long as the client's Receive Maximum allows. Messages that expired
+// while queued are dropped
+func (c *clientSession) sendQueued() {
+	for {
+		c.mu.Lock()
+		if len(c.queue) == 0 || !c.hasQuota() {
+			c.mu.Unlock()
+			return
+		}
+		q := c.queue[0]
+		c.queue[0] = queuedMsg{} // GC
+		c.queue = c.queue[1:]
+		var out *p.PublishPacket
+		if !expired(q.expiresAt) {
+			out = &p.PublishPacket{
+				QoS:        q.pkt.QoS,
+				Retain:     q.pkt.Retain,
+				TopicName:  q.pkt.TopicName,
+				Payload:    q.pkt.Payload,
+				Properties: publishProperties(q.pkt.Properties, q.expiresAt, q.subIDs),
+			}
+			c.addInflight(out, q.expiresAt, q.subIDs)
+		}
+		c.mu.Unlock()
+		c.persist(func(st store.Store) error {
+			return st.DeleteQueued(c.id, q.seq)
+		})
+		if out != nil {
+			c.sendInflight(out, q.expiresAt, q.subIDs)
+		}
+	}
+}
+
+// hasQuota reports whether the client accepts another unacknowledged QoS
+// 1 or 2 publish. Should be called with c.mu held
+func (c *clientSession) hasQuota() bool {
+	return c.receiveMax == 0 || len(c.inflight)+len(c.awaitingComp) < int(c.receiveMax)
+}
+
+// addInflight assigns a packet identifier to a QoS 1 or 2 publish and
+// records it as inflight. Should be called with c.mu held
+func (c *clientSession) addInflight(out *p.PublishPacket, expiresAt time.Time, subIDs []uint32) {
+	out.PacketIdentifier = c.nextPacketID()
+	c.inflight[out.PacketIdentifier] = inflightMsg{pkt: out, expiresAt: expiresAt, subIDs: subIDs}
+}
+
+// sendInflight writes a publish through to the store if it's inflight,
+// then sends it. As per the spec, a publish that's too large for the
+// client is dropped as if it had been delivered
+func (c *clientSession) sendInflight(out *p.PublishPacket, expiresAt time.Time, subIDs []uint32) {
+	if out.QoS > 0 {
+		c.persist(func(st store.Store) error {
+			return st.PutInflight(c.id, store.Message{
+				Topic:           string(out.TopicName),
+				Payload:         out.Payload,
+				QoS:             out.QoS,
+				Retain:          out.Retain,
+				PacketID:        out.PacketIdentifier,
+				ExpiresAt:       expiresAt,
+				SubscriptionIDs: subIDs,
+				Properties:      storedProperties(out.Properties),
+			})
+		})
+	}
+	if c.sendPacket(out) == errPacketTooLarge && out.QoS > 0 {
+		c.discardInflight(out.PacketIdentifier)
+	}
+}
+
+// discardInflight ends the delivery of an inflight QoS 1 or 2 publish,
+// freeing up room for queued messages
+func (c *clientSession) discardInflight(pktID uint16) {
+	c.mu.Lock()
+	delete(c.inflight, pktID)
+	c.mu.Unlock()
+	c.persist(func(st store.Store) error {
+		return st.DeleteInflight(c.id, pktID)
+	})
+	c.signalQueue()
+}
+
+// signalQueue tells the monitor to send any queued messages the client's
+// Receive Maximum allows
+func (c *clientSession) signalQueue() {
+	select {
+	case c.queueSigCh <- struct{}{}:
+	default:
+	}
+}
+
+// resume picks up where a persistent session left off once the client
+// reconnects. As per the spec, unacknowledged PUBLISH and PUBREL packets
+// are resent first, then messages queued while the client was offline
+// are sent in order as its Receive Maximum allows. Messages that expired
+// in the meantime are dropped
+func (c *clientSession) resume() {
+	c.mu.Lock()
+	inflight := make([]inflightMsg, 0, len(c.inflight))
+	var expiredIDs []uint16
+	for pktID, msg := range c.inflight {
+		if expired(msg.expiresAt) {
+			delete(c.inflight, pktID)
+			expiredIDs = append(expiredIDs, pktID)
+			continue
+		}
+		inflight = append(inflight, msg)
+	}
+	released := make([]uint16, 0, len(c.awaitingComp))
+	for pktID := range c.awaitingComp {
+		released = append(released, pktID)
+	}
+	c.mu.Unlock()
+	for _, pktID := range expiredIDs {
+		pktID := pktID
+		c.persist(func(st store.Store) error {
+			return st.DeleteInflight(c.id, pktID)
+		})
+	}
+
+	// packet IDs are assigned in order, barring wrap around
+	sort.Slice(inflight, func(i, j int) bool {
+		return inflight[i].pkt.PacketIdentifier < inflight[j].pkt.PacketIdentifier
+	})
+	sort.Slice(released, func(i, j int) bool { return released[i] < released[j] })
+	for _, msg := range inflight {
+		dup := *msg.pkt
+		dup.Dup = true
+		dup.Properties = publishProperties(msg.pkt.Properties, msg.expiresAt, msg.subIDs)
+		if c.sendPacket(&dup) == errPacketTooLarge {
+			c.discardInflight(dup.PacketIdentifier)
+		}
+	}
+	for _, pktID := range released {
+		c.sendPacket(&p.PubrelPacket{PacketIdentifier: pktID})
+	}
+	c.sendQueued()
+}
+
+// nextPacketID returns an unused packet identifier. Should be
+// called with c.mu held
+func (c *clientSession) nextPacketID() uint16 {
+	for {
+		c.lastPktID++
+		if c.lastPktID == 0 {
+			continue
+		}
+		_, inflight := c.inflight[c.lastPktID]
+		_, awaitingComp := c.awaitingComp[c.lastPktID]
+		if !inflight && !awaitingComp {
+			return c.lastPktID
+		}
+	}
+}
+
+// end cleans up once the session is closed: removes the session's
+// subscriptions unless the session is persistent and publishes the
+// will message unless the client disconnected gracefully, which clears
+// the will
+func (c *clientSession) end(reason disconnectReason) {
+	if !c.persistent {
+		c.discard()
+	}
+
+	// the DISCONNECT might be handled after the session is closed for
+	// some other reason, eg server shutdown
+	c.mu.Lock()
+	will := c.will
+	c.mu.Unlock()
+	if will != nil {
+		tokens, hasWildcard, err := ParseTopic(will.TopicName)
+		if err == nil && !hasWildcard && !IsReservedTopic(tokens) {
+			c.stamp(will)
+			c.broker.publish(will, tokens, c.id)
+		}
+	}
+}
+
+func (c *clientSession) protocolError(f p.FixedHeader, err error) {
+	c.logger.Debug("protocol error",
+		logging.F("packet_type", p.ControlPacketType(f.PktType)),
+		logging.Err(err))
+	// MQTT 5 clients are told why they're being disconnected
+	if c.protocolLevel == p.ProtocolLevel5 {
+		c.sendPacket(&p.DisconnectPacket{ReasonCode: disconnectReasonCode(err)})
+	}
+	c.close(reasonProtocolError)
+}
+
+// close closes the session, only the first reason given is recorded
+func (c *clientSession) close(reason disconnectReason) {
 	c.onceClose.Do(func() {
+		c.closeReason = reason
 		close(c.closeSigCh)
 	})
 }
 
+// sendPacket serializes the packet as per the protocol level the client
+// connected with then writes it out
 func (c *clientSession) sendPacket(pkt p.Packet) (err error) {
-	var p []byte
-	p, err = pkt.Serialize(nil)
+	// topic aliases are assigned in the order publishes are written out
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if pub, ok := pkt.(*p.PublishPacket); ok {
+		pkt = c.outAliases.apply(pub)
+	}
+	var b []byte
+	b, err = p.Versioned(pkt, c.protocolLevel).Serialize(nil)
+	if err != nil {
+		return
+	}
+	if c.maxPacketSize > 0 && len(b) > int(c.maxPacketSize) {
+		// the client never learns of an alias set by a dropped publish
+		if pub, ok := pkt.(*p.PublishPacket); ok && len(pub.TopicName) > 0 {
+			c.outAliases.forget(string(pub.TopicName))
+		}
+		c.logger.Debug("dropped packet exceeding client's maximum packet size",
+			logging.F("packet_type", p.ControlPacketType(b[0]>>4)),
+			logging.F("size", len(b)))
+		return errPacketTooLarge
+	}
+	_, err = c.conn.Write(b)
 	if err == nil {
-		_, err = c.conn.Write(p)
+		c.broker.metrics.packet(b[0]>>4, directionOut, len(b))
 	}
 	return
 }
 
 type mqttPacketReader struct {
 	r *bufio.Reader
+	// maxPacketSize is the size of the largest packet accepted, 0 if
+	// there's no limit
+	maxPacketSize uint32
 }
 
 func (r mqttPacketReader) readPkt() (f p.FixedHeader, payload []byte, err error) {
@@ -121,6 +686,12 @@ func (r mqttPacketReader) readPkt() (f p.FixedHeader, payload []byte, err error)
 	if err != nil {
 		return
 	}
+	// checked before the payload is allocated, the rest of the packet
+	// isn't read since the connection is closed
+	if r.maxPacketSize > 0 && f.PacketLen() > int(r.maxPacketSize) {
+		err = errPacketTooLarge
+		return
+	}
 	// read rest of payload
 	if f.PayloadSize > 0 {
 		payload = make([]byte, f.PayloadSize)
@@ -0,0 +1,147 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nagamocha3000/go-mqtt-broker/internal/protocol"
+	"github.com/stretchr/testify/require"
+)
+
+// pendingAcks returns how many of the publishes sent to a client are
+// awaiting PUBACK/PUBREC and how many are awaiting PUBCOMP
+func pendingAcks(b *Broker, clientID string) (inflight, awaitingComp int) {
+	b.clientsMu.Lock()
+	cs := b.clients[clientID]
+	b.clientsMu.Unlock()
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return len(cs.inflight), len(cs.awaitingComp)
+}
+
+// readAck reads a packet that only carries a packet identifier
+// and returns the identifier
+func (c *testClient) readAck(pktType byte) uint16 {
+	f, payload := c.read()
+	require.Equal(c.t, pktType, f.PktType)
+	require.Len(c.t, payload, 2)
+	return uint16(payload[0])<<8 | uint16(payload[1])
+}
+
+func TestClientSessionQoS1Delivery(t *testing.T) {
+	b := NewBroker()
+	defer b.Close()
+
+	sub := newTestClient(t, b, "sub")
+	sub.subscribe(1, "a/b", 1)
+	pub := newTestClient(t, b, "pub")
+	pub.send(&protocol.PublishPacket{QoS: 1, PacketIdentifier: 5, TopicName: []byte("a/b"), Payload: []byte("x")})
+	require.Equal(t, uint16(5), pub.readAck(protocol.Puback))
+
+	pkt := sub.readPublish()
+	require.Equal(t, byte(1), pkt.QoS)
+	require.NotZero(t, pkt.PacketIdentifier)
+	inflight, _ := pendingAcks(b, "sub")
+	require.Equal(t, 1, inflight)
+
+	sub.send(&protocol.PubackPacket{PacketIdentifier: pkt.PacketIdentifier})
+	require.Eventually(t, func() bool {
+		inflight, _ := pendingAcks(b, "sub")
+		return inflight == 0
+	}, time.Second, 5*time.Millisecond)
+
+	pub.disconnect()
+	sub.disconnect()
+}
+
+func TestClientSessionQoS2Delivery(t *testing.T) {
+	b := NewBroker()
+	defer b.Close()
+
+	sub := newTestClient(t, b, "sub")
+	sub.subscribe(1, "a/b", 2)
+	pub := newTestClient(t, b, "pub")
+
+	// a publish resent before it's released is only routed once
+	msg := &protocol.PublishPacket{QoS: 2, PacketIdentifier: 7, TopicName: []byte("a/b"), Payload: []byte("x")}
+	pub.send(msg)
+	require.Equal(t, uint16(7), pub.readAck(protocol.Pubrec))
+	dup := *msg
+	dup.Dup = true
+	pub.send(&dup)
+	require.Equal(t, uint16(7), pub.readAck(protocol.Pubrec))
+	pub.send(&protocol.PubrelPacket{PacketIdentifier: 7})
+	require.Equal(t, uint16(7), pub.readAck(protocol.Pubcomp))
+
+	pkt := sub.readPublish()
+	require.Equal(t, byte(2), pkt.QoS)
+	require.Equal(t, "x", string(pkt.Payload))
+
+	// the outbound flow, PUBREC is answered with PUBREL
+	sub.send(&protocol.PubrecPacket{PacketIdentifier: pkt.PacketIdentifier})
+	require.Equal(t, pkt.PacketIdentifier, sub.readAck(protocol.Pubrel))
+	inflight, awaitingComp := pendingAcks(b, "sub")
+	require.Equal(t, 0, inflight)
+	require.Equal(t, 1, awaitingComp)
+	sub.send(&protocol.PubcompPacket{PacketIdentifier: pkt.PacketIdentifier})
+	require.Eventually(t, func() bool {
+		_, awaitingComp := pendingAcks(b, "sub")
+		return awaitingComp == 0
+	}, time.Second, 5*time.Millisecond)
+
+	// the next message is the one published after, not the resent one
+	pub.send(&protocol.PublishPacket{TopicName: []byte("a/b"), Payload: []byte("y")})
+	require.Equal(t, "y", string(sub.readPublish().Payload))
+
+	pub.disconnect()
+	sub.disconnect()
+}
+
+func TestClientSessionUnsubscribe(t *testing.T) {
+	b := NewBroker()
+	defer b.Close()
+
+	sub := newTestClient(t, b, "sub")
+	sub.subscribe(1, "a/+", 0)
+	sub.subscribe(2, "b", 0)
+	unsub := &protocol.UnsubscribePacket{PacketIdentifier: 3}
+	require.NoError(t, unsub.AddTopic([]byte("a/+")))
+	require.NoError(t, unsub.AddTopic([]byte("c")))
+	sub.send(unsub)
+	require.Equal(t, uint16(3), sub.readAck(protocol.Unsuback))
+
+	pub := newTestClient(t, b, "pub")
+	pub.send(&protocol.PublishPacket{TopicName: []byte("a/x"), Payload: []byte("x")})
+	pub.send(&protocol.PublishPacket{TopicName: []byte("b"), Payload: []byte("y")})
+	pkt := sub.readPublish()
+	require.Equal(t, "b", string(pkt.TopicName))
+
+	pub.disconnect()
+	sub.disconnect()
+}
+
+func TestClientSessionPubrecForUnknownPacketID(t *testing.T) {
+	b := NewBroker()
+	defer b.Close()
+
+	c := newTestClient(t, b, "c")
+	c.send(&protocol.PubrecPacket{PacketIdentifier: 42})
+	require.Equal(t, uint16(42), c.readAck(protocol.Pubrel))
+	_, awaitingComp := pendingAcks(b, "c")
+	require.Equal(t, 0, awaitingComp)
+	c.disconnect()
+
+	// MQTT 5 clients are told the packet ID isn't in use
+	c5, _ := dialTestClient(t, b, &protocol.ConnectPacketConfig{
+		ClientIdentifier: []byte("c5"),
+		ProtocolLevel:    protocol.ProtocolLevel5,
+	})
+	c5.send(&protocol.PubrecPacket{PacketIdentifier: 42})
+	pubrel, ok := c5.readPacket().(*protocol.PubrelPacket)
+	require.True(t, ok)
+	require.Equal(t, uint16(42), pubrel.PacketIdentifier)
+	require.Equal(t, protocol.ReasonPacketIdentifierNotFound, pubrel.ReasonCode)
+	_, awaitingComp = pendingAcks(b, "c5")
+	require.Equal(t, 0, awaitingComp)
+	c5.disconnect()
+}
@@ -0,0 +1,116 @@
+package broker
+
+import (
+	"errors"
+
+	"github.com/nagamocha3000/go-mqtt-broker/internal/logging"
+	p "github.com/nagamocha3000/go-mqtt-broker/internal/protocol"
+)
+
+// disconnectReason records why a client's connection was closed
+type disconnectReason int
+
+const (
+	reasonUnknown disconnectReason = iota
+	reasonClientDisconnect
+	reasonProtocolError
+	reasonAuthFailure
+	reasonIdentifierRejected
+	reasonKeepAliveTimeout
+	reasonConnectionLost
+	reasonServerShutdown
+	reasonKicked
+)
+
+func (r disconnectReason) String() string {
+	switch r {
+	case reasonClientDisconnect:
+		return "client disconnect"
+	case reasonProtocolError:
+		return "protocol error"
+	case reasonAuthFailure:
+		return "auth failure"
+	case reasonIdentifierRejected:
+		return "identifier rejected"
+	case reasonKeepAliveTimeout:
+		return "keep alive timeout"
+	case reasonConnectionLost:
+		return "connection lost"
+	case reasonServerShutdown:
+		return "server shutdown"
+	case reasonKicked:
+		return "kicked"
+	default:
+		return "unknown"
+	}
+}
+
+var (
+	errFirstPktNotConnect     = errors.New("first packet sent by client is not a CONNECT packet")
+	errUnexpectedPacket       = errors.New("unexpected packet type")
+	errInvalidFlags           = errors.New("invalid fixed header flags")
+	errSessionExpiry          = errors.New("session expiry set on DISCONNECT although it was 0 on CONNECT")
+	errTopicAliasInvalid      = errors.New("invalid topic alias")
+	errPacketTooLarge         = errors.New("packet exceeds maximum packet size")
+	errReceiveMaximumExceeded = errors.New("receive maximum exceeded")
+	errAuthMethod             = errors.New("unsupported or mismatched authentication method")
+	errSubscriptionIDSent     = errors.New("subscription identifier set on PUBLISH sent by client")
+)
+
+// disconnectReasonCode returns the reason code of the DISCONNECT an MQTT
+// 5 client is sent when it's disconnected over the given protocol error
+func disconnectReasonCode(err error) p.ReasonCode {
+	switch err {
+	case ErrInvalidTopicName:
+		return p.ReasonTopicNameInvalid
+	case errReceiveMaximumExceeded:
+		return p.ReasonReceiveMaximumExceeded
+	case errTopicAliasInvalid:
+		return p.ReasonTopicAliasInvalid
+	case errPacketTooLarge:
+		return p.ReasonPacketTooLarge
+	default:
+		return p.ReasonProtocolError
+	}
+}
+
+// disconnectError wraps an error that led to a client being
+// disconnected together with the reason
+type disconnectError struct {
+	reason disconnectReason
+	err    error
+}
+
+func disconnectErr(reason disconnectReason, err error) error {
+	return &disconnectError{reason: reason, err: err}
+}
+
+func (e *disconnectError) Error() string {
+	return e.reason.String() + ": " + e.err.Error()
+}
+
+func (e *disconnectError) Unwrap() error {
+	return e.err
+}
+
+func reasonOf(err error) disconnectReason {
+	var de *disconnectError
+	if errors.As(err, &de) {
+		return de.reason
+	}
+	return reasonUnknown
+}
+
+// logDisconnect logs a client disconnecting. A client sending DISCONNECT
+// is the expected way for a connection to end, anything else is a warning
+func logDisconnect(logger logging.Logger, reason disconnectReason, err error) {
+	fields := []logging.Field{logging.F("reason", reason)}
+	if err != nil {
+		fields = append(fields, logging.Err(err))
+	}
+	if reason == reasonClientDisconnect {
+		logger.Info("client disconnected", fields...)
+	} else {
+		logger.Warn("client disconnected", fields...)
+	}
+}
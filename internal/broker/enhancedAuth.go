@@ -0,0 +1,116 @@
+package broker
+
+import (
+	"github.com/nagamocha3000/go-mqtt-broker/auth"
+	"github.com/nagamocha3000/go-mqtt-broker/internal/logging"
+	p "github.com/nagamocha3000/go-mqtt-broker/internal/protocol"
+)
+
+// WithAuthMechanism sets up an enhanced authentication mechanism MQTT 5
+// clients can authenticate with by setting its name as their
+// Authentication Method. Once a mechanism is set up, clients that don't
+// use one are refused unless an Authenticator is set too
+func WithAuthMechanism(m auth.Mechanism) Option {
+	return func(b *Broker) {
+		if b.authMechanisms == nil {
+			b.authMechanisms = make(map[string]auth.Mechanism)
+		}
+		b.authMechanisms[m.Name()] = m
+	}
+}
+
+// enhancedAuth runs the enhanced authentication exchange an MQTT 5
+// client starts on connecting, before the CONNACK is sent. The client
+// is sent a CONNACK if the exchange fails, otherwise the data to send it
+// along with the CONNACK is returned
+func (b *Broker) enhancedAuth(cs *clientSession, pkt *p.ConnectPacket) ([]byte, error) {
+	method := pkt.Properties.AuthenticationMethod
+	mech, ok := b.authMechanisms[string(method)]
+	if !ok {
+		cs.sendPacket(&p.ConnackPacket{Code: p.ConnectReturnCode(p.ReasonBadAuthenticationMethod)})
+		return nil, disconnectErr(reasonAuthFailure, errAuthMethod)
+	}
+	ex := mech.Start(string(pkt.ClientIdentifier))
+	data := pkt.Properties.AuthenticationData
+	for {
+		resp, done, err := ex.Step(data)
+		if err != nil {
+			cs.sendPacket(&p.ConnackPacket{Code: p.ConnectReturnCode(p.ReasonNotAuthorized)})
+			return nil, disconnectErr(reasonAuthFailure, err)
+		}
+		if done {
+			return resp, nil
+		}
+		err = cs.sendPacket(&p.AuthPacket{
+			ReasonCode: p.ReasonContinueAuthentication,
+			Properties: &p.Properties{AuthenticationMethod: method, AuthenticationData: resp},
+		})
+		if err != nil {
+			return nil, disconnectErr(reasonConnectionLost, err)
+		}
+
+		// the client may only reply with an AUTH packet until the
+		// exchange is over
+		f, payload, err := cs.reader.readPkt()
+		if err == errPacketTooLarge {
+			return nil, disconnectErr(reasonProtocolError, err)
+		}
+		if err != nil {
+			return nil, disconnectErr(reasonConnectionLost, err)
+		}
+		b.metrics.packet(f.PktType, directionIn, f.PacketLen())
+		reply, err := p.DeserializePacket(f, payload, cs.protocolLevel)
+		if err != nil {
+			return nil, disconnectErr(reasonProtocolError, err)
+		}
+		authPkt, ok := reply.(*p.AuthPacket)
+		if !ok || authPkt.ReasonCode != p.ReasonContinueAuthentication {
+			return nil, disconnectErr(reasonProtocolError, errUnexpectedPacket)
+		}
+		if authPkt.Properties == nil || string(authPkt.Properties.AuthenticationMethod) != string(method) {
+			return nil, disconnectErr(reasonProtocolError, errAuthMethod)
+		}
+		data = authPkt.Properties.AuthenticationData
+	}
+}
+
+// handleAuth handles the AUTH packets of a re-authentication exchange,
+// which the client starts with the Authentication Method it connected
+// with. The client is disconnected if it fails to re-authenticate
+func (c *clientSession) handleAuth(f p.FixedHeader, pkt *p.AuthPacket) {
+	var method, data []byte
+	if pkt.Properties != nil {
+		method = pkt.Properties.AuthenticationMethod
+		data = pkt.Properties.AuthenticationData
+	}
+	if c.authMethod == "" || string(method) != c.authMethod {
+		c.protocolError(f, errAuthMethod)
+		return
+	}
+	switch {
+	case pkt.ReasonCode == p.ReasonReauthenticate:
+		c.reauth = c.broker.authMechanisms[c.authMethod].Start(c.id)
+	case pkt.ReasonCode != p.ReasonContinueAuthentication || c.reauth == nil:
+		c.protocolError(f, errUnexpectedPacket)
+		return
+	}
+
+	resp, done, err := c.reauth.Step(data)
+	if err != nil {
+		c.reauth = nil
+		c.logger.Debug("re-authentication failed", logging.Err(err))
+		c.sendPacket(&p.DisconnectPacket{ReasonCode: p.ReasonNotAuthorized})
+		c.close(reasonAuthFailure)
+		return
+	}
+	code := p.ReasonContinueAuthentication
+	if done {
+		c.reauth = nil
+		code = p.ReasonSuccess
+		c.logger.Debug("client re-authenticated")
+	}
+	c.sendPacket(&p.AuthPacket{
+		ReasonCode: code,
+		Properties: &p.Properties{AuthenticationMethod: method, AuthenticationData: resp},
+	})
+}
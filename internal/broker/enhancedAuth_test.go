@@ -0,0 +1,132 @@
+package broker
+
+import (
+	"bufio"
+	"net"
+	"testing"
+
+	"github.com/nagamocha3000/go-mqtt-broker/auth"
+	"github.com/nagamocha3000/go-mqtt-broker/internal/protocol"
+	"github.com/stretchr/testify/require"
+)
+
+// readPacket reads and deserializes the next packet sent to the client
+func (c *testClient) readPacket() protocol.Packet {
+	f, payload := c.read()
+	pkt, err := protocol.DeserializePacket(f, payload, c.level)
+	require.NoError(c.t, err)
+	return pkt
+}
+
+// scramConnect connects an MQTT 5 client through a SCRAM-SHA-256
+// exchange, returning the CONNACK
+func scramConnect(t *testing.T, b *Broker, username, password string) (*testClient, *protocol.ConnackPacket) {
+	serverSide, clientSide := net.Pipe()
+	b.OnConn(serverSide)
+	c := &testClient{t: t, conn: clientSide, r: mqttPacketReader{r: bufio.NewReader(clientSide)}}
+	scram := auth.NewSCRAMClient(username, password)
+	pkt, err := protocol.NewConnectPacket(&protocol.ConnectPacketConfig{
+		ClientIdentifier:   []byte(username),
+		ShouldCleanSession: true,
+		ProtocolLevel:      protocol.ProtocolLevel5,
+		Properties: &protocol.Properties{
+			AuthenticationMethod: []byte(auth.SCRAMSHA256),
+			AuthenticationData:   scram.First(),
+		},
+	})
+	require.NoError(t, err)
+	c.level = pkt.ProtocolLevel
+	c.send(pkt)
+
+	challenge := c.readPacket().(*protocol.AuthPacket)
+	require.Equal(t, protocol.ReasonContinueAuthentication, challenge.ReasonCode)
+	require.Equal(t, auth.SCRAMSHA256, string(challenge.Properties.AuthenticationMethod))
+	final, err := scram.Final(challenge.Properties.AuthenticationData)
+	require.NoError(t, err)
+	c.send(&protocol.AuthPacket{
+		ReasonCode: protocol.ReasonContinueAuthentication,
+		Properties: &protocol.Properties{
+			AuthenticationMethod: []byte(auth.SCRAMSHA256),
+			AuthenticationData:   final,
+		},
+	})
+	connack := c.readPacket().(*protocol.ConnackPacket)
+	if connack.Code == protocol.ConnAccepted {
+		require.Equal(t, auth.SCRAMSHA256, string(connack.Properties.AuthenticationMethod))
+		require.NoError(t, scram.Verify(connack.Properties.AuthenticationData))
+	}
+	return c, connack
+}
+
+func TestBrokerEnhancedAuth(t *testing.T) {
+	creds := auth.NewMemoryCredentials()
+	alice, err := auth.NewCredentials("secret", 0)
+	require.NoError(t, err)
+	creds.Set("alice", alice)
+	b := NewBroker(WithAuthMechanism(auth.NewSCRAM(creds)))
+	defer b.Close()
+
+	// clients that don't use enhanced authentication are refused
+	c, connack := dialTestClient(t, b, &protocol.ConnectPacketConfig{
+		ClientIdentifier: []byte("a"),
+		Username:         []byte("alice"),
+		Password:         []byte("secret"),
+		ProtocolLevel:    protocol.ProtocolLevel5,
+	})
+	require.Equal(t, protocol.ConnectReturnCode(protocol.ReasonBadUserNameOrPassword), connack.Code)
+	c.requireClosed()
+	c, connack = dialTestClient(t, b, &protocol.ConnectPacketConfig{
+		ClientIdentifier: []byte("a"),
+		ProtocolLevel:    protocol.ProtocolLevel5,
+		Properties:       &protocol.Properties{AuthenticationMethod: []byte("PLAIN")},
+	})
+	require.Equal(t, protocol.ConnectReturnCode(protocol.ReasonBadAuthenticationMethod), connack.Code)
+	c.requireClosed()
+
+	c, connack = scramConnect(t, b, "alice", "wrong")
+	require.Equal(t, protocol.ConnectReturnCode(protocol.ReasonNotAuthorized), connack.Code)
+	c.requireClosed()
+	c, connack = scramConnect(t, b, "bob", "secret")
+	require.Equal(t, protocol.ConnectReturnCode(protocol.ReasonNotAuthorized), connack.Code)
+	c.requireClosed()
+
+	c, connack = scramConnect(t, b, "alice", "secret")
+	require.Equal(t, protocol.ConnAccepted, connack.Code)
+
+	// clients re-authenticate with the method they connected with
+	reauth := func(password string) protocol.Packet {
+		scram := auth.NewSCRAMClient("alice", password)
+		props := &protocol.Properties{AuthenticationMethod: []byte(auth.SCRAMSHA256)}
+		props.AuthenticationData = scram.First()
+		c.send(&protocol.AuthPacket{ReasonCode: protocol.ReasonReauthenticate, Properties: props})
+		challenge := c.readPacket().(*protocol.AuthPacket)
+		require.Equal(t, protocol.ReasonContinueAuthentication, challenge.ReasonCode)
+		final, err := scram.Final(challenge.Properties.AuthenticationData)
+		require.NoError(t, err)
+		props.AuthenticationData = final
+		c.send(&protocol.AuthPacket{ReasonCode: protocol.ReasonContinueAuthentication, Properties: props})
+		reply := c.readPacket()
+		if pkt, ok := reply.(*protocol.AuthPacket); ok {
+			require.Equal(t, protocol.ReasonSuccess, pkt.ReasonCode)
+			require.NoError(t, scram.Verify(pkt.Properties.AuthenticationData))
+		}
+		return reply
+	}
+	reauth("secret")
+	c.subscribe(1, "a", 0)
+	pkt := reauth("wrong").(*protocol.DisconnectPacket)
+	require.Equal(t, protocol.ReasonNotAuthorized, pkt.ReasonCode)
+	c.requireClosed()
+
+	c, _ = scramConnect(t, b, "alice", "secret")
+	c.send(&protocol.AuthPacket{
+		ReasonCode: protocol.ReasonReauthenticate,
+		Properties: &protocol.Properties{AuthenticationMethod: []byte("PLAIN")},
+	})
+	c.requireDisconnected(protocol.ReasonProtocolError)
+
+	// MQTT 3.1.1 clients can't use enhanced authentication
+	c, connack = dialTestClient(t, b, &protocol.ConnectPacketConfig{ClientIdentifier: []byte("a")})
+	require.Equal(t, protocol.ConnRefusedBadUsernamePass, connack.Code)
+	c.requireClosed()
+}
@@ -4,7 +4,10 @@ import (
 	"context"
 	"reflect"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/nagamocha3000/go-mqtt-broker/internal/metrics"
 	p "github.com/nagamocha3000/go-mqtt-broker/internal/protocol"
 )
 
@@ -14,6 +17,18 @@ import (
 type PublishEvent struct {
 	Topic  string
 	RawPkt *p.PublishPacket
+	// Matched holds the topic filters of all the feeds the packet is
+	// published to. A subscriber with overlapping subscriptions is only
+	// sent the packet via one of the feeds, so it can tell which of its
+	// other subscriptions the packet matches. It's shared across events
+	// hence should not be modified
+	Matched []string
+	// ExpiresAt is set if the message expires, see Message Expiry
+	// Interval
+	ExpiresAt time.Time
+	// Publisher is the ID of the client that published the packet,
+	// empty if it was published from within the broker
+	Publisher string
 }
 
 // Subscription ...
@@ -26,12 +41,17 @@ type Subscription struct {
 // Unsubscribe ...
 func (s *Subscription) Unsubscribe() {
 	s.onceUnsubscribe.Do(func() {
+		atomic.AddInt64(&s.feed.nSubs, -1)
 		s.feed.remove(s)
 	})
 }
 
 // Feed ...
 type Feed struct {
+	// number of subscriptions, accessed atomically
+	// kept first for 64-bit alignment
+	nSubs int64
+
 	// holds currently subscribed channels, whenever modifying
 	// or accessing cases, one should acquire the sendLock
 	sendLock chan struct{}
@@ -46,6 +66,9 @@ type Feed struct {
 
 	// holds topic name
 	topic string
+
+	// observes how long each publish takes to fan out, optional
+	fanoutLatency *metrics.Histogram
 }
 
 const firstSubSendCase = 2
@@ -72,6 +95,7 @@ func (f *Feed) Subscribe(ch chan<- PublishEvent) *Subscription {
 		feed:    f,
 		channel: ch,
 	}
+	atomic.AddInt64(&f.nSubs, 1)
 
 	// add to pending, will be added on next send
 	f.pendingMu.Lock()
@@ -84,6 +108,17 @@ func (f *Feed) Subscribe(ch chan<- PublishEvent) *Subscription {
 	return sub
 }
 
+// Topic returns the topic filter the feed was created for
+func (f *Feed) Topic() string {
+	return f.topic
+}
+
+// NumSubscribers returns the number of subscriptions on the feed
+// that haven't been unsubscribed
+func (f *Feed) NumSubscribers() int {
+	return int(atomic.LoadInt64(&f.nSubs))
+}
+
 // Remove ...
 func (f *Feed) remove(sub *Subscription) {
 	// if in pending, delete first
@@ -111,6 +146,25 @@ func (f *Feed) remove(sub *Subscription) {
 
 // Publish ...
 func (f *Feed) Publish(ctx context.Context, rawPkt *p.PublishPacket) (nSent int) {
+	return f.PublishMatched(ctx, PublishEvent{RawPkt: rawPkt})
+}
+
+// PublishMatched is similar to Publish but sends out the given event,
+// which carries the topic filters of all feeds the packet is published
+// to plus its expiry and publisher. The event's topic is set to the
+// feed's
+func (f *Feed) PublishMatched(ctx context.Context, ev PublishEvent) (nSent int) {
+	return f.publish(ctx, ev, nil)
+}
+
+// publish sends out the event to the feed's subscribers except for those
+// in sent, ie that were already sent the packet via another feed. If sent
+// isn't nil, the subscribers the event is sent to are added to it
+func (f *Feed) publish(ctx context.Context, ev PublishEvent, sent map[chan<- PublishEvent]struct{}) (nSent int) {
+	if f.fanoutLatency != nil {
+		start := time.Now()
+		defer func() { f.fanoutLatency.Observe(time.Since(start).Seconds()) }()
+	}
 	<-f.sendLock
 
 	// add new cases from pending subs
@@ -120,10 +174,8 @@ func (f *Feed) Publish(ctx context.Context, rawPkt *p.PublishPacket) (nSent int)
 	f.pendingMu.Unlock()
 
 	// set up rval & the send on all channels
-	rval := reflect.ValueOf(PublishEvent{
-		Topic:  f.topic,
-		RawPkt: rawPkt,
-	})
+	ev.Topic = f.topic
+	rval := reflect.ValueOf(ev)
 	for i := firstSubSendCase; i < len(f.cases); i++ {
 		f.cases[i].Send = rval
 	}
@@ -134,12 +186,24 @@ func (f *Feed) Publish(ctx context.Context, rawPkt *p.PublishPacket) (nSent int)
 		Chan: reflect.ValueOf(ctx.Done()),
 	}
 	currCases := f.cases
+	markSent := func(c reflect.SelectCase) {
+		if sent != nil {
+			sent[c.Chan.Interface().(chan<- PublishEvent)] = struct{}{}
+		}
+	}
+	for i := firstSubSendCase; i < len(currCases) && len(sent) > 0; i++ {
+		if _, ok := sent[currCases[i].Chan.Interface().(chan<- PublishEvent)]; ok {
+			currCases = caseDelete(currCases, i)
+			i--
+		}
+	}
 
 	for {
 		// first send to all those that can receive without blocking
 		for i := firstSubSendCase; i < len(currCases); i++ {
 			if currCases[i].Chan.TrySend(rval) {
 				nSent++
+				markSent(currCases[i])
 				currCases = caseDelete(currCases, i)
 				i--
 			}
@@ -165,6 +229,7 @@ func (f *Feed) Publish(ctx context.Context, rawPkt *p.PublishPacket) (nSent int)
 				}
 			}
 		} else {
+			markSent(currCases[chosen])
 			currCases = caseDelete(currCases, chosen)
 			nSent++
 		}
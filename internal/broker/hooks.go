@@ -0,0 +1,84 @@
+package broker
+
+// Authenticator decides whether a client connecting with the given
+// credentials is let in. The client ID is empty if the client left it
+// to the broker to assign one
+type Authenticator interface {
+	Authenticate(clientID string, username, password []byte) bool
+}
+
+// Hook is notified of client activity. Hooks are called synchronously
+// from the client's session hence they should not block
+type Hook interface {
+	// OnConnect is called once a client's connection is accepted
+	OnConnect(info ClientInfo)
+	// OnDisconnect is called once a client's connection is closed
+	OnDisconnect(clientID string)
+	// OnSubscribe is called for every topic filter a client subscribes to
+	OnSubscribe(clientID, filter string, qos byte)
+	// OnUnsubscribe is called for every topic filter a client unsubscribes from
+	OnUnsubscribe(clientID, filter string)
+	// OnPublish is called for every message a client publishes, before
+	// it's routed to subscribers
+	OnPublish(clientID, topic string, payload []byte, qos byte, retain bool)
+}
+
+// WithAuthenticator sets the authenticator clients are checked against
+// on connecting, unless they use enhanced authentication. By default,
+// all clients are let in unless an enhanced authentication mechanism
+// is set up
+func WithAuthenticator(a Authenticator) Option {
+	return func(b *Broker) {
+		b.authenticator = a
+	}
+}
+
+// WithHook adds a hook to be notified of client activity. Hooks are
+// called in the order they're added
+func WithHook(h Hook) Option {
+	return func(b *Broker) {
+		b.hooks = append(b.hooks, h)
+	}
+}
+
+func (b *Broker) authenticate(clientID string, username, password []byte) bool {
+	if b.authenticator == nil {
+		// clients are expected to use enhanced authentication if set up
+		return len(b.authMechanisms) == 0
+	}
+	return b.authenticator.Authenticate(clientID, username, password)
+}
+
+func (b *Broker) onConnect(cs *clientSession) {
+	if len(b.hooks) == 0 {
+		return
+	}
+	info := cs.info()
+	for _, h := range b.hooks {
+		h.OnConnect(info)
+	}
+}
+
+func (b *Broker) onDisconnect(clientID string) {
+	for _, h := range b.hooks {
+		h.OnDisconnect(clientID)
+	}
+}
+
+func (b *Broker) onSubscribe(clientID, filter string, qos byte) {
+	for _, h := range b.hooks {
+		h.OnSubscribe(clientID, filter, qos)
+	}
+}
+
+func (b *Broker) onUnsubscribe(clientID, filter string) {
+	for _, h := range b.hooks {
+		h.OnUnsubscribe(clientID, filter)
+	}
+}
+
+func (b *Broker) onPublish(clientID, topic string, payload []byte, qos byte, retain bool) {
+	for _, h := range b.hooks {
+		h.OnPublish(clientID, topic, payload, qos, retain)
+	}
+}
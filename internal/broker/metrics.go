@@ -0,0 +1,60 @@
+package broker
+
+import (
+	"github.com/nagamocha3000/go-mqtt-broker/internal/metrics"
+	p "github.com/nagamocha3000/go-mqtt-broker/internal/protocol"
+)
+
+// brokerMetrics holds the metrics the broker and client sessions update.
+// Gauges that can be read off the broker's state directly are registered
+// as functions rather than being updated on every change
+type brokerMetrics struct {
+	packets       *metrics.CounterVec
+	bytes         *metrics.CounterVec
+	disconnects   *metrics.CounterVec
+	fanoutLatency *metrics.Histogram
+	subscriptions *metrics.Gauge
+}
+
+const (
+	directionIn  = "in"
+	directionOut = "out"
+)
+
+func newBrokerMetrics(b *Broker, reg *metrics.Registry) *brokerMetrics {
+	reg.NewGaugeFunc("mqtt_connected_clients",
+		"Number of clients currently connected",
+		func() float64 { return float64(b.numClients()) })
+	reg.NewGaugeFunc("mqtt_sessions",
+		"Number of client sessions held by the broker",
+		func() float64 { return float64(b.numSessions()) })
+	reg.NewGaugeFunc("mqtt_retained_messages",
+		"Number of retained messages held by the broker",
+		func() float64 { return float64(b.retained.len()) })
+	reg.NewGaugeFunc("mqtt_topic_feeds",
+		"Number of feeds (topic filters) held in the topic map",
+		func() float64 { return float64(b.topicMap.NumFeeds()) })
+
+	return &brokerMetrics{
+		packets: reg.NewCounterVec("mqtt_packets_total",
+			"Number of MQTT packets by type and direction", "type", "direction"),
+		bytes: reg.NewCounterVec("mqtt_bytes_total",
+			"Number of bytes of MQTT packets by type and direction", "type", "direction"),
+		disconnects: reg.NewCounterVec("mqtt_disconnects_total",
+			"Number of client disconnects by reason", "reason"),
+		fanoutLatency: reg.NewHistogram("mqtt_publish_fanout_seconds",
+			"Time taken to fan out a publish to the subscribers of a single feed", nil),
+		subscriptions: reg.NewGauge("mqtt_subscriptions",
+			"Number of subscriptions across all client sessions"),
+	}
+}
+
+func (m *brokerMetrics) packet(pktType byte, direction string, nBytes int) {
+	t := p.ControlPacketType(pktType).String()
+	m.packets.With(t, direction).Inc()
+	m.bytes.With(t, direction).Add(float64(nBytes))
+}
+
+func (m *brokerMetrics) disconnect(reason disconnectReason) {
+	m.disconnects.With(reason.String()).Inc()
+}
@@ -1,11 +1,21 @@
 package broker
 
-import "errors"
+import (
+	"errors"
+	"strings"
+
+	"github.com/nagamocha3000/go-mqtt-broker/topic"
+)
 
 // ErrInvalidTopicName is returned whenever a topic name or filter
 // is invalid
 var ErrInvalidTopicName = errors.New("invalid topic name/filter")
 
+// ReservedTopicPrefix marks topics reserved for use by the broker, eg
+// $SYS/... As per the spec, topic filters starting with a wildcard
+// do not match such topics and clients cannot publish to them
+const ReservedTopicPrefix = topic.ReservedPrefix
+
 // MatchType indicates whether a match
 // is an exact match(string), single-level or multi-level
 type MatchType byte
@@ -26,94 +36,69 @@ type TopicToken struct {
 
 // ParseTopic parses a given bytes slice into a slice of topic filters
 // each representing a topic level. For use mainly with Subscribe/Unsubscribe packets
-// which might contain wildcards.
+// which might contain wildcards. See the topic package for the validation rules
 func ParseTopic(b []byte) (tokens []TopicToken, hasWildcard bool, err error) {
-	if len(b) == 0 {
-		// topic name must have 1 or more characters
+	s := string(b)
+	if err := topic.ValidateFilter(s); err != nil {
 		return nil, false, ErrInvalidTopicName
 	}
-	last := len(b) - 1
-	var from, i int
-	for i = 0; i < len(b); {
-		c := b[i]
-		// topic name should not contain  NUL character
-		if c == 0 {
-			return nil, false, ErrInvalidTopicName
-		}
-
-		// multilevel wildcard should only occur as last char
-		if c == '#' {
-			if i != last {
-				return nil, false, ErrInvalidTopicName
-			}
-			tokens = append(tokens, TopicToken{
-				Value:     "#",
-				MatchType: MultiLevelMatch,
-			})
-			return tokens, true, nil
-		}
-
-		// single level wildcard should take up a whole level by itseld
-		if c == '+' {
+	tokens = make([]TopicToken, 0, topic.NumLevels(s))
+	levels := topic.NewLevels(s)
+	for level, ok := levels.Next(); ok; level, ok = levels.Next() {
+		token := TopicToken{Value: level, MatchType: ExactMatch}
+		switch level {
+		case topic.SingleLevelWildcard:
+			token.MatchType = SingleLevelMatch
+			hasWildcard = true
+		case topic.MultiLevelWildcard:
+			token.MatchType = MultiLevelMatch
 			hasWildcard = true
-			if i != last && b[i+1] != '/' {
-				return nil, false, ErrInvalidTopicName
-			}
-			if i != 0 && b[i-1] != '/' {
-				return nil, false, ErrInvalidTopicName
-			}
-			tokens = append(tokens, TopicToken{
-				Value:     "+",
-				MatchType: SingleLevelMatch,
-			})
-			// skip next sep
-			i += 2
-			from = i
-			continue
-		}
-
-		if c == '/' {
-			tokens = append(tokens, TopicToken{
-				Value:     string(b[from:i]),
-				MatchType: ExactMatch,
-			})
-			from = i + 1
 		}
-		i++
-	}
-	if from < len(b) || b[last] == '/' {
-		tokens = append(tokens, TopicToken{
-			Value:     string(b[from:i]),
-			MatchType: ExactMatch,
-		})
+		tokens = append(tokens, token)
 	}
 	return tokens, hasWildcard, nil
 }
 
+// IsReservedTopic returns true if the parsed topic name or filter
+// starts with ReservedTopicPrefix
+func IsReservedTopic(tokens []TopicToken) bool {
+	return len(tokens) > 0 && tokens[0].MatchType == ExactMatch &&
+		strings.HasPrefix(tokens[0].Value, ReservedTopicPrefix)
+}
+
 // ParseTopicName parses a given bytes slice into a slice of strings
 // each representing a topic level. For use mainly with Publish packets
 // which should not contain wildcards.
 func ParseTopicName(b []byte) ([]string, error) {
-	if len(b) == 0 {
-		// topic name must have 1 or more characters
+	s := string(b)
+	if err := topic.ValidateName(s); err != nil {
 		return nil, ErrInvalidTopicName
 	}
-	var topics []string
-	var from, i int
-	for i = 0; i < len(b); i++ {
-		c := b[i]
-		if c == '#' || c == '+' || c == 0 {
-			// topic name should not contain wildcards or NUL character
-			return nil, ErrInvalidTopicName
-		}
-		if c == '/' {
-			topics = append(topics, string(b[from:i]))
-			from = i + 1
-		}
+	return strings.Split(s, string(topic.Separator)), nil
+}
 
+// topicMatchesFilter checks whether the given topic name matches the
+// given topic filter which may contain wildcards. Both should be parsed
+// via ParseTopic beforehand
+func topicMatchesFilter(filter, name []TopicToken) bool {
+	// wildcards at the first level don't match reserved topics
+	if IsReservedTopic(name) && len(filter) > 0 && filter[0].MatchType != ExactMatch {
+		return false
 	}
-	if from < len(b) || b[len(b)-1] == '/' {
-		topics = append(topics, string(b[from:]))
+	for i, ft := range filter {
+		switch ft.MatchType {
+		case MultiLevelMatch:
+			// # also matches the parent level
+			return true
+		case SingleLevelMatch:
+			if i >= len(name) {
+				return false
+			}
+		default:
+			if i >= len(name) || name[i].Value != ft.Value {
+				return false
+			}
+		}
 	}
-	return topics, nil
+	return len(filter) == len(name)
 }
@@ -315,3 +315,34 @@ func TestParseTopicName(t *testing.T) {
 		})
 	}
 }
+
+func TestParseTopicFilterSpecExamples(t *testing.T) {
+	// validity examples from section 4.7 of the MQTT 3.1.1 spec
+	cases := []struct {
+		filter string
+		valid  bool
+	}{
+		{"sport/tennis/player1/#", true},
+		{"#", true},
+		{"sport/tennis#", false},
+		{"sport/tennis/#/ranking", false},
+		{"+", true},
+		{"+/tennis/#", true},
+		{"sport+", false},
+		{"sport/+/player1", true},
+		{"+/+", true},
+		{"/+", true},
+		{"$SYS/#", true},
+		{"$SYS/monitor/+", true},
+		{"Accounts payable", true},
+		{"/", true},
+	}
+	for _, cs := range cases {
+		_, _, err := ParseTopic([]byte(cs.filter))
+		if cs.valid {
+			require.NoError(t, err, cs.filter)
+		} else {
+			require.Equal(t, ErrInvalidTopicName, err, cs.filter)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package broker
+
+import (
+	"time"
+
+	p "github.com/nagamocha3000/go-mqtt-broker/internal/protocol"
+	"github.com/nagamocha3000/go-mqtt-broker/internal/store"
+)
+
+// PropertyStamps names the User Properties the broker adds to the
+// messages clients publish, including wills, before routing them to
+// subscribers. Stamps with an empty name aren't added. User Properties
+// the publisher set with the same names are dropped, so that stamps can
+// be relied on
+type PropertyStamps struct {
+	// ReceivedAt is set to when the broker received the message, in
+	// RFC 3339 format with nanoseconds, in UTC
+	ReceivedAt string
+	// Publisher is set to the publisher's client ID
+	Publisher string
+	// Listener is set to the name of the listener the publisher
+	// connected through, see Broker.OnListenerConn
+	Listener string
+}
+
+// WithPropertyStamps sets the User Properties the broker adds to the
+// messages clients publish, eg for tracing. By default none are added
+func WithPropertyStamps(s PropertyStamps) Option {
+	return func(b *Broker) {
+		b.stamps = s
+	}
+}
+
+// stamp adds the broker's User Properties to a message the client
+// publishes
+func (c *clientSession) stamp(pkt *p.PublishPacket) {
+	s := c.broker.stamps
+	if s == (PropertyStamps{}) {
+		return
+	}
+	if pkt.Properties == nil {
+		pkt.Properties = &p.Properties{}
+	}
+	var stamps []p.UserProperty
+	add := func(key, value string) {
+		if key != "" {
+			stamps = append(stamps, p.UserProperty{Key: []byte(key), Value: []byte(value)})
+		}
+	}
+	add(s.ReceivedAt, time.Now().UTC().Format(time.RFC3339Nano))
+	add(s.Publisher, c.id)
+	add(s.Listener, c.listener)
+
+	isStamp := func(key string) bool {
+		return key != "" && (key == s.ReceivedAt || key == s.Publisher || key == s.Listener)
+	}
+	props := pkt.Properties.UserProperties[:0]
+	for _, up := range pkt.Properties.UserProperties {
+		if !isStamp(string(up.Key)) {
+			props = append(props, up)
+		}
+	}
+	pkt.Properties.UserProperties = append(props, stamps...)
+}
+
+// forwardedProperties returns the properties of a publish that are
+// forwarded unchanged to subscribers as per the spec, nil if there are
+// none
+func forwardedProperties(props *p.Properties) *p.Properties {
+	if props == nil {
+		return nil
+	}
+	fwd := &p.Properties{
+		PayloadFormatIndicator: props.PayloadFormatIndicator,
+		ContentType:            props.ContentType,
+		ResponseTopic:          props.ResponseTopic,
+		CorrelationData:        props.CorrelationData,
+		UserProperties:         props.UserProperties,
+	}
+	if fwd.PayloadFormatIndicator == nil && len(fwd.ContentType) == 0 && len(fwd.ResponseTopic) == 0 &&
+		len(fwd.CorrelationData) == 0 && len(fwd.UserProperties) == 0 {
+		return nil
+	}
+	return fwd
+}
+
+// publishProperties returns the properties of a publish sent to the
+// client: those forwarded from the publisher, the lifetime left of a
+// message that expires at the given time plus the identifiers of the
+// subscriptions it's sent via. Returns nil if there are none
+func publishProperties(props *p.Properties, expiresAt time.Time, subIDs []uint32) *p.Properties {
+	fwd := forwardedProperties(props)
+	if fwd == nil && expiresAt.IsZero() && len(subIDs) == 0 {
+		return nil
+	}
+	if fwd == nil {
+		fwd = &p.Properties{}
+	}
+	fwd.SubscriptionIdentifiers = subIDs
+	if !expiresAt.IsZero() {
+		// rounded up so that a message that's yet to expire isn't
+		// taken to have expired by the client
+		left := (time.Until(expiresAt) + time.Second - 1) / time.Second
+		fwd.MessageExpiryInterval = p.Uint32(uint32(left))
+	}
+	return fwd
+}
+
+// storedProperties returns the forwarded properties of a publish as
+// held in the store
+func storedProperties(props *p.Properties) *store.Properties {
+	fwd := forwardedProperties(props)
+	if fwd == nil {
+		return nil
+	}
+	stored := &store.Properties{
+		PayloadFormat:   fwd.PayloadFormatIndicator,
+		ContentType:     string(fwd.ContentType),
+		ResponseTopic:   string(fwd.ResponseTopic),
+		CorrelationData: fwd.CorrelationData,
+	}
+	for _, up := range fwd.UserProperties {
+		stored.UserProperties = append(stored.UserProperties, store.UserProperty{
+			Key:   string(up.Key),
+			Value: string(up.Value),
+		})
+	}
+	return stored
+}
+
+// restoredProperties reverses storedProperties
+func restoredProperties(stored *store.Properties) *p.Properties {
+	if stored == nil {
+		return nil
+	}
+	props := &p.Properties{
+		PayloadFormatIndicator: stored.PayloadFormat,
+		ContentType:            []byte(stored.ContentType),
+		ResponseTopic:          []byte(stored.ResponseTopic),
+		CorrelationData:        stored.CorrelationData,
+	}
+	for _, up := range stored.UserProperties {
+		props.UserProperties = append(props.UserProperties, p.UserProperty{
+			Key:   []byte(up.Key),
+			Value: []byte(up.Value),
+		})
+	}
+	return props
+}
+
+// willProperties returns the properties a will message is published
+// with, ie without the Will Delay Interval which only concerns the will
+func willProperties(props *p.Properties) *p.Properties {
+	if props == nil {
+		return nil
+	}
+	will := *props
+	will.WillDelayInterval = nil
+	return &will
+}
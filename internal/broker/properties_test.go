@@ -0,0 +1,162 @@
+package broker
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/nagamocha3000/go-mqtt-broker/internal/protocol"
+	"github.com/nagamocha3000/go-mqtt-broker/internal/store"
+	"github.com/stretchr/testify/require"
+)
+
+func userProps(kv ...string) []protocol.UserProperty {
+	var props []protocol.UserProperty
+	for i := 0; i < len(kv); i += 2 {
+		props = append(props, protocol.UserProperty{Key: []byte(kv[i]), Value: []byte(kv[i+1])})
+	}
+	return props
+}
+
+// requireStamped checks that the publisher's User Properties are
+// forwarded unchanged, followed by the broker's stamps
+func requireStamped(t *testing.T, pkt *protocol.PublishPacket, kv ...string) {
+	props := pkt.Properties.UserProperties
+	require.Len(t, props, len(kv)/2+3)
+	require.Equal(t, userProps(kv...), props[:len(kv)/2])
+	stamps := props[len(kv)/2:]
+	require.Equal(t, "received-at", string(stamps[0].Key))
+	receivedAt, err := time.Parse(time.RFC3339Nano, string(stamps[0].Value))
+	require.NoError(t, err)
+	require.WithinDuration(t, time.Now(), receivedAt, 5*time.Second)
+	require.Equal(t, userProps("publisher", "pub", "listener", "tcp"), stamps[1:])
+}
+
+func TestBrokerForwardsProperties(t *testing.T) {
+	st := store.NewMemoryStore()
+	b := NewBroker(WithStore(st), WithPropertyStamps(PropertyStamps{
+		ReceivedAt: "received-at",
+		Publisher:  "publisher",
+		Listener:   "listener",
+	}))
+	defer b.Close()
+
+	sub, _ := connectTestClient5(t, b, "sub", false, 3600)
+	sub.subscribe(1, "a/#", 1)
+	sub311 := newTestClient(t, b, "sub311")
+	sub311.subscribe(1, "a/#", 0)
+	pub, connack := dialListenerTestClient(t, b, "tcp", &protocol.ConnectPacketConfig{
+		ClientIdentifier:   []byte("pub"),
+		ShouldCleanSession: true,
+		ProtocolLevel:      protocol.ProtocolLevel5,
+		WillTopic:          []byte("a/will"),
+		WillMessage:        []byte("gone"),
+		WillQoS:            1,
+		WillProperties: &protocol.Properties{
+			WillDelayInterval: protocol.Uint32(0),
+			UserProperties:    userProps("k", "will"),
+		},
+	})
+	require.Equal(t, protocol.ConnAccepted, connack.Code)
+	publish := func(topic string, retain bool) {
+		pub.send(&protocol.PublishPacket{
+			QoS:              1,
+			Retain:           retain,
+			PacketIdentifier: 1,
+			TopicName:        []byte(topic),
+			Payload:          []byte(topic),
+			Properties: &protocol.Properties{
+				PayloadFormatIndicator: protocol.Byte(1),
+				MessageExpiryInterval:  protocol.Uint32(60),
+				ContentType:            []byte("text/plain"),
+				ResponseTopic:          []byte("reply"),
+				CorrelationData:        []byte{1, 2},
+				// stamps can't be forged
+				UserProperties: userProps("k", "1", "publisher", "forged", "k", "2"),
+			},
+		})
+		f, _ := pub.read()
+		require.Equal(t, protocol.Puback, f.PktType)
+		require.Equal(t, topic, string(sub311.readPublish().Payload))
+	}
+	readPublish := func(topic string) *protocol.PublishPacket {
+		pkt := sub.readPublish()
+		require.Equal(t, topic, string(pkt.TopicName))
+		sub.send(&protocol.PubackPacket{PacketIdentifier: pkt.PacketIdentifier})
+		return pkt
+	}
+	requireForwarded := func(pkt *protocol.PublishPacket) {
+		props := pkt.Properties
+		require.Equal(t, protocol.Byte(1), props.PayloadFormatIndicator)
+		require.Equal(t, "text/plain", string(props.ContentType))
+		require.Equal(t, "reply", string(props.ResponseTopic))
+		require.Equal(t, []byte{1, 2}, props.CorrelationData)
+		require.NotNil(t, props.MessageExpiryInterval)
+		requireStamped(t, pkt, "k", "1", "k", "2")
+	}
+
+	// User Properties reach MQTT 5 subscribers, in order
+	publish("a/1", false)
+	requireForwarded(readPublish("a/1"))
+	publish("a/r", true)
+	requireForwarded(readPublish("a/r"))
+
+	// they're kept on messages queued in the store, including wills
+	sub.disconnect()
+	waitOffline(t, b, "sub", 0)
+	publish("a/2", false)
+	pub.conn.Close()
+	require.Equal(t, "gone", string(sub311.readPublish().Payload))
+	waitOffline(t, b, "sub", 2)
+	b.Close()
+
+	b = NewBroker(WithStore(st))
+	defer b.Close()
+	sub, _ = connectTestClient5(t, b, "sub", false, 3600)
+	requireForwarded(readPublish("a/2"))
+	will := readPublish("a/will")
+	require.Nil(t, will.Properties.WillDelayInterval)
+	requireStamped(t, will, "k", "will")
+	sub.subscribe(2, "a/r", 1)
+	requireForwarded(readPublish("a/r"))
+	sub.ping()
+	sub.disconnect()
+}
+
+func TestBrokerKeepsPropertiesOfRetainedMessages(t *testing.T) {
+	b := NewBroker()
+	defer b.Close()
+	pub, _ := connectTestClient5(t, b, "pub", true, 0)
+	pub.send(&protocol.PublishPacket{
+		Retain:    true,
+		TopicName: []byte("r"),
+		Payload:   []byte("retained"),
+		Properties: &protocol.Properties{
+			ContentType:    []byte("text/plain"),
+			UserProperties: userProps("k", "v"),
+		},
+	})
+	pub.ping()
+	requireRetained := func(c *testClient) {
+		c.subscribe(1, "r", 0)
+		pkt := c.readPublish()
+		require.True(t, pkt.Retain)
+		require.Equal(t, "text/plain", string(pkt.Properties.ContentType))
+		require.Equal(t, userProps("k", "v"), pkt.Properties.UserProperties)
+		c.disconnect()
+	}
+
+	// subscribing afterwards, the message comes from the retained store
+	sub, _ := connectTestClient5(t, b, "sub", true, 0)
+	requireRetained(sub)
+
+	// likewise once imported into another broker
+	var buf bytes.Buffer
+	require.NoError(t, b.ExportSnapshot(&buf))
+	dst := NewBroker()
+	defer dst.Close()
+	require.NoError(t, dst.ImportSnapshot(&buf))
+	sub, _ = connectTestClient5(t, dst, "sub", true, 0)
+	requireRetained(sub)
+	pub.disconnect()
+}
@@ -0,0 +1,153 @@
+package broker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/nagamocha3000/go-mqtt-broker/internal/logging"
+	p "github.com/nagamocha3000/go-mqtt-broker/internal/protocol"
+	"github.com/nagamocha3000/go-mqtt-broker/internal/store"
+)
+
+// retainedStore holds the last retained message published on each
+// topic so that it can be sent to clients that subscribe later on.
+// Changes are written through to st, while holding the lock so that
+// st ends up with the same message per topic
+type retainedStore struct {
+	mu   sync.RWMutex
+	msgs map[string]retainedMsg
+	st   store.Store
+}
+
+type retainedMsg struct {
+	pkt       *p.PublishPacket
+	tokens    []TopicToken
+	expiresAt time.Time
+}
+
+func newRetainedStore(st store.Store) *retainedStore {
+	return &retainedStore{msgs: make(map[string]retainedMsg), st: st}
+}
+
+// load adds retained messages read back from the store. Messages that
+// expired in the meantime are deleted instead
+func (s *retainedStore) load(msgs []store.Message, logger logging.Logger) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, msg := range msgs {
+		tokens, hasWildcard, err := ParseTopic([]byte(msg.Topic))
+		if err != nil || hasWildcard {
+			logger.Warn("skipped invalid stored retained message",
+				logging.F("topic", msg.Topic))
+			continue
+		}
+		if expired(msg.ExpiresAt) {
+			if err := s.st.DeleteRetained(msg.Topic); err != nil {
+				logger.Error("failed to delete expired retained message",
+					logging.F("topic", msg.Topic), logging.Err(err))
+			}
+			continue
+		}
+		s.msgs[msg.Topic] = retainedMsg{
+			pkt: &p.PublishPacket{
+				QoS:        msg.QoS,
+				Retain:     true,
+				TopicName:  []byte(msg.Topic),
+				Payload:    msg.Payload,
+				Properties: restoredProperties(msg.Properties),
+			},
+			tokens:    tokens,
+			expiresAt: msg.ExpiresAt,
+		}
+	}
+}
+
+// set stores pkt as the retained message for its topic until it expires,
+// if ever. As per the spec, a retained message with a zero length payload
+// clears the topic's retained message instead
+func (s *retainedStore) set(tokens []TopicToken, pkt *p.PublishPacket, expiresAt time.Time) error {
+	topic := string(pkt.TopicName)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(pkt.Payload) == 0 {
+		if _, ok := s.msgs[topic]; !ok {
+			return nil
+		}
+		delete(s.msgs, topic)
+		return s.st.DeleteRetained(topic)
+	}
+	s.msgs[topic] = retainedMsg{
+		pkt: &p.PublishPacket{
+			QoS:        pkt.QoS,
+			Retain:     true,
+			TopicName:  pkt.TopicName,
+			Payload:    pkt.Payload,
+			Properties: forwardedProperties(pkt.Properties),
+		},
+		tokens:    tokens,
+		expiresAt: expiresAt,
+	}
+	return s.st.PutRetained(store.Message{
+		Topic:      topic,
+		Payload:    pkt.Payload,
+		QoS:        pkt.QoS,
+		Retain:     true,
+		ExpiresAt:  expiresAt,
+		Properties: storedProperties(pkt.Properties),
+	})
+}
+
+// remove removes the retained message for the given topic. Returns
+// false if there was none
+func (s *retainedStore) remove(topic string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.msgs[topic]; !ok {
+		return false, nil
+	}
+	delete(s.msgs, topic)
+	return true, s.st.DeleteRetained(topic)
+}
+
+// matching returns all retained messages whose topic matches the given
+// filter. Expired messages found along the way are removed
+func (s *retainedStore) matching(filter []TopicToken) []retainedMsg {
+	s.mu.RLock()
+	var msgs, expiredMsgs []retainedMsg
+	for _, msg := range s.msgs {
+		if !topicMatchesFilter(filter, msg.tokens) {
+			continue
+		}
+		if expired(msg.expiresAt) {
+			expiredMsgs = append(expiredMsgs, msg)
+			continue
+		}
+		msgs = append(msgs, msg)
+	}
+	s.mu.RUnlock()
+	for _, msg := range expiredMsgs {
+		s.removeExpired(msg)
+	}
+	return msgs
+}
+
+// removeExpired removes an expired retained message unless it has been
+// replaced in the meantime
+func (s *retainedStore) removeExpired(msg retainedMsg) {
+	topic := string(msg.pkt.TopicName)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.msgs[topic].pkt != msg.pkt {
+		return
+	}
+	delete(s.msgs, topic)
+	// failing to delete the message from the store is harmless, it's
+	// removed once read back
+	s.st.DeleteRetained(topic)
+}
+
+func (s *retainedStore) len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.msgs)
+}
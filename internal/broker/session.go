@@ -0,0 +1,435 @@
+package broker
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nagamocha3000/go-mqtt-broker/internal/logging"
+	p "github.com/nagamocha3000/go-mqtt-broker/internal/protocol"
+	"github.com/nagamocha3000/go-mqtt-broker/internal/store"
+)
+
+// sessionSubscription holds a client's subscription to a single
+// topic filter plus the QoS granted and MQTT 5 subscription options
+type sessionSubscription struct {
+	sub               *Subscription
+	tokens            []TopicToken // parsed filter
+	qos               byte
+	noLocal           bool
+	retainAsPublished bool
+	subID             uint32 // MQTT 5 subscription identifier, 0 if none
+}
+
+// options returns the subscription's options as held in the store
+func (s *sessionSubscription) options() byte {
+	return p.TopicQoS{
+		Qos:               s.qos,
+		NoLocal:           s.noLocal,
+		RetainAsPublished: s.retainAsPublished,
+	}.Options()
+}
+
+// setOptions sets the subscription's QoS and options
+func (s *sessionSubscription) setOptions(t p.TopicQoS) {
+	s.qos = t.Qos
+	s.noLocal = t.NoLocal
+	s.retainAsPublished = t.RetainAsPublished
+}
+
+// matches reports whether the event should be delivered via the
+// subscription, ie unless it's the client's own publish and the
+// subscription is No Local
+func (s *sessionSubscription) matches(ev PublishEvent, clientID string) bool {
+	return !s.noLocal || ev.Publisher != clientID
+}
+
+// queuedMsg holds a message queued for a client while it's offline or
+// while its Receive Maximum is reached
+type queuedMsg struct {
+	seq       uint64
+	pkt       *p.PublishPacket
+	expiresAt time.Time
+	subIDs    []uint32
+}
+
+// inflightMsg holds a QoS 1 or 2 message sent to the client that's
+// yet to be acknowledged
+type inflightMsg struct {
+	pkt       *p.PublishPacket
+	expiresAt time.Time
+	subIDs    []uint32
+}
+
+// delivery holds how a message is sent to the client: at what QoS,
+// whether the RETAIN flag is set and the identifiers of the
+// subscriptions it's sent via
+type delivery struct {
+	qos    byte
+	retain bool
+	subIDs []uint32
+}
+
+// expired reports whether a message that expires at the given time, if
+// ever, has expired
+func expired(expiresAt time.Time) bool {
+	return !expiresAt.IsZero() && !time.Now().Before(expiresAt)
+}
+
+// session holds the state of a client that outlives a single connection
+// if the client connects with CleanSession set to 0, or under MQTT 5 with
+// a non-zero Session Expiry Interval: its subscriptions plus QoS 1 & 2
+// messages that are yet to be acknowledged. While the client is offline,
+// QoS 1 & 2 messages are queued for it until the session expires. The
+// state of persistent sessions is written through to the broker's store
+// so that it survives restarts
+type session struct {
+	id         string
+	persistent bool
+	broker     *Broker
+	topicMap   TopicMap
+
+	// messages client has subscribed to
+	messagesCh chan PublishEvent
+
+	// mu guards the subscriptions plus QoS 1 & 2 state
+	mu            sync.Mutex
+	subscriptions map[string]*sessionSubscription
+	lastPktID     uint16
+	inflight      map[uint16]inflightMsg // sent QoS 1/2 awaiting PUBACK/PUBREC
+	awaitingComp  map[uint16]struct{}    // sent PUBREL awaiting PUBCOMP
+	receivedQoS2  map[uint16]struct{}    // received QoS 2 awaiting PUBREL
+	queue         []queuedMsg            // QoS 1/2 messages yet to be sent
+	nextSeq       uint64
+
+	// set while the client is offline, guarded by the broker's clientsMu
+	offlineQuitCh chan struct{}
+	offlineDoneCh chan struct{}
+
+	// seconds the session is kept once the client disconnects, guarded
+	// by the broker's clientsMu
+	expiry      uint32
+	expiresAt   time.Time // set while offline unless the session never expires
+	expiryTimer *time.Timer
+	expiryGen   uint64 // tells apart timers that fired after being stopped
+}
+
+const messagesChSize = 64
+
+// sessionNeverExpires is the Session Expiry Interval of sessions that
+// are kept until the client connects with a clean session
+const sessionNeverExpires uint32 = 0xFFFFFFFF
+
+func newSession(b *Broker, id string, persistent bool) *session {
+	return &session{
+		id:            id,
+		persistent:    persistent,
+		broker:        b,
+		topicMap:      b.topicMap,
+		messagesCh:    make(chan PublishEvent, messagesChSize),
+		subscriptions: make(map[string]*sessionSubscription),
+		inflight:      make(map[uint16]inflightMsg),
+		awaitingComp:  make(map[uint16]struct{}),
+		receivedQoS2:  make(map[uint16]struct{}),
+	}
+}
+
+// restoreSession rebuilds a persistent session from its stored state,
+// subscribing it to the topic map afresh
+func restoreSession(b *Broker, stored store.Session) *session {
+	s := newSession(b, stored.ClientID, true)
+	s.expiry = sessionNeverExpires
+	if stored.Expiry > 0 {
+		s.expiry = stored.Expiry
+		s.expiresAt = stored.ExpiresAt
+	}
+	for filter, opts := range stored.Subscriptions {
+		tokens, _, err := ParseTopic([]byte(filter))
+		var t p.TopicQoS
+		if err == nil {
+			err = t.SetOptions(opts)
+		}
+		if err != nil {
+			b.logger.Warn("skipped invalid stored subscription",
+				logging.F("client_id", s.id), logging.F("filter", filter))
+			continue
+		}
+		sub := &sessionSubscription{
+			sub:    s.topicMap.SubscribeByTopic(filter, tokens, s.messagesCh),
+			tokens: tokens,
+		}
+		sub.setOptions(t)
+		sub.subID = stored.SubscriptionIDs[filter]
+		s.subscriptions[filter] = sub
+		b.metrics.subscriptions.Inc()
+	}
+	for _, msg := range stored.Inflight {
+		if msg.Released {
+			s.awaitingComp[msg.PacketID] = struct{}{}
+		} else {
+			s.inflight[msg.PacketID] = inflightMsg{
+				pkt: &p.PublishPacket{
+					QoS:              msg.QoS,
+					Retain:           msg.Retain,
+					TopicName:        []byte(msg.Topic),
+					Payload:          msg.Payload,
+					PacketIdentifier: msg.PacketID,
+					Properties:       restoredProperties(msg.Properties),
+				},
+				expiresAt: msg.ExpiresAt,
+				subIDs:    msg.SubscriptionIDs,
+			}
+		}
+	}
+	for _, q := range stored.Queued {
+		s.queue = append(s.queue, queuedMsg{
+			seq: q.Seq,
+			pkt: &p.PublishPacket{
+				QoS:        q.Message.QoS,
+				Retain:     q.Message.Retain,
+				TopicName:  []byte(q.Message.Topic),
+				Payload:    q.Message.Payload,
+				Properties: restoredProperties(q.Message.Properties),
+			},
+			expiresAt: q.Message.ExpiresAt,
+			subIDs:    q.Message.SubscriptionIDs,
+		})
+		s.nextSeq = q.Seq + 1
+	}
+	for _, pktID := range stored.ReceivedQoS2 {
+		s.receivedQoS2[pktID] = struct{}{}
+	}
+	return s
+}
+
+// persist runs fn against the broker's store if the session is
+// persistent. Failing to persist shouldn't bring down the session
+// hence errors are only logged
+func (s *session) persist(fn func(store.Store) error) {
+	if !s.persistent {
+		return
+	}
+	if err := fn(s.broker.store); err != nil {
+		s.broker.logger.Error("failed to persist session state",
+			logging.F("client_id", s.id), logging.Err(err))
+	}
+}
+
+// delivery returns how the event should be delivered to the client.
+// Routing sends the session a single event for a message that matches
+// several of its subscriptions, so the message is delivered via those of
+// them the client is still subscribed with, at the highest QoS granted
+// across them, keeping the RETAIN flag if any of them is Retain As
+// Published and with all their subscription identifiers. Returns false if
+// the message shouldn't be delivered, eg the client unsubscribed since
+func (s *session) delivery(ev PublishEvent) (delivery, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	filters := ev.Matched
+	if len(filters) == 0 {
+		filters = []string{ev.Topic}
+	}
+	var d delivery
+	ok := false
+	for _, filter := range filters {
+		sub, subscribed := s.subscriptions[filter]
+		if !subscribed || !sub.matches(ev, s.id) {
+			// unsubscribed in the meantime or the client's own publish
+			continue
+		}
+		if !ok || sub.qos > d.qos {
+			d.qos = sub.qos
+		}
+		ok = true
+		d.retain = d.retain || sub.retainAsPublished
+		if sub.subID > 0 {
+			d.subIDs = append(d.subIDs, sub.subID)
+		}
+	}
+	if !ok {
+		return delivery{}, false
+	}
+	if ev.RawPkt.QoS < d.qos {
+		d.qos = ev.RawPkt.QoS
+	}
+	d.retain = d.retain && ev.RawPkt.Retain
+	sort.Slice(d.subIDs, func(i, j int) bool { return d.subIDs[i] < d.subIDs[j] })
+	return d, true
+}
+
+// storedExpiry returns the session's expiry as held in the store
+func (s *session) storedExpiry() uint32 {
+	if s.expiry == sessionNeverExpires {
+		return 0
+	}
+	return s.expiry
+}
+
+// goOffline starts queuing messages for the client once it's
+// disconnected and starts the countdown to the session's expiry, unless
+// it's already underway, eg for sessions restored from the store.
+// Should be called with the broker's clientsMu held
+func (s *session) goOffline() {
+	s.offlineQuitCh = make(chan struct{})
+	s.offlineDoneCh = make(chan struct{})
+	s.broker.sessionsWg.Add(1)
+	go s.queueWhileOffline(s.offlineQuitCh, s.offlineDoneCh)
+
+	if s.expiry == sessionNeverExpires {
+		return
+	}
+	if s.expiresAt.IsZero() {
+		s.expiresAt = time.Now().Add(time.Duration(s.expiry) * time.Second)
+		s.persist(func(st store.Store) error {
+			return st.PutSessionExpiry(s.id, s.storedExpiry(), s.expiresAt)
+		})
+	}
+	s.expiryGen++
+	gen := s.expiryGen
+	s.expiryTimer = time.AfterFunc(time.Until(s.expiresAt), func() {
+		s.expire(gen)
+	})
+}
+
+// goOnline stops queuing messages once the client reconnects. Any message
+// already taken off messagesCh is queued by the time goOnline returns.
+// Should be called with the broker's clientsMu held
+func (s *session) goOnline() {
+	if s.expiryTimer != nil {
+		s.expiryTimer.Stop()
+		s.expiryTimer = nil
+	}
+	s.expiresAt = time.Time{}
+	if s.offlineQuitCh == nil {
+		return
+	}
+	close(s.offlineQuitCh)
+	<-s.offlineDoneCh
+	s.offlineQuitCh, s.offlineDoneCh = nil, nil
+}
+
+// expire discards the session once its expiry interval elapses while the
+// client is offline. gen identifies the timer that fired, the session
+// might have been resumed in the meantime
+func (s *session) expire(gen uint64) {
+	b := s.broker
+	b.clientsMu.Lock()
+	defer b.clientsMu.Unlock()
+	if s.expiryTimer == nil || s.expiryGen != gen {
+		return
+	}
+	select {
+	case <-b.quitCh:
+		return
+	default:
+	}
+	s.goOnline()
+	s.discard()
+	delete(b.sessions, s.id)
+	b.logger.Info("session expired", logging.F("client_id", s.id))
+}
+
+func (s *session) queueWhileOffline(quitCh, doneCh chan struct{}) {
+	defer func() {
+		close(doneCh)
+		s.broker.sessionsWg.Done()
+	}()
+	for {
+		select {
+		case ev := <-s.messagesCh:
+			s.enqueue(ev)
+		case <-quitCh:
+			return
+		case <-s.broker.quitCh:
+			return
+		}
+	}
+}
+
+// enqueue queues a message for the offline client. As per the spec,
+// QoS 0 messages need not be queued. Messages that expire while queued
+// are dropped once the client reconnects or to make room in a full queue
+func (s *session) enqueue(ev PublishEvent) {
+	d, ok := s.delivery(ev)
+	if !ok || d.qos == 0 || expired(ev.ExpiresAt) {
+		return
+	}
+	s.push(ev.RawPkt, d, ev.ExpiresAt)
+}
+
+// push appends a QoS 1 or 2 message to the queue, to be sent once the
+// client is online and its Receive Maximum allows
+func (s *session) push(pkt *p.PublishPacket, d delivery, expiresAt time.Time) {
+	s.mu.Lock()
+	if len(s.queue) >= s.broker.maxQueued {
+		s.dropExpired()
+	}
+	if len(s.queue) >= s.broker.maxQueued {
+		s.mu.Unlock()
+		s.broker.logger.Warn("message queue full, dropped message",
+			logging.F("client_id", s.id), logging.F("topic", string(pkt.TopicName)))
+		return
+	}
+	q := queuedMsg{
+		seq: s.nextSeq,
+		pkt: &p.PublishPacket{
+			QoS:        d.qos,
+			Retain:     d.retain,
+			TopicName:  pkt.TopicName,
+			Payload:    pkt.Payload,
+			Properties: forwardedProperties(pkt.Properties),
+		},
+		expiresAt: expiresAt,
+		subIDs:    d.subIDs,
+	}
+	s.nextSeq++
+	s.queue = append(s.queue, q)
+	s.mu.Unlock()
+	s.persist(func(st store.Store) error {
+		return st.PutQueued(s.id, q.seq, store.Message{
+			Topic:           string(q.pkt.TopicName),
+			Payload:         q.pkt.Payload,
+			QoS:             q.pkt.QoS,
+			Retain:          q.pkt.Retain,
+			ExpiresAt:       q.expiresAt,
+			SubscriptionIDs: q.subIDs,
+			Properties:      storedProperties(q.pkt.Properties),
+		})
+	})
+}
+
+// dropExpired drops expired messages from the queue. Should be called
+// with s.mu held
+func (s *session) dropExpired() {
+	queue := s.queue[:0]
+	for _, q := range s.queue {
+		if !expired(q.expiresAt) {
+			queue = append(queue, q)
+			continue
+		}
+		seq := q.seq
+		s.persist(func(st store.Store) error {
+			return st.DeleteQueued(s.id, seq)
+		})
+	}
+	for i := len(queue); i < len(s.queue); i++ {
+		s.queue[i] = queuedMsg{} // GC
+	}
+	s.queue = queue
+}
+
+// discard unsubscribes the session from the topic map and deletes it from
+// the store. The session should be offline
+func (s *session) discard() {
+	s.mu.Lock()
+	subs := s.subscriptions
+	s.subscriptions = make(map[string]*sessionSubscription)
+	s.mu.Unlock()
+	for _, sub := range subs {
+		s.topicMap.UnsubscribeByTopic(sub.sub, sub.tokens)
+		s.broker.metrics.subscriptions.Dec()
+	}
+	s.persist(func(st store.Store) error {
+		return st.DeleteSession(s.id)
+	})
+}
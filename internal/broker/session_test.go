@@ -0,0 +1,350 @@
+package broker
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/nagamocha3000/go-mqtt-broker/internal/protocol"
+	"github.com/nagamocha3000/go-mqtt-broker/internal/store"
+	"github.com/stretchr/testify/require"
+)
+
+// waitOffline waits until the broker has queued n messages for
+// the offline session with the given client ID
+func waitOffline(t *testing.T, b *Broker, clientID string, nQueued int) {
+	require.Eventually(t, func() bool {
+		b.clientsMu.Lock()
+		defer b.clientsMu.Unlock()
+		s, ok := b.sessions[clientID]
+		if !ok || s.offlineQuitCh == nil {
+			return false
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return len(s.queue) == nQueued
+	}, 2*time.Second, time.Millisecond)
+}
+
+// ping ensures that the broker has handled all packets sent before it
+func (c *testClient) ping() {
+	c.send(&protocol.PingreqPacket{})
+	f, _ := c.read()
+	require.Equal(c.t, protocol.Pingresp, f.PktType)
+}
+
+func TestBrokerResumesPersistentSession(t *testing.T) {
+	b := NewBroker()
+	defer b.Close()
+
+	sub, present := connectTestClient(t, b, "sub", false)
+	require.False(t, present)
+	sub.subscribe(1, "a/b", 1)
+	sub.disconnect()
+	waitOffline(t, b, "sub", 0)
+
+	// QoS 0 messages aren't queued for offline clients
+	pub := newTestClient(t, b, "pub")
+	for i, qos := range []byte{1, 0, 2} {
+		pub.send(&protocol.PublishPacket{
+			QoS:              qos,
+			TopicName:        []byte("a/b"),
+			Payload:          []byte{byte('0' + i)},
+			PacketIdentifier: uint16(i + 1),
+		})
+		if qos > 0 {
+			pub.read() // PUBACK or PUBREC
+		}
+	}
+	pub.send(&protocol.PubrelPacket{PacketIdentifier: 3})
+	pub.read() // PUBCOMP
+	waitOffline(t, b, "sub", 2)
+	require.Equal(t, 2, b.numSessions())
+
+	sub, present = connectTestClient(t, b, "sub", false)
+	require.True(t, present)
+	first := sub.readPublish()
+	require.Equal(t, []byte("0"), first.Payload)
+	require.Equal(t, byte(1), first.QoS)
+	second := sub.readPublish()
+	require.Equal(t, []byte("2"), second.Payload)
+	require.Equal(t, byte(1), second.QoS, "capped at the QoS granted")
+	sub.send(&protocol.PubackPacket{PacketIdentifier: first.PacketIdentifier})
+	sub.ping()
+	sub.conn.Close()
+	waitOffline(t, b, "sub", 0)
+
+	// unacknowledged messages are resent as duplicates
+	sub, present = connectTestClient(t, b, "sub", false)
+	require.True(t, present)
+	resent := sub.readPublish()
+	require.True(t, resent.Dup)
+	require.Equal(t, second.PacketIdentifier, resent.PacketIdentifier)
+	require.Equal(t, []byte("2"), resent.Payload)
+	sub.send(&protocol.PubackPacket{PacketIdentifier: resent.PacketIdentifier})
+	sub.disconnect()
+	waitOffline(t, b, "sub", 0)
+
+	// a clean session discards the stored session
+	sub, present = connectTestClient(t, b, "sub", true)
+	require.False(t, present)
+	require.Empty(t, b.TopicFilters())
+	sub.disconnect()
+	pub.disconnect()
+	require.Eventually(t, func() bool { return b.numSessions() == 0 }, time.Second, time.Millisecond)
+}
+
+func TestBrokerRebuildsStateFromStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "broker")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	st, err := store.Open(dir)
+	require.NoError(t, err)
+	b := NewBroker(WithStore(st))
+	sub, _ := connectTestClient(t, b, "sub", false)
+	sub.subscribe(1, "a/+", 2)
+	sub.disconnect()
+	waitOffline(t, b, "sub", 0)
+	pub := newTestClient(t, b, "pub")
+	pub.send(&protocol.PublishPacket{
+		QoS:              1,
+		Retain:           true,
+		TopicName:        []byte("a/b"),
+		Payload:          []byte("hello"),
+		PacketIdentifier: 1,
+	})
+	pub.read() // PUBACK
+	waitOffline(t, b, "sub", 1)
+	pub.disconnect()
+	b.Close()
+	require.NoError(t, st.Close())
+
+	st, err = store.Open(dir)
+	require.NoError(t, err)
+	defer st.Close()
+	b = NewBroker(WithStore(st))
+	defer b.Close()
+	require.Equal(t, []RetainedMessage{{Topic: "a/b", QoS: 1, Payload: []byte("hello")}}, b.RetainedMessages())
+	require.Equal(t, []TopicFilterInfo{{Filter: "a/+", Subscribers: 1, Depth: 2}}, b.TopicFilters())
+
+	sub, present := connectTestClient(t, b, "sub", false)
+	require.True(t, present)
+	pkt := sub.readPublish()
+	require.Equal(t, []byte("hello"), pkt.Payload)
+	require.Equal(t, byte(1), pkt.QoS)
+	sub.send(&protocol.PubackPacket{PacketIdentifier: pkt.PacketIdentifier})
+	sub.ping()
+
+	sessions, err := st.Sessions()
+	require.NoError(t, err)
+	require.Equal(t, []store.Session{{
+		ClientID:      "sub",
+		Subscriptions: map[string]byte{"a/+": 2},
+	}}, sessions)
+	sub.disconnect()
+}
+
+// connectTestClient5 connects an MQTT 5 test client with the given
+// Clean Start flag and Session Expiry Interval
+func connectTestClient5(t *testing.T, b *Broker, clientID string, clean bool, expiry uint32) (*testClient, *protocol.ConnackPacket) {
+	c, connack := dialTestClient(t, b, &protocol.ConnectPacketConfig{
+		ClientIdentifier:   []byte(clientID),
+		ShouldCleanSession: clean,
+		ProtocolLevel:      protocol.ProtocolLevel5,
+		Properties:         &protocol.Properties{SessionExpiryInterval: protocol.Uint32(expiry)},
+	})
+	require.Equal(t, protocol.ConnAccepted, connack.Code)
+	return c, connack
+}
+
+func TestBrokerSessionExpiry(t *testing.T) {
+	st := store.NewMemoryStore()
+	b := NewBroker(WithStore(st), WithMaxSessionExpiry(time.Second))
+	defer b.Close()
+
+	// an expiry of 0 ends the session along with the connection
+	c, connack := connectTestClient5(t, b, "a", false, 0)
+	require.False(t, connack.SessionPresent)
+	c.subscribe(1, "a/b", 1)
+	c.disconnect()
+	require.Eventually(t, func() bool { return b.numSessions() == 0 }, time.Second, time.Millisecond)
+	c, connack = connectTestClient5(t, b, "a", false, 0)
+	require.False(t, connack.SessionPresent)
+
+	// setting an expiry on DISCONNECT when it was 0 on CONNECT is a
+	// protocol error
+	c.send(&protocol.DisconnectPacket{Properties: &protocol.Properties{
+		SessionExpiryInterval: protocol.Uint32(10),
+	}})
+	c.requireDisconnected(protocol.ReasonProtocolError)
+
+	// the session is kept once the client disconnects, the expiry
+	// requested being capped by the broker's maximum
+	c, connack = connectTestClient5(t, b, "b", false, 3600)
+	require.False(t, connack.SessionPresent)
+	require.Equal(t, protocol.Uint32(1), connack.Properties.SessionExpiryInterval)
+	c.subscribe(1, "a/b", 1)
+	c.disconnect()
+	waitOffline(t, b, "b", 0)
+	c, connack = connectTestClient5(t, b, "b", false, 1)
+	require.True(t, connack.SessionPresent)
+	require.Nil(t, connack.Properties.SessionExpiryInterval)
+
+	// ... until it expires, discarding its subscriptions
+	disconnectedAt := time.Now()
+	c.disconnect()
+	waitOffline(t, b, "b", 0)
+	require.Eventually(t, func() bool { return b.numSessions() == 0 }, 3*time.Second, 10*time.Millisecond)
+	require.True(t, time.Since(disconnectedAt) >= time.Second)
+	require.Empty(t, b.TopicFilters())
+	sessions, err := st.Sessions()
+	require.NoError(t, err)
+	require.Empty(t, sessions)
+
+	// likewise when resuming a session with an expiry of 0 on CONNECT,
+	// which then ends along with the connection
+	c, _ = connectTestClient5(t, b, "d", false, 1)
+	c.disconnect()
+	waitOffline(t, b, "d", 0)
+	c, connack = connectTestClient5(t, b, "d", false, 0)
+	require.True(t, connack.SessionPresent)
+	c.send(&protocol.DisconnectPacket{Properties: &protocol.Properties{
+		SessionExpiryInterval: protocol.Uint32(10),
+	}})
+	c.requireDisconnected(protocol.ReasonProtocolError)
+	require.Eventually(t, func() bool { return b.numSessions() == 0 }, time.Second, time.Millisecond)
+
+	// Clean Start discards the previous session even if the new one is
+	// kept once the client disconnects
+	c, _ = connectTestClient5(t, b, "c", false, 1)
+	c.subscribe(1, "a/b", 1)
+	c.disconnect()
+	waitOffline(t, b, "c", 0)
+	c, connack = connectTestClient5(t, b, "c", true, 1)
+	require.False(t, connack.SessionPresent)
+	require.Empty(t, b.TopicFilters())
+
+	// the expiry can be brought down to 0 on DISCONNECT
+	c.send(&protocol.DisconnectPacket{Properties: &protocol.Properties{
+		SessionExpiryInterval: protocol.Uint32(0),
+	}})
+	c.conn.Close()
+	require.Eventually(t, func() bool { return b.numSessions() == 0 }, time.Second, time.Millisecond)
+}
+
+func TestBrokerExpiresRestoredSessions(t *testing.T) {
+	st := store.NewMemoryStore()
+	b := NewBroker(WithStore(st))
+	c, _ := connectTestClient5(t, b, "a", false, 60)
+	c.subscribe(1, "a/b", 1)
+	c.disconnect()
+	waitOffline(t, b, "a", 0)
+	b.Close()
+
+	sessions, err := st.Sessions()
+	require.NoError(t, err)
+	require.Len(t, sessions, 1)
+	require.Equal(t, uint32(60), sessions[0].Expiry)
+	require.False(t, sessions[0].ExpiresAt.IsZero())
+
+	// sessions whose expiry elapsed while the broker was down are
+	// discarded on restart
+	require.NoError(t, st.PutSessionExpiry("a", 60, time.Now().Add(-time.Second)))
+	b = NewBroker(WithStore(st))
+	defer b.Close()
+	require.Eventually(t, func() bool { return b.numSessions() == 0 }, time.Second, time.Millisecond)
+	require.Empty(t, b.TopicFilters())
+}
+
+func TestBrokerMessageExpiry(t *testing.T) {
+	b := NewBroker(WithDefaultMessageExpiry(time.Second), WithMaxMessageExpiry(time.Minute))
+	defer b.Close()
+
+	sub, _ := connectTestClient5(t, b, "sub", false, 60)
+	sub.subscribe(1, "a/#", 1)
+	pub, _ := connectTestClient5(t, b, "pub", true, 0)
+	pub311 := newTestClient(t, b, "pub311")
+	publish := func(c *testClient, topic string, retain bool, expiry *uint32) {
+		pkt := &protocol.PublishPacket{
+			QoS:              1,
+			Retain:           retain,
+			TopicName:        []byte(topic),
+			Payload:          []byte(topic),
+			PacketIdentifier: 1,
+		}
+		if expiry != nil {
+			pkt.Properties = &protocol.Properties{MessageExpiryInterval: expiry}
+		}
+		c.send(pkt)
+		c.read() // PUBACK
+	}
+
+	// left unacknowledged, hence inflight while the client is offline
+	publish(pub, "a/0", false, protocol.Uint32(1))
+	pkt := sub.readPublish()
+	require.Equal(t, protocol.Uint32(1), pkt.Properties.MessageExpiryInterval)
+	sub.conn.Close()
+	waitOffline(t, b, "sub", 0)
+
+	// 3.1.1 publishers get the default expiry, the expiry requested by
+	// MQTT 5 publishers is capped
+	publish(pub311, "a/1", false, nil)
+	publish(pub, "a/2", false, protocol.Uint32(3600))
+	publish(pub, "a/r", true, protocol.Uint32(1))
+	waitOffline(t, b, "sub", 3)
+	require.Len(t, b.RetainedMessages(), 1)
+	time.Sleep(1100 * time.Millisecond)
+
+	// expired messages are dropped, the lifetime left is passed on
+	sub, _ = connectTestClient5(t, b, "sub", false, 60)
+	pkt = sub.readPublish()
+	require.Equal(t, []byte("a/2"), pkt.Payload)
+	require.False(t, pkt.Dup)
+	left := *pkt.Properties.MessageExpiryInterval
+	require.True(t, left > 0 && left < 60, "%d seconds left", left)
+	sub.send(&protocol.PubackPacket{PacketIdentifier: pkt.PacketIdentifier})
+	sub.ping()
+	require.Empty(t, b.RetainedMessages())
+	sub.subscribe(2, "a/r", 1)
+	sub.ping() // no retained message sent
+
+	sub.disconnect()
+	pub.disconnect()
+	pub311.disconnect()
+}
+
+func TestSessionDeliversOverlappingSubscriptionsOnce(t *testing.T) {
+	b := NewBroker()
+	defer b.Close()
+	s := newSession(b, "s", false)
+	for _, filter := range []string{"a/#", "a/+", "a/b"} {
+		tokens, _, err := ParseTopic([]byte(filter))
+		require.NoError(t, err)
+		sub := s.topicMap.SubscribeByTopic(filter, tokens, s.messagesCh)
+		defer sub.Unsubscribe()
+		s.subscriptions[filter] = &sessionSubscription{sub: sub, tokens: tokens, qos: 1}
+	}
+
+	tokens, _, err := ParseTopic([]byte("a/b"))
+	require.NoError(t, err)
+	b.publish(&protocol.PublishPacket{QoS: 2, TopicName: []byte("a/b")}, tokens, "pub")
+	require.Len(t, s.messagesCh, 1)
+	ev := <-s.messagesCh
+	require.Len(t, ev.Matched, 3)
+
+	// the subscription the message was routed via is gone by the time
+	// it's delivered, it's still delivered via the others
+	s.subscriptions[ev.Topic].sub.Unsubscribe()
+	delete(s.subscriptions, ev.Topic)
+	d, ok := s.delivery(ev)
+	require.True(t, ok)
+	require.Equal(t, byte(1), d.qos)
+
+	for filter := range s.subscriptions {
+		delete(s.subscriptions, filter)
+	}
+	_, ok = s.delivery(ev)
+	require.False(t, ok)
+}
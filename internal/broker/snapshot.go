@@ -0,0 +1,168 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	p "github.com/nagamocha3000/go-mqtt-broker/internal/protocol"
+	"github.com/nagamocha3000/go-mqtt-broker/internal/store"
+)
+
+// SnapshotVersion is the version of the snapshot format written by
+// ExportSnapshot. It should be bumped whenever the format changes in a
+// way that older brokers can't read
+const SnapshotVersion = 1
+
+// ErrSnapshotVersion is returned when importing a snapshot whose
+// format version differs from SnapshotVersion
+var ErrSnapshotVersion = errors.New("unsupported snapshot version")
+
+// ErrSessionConnected is returned when importing a snapshot holding a
+// session whose client is currently connected
+var ErrSessionConnected = errors.New("session's client is connected")
+
+// Snapshot holds the broker's state that outlives client connections:
+// retained messages plus persistent sessions together with their
+// subscriptions, inflight and queued messages. The broker doesn't
+// manage users or ACLs hence there are none to include
+type Snapshot struct {
+	Version   int             `json:"version"`
+	CreatedAt time.Time       `json:"created_at"`
+	Retained  []store.Message `json:"retained"`
+	Sessions  []store.Session `json:"sessions"`
+}
+
+// ExportSnapshot writes a snapshot of the broker's state to w as JSON.
+// The state is read off the broker's store, which holds every change
+// made to persistent sessions and retained messages
+func (b *Broker) ExportSnapshot(w io.Writer) error {
+	retained, err := b.store.Retained()
+	if err != nil {
+		return err
+	}
+	sessions, err := b.store.Sessions()
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(&Snapshot{
+		Version:   SnapshotVersion,
+		CreatedAt: time.Now().UTC(),
+		Retained:  retained,
+		Sessions:  sessions,
+	})
+}
+
+// ImportSnapshot reads a snapshot written by ExportSnapshot and loads it
+// into the broker. Retained messages replace those held for the same
+// topic and sessions replace offline sessions with the same client ID.
+// The snapshot is checked in full before anything is loaded: a snapshot
+// of a different format version, with invalid topics or holding a
+// session whose client is connected is rejected as a whole
+func (b *Broker) ImportSnapshot(r io.Reader) error {
+	var snap Snapshot
+	if err := json.NewDecoder(r).Decode(&snap); err != nil {
+		return fmt.Errorf("decoding snapshot: %w", err)
+	}
+	if snap.Version != SnapshotVersion {
+		return fmt.Errorf("%w: got %d, want %d", ErrSnapshotVersion, snap.Version, SnapshotVersion)
+	}
+
+	retainedTokens := make([][]TopicToken, len(snap.Retained))
+	for i, msg := range snap.Retained {
+		tokens, hasWildcard, err := ParseTopic([]byte(msg.Topic))
+		if err != nil || hasWildcard || msg.QoS > 2 {
+			return fmt.Errorf("invalid retained message on topic %q", msg.Topic)
+		}
+		retainedTokens[i] = tokens
+	}
+	for _, s := range snap.Sessions {
+		if s.ClientID == "" {
+			return errors.New("session without client ID")
+		}
+		for filter, opts := range s.Subscriptions {
+			_, _, err := ParseTopic([]byte(filter))
+			if err == nil {
+				err = (&p.TopicQoS{}).SetOptions(opts)
+			}
+			if err != nil {
+				return fmt.Errorf("invalid subscription %q of session %q", filter, s.ClientID)
+			}
+		}
+	}
+
+	b.clientsMu.Lock()
+	defer b.clientsMu.Unlock()
+	for _, s := range snap.Sessions {
+		if _, ok := b.clients[s.ClientID]; ok {
+			return fmt.Errorf("%w: %s", ErrSessionConnected, s.ClientID)
+		}
+	}
+
+	for i, msg := range snap.Retained {
+		if len(msg.Payload) == 0 {
+			continue
+		}
+		pkt := &p.PublishPacket{
+			QoS:        msg.QoS,
+			Retain:     true,
+			TopicName:  []byte(msg.Topic),
+			Payload:    msg.Payload,
+			Properties: restoredProperties(msg.Properties),
+		}
+		if err := b.retained.set(retainedTokens[i], pkt, msg.ExpiresAt); err != nil {
+			return err
+		}
+	}
+	for _, stored := range snap.Sessions {
+		if existing, ok := b.sessions[stored.ClientID]; ok {
+			existing.goOnline()
+			existing.discard()
+			delete(b.sessions, stored.ClientID)
+		}
+		if err := putSession(b.store, stored); err != nil {
+			return err
+		}
+		s := restoreSession(b, stored)
+		b.sessions[s.id] = s
+		s.goOffline()
+	}
+	return nil
+}
+
+// putSession writes all of a session's state to the store
+func putSession(st store.Store, s store.Session) error {
+	if err := st.PutSession(s.ClientID); err != nil {
+		return err
+	}
+	if s.Expiry > 0 {
+		if err := st.PutSessionExpiry(s.ClientID, s.Expiry, s.ExpiresAt); err != nil {
+			return err
+		}
+	}
+	for filter, qos := range s.Subscriptions {
+		if err := st.PutSubscription(s.ClientID, filter, qos, s.SubscriptionIDs[filter]); err != nil {
+			return err
+		}
+	}
+	for _, msg := range s.Inflight {
+		if err := st.PutInflight(s.ClientID, msg); err != nil {
+			return err
+		}
+	}
+	for _, q := range s.Queued {
+		if err := st.PutQueued(s.ClientID, q.Seq, q.Message); err != nil {
+			return err
+		}
+	}
+	for _, pktID := range s.ReceivedQoS2 {
+		if err := st.PutReceived(s.ClientID, pktID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/nagamocha3000/go-mqtt-broker/internal/store"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBrokerSnapshotExportImport(t *testing.T) {
+	src := NewBroker()
+	defer src.Close()
+	sub, _ := connectTestClient(t, src, "sub", false)
+	sub.subscribe(1, "a/#", 1)
+	sub.disconnect()
+	waitOffline(t, src, "sub", 0)
+	require.NoError(t, src.Publish("a/b", []byte("queued"), 1, false))
+	require.NoError(t, src.Publish("r", []byte("retained"), 0, true))
+	waitOffline(t, src, "sub", 1)
+
+	var buf bytes.Buffer
+	require.NoError(t, src.ExportSnapshot(&buf))
+	var snap Snapshot
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &snap))
+	require.Equal(t, SnapshotVersion, snap.Version)
+	require.Equal(t, []store.Session{{
+		ClientID:      "sub",
+		Subscriptions: map[string]byte{"a/#": 1},
+		Queued: []store.QueuedMessage{
+			{Seq: 0, Message: store.Message{Topic: "a/b", Payload: []byte("queued"), QoS: 1}},
+		},
+	}}, snap.Sessions)
+
+	st := store.NewMemoryStore()
+	dst := NewBroker(WithStore(st))
+	defer dst.Close()
+	require.NoError(t, dst.ImportSnapshot(bytes.NewReader(buf.Bytes())))
+	require.Equal(t, []RetainedMessage{{Topic: "r", Payload: []byte("retained")}}, dst.RetainedMessages())
+	sessions, err := st.Sessions()
+	require.NoError(t, err)
+	require.Equal(t, snap.Sessions, sessions)
+
+	// the imported session picks up where it left off
+	sub, present := connectTestClient(t, dst, "sub", false)
+	require.True(t, present)
+	require.Equal(t, []byte("queued"), sub.readPublish().Payload)
+	require.NoError(t, dst.Publish("a/c", []byte("live"), 0, false))
+	require.Equal(t, []byte("live"), sub.readPublish().Payload)
+
+	// a session whose client is connected can't be replaced
+	err = dst.ImportSnapshot(bytes.NewReader(buf.Bytes()))
+	require.True(t, errors.Is(err, ErrSessionConnected))
+	sub.disconnect()
+}
+
+func TestBrokerSnapshotImportRejectsInvalidSnapshots(t *testing.T) {
+	b := NewBroker()
+	defer b.Close()
+
+	cases := []struct {
+		description string
+		snapshot    string
+	}{
+		{"newer version", `{"version": 2, "retained": [], "sessions": []}`},
+		{"missing version", `{"retained": [], "sessions": []}`},
+		{"retained topic with wildcard", `{"version": 1, "retained": [{"topic": "a/+", "payload": "YQ=="}]}`},
+		{"invalid subscription", `{"version": 1, "sessions": [{"client_id": "c", "subscriptions": {"a/#/b": 1}}]}`},
+		{"session without client ID", `{"version": 1, "sessions": [{"subscriptions": {"a": 1}}]}`},
+		{"not json", `version 1`},
+	}
+	for _, c := range cases {
+		t.Run(c.description, func(t *testing.T) {
+			require.Error(t, b.ImportSnapshot(bytes.NewReader([]byte(c.snapshot))))
+			require.Empty(t, b.RetainedMessages())
+			require.Zero(t, b.numSessions())
+		})
+	}
+	err := b.ImportSnapshot(bytes.NewReader([]byte(cases[0].snapshot)))
+	require.True(t, errors.Is(err, ErrSnapshotVersion))
+
+	// nothing is loaded if any part of the snapshot is invalid
+	err = b.ImportSnapshot(bytes.NewReader([]byte(`{"version": 1,
+		"retained": [{"topic": "a", "payload": "YQ=="}],
+		"sessions": [{"client_id": "c", "subscriptions": {"a/#/b": 1}}]}`)))
+	require.Error(t, err)
+	require.Empty(t, b.RetainedMessages())
+}
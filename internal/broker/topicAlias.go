@@ -0,0 +1,118 @@
+package broker
+
+import (
+	"container/list"
+
+	p "github.com/nagamocha3000/go-mqtt-broker/internal/protocol"
+)
+
+// inboundAliases holds the topic aliases set by an MQTT 5 client on the
+// publishes it sends. Aliases last as long as the connection
+type inboundAliases struct {
+	max    uint16
+	topics map[uint16][]byte
+}
+
+func newInboundAliases(max uint16) *inboundAliases {
+	return &inboundAliases{max: max, topics: make(map[uint16][]byte)}
+}
+
+// resolve sets the topic name of a publish that refers to it by alias
+// only, or maps the alias to the publish's topic name otherwise. The
+// alias is then cleared from the publish
+func (a *inboundAliases) resolve(pkt *p.PublishPacket) error {
+	if pkt.Properties == nil || pkt.Properties.TopicAlias == nil {
+		return nil
+	}
+	alias := *pkt.Properties.TopicAlias
+	if alias > a.max {
+		return errTopicAliasInvalid
+	}
+	if len(pkt.TopicName) > 0 {
+		a.topics[alias] = pkt.TopicName
+	} else if topic, ok := a.topics[alias]; ok {
+		pkt.TopicName = topic
+	} else {
+		return errTopicAliasInvalid
+	}
+	pkt.Properties.TopicAlias = nil
+	return nil
+}
+
+// outboundAliases assigns topic aliases to the publishes sent to an MQTT
+// 5 client, up to the maximum it accepts. Once all aliases are in use,
+// the least recently used one is reassigned
+type outboundAliases struct {
+	max     uint16
+	aliases map[string]*list.Element
+	lru     *list.List // of *outboundAlias, most recently used first
+}
+
+type outboundAlias struct {
+	topic string
+	alias uint16
+}
+
+func newOutboundAliases(max uint16) *outboundAliases {
+	return &outboundAliases{
+		max:     max,
+		aliases: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// assign returns the alias of the given topic plus whether the client
+// already maps the alias to the topic
+func (a *outboundAliases) assign(topic string) (uint16, bool) {
+	if e, ok := a.aliases[topic]; ok {
+		a.lru.MoveToFront(e)
+		return e.Value.(*outboundAlias).alias, true
+	}
+	if a.lru.Len() < int(a.max) {
+		alias := &outboundAlias{topic: topic, alias: uint16(a.lru.Len() + 1)}
+		a.aliases[topic] = a.lru.PushFront(alias)
+		return alias.alias, false
+	}
+	e := a.lru.Back()
+	alias := e.Value.(*outboundAlias)
+	delete(a.aliases, alias.topic)
+	alias.topic = topic
+	a.aliases[topic] = e
+	a.lru.MoveToFront(e)
+	return alias.alias, false
+}
+
+// forget drops the alias assigned to the topic, if any, so that it's
+// set anew by the next publish on the topic. The alias itself is the
+// next to be reassigned
+func (a *outboundAliases) forget(topic string) {
+	if a == nil {
+		return
+	}
+	if e, ok := a.aliases[topic]; ok {
+		delete(a.aliases, topic)
+		e.Value.(*outboundAlias).topic = ""
+		a.lru.MoveToBack(e)
+	}
+}
+
+// apply returns a copy of the publish that refers to its topic by alias,
+// dropping the topic name if the client already knows the alias. The
+// publish is returned as is if the client doesn't accept aliases
+func (a *outboundAliases) apply(pkt *p.PublishPacket) *p.PublishPacket {
+	if a == nil || a.max == 0 {
+		return pkt
+	}
+	alias, known := a.assign(string(pkt.TopicName))
+	out := *pkt
+	props := p.Properties{}
+	if pkt.Properties != nil {
+		props = *pkt.Properties
+	}
+	props.TopicAlias = p.Uint16(alias)
+	out.Properties = &props
+	if known {
+		out.TopicName = nil
+	}
+	return &out
+}
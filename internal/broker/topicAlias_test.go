@@ -0,0 +1,90 @@
+package broker
+
+import (
+	"testing"
+
+	p "github.com/nagamocha3000/go-mqtt-broker/internal/protocol"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInboundAliases(t *testing.T) {
+	a := newInboundAliases(2)
+	publish := func(topic string, alias uint16) *p.PublishPacket {
+		return &p.PublishPacket{
+			TopicName:  []byte(topic),
+			Properties: &p.Properties{TopicAlias: p.Uint16(alias)},
+		}
+	}
+
+	// an alias can't be used before it's set
+	require.Equal(t, errTopicAliasInvalid, a.resolve(publish("", 1)))
+
+	pkt := publish("a/b", 1)
+	require.NoError(t, a.resolve(pkt))
+	require.Nil(t, pkt.Properties.TopicAlias)
+	pkt = publish("", 1)
+	require.NoError(t, a.resolve(pkt))
+	require.Equal(t, []byte("a/b"), pkt.TopicName)
+	require.Nil(t, pkt.Properties.TopicAlias)
+
+	// aliases can be remapped
+	require.NoError(t, a.resolve(publish("c", 1)))
+	pkt = publish("", 1)
+	require.NoError(t, a.resolve(pkt))
+	require.Equal(t, []byte("c"), pkt.TopicName)
+
+	// up to the maximum
+	require.Equal(t, errTopicAliasInvalid, a.resolve(publish("a/b", 3)))
+	require.Equal(t, errTopicAliasInvalid, newInboundAliases(0).resolve(publish("a/b", 1)))
+
+	pkt = &p.PublishPacket{TopicName: []byte("a/b")}
+	require.NoError(t, a.resolve(pkt))
+	require.Equal(t, []byte("a/b"), pkt.TopicName)
+}
+
+func TestOutboundAliases(t *testing.T) {
+	a := newOutboundAliases(2)
+	send := func(topic string) (string, uint16) {
+		pkt := &p.PublishPacket{TopicName: []byte(topic), Payload: []byte("x")}
+		out := a.apply(pkt)
+		require.Equal(t, []byte(topic), pkt.TopicName, "original left as is")
+		require.Nil(t, pkt.Properties)
+		return string(out.TopicName), *out.Properties.TopicAlias
+	}
+
+	topic, alias := send("a")
+	require.Equal(t, "a", topic)
+	require.Equal(t, uint16(1), alias)
+	topic, alias = send("b")
+	require.Equal(t, "b", topic)
+	require.Equal(t, uint16(2), alias)
+	topic, alias = send("a")
+	require.Equal(t, "", topic)
+	require.Equal(t, uint16(1), alias)
+
+	// the least recently used alias is reassigned
+	topic, alias = send("c")
+	require.Equal(t, "c", topic)
+	require.Equal(t, uint16(2), alias)
+	topic, alias = send("b")
+	require.Equal(t, "b", topic)
+	require.Equal(t, uint16(1), alias)
+	topic, alias = send("c")
+	require.Equal(t, "", topic)
+	require.Equal(t, uint16(2), alias)
+
+	// a forgotten alias is set anew, being the next reassigned
+	a.forget("c")
+	topic, alias = send("d")
+	require.Equal(t, "d", topic)
+	require.Equal(t, uint16(2), alias)
+	topic, alias = send("b")
+	require.Equal(t, "", topic)
+	require.Equal(t, uint16(1), alias)
+
+	// clients that don't accept aliases get publishes as is
+	pkt := &p.PublishPacket{TopicName: []byte("a")}
+	var none *outboundAliases
+	require.True(t, pkt == none.apply(pkt))
+	require.True(t, pkt == newOutboundAliases(0).apply(pkt))
+}
@@ -2,15 +2,95 @@ package broker
 
 import (
 	"fmt"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"unsafe"
 
-	hm "github.com/cornelk/hashmap"
+	"github.com/nagamocha3000/go-mqtt-broker/internal/metrics"
 )
 
-// node holds a level for a wildcard match
+// node holds a level for a wildcard match. Readers traverse nodes without
+// any locks: children is a sync.Map, which is optimized for keys that are
+// written once but read many times, and the feed is swapped atomically.
+// Since every match looks up the wildcard children at each level, they're
+// kept out of the sync.Map behind atomic pointers, which are cheaper to
+// load. Nodes are only ever modified with the TopicMap's write lock held
 type node struct {
-	children map[string]*node
-	feed     *Feed
+	children  sync.Map       // string -> *node, excluding wildcards
+	plus      unsafe.Pointer // *node for the "+" child, accessed atomically
+	hash      unsafe.Pointer // *node for the "#" child, accessed atomically
+	nChildren int            // accessed only with the write lock held
+	feed      unsafe.Pointer // *Feed, accessed atomically
+}
+
+// wildcardChild returns the pointer to the child for the given token
+// if it's a wildcard, nil otherwise
+func (n *node) wildcardChild(token string) *unsafe.Pointer {
+	switch token {
+	case "+":
+		return &n.plus
+	case "#":
+		return &n.hash
+	}
+	return nil
+}
+
+func (n *node) child(token string) (*node, bool) {
+	if ptr := n.wildcardChild(token); ptr != nil {
+		return loadNode(ptr)
+	}
+	v, ok := n.children.Load(token)
+	if !ok {
+		return nil, false
+	}
+	return v.(*node), true
+}
+
+func loadNode(ptr *unsafe.Pointer) (*node, bool) {
+	c := (*node)(atomic.LoadPointer(ptr))
+	return c, c != nil
+}
+
+// setChild should be called with the write lock held
+func (n *node) setChild(token string, c *node) {
+	if ptr := n.wildcardChild(token); ptr != nil {
+		atomic.StorePointer(ptr, unsafe.Pointer(c))
+	} else {
+		n.children.Store(token, c)
+	}
+	n.nChildren++
+}
+
+// deleteChild should be called with the write lock held
+func (n *node) deleteChild(token string) {
+	if ptr := n.wildcardChild(token); ptr != nil {
+		atomic.StorePointer(ptr, nil)
+	} else {
+		n.children.Delete(token)
+	}
+	n.nChildren--
+}
+
+// rangeChildren calls fn for each child, wildcards first
+func (n *node) rangeChildren(fn func(*node)) {
+	for _, ptr := range []*unsafe.Pointer{&n.plus, &n.hash} {
+		if c, ok := loadNode(ptr); ok {
+			fn(c)
+		}
+	}
+	n.children.Range(func(_, c interface{}) bool {
+		fn(c.(*node))
+		return true
+	})
+}
+
+func (n *node) getFeed() *Feed {
+	return (*Feed)(atomic.LoadPointer(&n.feed))
+}
+
+func (n *node) setFeed(f *Feed) {
+	atomic.StorePointer(&n.feed, unsafe.Pointer(f))
 }
 
 // TopicMap holds a specialized map of topics to feeds through which subscribers can receive
@@ -20,23 +100,25 @@ type node struct {
 // O(l) regardless of the entire length of the topic name or number of matching topics
 // This is under the assumption that hashing the string of a single level of constant
 // time. TopicMap is concurrency safe, ie can be accessed safely from multiple concurrent
-// goroutines.
+// goroutines. Matching is lock-free so that publishes don't contend with one another
+// or with subscribes; writes are serialized and a concurrent match observes the
+// tree either before or after each write.
 type TopicMap struct {
-	root        *node
-	rwLock      *sync.RWMutex
-	topicToFeed *hm.HashMap
+	root      *node
+	writeLock *sync.Mutex
+	nFeeds    *int64 // accessed atomically
+
+	// set on the feeds the map creates, optional
+	fanoutLatency *metrics.Histogram
 }
 
 // NewTopicMap returns an instance of a topic map
 // for holding topics with wildcards
 func NewTopicMap() TopicMap {
-	//var rwLock sync.RWMutex
 	return TopicMap{
-		root: &node{
-			children: make(map[string]*node),
-		},
-		rwLock:      &sync.RWMutex{},
-		topicToFeed: &hm.HashMap{},
+		root:      &node{},
+		writeLock: &sync.Mutex{},
+		nFeeds:    new(int64),
 	}
 }
 
@@ -49,36 +131,53 @@ func NewTopicMap() TopicMap {
 // check for errors then retrieve the appropriate arguments to pass to the function
 func (m TopicMap) InitFeedByTopic(topic string, tokens []TopicToken) (*Feed, bool) {
 
-	// first check topic to feed
-	if feed, alreadyPresent := m.topicToFeed.Get(topic); alreadyPresent {
-		return feed.(*Feed), alreadyPresent
+	// first check without locking
+	if feed := m.lookupFeed(tokens); feed != nil {
+		return feed, true
 	}
 
 	// if topic feed not set, add
 	// lock for writing
-	m.rwLock.Lock()
-	defer m.rwLock.Unlock()
+	m.writeLock.Lock()
+	defer m.writeLock.Unlock()
 
+	return m.initFeed(topic, tokens)
+}
+
+// initFeed should be called with the write lock held
+func (m TopicMap) initFeed(topic string, tokens []TopicToken) (*Feed, bool) {
 	curr := m.root
 	for _, token := range tokens {
-		next, present := curr.children[token.Value]
+		next, present := curr.child(token.Value)
 		if !present {
-			next = &node{
-				children: make(map[string]*node),
-			}
-			curr.children[token.Value] = next
+			// node is fully set up before it's visible to readers
+			next = &node{}
+			curr.setChild(token.Value, next)
 		}
 		curr = next
 	}
 	// Set topic
-	if curr.feed == nil {
-		feed := NewFeed(topic)
-		curr.feed = feed
-		m.topicToFeed.Set(topic, feed)
-		return feed, false
+	if feed := curr.getFeed(); feed != nil {
+		return feed, true
 	}
-	return curr.feed, true
+	feed := NewFeed(topic)
+	feed.fanoutLatency = m.fanoutLatency
+	curr.setFeed(feed)
+	atomic.AddInt64(m.nFeeds, 1)
+	return feed, false
+}
 
+// lookupFeed returns the feed for the given topic filter if present
+func (m TopicMap) lookupFeed(tokens []TopicToken) *Feed {
+	curr := m.root
+	for _, token := range tokens {
+		next, present := curr.child(token.Value)
+		if !present {
+			return nil
+		}
+		curr = next
+	}
+	return curr.getFeed()
 }
 
 // RemoveFeedByTopic removes a given feed. It's
@@ -86,30 +185,85 @@ func (m TopicMap) InitFeedByTopic(topic string, tokens []TopicToken) (*Feed, boo
 // However, the function is provided for situations whereby
 // there are multiple feeds but each is sparsely and infrequently
 // used. A Nil feed is returned if the feed was not present to
-// begin with. For simplicity, one should use the ParseTopic helper
+// begin with. Nodes left without a feed or children are pruned from
+// the tree. For simplicity, one should use the ParseTopic helper
 // to parse a given topic name, check for errors then retrieve the appropriate
 // arguments to pass to the function
 func (m TopicMap) RemoveFeedByTopic(topic string, tokens []TopicToken) *Feed {
 	// lock for writing
-	m.rwLock.Lock()
-	defer m.rwLock.Unlock()
+	m.writeLock.Lock()
+	defer m.writeLock.Unlock()
 
-	m.topicToFeed.Del(string(topic))
+	return m.removeFeed(tokens, nil)
+}
 
+// removeFeed removes the feed for the given topic, if only is non-nil
+// the feed is only removed if it's the one currently held. Should be
+// called with the write lock held
+func (m TopicMap) removeFeed(tokens []TopicToken, only *Feed) *Feed {
+	path := make([]*node, 0, len(tokens)+1)
 	curr := m.root
+	path = append(path, curr)
 	for _, token := range tokens {
-		next, present := curr.children[token.Value]
+		next, present := curr.child(token.Value)
 		if !present {
 			return nil
 		}
 		curr = next
+		path = append(path, curr)
+	}
+	feed := curr.getFeed()
+	if feed == nil || (only != nil && feed != only) {
+		return nil
 	}
-	feed := curr.feed
-	curr.feed = nil // GC
+	curr.setFeed(nil) // GC
+	atomic.AddInt64(m.nFeeds, -1)
 
+	// prune nodes that are no longer needed, from the leaf upwards.
+	// Readers that are already past a pruned node simply see it empty
+	for i := len(tokens); i > 0; i-- {
+		n := path[i]
+		if n.getFeed() != nil || n.nChildren > 0 {
+			break
+		}
+		path[i-1].deleteChild(tokens[i-1].Value)
+	}
 	return feed
 }
 
+// SubscribeByTopic subscribes ch to the feed for the given topic filter,
+// instantiating the feed if need be. Unlike calling InitFeedByTopic then
+// Feed.Subscribe, the feed can't be removed by a concurrent
+// UnsubscribeByTopic in between
+func (m TopicMap) SubscribeByTopic(topic string, tokens []TopicToken, ch chan<- PublishEvent) *Subscription {
+	m.writeLock.Lock()
+	defer m.writeLock.Unlock()
+
+	feed, _ := m.initFeed(topic, tokens)
+	return feed.Subscribe(ch)
+}
+
+// UnsubscribeByTopic unsubscribes sub, which should have been obtained
+// via SubscribeByTopic with the same tokens. Once the feed has no more
+// subscribers, it's removed and the tree pruned so that topics which
+// come and go don't leak nodes
+func (m TopicMap) UnsubscribeByTopic(sub *Subscription, tokens []TopicToken) {
+	// unsubscribing might have to wait for an ongoing publish hence
+	// done without holding the lock
+	sub.Unsubscribe()
+
+	m.writeLock.Lock()
+	defer m.writeLock.Unlock()
+	if sub.feed.NumSubscribers() == 0 {
+		m.removeFeed(tokens, sub.feed)
+	}
+}
+
+// NumFeeds returns the number of feeds currently held
+func (m TopicMap) NumFeeds() int {
+	return int(atomic.LoadInt64(m.nFeeds))
+}
+
 // GetFeedsThatMatchTopic The given topic should be an exact topic match, ie,
 // it should not have any wildcards. For use mainly when a publish packet
 // arrives and one needs to check whether a subscriber qualifies to receive
@@ -120,47 +274,63 @@ func (m TopicMap) RemoveFeedByTopic(topic string, tokens []TopicToken) *Feed {
 // helper function ParseTopicName to check for possible errors and retrieve
 // valid tokens
 func (m TopicMap) GetFeedsThatMatchTopic(topicTokens []TopicToken) []*Feed {
-	// lock for reading
-	m.rwLock.RLock()
-	defer m.rwLock.RUnlock()
-
-	// find matching wildcard topics
-	feeds := findFeedsThatMatchTopic(0, topicTokens, m.root, make([]*Feed, 0, 10))
+	return m.AppendFeedsThatMatchTopic(make([]*Feed, 0, 10), topicTokens)
+}
 
-	return feeds
+// AppendFeedsThatMatchTopic is similar to GetFeedsThatMatchTopic but appends
+// the matching feeds to feeds and returns the extended slice. Callers on hot
+// paths can reuse the slice across calls so that matching doesn't allocate
+func (m TopicMap) AppendFeedsThatMatchTopic(feeds []*Feed, topicTokens []TopicToken) []*Feed {
+	if IsReservedTopic(topicTokens) {
+		// as per the spec, filters starting with a wildcard
+		// don't match topics starting with $
+		if v, ok := m.root.child(topicTokens[0].Value); ok {
+			feeds = findFeedsThatMatchTopicAfterLevel(0, topicTokens, v, feeds)
+		}
+		return feeds
+	}
+	return findFeedsThatMatchTopic(0, topicTokens, m.root, feeds)
 }
 
 func findFeedsThatMatchTopic(level int, tokens []TopicToken, curr *node, feeds []*Feed) []*Feed {
 	// first check single level matches
-	matches := [2]string{tokens[0].Value, "+"}
-	for _, m := range matches {
-		if v, ok := curr.children[m]; ok {
-
-			// last token
-			if len(tokens) == 1 {
-				if v.feed != nil {
-					feeds = append(feeds, v.feed)
-				}
-				// # matches parent level too
-				if vp, ok := v.children["#"]; ok && vp.feed != nil {
-					feeds = append(feeds, vp.feed)
-				}
-				continue
-			}
-
-			// more remaining tokens
-			feeds = findFeedsThatMatchTopic(level+1, tokens[1:], v, feeds)
-
-		}
+	if v, ok := curr.child(tokens[0].Value); ok {
+		feeds = findFeedsThatMatchTopicAfterLevel(level, tokens, v, feeds)
+	}
+	if v, ok := loadNode(&curr.plus); ok {
+		feeds = findFeedsThatMatchTopicAfterLevel(level, tokens, v, feeds)
 	}
 
 	// check multi-level matches
-	if v, ok := curr.children["#"]; ok && v.feed != nil {
-		feeds = append(feeds, v.feed)
+	if v, ok := loadNode(&curr.hash); ok {
+		if feed := v.getFeed(); feed != nil {
+			feeds = append(feeds, feed)
+		}
 	}
 	return feeds
 }
 
+// findFeedsThatMatchTopicAfterLevel collects the feeds under v given
+// that v matched tokens[0]
+func findFeedsThatMatchTopicAfterLevel(level int, tokens []TopicToken, v *node, feeds []*Feed) []*Feed {
+	// last token
+	if len(tokens) == 1 {
+		if feed := v.getFeed(); feed != nil {
+			feeds = append(feeds, feed)
+		}
+		// # matches parent level too
+		if vp, ok := loadNode(&v.hash); ok {
+			if feed := vp.getFeed(); feed != nil {
+				feeds = append(feeds, feed)
+			}
+		}
+		return feeds
+	}
+
+	// more remaining tokens
+	return findFeedsThatMatchTopic(level+1, tokens[1:], v, feeds)
+}
+
 func printStr(level int, str string) {
 	for i := 0; i < level; i++ {
 		fmt.Print("   ")
@@ -193,11 +363,62 @@ func printFeeds(level int, prefix string, fs []*Feed) {
 	fmt.Print("\n")
 }
 
-// TraverseAll .For debugging mostly
+// TopicFilterInfo holds a snapshot of a single topic filter held in
+// the TopicMap
+type TopicFilterInfo struct {
+	Filter      string
+	Subscribers int
+	Depth       int // number of levels in the filter
+}
+
+// Filters returns a snapshot of all the topic filters that currently
+// have a feed, sorted by filter. The snapshot is a copy hence it's safe
+// to use after the call returns
+func (m TopicMap) Filters() []TopicFilterInfo {
+	var filters []TopicFilterInfo
+	m.TraverseAll(func(level int, n *node) {
+		if feed := n.getFeed(); feed != nil {
+			filters = append(filters, TopicFilterInfo{
+				Filter:      feed.topic,
+				Subscribers: feed.NumSubscribers(),
+				Depth:       level,
+			})
+		}
+	})
+	sort.Slice(filters, func(i, j int) bool { return filters[i].Filter < filters[j].Filter })
+	return filters
+}
+
+// TopicMapStats holds a snapshot of the shape of the topic tree
+type TopicMapStats struct {
+	Nodes    int // excluding the root
+	Feeds    int
+	MaxDepth int
+}
+
+// Stats returns a snapshot of the size of the topic tree
+func (m TopicMap) Stats() TopicMapStats {
+	var stats TopicMapStats
+	m.TraverseAll(func(level int, n *node) {
+		if level == 0 {
+			return
+		}
+		stats.Nodes++
+		if n.getFeed() != nil {
+			stats.Feeds++
+		}
+		if level > stats.MaxDepth {
+			stats.MaxDepth = level
+		}
+	})
+	return stats
+}
+
+// TraverseAll .For debugging mostly. Writes are blocked for the duration
+// so that fn sees a consistent tree, fn should not modify the TopicMap
 func (m TopicMap) TraverseAll(fn func(int, *node)) {
-	// lock for reading
-	m.rwLock.RLock()
-	defer m.rwLock.RUnlock()
+	m.writeLock.Lock()
+	defer m.writeLock.Unlock()
 
 	traverseAll(0, m.root, fn)
 }
@@ -205,7 +426,7 @@ func (m TopicMap) TraverseAll(fn func(int, *node)) {
 func traverseAll(level int, n *node, fn func(int, *node)) {
 	fn(level, n)
 
-	for _, cn := range n.children {
+	n.rangeChildren(func(cn *node) {
 		traverseAll(level+1, cn, fn)
-	}
+	})
 }
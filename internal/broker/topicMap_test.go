@@ -4,10 +4,14 @@ import (
 	"context"
 	"fmt"
 	"math/rand"
+	"reflect"
 	"strings"
 	"sync"
 	"testing"
+	"testing/quick"
 
+	hm "github.com/cornelk/hashmap"
+	"github.com/nagamocha3000/go-mqtt-broker/topic"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -122,6 +126,9 @@ func generateRandomTopics(n int) []string {
 
 	for len(topics) != n {
 		topic := genRandTopic(rand.Intn(15))
+		if topic == "" { // empty topics are invalid
+			continue
+		}
 		if _, alreadyAdded := topicsSet[topic]; alreadyAdded {
 			continue
 		}
@@ -321,3 +328,605 @@ func TestTopicMap_GetFeedsThatMatchTopic_AllPermutations(t *testing.T) {
 
 	wg.Wait()
 }
+
+func mustParseTopic(t *testing.T, topic string) []TopicToken {
+	tokens, _, err := ParseTopic([]byte(topic))
+	require.NoError(t, err)
+	return tokens
+}
+
+func TestTopicMapRemoveFeedPrunesEmptyNodes(t *testing.T) {
+	m := NewTopicMap()
+	for _, topic := range []string{"a/b/c/d", "a/b", "a/+/c/#"} {
+		m.InitFeedByTopic(topic, mustParseTopic(t, topic))
+	}
+	require.Equal(t, TopicMapStats{Nodes: 7, Feeds: 3, MaxDepth: 4}, m.Stats())
+
+	// removing a feed whose node still has children prunes nothing
+	require.NotNil(t, m.RemoveFeedByTopic("a/b", mustParseTopic(t, "a/b")))
+	require.Equal(t, TopicMapStats{Nodes: 7, Feeds: 2, MaxDepth: 4}, m.Stats())
+
+	// d, c then b are pruned, a is still needed for a/+/c/#
+	require.NotNil(t, m.RemoveFeedByTopic("a/b/c/d", mustParseTopic(t, "a/b/c/d")))
+	require.Equal(t, TopicMapStats{Nodes: 4, Feeds: 1, MaxDepth: 4}, m.Stats())
+
+	// absent feeds
+	require.Nil(t, m.RemoveFeedByTopic("a/b", mustParseTopic(t, "a/b")))
+	require.Nil(t, m.RemoveFeedByTopic("x/y", mustParseTopic(t, "x/y")))
+
+	// tree is empty once the last feed is removed
+	require.NotNil(t, m.RemoveFeedByTopic("a/+/c/#", mustParseTopic(t, "a/+/c/#")))
+	require.Equal(t, TopicMapStats{}, m.Stats())
+	require.Equal(t, 0, m.NumFeeds())
+	require.Equal(t, 0, m.root.nChildren)
+}
+
+func TestTopicMapFilters(t *testing.T) {
+	m := NewTopicMap()
+	ch := make(chan PublishEvent)
+	m.SubscribeByTopic("a/+", mustParseTopic(t, "a/+"), ch)
+	m.SubscribeByTopic("a/+", mustParseTopic(t, "a/+"), ch)
+	m.SubscribeByTopic("#", mustParseTopic(t, "#"), ch)
+	m.InitFeedByTopic("a/b/c", mustParseTopic(t, "a/b/c"))
+
+	filters := m.Filters()
+	require.Equal(t, []TopicFilterInfo{
+		{Filter: "#", Subscribers: 1, Depth: 1},
+		{Filter: "a/+", Subscribers: 2, Depth: 2},
+		{Filter: "a/b/c", Subscribers: 0, Depth: 3},
+	}, filters)
+
+	// snapshot is unaffected by later changes
+	m.RemoveFeedByTopic("#", mustParseTopic(t, "#"))
+	require.Len(t, filters, 3)
+	require.Len(t, m.Filters(), 2)
+}
+
+func TestTopicMapUnsubscribeByTopicRemovesFeedOnLastSubscriber(t *testing.T) {
+	m := NewTopicMap()
+	tokens := mustParseTopic(t, "devices/d1/status")
+	ch := make(chan PublishEvent)
+	sub1 := m.SubscribeByTopic("devices/d1/status", tokens, ch)
+	sub2 := m.SubscribeByTopic("devices/d1/status", tokens, ch)
+
+	m.UnsubscribeByTopic(sub1, tokens)
+	require.Equal(t, 1, m.NumFeeds())
+
+	m.UnsubscribeByTopic(sub2, tokens)
+	require.Equal(t, 0, m.NumFeeds())
+	require.Equal(t, TopicMapStats{}, m.Stats())
+}
+
+func TestTopicMapConcurrentSubscribeUnsubscribe(t *testing.T) {
+	// per-session topics come and go concurrently, once all
+	// subscribers are gone the tree should be empty
+	m := NewTopicMap()
+	const nGoroutines = 8
+	const nIterations = 500
+	var wg sync.WaitGroup
+	wg.Add(nGoroutines)
+	for g := 0; g < nGoroutines; g++ {
+		go func(g int) {
+			defer wg.Done()
+			ch := make(chan PublishEvent)
+			for i := 0; i < nIterations; i++ {
+				// some topics are shared across goroutines
+				topic := fmt.Sprintf("sessions/%d/inbox", i%(g+1))
+				tokens, _, _ := ParseTopic([]byte(topic))
+				sub := m.SubscribeByTopic(topic, tokens, ch)
+				m.UnsubscribeByTopic(sub, tokens)
+			}
+		}(g)
+	}
+	wg.Wait()
+	require.Equal(t, 0, m.NumFeeds())
+	require.Equal(t, TopicMapStats{}, m.Stats())
+}
+
+// matching examples from section 4.7 of the MQTT 3.1.1 spec
+var specMatchingCases = []struct {
+	filter  string
+	topic   string
+	matches bool
+}{
+	// 4.7.1.2 multi-level wildcard
+	{"sport/tennis/player1/#", "sport/tennis/player1", true},
+	{"sport/tennis/player1/#", "sport/tennis/player1/ranking", true},
+	{"sport/tennis/player1/#", "sport/tennis/player1/score/wimbledon", true},
+	{"sport/#", "sport", true},
+	{"#", "sport/tennis/player1", true},
+
+	// 4.7.1.3 single level wildcard
+	{"sport/tennis/+", "sport/tennis/player1", true},
+	{"sport/tennis/+", "sport/tennis/player2", true},
+	{"sport/tennis/+", "sport/tennis/player1/ranking", false},
+	{"sport/+", "sport", false},
+	{"sport/+", "sport/", true},
+	{"+/+", "/finance", true},
+	{"/+", "/finance", true},
+	{"+", "/finance", false},
+	{"+/tennis/#", "sport/tennis/player1", true},
+	{"sport/+/player1", "sport/tennis/player1", true},
+
+	// 4.7.2 topics beginning with $
+	{"#", "$SYS/broker/clients", false},
+	{"#", "$SYS", false},
+	{"+", "$SYS", false},
+	{"+/monitor/Clients", "$SYS/monitor/Clients", false},
+	{"+/#", "$SYS/monitor/Clients", false},
+	{"$SYS/#", "$SYS/monitor/Clients", true},
+	{"$SYS/#", "$SYS", true},
+	{"$SYS/monitor/+", "$SYS/monitor/Clients", true},
+	{"$SYS/monitor/Clients", "$SYS/monitor/Clients", true},
+	{"+/SYS", "a$/SYS", true}, // only a leading $ is reserved
+	{"a/#", "a/$SYS", true},
+
+	// 4.7.3 topic semantic and usage
+	{"ACCOUNTS", "Accounts", false},
+	{"Accounts payable", "Accounts payable", true},
+	{"/finance", "finance", false},
+	{"finance", "/finance", false},
+	{"/", "/", true},
+}
+
+func TestTopicMatchingSpecExamples(t *testing.T) {
+	for _, cs := range specMatchingCases {
+		name := fmt.Sprintf("%s matches %s", cs.filter, cs.topic)
+		t.Run(name, func(t *testing.T) {
+			filter := mustParseTopic(t, cs.filter)
+			topic, hasWildcard, err := ParseTopic([]byte(cs.topic))
+			require.NoError(t, err)
+			require.False(t, hasWildcard)
+
+			require.Equal(t, cs.matches, topicMatchesFilter(filter, topic))
+
+			m := NewTopicMap()
+			feed, _ := m.InitFeedByTopic(cs.filter, filter)
+			feeds := m.GetFeedsThatMatchTopic(topic)
+			if cs.matches {
+				require.Equal(t, []*Feed{feed}, feeds)
+			} else {
+				require.Empty(t, feeds)
+			}
+		})
+	}
+}
+
+func TestIsReservedTopic(t *testing.T) {
+	require.True(t, IsReservedTopic(mustParseTopic(t, "$SYS/broker")))
+	require.True(t, IsReservedTopic(mustParseTopic(t, "$")))
+	require.False(t, IsReservedTopic(mustParseTopic(t, "SYS/$broker")))
+	require.False(t, IsReservedTopic(mustParseTopic(t, "+/broker")))
+	require.False(t, IsReservedTopic(mustParseTopic(t, "/$SYS")))
+}
+
+// rwMutexTopicMap is TopicMap as it was before matching was made
+// lock-free: the trie is guarded by a single RWMutex, and a hashmap of
+// the filters held lets InitFeedByTopic skip the lock when the feed
+// exists. It's kept as the baseline for the benchmarks below
+type rwMutexTopicMap struct {
+	root        *rwMutexNode
+	rwLock      sync.RWMutex
+	topicToFeed *hm.HashMap
+}
+
+type rwMutexNode struct {
+	children map[string]*rwMutexNode
+	feed     *Feed
+}
+
+func newRWMutexTopicMap() *rwMutexTopicMap {
+	return &rwMutexTopicMap{
+		root:        &rwMutexNode{children: make(map[string]*rwMutexNode)},
+		topicToFeed: &hm.HashMap{},
+	}
+}
+
+func (m *rwMutexTopicMap) InitFeedByTopic(topic string, tokens []TopicToken) (*Feed, bool) {
+	if feed, alreadyPresent := m.topicToFeed.Get(topic); alreadyPresent {
+		return feed.(*Feed), alreadyPresent
+	}
+	m.rwLock.Lock()
+	defer m.rwLock.Unlock()
+	curr := m.root
+	for _, token := range tokens {
+		next, present := curr.children[token.Value]
+		if !present {
+			next = &rwMutexNode{children: make(map[string]*rwMutexNode)}
+			curr.children[token.Value] = next
+		}
+		curr = next
+	}
+	if curr.feed == nil {
+		feed := NewFeed(topic)
+		curr.feed = feed
+		m.topicToFeed.Set(topic, feed)
+		return feed, false
+	}
+	return curr.feed, true
+}
+
+func (m *rwMutexTopicMap) RemoveFeedByTopic(topic string, tokens []TopicToken) *Feed {
+	m.rwLock.Lock()
+	defer m.rwLock.Unlock()
+	path := make([]*rwMutexNode, 0, len(tokens)+1)
+	curr := m.root
+	path = append(path, curr)
+	for _, token := range tokens {
+		next, present := curr.children[token.Value]
+		if !present {
+			return nil
+		}
+		curr = next
+		path = append(path, curr)
+	}
+	feed := curr.feed
+	if feed == nil {
+		return nil
+	}
+	curr.feed = nil
+	m.topicToFeed.Del(topic)
+	for i := len(tokens); i > 0; i-- {
+		n := path[i]
+		if n.feed != nil || len(n.children) > 0 {
+			break
+		}
+		delete(path[i-1].children, tokens[i-1].Value)
+	}
+	return feed
+}
+
+func (m *rwMutexTopicMap) GetFeedsThatMatchTopic(topicTokens []TopicToken) []*Feed {
+	m.rwLock.RLock()
+	defer m.rwLock.RUnlock()
+	feeds := make([]*Feed, 0, 10)
+	if IsReservedTopic(topicTokens) {
+		if v, ok := m.root.children[topicTokens[0].Value]; ok {
+			feeds = rwMutexFindFeedsAfterLevel(topicTokens, v, feeds)
+		}
+		return feeds
+	}
+	return rwMutexFindFeeds(topicTokens, m.root, feeds)
+}
+
+func rwMutexFindFeeds(tokens []TopicToken, curr *rwMutexNode, feeds []*Feed) []*Feed {
+	matches := [2]string{tokens[0].Value, "+"}
+	for _, m := range matches {
+		if v, ok := curr.children[m]; ok {
+			feeds = rwMutexFindFeedsAfterLevel(tokens, v, feeds)
+		}
+	}
+	if v, ok := curr.children["#"]; ok && v.feed != nil {
+		feeds = append(feeds, v.feed)
+	}
+	return feeds
+}
+
+func rwMutexFindFeedsAfterLevel(tokens []TopicToken, v *rwMutexNode, feeds []*Feed) []*Feed {
+	if len(tokens) == 1 {
+		if v.feed != nil {
+			feeds = append(feeds, v.feed)
+		}
+		if vp, ok := v.children["#"]; ok && vp.feed != nil {
+			feeds = append(feeds, vp.feed)
+		}
+		return feeds
+	}
+	return rwMutexFindFeeds(tokens[1:], v, feeds)
+}
+
+// benchTopicMap is implemented by both TopicMap, which keeps each node's
+// children in a sync.Map, and the baseline rwMutexTopicMap
+type benchTopicMap interface {
+	init(topic string, tokens []TopicToken)
+	remove(topic string, tokens []TopicToken)
+	match(buf []*Feed, tokens []TopicToken) []*Feed
+}
+
+type benchSyncMapTopicMap struct{ TopicMap }
+
+func (m benchSyncMapTopicMap) init(topic string, tokens []TopicToken) {
+	m.InitFeedByTopic(topic, tokens)
+}
+
+func (m benchSyncMapTopicMap) remove(topic string, tokens []TopicToken) {
+	m.RemoveFeedByTopic(topic, tokens)
+}
+
+func (m benchSyncMapTopicMap) match(buf []*Feed, tokens []TopicToken) []*Feed {
+	return m.AppendFeedsThatMatchTopic(buf[:0], tokens)
+}
+
+type benchRWMutexTopicMap struct{ *rwMutexTopicMap }
+
+func (m benchRWMutexTopicMap) init(topic string, tokens []TopicToken) {
+	m.InitFeedByTopic(topic, tokens)
+}
+
+func (m benchRWMutexTopicMap) remove(topic string, tokens []TopicToken) {
+	m.RemoveFeedByTopic(topic, tokens)
+}
+
+func (m benchRWMutexTopicMap) match(_ []*Feed, tokens []TopicToken) []*Feed {
+	return m.GetFeedsThatMatchTopic(tokens)
+}
+
+// benchFilters returns n unique filters, a fifth of which are exact
+// and the rest use wildcards at various levels, plus a few catch-all
+// filters that match most topics
+func benchFilters(n int) []string {
+	filters := []string{"#", "+/+/+", "+/+/+/#"}
+	for i := 0; i < n; i++ {
+		a, b, c := i%100, (i/100)%1000, i/100000
+		var filter string
+		switch i % 5 {
+		case 0:
+			filter = fmt.Sprintf("t%d/d%d/s%d", a, b, c)
+		case 1:
+			filter = fmt.Sprintf("t%d/d%d/s%d/+", a, b, c)
+		case 2:
+			filter = fmt.Sprintf("t%d/+/d%d/s%d", a, b, c)
+		case 3:
+			filter = fmt.Sprintf("t%d/d%d/s%d/#", a, b, c)
+		case 4:
+			filter = fmt.Sprintf("+/t%d/d%d/s%d/#", a, b, c)
+		}
+		filters = append(filters, filter)
+	}
+	return filters
+}
+
+// benchTopics returns topic names that match a handful of filters each
+func benchTopics(n int) [][]TopicToken {
+	r := rand.New(rand.NewSource(1))
+	topics := make([][]TopicToken, 0, 1024)
+	for i := 0; i < cap(topics); i++ {
+		a, b, c := r.Intn(100), r.Intn(1000), r.Intn(n/100000+1)
+		var topic string
+		switch i % 3 {
+		case 0:
+			topic = fmt.Sprintf("t%d/d%d/s%d", a, b, c)
+		case 1:
+			topic = fmt.Sprintf("t%d/d%d/s%d/x", a, b, c)
+		case 2:
+			topic = fmt.Sprintf("t%d/x/d%d/s%d", a, b, c)
+		}
+		tokens, _, _ := ParseTopic([]byte(topic))
+		topics = append(topics, tokens)
+	}
+	return topics
+}
+
+var benchMaps struct {
+	once    sync.Once
+	n       int
+	syncMap benchTopicMap
+	rwMutex benchTopicMap
+	topics  [][]TopicToken
+}
+
+// loadBenchMaps builds both topic maps with 50k filters once, since
+// building them dominates the benchmarks' run time. Inserting into the
+// baseline's hashmap slows down faster than linearly as it grows, so
+// much larger maps take too long to build
+func loadBenchMaps(b *testing.B) {
+	benchMaps.once.Do(func() {
+		benchMaps.n = 50000
+		if testing.Short() {
+			benchMaps.n = 10000
+		}
+		syncMap := NewTopicMap()
+		rwMutex := newRWMutexTopicMap()
+		for _, filter := range benchFilters(benchMaps.n) {
+			tokens, _, err := ParseTopic([]byte(filter))
+			if err != nil {
+				panic(err)
+			}
+			syncMap.InitFeedByTopic(filter, tokens)
+			rwMutex.InitFeedByTopic(filter, tokens)
+		}
+		benchMaps.syncMap = benchSyncMapTopicMap{syncMap}
+		benchMaps.rwMutex = benchRWMutexTopicMap{rwMutex}
+		benchMaps.topics = benchTopics(benchMaps.n)
+	})
+	b.ResetTimer()
+}
+
+func benchmarkMatch(b *testing.B, m benchTopicMap, churn bool) {
+	if churn {
+		// per-session topics constantly come and go
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			for i := 0; ; i++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				topic := fmt.Sprintf("sessions/%d/inbox/+", i%1000)
+				tokens, _, _ := ParseTopic([]byte(topic))
+				m.init(topic, tokens)
+				m.remove(topic, tokens)
+			}
+		}()
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		buf := make([]*Feed, 0, 16)
+		i := rand.Intn(len(benchMaps.topics))
+		for pb.Next() {
+			buf = m.match(buf, benchMaps.topics[i%len(benchMaps.topics)])
+			if len(buf) == 0 {
+				panic("expected catch-all filters to match")
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkTopicMapMatch(b *testing.B) {
+	b.Run("syncmap", func(b *testing.B) {
+		loadBenchMaps(b)
+		benchmarkMatch(b, benchMaps.syncMap, false)
+	})
+	b.Run("rwmutex", func(b *testing.B) {
+		loadBenchMaps(b)
+		benchmarkMatch(b, benchMaps.rwMutex, false)
+	})
+}
+
+func BenchmarkTopicMapMatchWithChurn(b *testing.B) {
+	b.Run("syncmap", func(b *testing.B) {
+		loadBenchMaps(b)
+		benchmarkMatch(b, benchMaps.syncMap, true)
+	})
+	b.Run("rwmutex", func(b *testing.B) {
+		loadBenchMaps(b)
+		benchmarkMatch(b, benchMaps.rwMutex, true)
+	})
+}
+
+func BenchmarkTopicMapSubscribeUnsubscribe(b *testing.B) {
+	for _, impl := range []string{"syncmap", "rwmutex"} {
+		b.Run(impl, func(b *testing.B) {
+			loadBenchMaps(b)
+			m := benchMaps.syncMap
+			if impl == "rwmutex" {
+				m = benchMaps.rwMutex
+			}
+			tokens := make([][]TopicToken, 1000)
+			topics := make([]string, len(tokens))
+			for i := range tokens {
+				topics[i] = fmt.Sprintf("sessions/%d/inbox/+", i)
+				tokens[i], _, _ = ParseTopic([]byte(topics[i]))
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				j := i % len(tokens)
+				m.init(topics[j], tokens[j])
+				m.remove(topics[j], tokens[j])
+			}
+		})
+	}
+}
+
+func TestTopicMapMatchDuringWrites(t *testing.T) {
+	// matching is lock-free, a filter that's never removed should
+	// always be found regardless of concurrent writes around it
+	m := NewTopicMap()
+	stable, _ := m.InitFeedByTopic("a/+/c", mustParseTopic(t, "a/+/c"))
+	topic := mustParseTopic(t, "a/b/c")
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ch := make(chan PublishEvent)
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			for _, filter := range []string{"a/b/c", "a/b/#", "a/+/c/d", fmt.Sprintf("a/%d/c", i%10)} {
+				tokens, _, _ := ParseTopic([]byte(filter))
+				sub := m.SubscribeByTopic(filter, tokens, ch)
+				m.UnsubscribeByTopic(sub, tokens)
+			}
+		}
+	}()
+
+	buf := make([]*Feed, 0, 4)
+	for i := 0; i < 10000; i++ {
+		buf = m.AppendFeedsThatMatchTopic(buf[:0], topic)
+		// compare pointers only, the other feeds are being written to
+		found := false
+		for _, feed := range buf {
+			found = found || feed == stable
+		}
+		require.True(t, found)
+	}
+	close(done)
+	wg.Wait()
+	require.Equal(t, []*Feed{stable}, m.GetFeedsThatMatchTopic(topic))
+	require.Equal(t, 1, m.NumFeeds())
+}
+
+// randTopics holds random filters and names, generated from a handful
+// of levels so that they frequently match one another
+type randTopics struct {
+	filters []string
+	names   []string
+}
+
+func (randTopics) Generate(r *rand.Rand, size int) reflect.Value {
+	levels := []string{"a", "b", "", "$s"}
+	gen := func(wildcards bool) string {
+		n := 1 + r.Intn(4)
+		parts := make([]string, n)
+		for i := range parts {
+			parts[i] = levels[r.Intn(len(levels))]
+			if wildcards && r.Intn(4) == 0 {
+				parts[i] = "+"
+				if i == n-1 && r.Intn(2) == 0 {
+					parts[i] = "#"
+				}
+			}
+		}
+		if s := strings.Join(parts, "/"); s != "" {
+			return s
+		}
+		return "a"
+	}
+	var t randTopics
+	for i := 0; i < 1+r.Intn(20); i++ {
+		t.filters = append(t.filters, gen(true))
+	}
+	for i := 0; i < 20; i++ {
+		t.names = append(t.names, gen(false))
+	}
+	return reflect.ValueOf(t)
+}
+
+func TestTopicMapAgreesWithTopicMatch(t *testing.T) {
+	err := quick.Check(func(rt randTopics) bool {
+		m := NewTopicMap()
+		for _, filter := range rt.filters {
+			tokens, _, err := ParseTopic([]byte(filter))
+			if err != nil {
+				return false
+			}
+			m.InitFeedByTopic(filter, tokens)
+		}
+		for _, name := range rt.names {
+			tokens, _, err := ParseTopic([]byte(name))
+			if err != nil {
+				return false
+			}
+			matched := make(map[string]bool)
+			for _, feed := range m.GetFeedsThatMatchTopic(tokens) {
+				if matched[feed.Topic()] {
+					return false // each filter should be matched once
+				}
+				matched[feed.Topic()] = true
+			}
+			for _, filter := range rt.filters {
+				if topic.Match(filter, name) != matched[filter] {
+					t.Logf("filter %q, name %q: trie %v", filter, name, matched[filter])
+					return false
+				}
+				// retained messages are matched via topicMatchesFilter
+				filterTokens, _, _ := ParseTopic([]byte(filter))
+				if topicMatchesFilter(filterTokens, tokens) != matched[filter] {
+					return false
+				}
+			}
+		}
+		return true
+	}, &quick.Config{MaxCount: 1000})
+	require.NoError(t, err)
+}
@@ -0,0 +1,89 @@
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const timeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+func encodeJSON(sb *strings.Builder, ts time.Time, level Level, msg string, fieldSets ...[]Field) {
+	sb.WriteString(`{"time":`)
+	writeJSONString(sb, ts.Format(timeFormat))
+	sb.WriteString(`,"level":`)
+	writeJSONString(sb, level.String())
+	sb.WriteString(`,"msg":`)
+	writeJSONString(sb, msg)
+	for _, fields := range fieldSets {
+		for _, f := range fields {
+			sb.WriteByte(',')
+			writeJSONString(sb, f.Key)
+			sb.WriteByte(':')
+			writeJSONValue(sb, f.Value)
+		}
+	}
+	sb.WriteString("}\n")
+}
+
+func writeJSONString(sb *strings.Builder, s string) {
+	b, _ := json.Marshal(s)
+	sb.Write(b)
+}
+
+func writeJSONValue(sb *strings.Builder, v interface{}) {
+	switch val := v.(type) {
+	case nil:
+		sb.WriteString("null")
+	case string:
+		writeJSONString(sb, val)
+	case error:
+		writeJSONString(sb, val.Error())
+	case time.Duration:
+		writeJSONString(sb, val.String())
+	case fmt.Stringer:
+		writeJSONString(sb, val.String())
+	default:
+		b, err := json.Marshal(val)
+		if err != nil {
+			writeJSONString(sb, fmt.Sprint(val))
+			return
+		}
+		sb.Write(b)
+	}
+}
+
+func encodeConsole(sb *strings.Builder, ts time.Time, level Level, msg string, fieldSets ...[]Field) {
+	sb.WriteString(ts.Format(timeFormat))
+	sb.WriteByte(' ')
+	sb.WriteString(fmt.Sprintf("%-5s", strings.ToUpper(level.String())))
+	sb.WriteByte(' ')
+	sb.WriteString(msg)
+	for _, fields := range fieldSets {
+		for _, f := range fields {
+			sb.WriteByte(' ')
+			sb.WriteString(f.Key)
+			sb.WriteByte('=')
+			writeConsoleValue(sb, f.Value)
+		}
+	}
+	sb.WriteByte('\n')
+}
+
+func writeConsoleValue(sb *strings.Builder, v interface{}) {
+	var s string
+	switch val := v.(type) {
+	case nil:
+		s = "<nil>"
+	case error:
+		s = val.Error()
+	default:
+		s = fmt.Sprint(val)
+	}
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		s = strconv.Quote(s)
+	}
+	sb.WriteString(s)
+}
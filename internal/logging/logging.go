@@ -0,0 +1,175 @@
+// Package logging provides a small leveled, structured logger. Log entries
+// consist of a message plus key/value fields and can be written out either
+// as JSON (one object per line) or in a human friendly console format.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log entry
+type Level int8
+
+// DebugLevel etc, in increasing order of severity
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+)
+
+func (l Level) String() string {
+	switch l {
+	case DebugLevel:
+		return "debug"
+	case InfoLevel:
+		return "info"
+	case WarnLevel:
+		return "warn"
+	case ErrorLevel:
+		return "error"
+	default:
+		return fmt.Sprintf("level(%d)", l)
+	}
+}
+
+// ParseLevel returns the Level matching the given name, eg "info"
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return DebugLevel, nil
+	case "info":
+		return InfoLevel, nil
+	case "warn", "warning":
+		return WarnLevel, nil
+	case "error":
+		return ErrorLevel, nil
+	}
+	return InfoLevel, fmt.Errorf("unknown log level: %q", s)
+}
+
+// Field is a single key/value pair attached to a log entry
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// F is shorthand for instantiating a Field
+func F(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+// Err returns a Field holding the given error under the "error" key
+func Err(err error) Field {
+	return Field{Key: "error", Value: err}
+}
+
+// Logger is implemented by all loggers. Fields passed to With are included
+// in every entry logged by the returned Logger, which makes it convenient to
+// derive a logger for a given client from a broker-wide one.
+type Logger interface {
+	Debug(msg string, fields ...Field)
+	Info(msg string, fields ...Field)
+	Warn(msg string, fields ...Field)
+	Error(msg string, fields ...Field)
+	With(fields ...Field) Logger
+}
+
+// Format indicates how log entries are encoded
+type Format int
+
+// JSONFormat writes each entry as a single line JSON object while
+// ConsoleFormat writes entries as human friendly text
+const (
+	JSONFormat Format = iota
+	ConsoleFormat
+)
+
+// ParseFormat returns the Format matching the given name, ie "json" or "console"
+func ParseFormat(s string) (Format, error) {
+	switch strings.ToLower(s) {
+	case "json":
+		return JSONFormat, nil
+	case "console", "text":
+		return ConsoleFormat, nil
+	}
+	return JSONFormat, fmt.Errorf("unknown log format: %q", s)
+}
+
+// output is shared by a logger and all loggers derived from it via With,
+// so that concurrent writes are serialized
+type output struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format Format
+	now    func() time.Time
+}
+
+type logger struct {
+	out    *output
+	level  Level
+	fields []Field
+}
+
+// New returns a Logger that writes entries at the given level and above
+// to w using the given format. It's safe for concurrent use
+func New(w io.Writer, format Format, level Level) Logger {
+	return &logger{
+		out: &output{
+			w:      w,
+			format: format,
+			now:    time.Now,
+		},
+		level: level,
+	}
+}
+
+func (l *logger) Debug(msg string, fields ...Field) { l.log(DebugLevel, msg, fields) }
+func (l *logger) Info(msg string, fields ...Field)  { l.log(InfoLevel, msg, fields) }
+func (l *logger) Warn(msg string, fields ...Field)  { l.log(WarnLevel, msg, fields) }
+func (l *logger) Error(msg string, fields ...Field) { l.log(ErrorLevel, msg, fields) }
+
+func (l *logger) With(fields ...Field) Logger {
+	combined := make([]Field, 0, len(l.fields)+len(fields))
+	combined = append(combined, l.fields...)
+	combined = append(combined, fields...)
+	return &logger{
+		out:    l.out,
+		level:  l.level,
+		fields: combined,
+	}
+}
+
+func (l *logger) log(level Level, msg string, fields []Field) {
+	if level < l.level {
+		return
+	}
+	var sb strings.Builder
+	ts := l.out.now()
+	switch l.out.format {
+	case ConsoleFormat:
+		encodeConsole(&sb, ts, level, msg, l.fields, fields)
+	default:
+		encodeJSON(&sb, ts, level, msg, l.fields, fields)
+	}
+	l.out.mu.Lock()
+	io.WriteString(l.out.w, sb.String())
+	l.out.mu.Unlock()
+}
+
+type nopLogger struct{}
+
+// Nop returns a Logger that discards everything
+func Nop() Logger {
+	return nopLogger{}
+}
+
+func (nopLogger) Debug(string, ...Field) {}
+func (nopLogger) Info(string, ...Field)  {}
+func (nopLogger) Warn(string, ...Field)  {}
+func (nopLogger) Error(string, ...Field) {}
+func (n nopLogger) With(...Field) Logger { return n }
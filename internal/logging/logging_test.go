@@ -0,0 +1,88 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestLogger(buf *bytes.Buffer, format Format, level Level) Logger {
+	l := New(buf, format, level).(*logger)
+	l.out.now = func() time.Time {
+		return time.Date(2020, 6, 1, 10, 30, 0, 0, time.UTC)
+	}
+	return l
+}
+
+func TestJSONLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := newTestLogger(&buf, JSONFormat, InfoLevel)
+	l = l.With(F("client_id", "abcde"))
+	l.Info("client connected", F("remote_addr", "127.0.0.1:1883"), F("keep_alive", 60))
+	l.Error("client disconnected", Err(errors.New("bad packet")))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+
+	var entry map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &entry))
+	require.Equal(t, map[string]interface{}{
+		"time":        "2020-06-01T10:30:00.000Z",
+		"level":       "info",
+		"msg":         "client connected",
+		"client_id":   "abcde",
+		"remote_addr": "127.0.0.1:1883",
+		"keep_alive":  float64(60),
+	}, entry)
+
+	entry = nil
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &entry))
+	require.Equal(t, "error", entry["level"])
+	require.Equal(t, "bad packet", entry["error"])
+	require.Equal(t, "abcde", entry["client_id"])
+}
+
+func TestConsoleLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := newTestLogger(&buf, ConsoleFormat, DebugLevel)
+	l.Debug("packet received", F("packet_type", "PINGREQ"), F("reason", "keep alive timeout"))
+	require.Equal(t,
+		"2020-06-01T10:30:00.000Z DEBUG packet received packet_type=PINGREQ reason=\"keep alive timeout\"\n",
+		buf.String())
+}
+
+func TestLoggerLevels(t *testing.T) {
+	var buf bytes.Buffer
+	l := newTestLogger(&buf, ConsoleFormat, WarnLevel)
+	l.Debug("a")
+	l.Info("b")
+	require.Equal(t, 0, buf.Len())
+	l.Warn("c")
+	l.With(F("k", "v")).Error("d")
+	require.Equal(t, 2, strings.Count(buf.String(), "\n"))
+
+	for _, name := range []string{"debug", "info", "warn", "error"} {
+		level, err := ParseLevel(name)
+		require.NoError(t, err)
+		require.Equal(t, name, level.String())
+	}
+	_, err := ParseLevel("verbose")
+	require.Error(t, err)
+}
+
+func TestLoggerWithDoesNotShareFields(t *testing.T) {
+	var buf bytes.Buffer
+	base := newTestLogger(&buf, ConsoleFormat, InfoLevel).With(F("a", 1))
+	l1 := base.With(F("b", 2))
+	l2 := base.With(F("c", 3))
+	l1.Info("one")
+	l2.Info("two")
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.True(t, strings.HasSuffix(lines[0], "one a=1 b=2"))
+	require.True(t, strings.HasSuffix(lines[1], "two a=1 c=3"))
+}
@@ -0,0 +1,196 @@
+// Package metrics provides a minimal set of metric types (counters, gauges
+// and histograms) plus a Registry that exposes them in the Prometheus text
+// exposition format. It only covers what the broker needs, hence avoids
+// pulling in the full Prometheus client library.
+package metrics
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Counter is a monotonically increasing value
+type Counter struct {
+	bits uint64 // float64 bits, accessed atomically
+}
+
+// Inc increments the counter by 1
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Add increments the counter by v which should not be negative
+func (c *Counter) Add(v float64) {
+	for {
+		old := atomic.LoadUint64(&c.bits)
+		next := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&c.bits, old, next) {
+			return
+		}
+	}
+}
+
+// Value returns the current value of the counter
+func (c *Counter) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&c.bits))
+}
+
+// Gauge is a value that can go up and down
+type Gauge struct {
+	bits uint64 // float64 bits, accessed atomically
+}
+
+// Set sets the gauge to v
+func (g *Gauge) Set(v float64) {
+	atomic.StoreUint64(&g.bits, math.Float64bits(v))
+}
+
+// Inc increments the gauge by 1
+func (g *Gauge) Inc() {
+	g.Add(1)
+}
+
+// Dec decrements the gauge by 1
+func (g *Gauge) Dec() {
+	g.Add(-1)
+}
+
+// Add adds v, which can be negative, to the gauge
+func (g *Gauge) Add(v float64) {
+	for {
+		old := atomic.LoadUint64(&g.bits)
+		next := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&g.bits, old, next) {
+			return
+		}
+	}
+}
+
+// Value returns the current value of the gauge
+func (g *Gauge) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&g.bits))
+}
+
+// DefBuckets are the default histogram buckets, in seconds. They're
+// tailored to measure latencies ranging from tens of microseconds to seconds
+var DefBuckets = []float64{.00001, .00005, .0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5}
+
+// Histogram counts observations into configurable buckets
+type Histogram struct {
+	mu      sync.Mutex
+	buckets []float64 // upper bounds, sorted
+	counts  []uint64  // non-cumulative count per bucket, last is +Inf
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	if len(buckets) == 0 {
+		buckets = DefBuckets
+	}
+	b := make([]float64, len(buckets))
+	copy(b, buckets)
+	sort.Float64s(b)
+	return &Histogram{
+		buckets: b,
+		counts:  make([]uint64, len(b)+1),
+	}
+}
+
+// Observe adds a single observation to the histogram
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+	h.mu.Lock()
+	h.counts[i]++
+	h.sum += v
+	h.count++
+	h.mu.Unlock()
+}
+
+// Count returns the number of observations made so far
+func (h *Histogram) Count() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.count
+}
+
+type histogramSnapshot struct {
+	buckets    []float64
+	cumulative []uint64
+	sum        float64
+	count      uint64
+}
+
+func (h *Histogram) snapshot() histogramSnapshot {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := histogramSnapshot{
+		buckets:    h.buckets,
+		cumulative: make([]uint64, len(h.counts)),
+		sum:        h.sum,
+		count:      h.count,
+	}
+	var total uint64
+	for i, c := range h.counts {
+		total += c
+		s.cumulative[i] = total
+	}
+	return s
+}
+
+// CounterVec is a set of counters partitioned by label values, eg
+// packets partitioned by type and direction
+type CounterVec struct {
+	labelNames []string
+	mu         sync.RWMutex
+	counters   map[string]*labeledCounter
+}
+
+type labeledCounter struct {
+	labelValues []string
+	counter     Counter
+}
+
+// With returns the counter for the given label values, which must be
+// given in the same order as the label names the vec was created with.
+// The counter is created if it doesn't exist yet
+func (v *CounterVec) With(labelValues ...string) *Counter {
+	if len(labelValues) != len(v.labelNames) {
+		panic("metrics: inconsistent label cardinality")
+	}
+	key := strings.Join(labelValues, "\xff")
+	v.mu.RLock()
+	lc, ok := v.counters[key]
+	v.mu.RUnlock()
+	if ok {
+		return &lc.counter
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if lc, ok = v.counters[key]; !ok {
+		values := make([]string, len(labelValues))
+		copy(values, labelValues)
+		lc = &labeledCounter{labelValues: values}
+		v.counters[key] = lc
+	}
+	return &lc.counter
+}
+
+func (v *CounterVec) sorted() []*labeledCounter {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	keys := make([]string, 0, len(v.counters))
+	for k := range v.counters {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	lcs := make([]*labeledCounter, len(keys))
+	for i, k := range keys {
+		lcs[i] = v.counters[k]
+	}
+	return lcs
+}
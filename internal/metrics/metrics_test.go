@@ -0,0 +1,98 @@
+package metrics
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistryWriteText(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("mqtt_test_total", "A test counter")
+	g := r.NewGauge("mqtt_test_gauge", "A test gauge")
+	r.NewGaugeFunc("mqtt_test_gauge_func", "A gauge\nfunc", func() float64 { return 42 })
+	v := r.NewCounterVec("mqtt_test_packets_total", "Packets by type", "type", "direction")
+	h := r.NewHistogram("mqtt_test_seconds", "A test histogram", []float64{0.1, 1})
+
+	c.Add(3)
+	g.Inc()
+	g.Inc()
+	g.Dec()
+	v.With("PUBLISH", "in").Inc()
+	v.With("PUBLISH", "in").Inc()
+	v.With("CONNACK", "out").Add(1)
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(5)
+
+	var buf bytes.Buffer
+	require.NoError(t, r.WriteText(&buf))
+	expected := `# HELP mqtt_test_gauge A test gauge
+# TYPE mqtt_test_gauge gauge
+mqtt_test_gauge 1
+# HELP mqtt_test_gauge_func A gauge\nfunc
+# TYPE mqtt_test_gauge_func gauge
+mqtt_test_gauge_func 42
+# HELP mqtt_test_packets_total Packets by type
+# TYPE mqtt_test_packets_total counter
+mqtt_test_packets_total{type="CONNACK",direction="out"} 1
+mqtt_test_packets_total{type="PUBLISH",direction="in"} 2
+# HELP mqtt_test_seconds A test histogram
+# TYPE mqtt_test_seconds histogram
+mqtt_test_seconds_bucket{le="0.1"} 1
+mqtt_test_seconds_bucket{le="1"} 2
+mqtt_test_seconds_bucket{le="+Inf"} 3
+mqtt_test_seconds_sum 5.55
+mqtt_test_seconds_count 3
+# HELP mqtt_test_total A test counter
+# TYPE mqtt_test_total counter
+mqtt_test_total 3
+`
+	require.Equal(t, expected, buf.String())
+}
+
+func TestRegistryDuplicateName(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("a", "")
+	require.Panics(t, func() { r.NewGauge("a", "") })
+}
+
+func TestConcurrentUpdates(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("c", "")
+	v := r.NewCounterVec("v", "", "k")
+	var wg sync.WaitGroup
+	const n = 100
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				c.Inc()
+				v.With("x").Inc()
+			}
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, float64(n*100), c.Value())
+	require.Equal(t, float64(n*100), v.With("x").Value())
+}
+
+func TestHandler(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("mqtt_test_total", "A test counter").Inc()
+	srv := httptest.NewServer(r.Handler())
+	defer srv.Close()
+
+	resp, err := srv.Client().Get(srv.URL)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Contains(t, resp.Header.Get("Content-Type"), "text/plain")
+	require.Contains(t, string(body), "mqtt_test_total 1\n")
+}
@@ -0,0 +1,187 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type metricType string
+
+const (
+	counterType   metricType = "counter"
+	gaugeType     metricType = "gauge"
+	histogramType metricType = "histogram"
+)
+
+// metric holds a single registered metric family. Exactly one
+// of the value fields is set
+type metric struct {
+	name, help string
+	typ        metricType
+
+	counter    *Counter
+	counterVec *CounterVec
+	gauge      *Gauge
+	valueFn    func() float64
+	histogram  *Histogram
+}
+
+// Registry holds a set of named metrics. It's safe for concurrent use
+type Registry struct {
+	mu      sync.Mutex
+	metrics map[string]*metric
+}
+
+// NewRegistry returns an empty registry
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]*metric)}
+}
+
+func (r *Registry) register(m *metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.metrics[m.name]; ok {
+		panic("metrics: duplicate metric name " + m.name)
+	}
+	r.metrics[m.name] = m
+}
+
+// NewCounter registers and returns a counter
+func (r *Registry) NewCounter(name, help string) *Counter {
+	c := &Counter{}
+	r.register(&metric{name: name, help: help, typ: counterType, counter: c})
+	return c
+}
+
+// NewCounterFunc registers a counter whose value is read by calling
+// fn on every scrape. fn should be safe for concurrent use
+func (r *Registry) NewCounterFunc(name, help string, fn func() float64) {
+	r.register(&metric{name: name, help: help, typ: counterType, valueFn: fn})
+}
+
+// NewCounterVec registers and returns a set of counters partitioned by
+// the given label names
+func (r *Registry) NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	v := &CounterVec{
+		labelNames: labelNames,
+		counters:   make(map[string]*labeledCounter),
+	}
+	r.register(&metric{name: name, help: help, typ: counterType, counterVec: v})
+	return v
+}
+
+// NewGauge registers and returns a gauge
+func (r *Registry) NewGauge(name, help string) *Gauge {
+	g := &Gauge{}
+	r.register(&metric{name: name, help: help, typ: gaugeType, gauge: g})
+	return g
+}
+
+// NewGaugeFunc registers a gauge whose value is read by calling fn on
+// every scrape. fn should be safe for concurrent use
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) {
+	r.register(&metric{name: name, help: help, typ: gaugeType, valueFn: fn})
+}
+
+// NewHistogram registers and returns a histogram with the given
+// bucket upper bounds. If none are given, DefBuckets are used
+func (r *Registry) NewHistogram(name, help string, buckets []float64) *Histogram {
+	h := newHistogram(buckets)
+	r.register(&metric{name: name, help: help, typ: histogramType, histogram: h})
+	return h
+}
+
+// WriteText writes out all registered metrics, sorted by name, in the
+// Prometheus text exposition format
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	ms := make([]*metric, 0, len(r.metrics))
+	for _, m := range r.metrics {
+		ms = append(ms, m)
+	}
+	r.mu.Unlock()
+	sort.Slice(ms, func(i, j int) bool { return ms[i].name < ms[j].name })
+
+	bw := bufio.NewWriter(w)
+	for _, m := range ms {
+		fmt.Fprintf(bw, "# HELP %s %s\n", m.name, escapeHelp(m.help))
+		fmt.Fprintf(bw, "# TYPE %s %s\n", m.name, m.typ)
+		switch {
+		case m.counter != nil:
+			writeSample(bw, m.name, "", m.counter.Value())
+		case m.gauge != nil:
+			writeSample(bw, m.name, "", m.gauge.Value())
+		case m.valueFn != nil:
+			writeSample(bw, m.name, "", m.valueFn())
+		case m.counterVec != nil:
+			for _, lc := range m.counterVec.sorted() {
+				writeSample(bw, m.name, labelPairs(m.counterVec.labelNames, lc.labelValues), lc.counter.Value())
+			}
+		case m.histogram != nil:
+			s := m.histogram.snapshot()
+			for i, upper := range s.buckets {
+				writeSample(bw, m.name+"_bucket", `le="`+formatFloat(upper)+`"`, float64(s.cumulative[i]))
+			}
+			writeSample(bw, m.name+"_bucket", `le="+Inf"`, float64(s.cumulative[len(s.buckets)]))
+			writeSample(bw, m.name+"_sum", "", s.sum)
+			writeSample(bw, m.name+"_count", "", float64(s.count))
+		}
+	}
+	return bw.Flush()
+}
+
+// Handler returns an http.Handler that serves the registry's metrics
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteText(w)
+	})
+}
+
+func writeSample(w io.Writer, name, labels string, v float64) {
+	if labels != "" {
+		fmt.Fprintf(w, "%s{%s} %s\n", name, labels, formatFloat(v))
+	} else {
+		fmt.Fprintf(w, "%s %s\n", name, formatFloat(v))
+	}
+}
+
+func labelPairs(names, values []string) string {
+	pairs := make([]string, len(names))
+	for i := range names {
+		pairs[i] = names[i] + `="` + escapeLabelValue(values[i]) + `"`
+	}
+	return strings.Join(pairs, ",")
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabelValue(s string) string {
+	return labelEscaper.Replace(s)
+}
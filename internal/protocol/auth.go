@@ -0,0 +1,46 @@
+package protocol
+
+/*
+	AUTH PACKET
+	MQTT 5 only, exchanged during enhanced authentication
+*/
+
+// AuthPacket holds the in-memory representation of an auth packet. The
+// authentication method and data are carried in its properties
+type AuthPacket struct {
+	ReasonCode ReasonCode
+	Properties *Properties
+}
+
+// Serialize serializes the contents of an auth packet into
+// a []byte buffer. Buffer should be of appropriate length
+// otherwise a ErrShortBuffer error is returned. If nil buffer
+// is provided, Serialize instantiates a buffer of required length
+// and returns it
+func (p *AuthPacket) Serialize(b []byte) ([]byte, error) {
+	return serializeReasonAndProperties(b, Auth, p.payloadLen(), p.ReasonCode, p.Properties)
+}
+
+func (p *AuthPacket) payloadLen() int {
+	return lenReasonAndProperties(p.ReasonCode, p.Properties, ProtocolLevel5)
+}
+
+// Len returns the total length in terms of bytes
+// that the auth packet takes
+func (p *AuthPacket) Len() int {
+	payloadLen := p.payloadLen()
+	return 1 + lenPayloadSizeField(payloadLen) + payloadLen
+}
+
+// DeserializeAuthPktPayload parses the contents of a bytes slice and returns
+// an AuthPacket as required.
+func DeserializeAuthPktPayload(f FixedHeader, p []byte) (*AuthPacket, error) {
+	if f.CtrlFlags != 0x00 {
+		return nil, ErrInvalidPacket
+	}
+	code, props, err := deserializeReasonAndProperties(Auth, p)
+	if err != nil {
+		return nil, err
+	}
+	return &AuthPacket{ReasonCode: code, Properties: props}, nil
+}
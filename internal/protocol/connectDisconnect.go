@@ -2,6 +2,7 @@ package protocol
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 )
 
@@ -12,6 +13,7 @@ import (
 // ConnectPacket holds the in-application deserialization
 // of a ConnectPacket
 type ConnectPacket struct {
+	ProtocolLevel    byte
 	usernamePresent  bool
 	passwordPresent  bool
 	WillRetain       bool
@@ -24,6 +26,9 @@ type ConnectPacket struct {
 	WillMessage      []byte
 	Username         []byte // ok
 	Password         []byte // ok
+	// Properties and WillProperties are only serialized under MQTT 5
+	Properties     *Properties
+	WillProperties *Properties
 }
 
 // ConnectPacketConfig is more of a necessary evil,
@@ -47,6 +52,11 @@ type ConnectPacketConfig struct {
 	WillTopic, WillMessage               []byte
 	WillQoS                              byte
 	WillRetain                           bool
+	// ProtocolLevel defaults to ProtocolLevel311 if unset
+	ProtocolLevel byte
+	// Properties and WillProperties are ignored unless ProtocolLevel is
+	// ProtocolLevel5
+	Properties, WillProperties *Properties
 }
 
 // NewConnectPacket instantiates a ConnectPacket based on the config object passed.
@@ -58,24 +68,39 @@ type ConnectPacketConfig struct {
 // The Will Flag is set iff both the cfg.WillTopic and cfg.WillMessage are
 // of nonzero length. If the WillQoS is invalid, ie not equal to 0x0, 0x1, 0x2
 // then an error is returned.
+// Under MQTT 5, a password can be set without a username and a client
+// identifier can be left for the broker to assign even if the session is
+// to be resumed.
 func NewConnectPacket(cfg *ConnectPacketConfig) (*ConnectPacket, error) {
 	// validate config
 	if cfg.WillQoS > 2 {
 		return nil, fmt.Errorf("Invalid QoS %d. Should be 0x0, 0x1 or 0x2", cfg.WillQoS)
 	}
-	if len(cfg.ClientIdentifier) == 0 && cfg.ShouldCleanSession == false {
+	p := new(ConnectPacket)
+	switch cfg.ProtocolLevel {
+	case 0:
+		p.ProtocolLevel = ProtocolLevel311
+	case ProtocolLevel31, ProtocolLevel311, ProtocolLevel5:
+		p.ProtocolLevel = cfg.ProtocolLevel
+	default:
+		return nil, fmt.Errorf("Unsupported protocol level %d", cfg.ProtocolLevel)
+	}
+	v5 := p.ProtocolLevel == ProtocolLevel5
+	if len(cfg.ClientIdentifier) == 0 && cfg.ShouldCleanSession == false && !v5 {
 		return nil, fmt.Errorf("If shouldCleanSession is set to false, then a client identifier must be provided")
 	}
-	p := new(ConnectPacket)
 	// setup username & password
 	p.ClientIdentifier = cfg.ClientIdentifier
 	if len(cfg.Username) > 0 {
 		p.usernamePresent = true
 		p.Username = cfg.Username
-		if len(cfg.Password) > 0 {
-			p.passwordPresent = true
-			p.Password = cfg.Password
-		}
+	}
+	if len(cfg.Password) > 0 && (p.usernamePresent || v5) {
+		p.passwordPresent = true
+		p.Password = cfg.Password
+	}
+	if v5 {
+		p.Properties = cfg.Properties
 	}
 
 	// setup will
@@ -85,6 +110,9 @@ func NewConnectPacket(cfg *ConnectPacketConfig) (*ConnectPacket, error) {
 		p.WillRetain = cfg.WillRetain
 		p.WillTopic = cfg.WillTopic
 		p.WillMessage = cfg.WillMessage
+		if v5 {
+			p.WillProperties = cfg.WillProperties
+		}
 	}
 
 	// setup other configurations
@@ -93,7 +121,43 @@ func NewConnectPacket(cfg *ConnectPacketConfig) (*ConnectPacket, error) {
 	return p, nil
 }
 
-var protocolVersion []byte = []byte{0, 4, 'M', 'Q', 'T', 'T', 0x04}
+// Protocol levels supported
+const (
+	ProtocolLevel31  byte = 3 // MQTT 3.1, protocol name MQIsdp
+	ProtocolLevel311 byte = 4 // MQTT 3.1.1, protocol name MQTT
+	ProtocolLevel5   byte = 5 // MQTT 5, protocol name MQTT
+)
+
+// MaxClientIdentifierLen31 is the maximum length of client identifiers
+// under MQTT 3.1. There's no such limit under 3.1.1
+const MaxClientIdentifierLen31 = 23
+
+// ErrUnacceptableProtocol is returned on deserializing a CONNECT packet
+// with a known protocol name but an unsupported protocol level. The
+// server should respond with ConnRefusedUnacceptableProtocol
+var ErrUnacceptableProtocol = errors.New("Unacceptable protocol level")
+
+var (
+	protocolName    = []byte("MQTT")
+	protocolName31  = []byte("MQIsdp")
+	protocolVersion = []byte{0, 4, 'M', 'Q', 'T', 'T', ProtocolLevel311}
+	// MQTT 5
+	protocolVersion5 = []byte{0, 4, 'M', 'Q', 'T', 'T', ProtocolLevel5}
+	// MQTT 3.1
+	protocolVersion31 = []byte{0, 6, 'M', 'Q', 'I', 's', 'd', 'p', ProtocolLevel31}
+)
+
+// protocolVersionBytes returns the protocol name and level as written
+// at the start of the variable header
+func (p *ConnectPacket) protocolVersionBytes() []byte {
+	switch p.ProtocolLevel {
+	case ProtocolLevel31:
+		return protocolVersion31
+	case ProtocolLevel5:
+		return protocolVersion5
+	}
+	return protocolVersion
+}
 
 // Serialize serializes the contents of a connect packet into
 // a []byte buffer. Buffer should be of appropriate length
@@ -115,17 +179,23 @@ func (p *ConnectPacket) Serialize(b []byte) ([]byte, error) {
 	buf := newWritableBuf(b)
 	buf.WriteByte(Connect<<4 | 0x0)
 	writePayloadSize(buf, uint32(p.payloadLen()))
-	// write protocol name + level version 3.11
-	buf.Write(protocolVersion)
+	// write protocol name + level
+	buf.Write(p.protocolVersionBytes())
 	// write connect flags
 	flags := p.getConnectFlagsByte()
 	buf.WriteByte(flags)
 	// write keep alive (msb then lsb)
 	buf.WriteByte(byte(p.KeepAlive >> 8))
 	buf.WriteByte(byte(p.KeepAlive))
+	if p.ProtocolLevel == ProtocolLevel5 {
+		buf.writeProperties(p.Properties)
+	}
 	// write payload
 	buf.writeMQTTStr(p.ClientIdentifier)
 	if p.WillFlag {
+		if p.ProtocolLevel == ProtocolLevel5 {
+			buf.writeProperties(p.WillProperties)
+		}
 		buf.writeMQTTStr(p.WillTopic)
 		buf.writeMQTTStr(p.WillMessage)
 	}
@@ -146,22 +216,35 @@ func DeserializeConnectPktPayload(f FixedHeader, p []byte) (*ConnectPacket, erro
 	if f.CtrlFlags != 0x00 {
 		return nil, ErrInvalidPacket
 	}
-	// payload must be at least 12 bytes to be valid
-	if len(p) < 12 {
+	// protocol name must be valid, the level must be supported
+	pr := &pktReader{from: p}
+	name := pr.readStr()
+	level := pr.readByte()
+	if pr.err != nil {
+		return nil, ErrInvalidPacket
+	}
+	switch {
+	case bytes.Equal(name, protocolName) && level == ProtocolLevel311:
+	case bytes.Equal(name, protocolName) && level == ProtocolLevel5:
+	case bytes.Equal(name, protocolName31) && level == ProtocolLevel31:
+	case bytes.Equal(name, protocolName) || bytes.Equal(name, protocolName31):
+		return nil, ErrUnacceptableProtocol
+	default:
 		return nil, ErrInvalidPacket
 	}
-	// protocol version must be valid
-	if !bytes.Equal(p[:7], protocolVersion) {
+	// rest of the variable header is 3 bytes, the payload at least 2
+	if len(p)-pr.i < 5 {
 		return nil, ErrInvalidPacket
 	}
-	flags := p[7]
+	flags := pr.readByte()
 	// reserved flag bit should not be set
 	if flags&0x01 != 0 {
 		return nil, ErrInvalidPacket
 	}
-	// password flag bit set iff username flag bit set
+	// password flag bit set iff username flag bit set, except under MQTT 5
+	v5 := level == ProtocolLevel5
 	usernamePresent, passwordPresent := (flags&0x80) == 0x80, (flags&0x40) == 0x40
-	if !usernamePresent && passwordPresent {
+	if !usernamePresent && passwordPresent && !v5 {
 		return nil, ErrInvalidPacket
 	}
 	// qos must be 0, 1 or 2
@@ -178,26 +261,33 @@ func DeserializeConnectPktPayload(f FixedHeader, p []byte) (*ConnectPacket, erro
 	}
 
 	pkt := &ConnectPacket{
+		ProtocolLevel:   level,
 		usernamePresent: usernamePresent,
 		passwordPresent: passwordPresent,
 		WillRetain:      willRetain,
 		WillQoS:         willQoS,
 		WillFlag:        willFlag,
 		CleanSession:    (flags & 0x02) == 0x02,
-		KeepAlive:       (uint16(p[8]) << 8) + uint16(p[9]),
+		KeepAlive:       pr.readUInt16(),
+	}
+	if v5 {
+		pkt.Properties = pr.readProperties(Connect)
 	}
 
-	pr := &pktReader{from: p, i: 10}
 	// get client identifier
 	pkt.ClientIdentifier = pr.readStr()
 
 	// if client sets cleanSession to false but does not
-	// provde a client ID, packet is invalid
-	if pkt.ClientIdentifier == nil && !pkt.CleanSession {
+	// provde a client ID, packet is invalid. Under MQTT 5
+	// it's up to the server whether to assign one
+	if pkt.ClientIdentifier == nil && !pkt.CleanSession && !v5 {
 		return nil, ErrInvalidPacket
 	}
 	// get will flag & will message
 	if pkt.WillFlag {
+		if v5 {
+			pkt.WillProperties = pr.readProperties(willProperties)
+		}
 		pkt.WillTopic = pr.readStr()
 		pkt.WillMessage = pr.readStr()
 	}
@@ -215,11 +305,11 @@ func DeserializeConnectPktPayload(f FixedHeader, p []byte) (*ConnectPacket, erro
 
 func (p *ConnectPacket) getConnectFlagsByte() byte {
 	var b byte = 0
-	if p.usernamePresent { // username & password present
+	if p.usernamePresent {
 		b = b | 0x80
-		if p.passwordPresent {
-			b = b | 0x40
-		}
+	}
+	if p.passwordPresent { // only without a username under MQTT 5
+		b = b | 0x40
 	}
 	if p.WillRetain {
 		b = b | 0x20
@@ -236,11 +326,17 @@ func (p *ConnectPacket) getConnectFlagsByte() byte {
 
 // PayloadLen returns length of payload, ie minus fixed header size
 func (p *ConnectPacket) payloadLen() int {
-	payloadLen := 10 + // variable Header
+	payloadLen := len(p.protocolVersionBytes()) + 3 + // variable Header
 		2 + len(p.ClientIdentifier)
 	if p.WillFlag {
 		payloadLen += 2 + len(p.WillTopic) + 2 + len(p.WillMessage)
 	}
+	if p.ProtocolLevel == ProtocolLevel5 {
+		payloadLen += lenPropertiesSection(p.Properties)
+		if p.WillFlag {
+			payloadLen += lenPropertiesSection(p.WillProperties)
+		}
+	}
 	if p.usernamePresent {
 		payloadLen += 2 + len(p.Username)
 	}
@@ -267,11 +363,15 @@ func (p *ConnectPacket) Len() int {
 type ConnackPacket struct {
 	Code           ConnectReturnCode
 	SessionPresent bool
+	// Properties are only serialized under MQTT 5
+	Properties *Properties
 }
 
 // ConnectReturnCode holds the return code for
 // when a broker responds to a client's connect
-// packet
+// packet. Under MQTT 5 it holds a ReasonCode, the
+// 3.1.1 codes are mapped to their MQTT 5 equivalents
+// on serializing and vice versa
 type ConnectReturnCode byte
 
 // ConnAccepted etc self-explanatory
@@ -298,14 +398,56 @@ func (code ConnectReturnCode) String() string {
 		return "The data in the user name or password is malformed"
 	case ConnRefusedNotAuthorized:
 		return "The Client is not authorized to connect"
-	default:
-		return "Reserved for future use"
 	}
+	if code >= 0x80 {
+		return ReasonCode(code).String()
+	}
+	return "Reserved for future use"
+}
+
+// reasonCode returns the MQTT 5 equivalent of a 3.1.1 return code
+func (code ConnectReturnCode) reasonCode() ReasonCode {
+	switch code {
+	case ConnRefusedUnacceptableProtocol:
+		return ReasonUnsupportedProtocolVersion
+	case ConnRefusedIdentifierRejected:
+		return ReasonClientIdentifierNotValid
+	case ConnRefusedServerUnavailable:
+		return ReasonServerUnavailable
+	case ConnRefusedBadUsernamePass:
+		return ReasonBadUserNameOrPassword
+	case ConnRefusedNotAuthorized:
+		return ReasonNotAuthorized
+	}
+	return ReasonCode(code)
+}
+
+// returnCode311 returns the closest 3.1.1 return code to an MQTT 5
+// reason code
+func (code ConnectReturnCode) returnCode311() ConnectReturnCode {
+	if code < 0x80 {
+		return code
+	}
+	switch ReasonCode(code) {
+	case ReasonUnsupportedProtocolVersion:
+		return ConnRefusedUnacceptableProtocol
+	case ReasonClientIdentifierNotValid:
+		return ConnRefusedIdentifierRejected
+	case ReasonBadUserNameOrPassword, ReasonBadAuthenticationMethod:
+		return ConnRefusedBadUsernamePass
+	case ReasonNotAuthorized, ReasonBanned:
+		return ConnRefusedNotAuthorized
+	}
+	return ConnRefusedServerUnavailable
 }
 
 // DeserializeConnackPktPayload parses the contents of a bytes slice and returns
 // a ConnackPacket as required.
 func DeserializeConnackPktPayload(f FixedHeader, p []byte) (*ConnackPacket, error) {
+	return deserializeConnack(f, p, ProtocolLevel311)
+}
+
+func deserializeConnack(f FixedHeader, p []byte, level byte) (*ConnackPacket, error) {
 	// check control flags are valid (reserved values)
 	if f.CtrlFlags != 0x00 {
 		return nil, ErrInvalidPacket
@@ -321,13 +463,27 @@ func DeserializeConnackPktPayload(f FixedHeader, p []byte) (*ConnackPacket, erro
 	}
 	// connect return code should not use reserved values
 	cr := p[1]
-	if cr > 5 {
-		return nil, ErrInvalidPacket
-	}
 	pkt := &ConnackPacket{
 		SessionPresent: (connAckFlags & 0x01) == 0x01,
 		Code:           ConnectReturnCode(cr),
 	}
+	if level != ProtocolLevel5 {
+		if cr > 5 {
+			return nil, ErrInvalidPacket
+		}
+		return pkt, nil
+	}
+	if !isValidReasonCode(Connack, ReasonCode(cr)) {
+		return nil, ErrInvalidPacket
+	}
+	pr := &pktReader{from: p, i: 2}
+	pkt.Properties = pr.readProperties(Connack)
+	if pr.err == nil && !pr.isReadComplete() {
+		pr.err = ErrInvalidPacket
+	}
+	if pr.err != nil {
+		return nil, pr.err
+	}
 	return pkt, nil
 }
 
@@ -350,10 +506,34 @@ func (p *ConnackPacket) Serialize(b []byte) ([]byte, error) {
 	} else {
 		b[2] = 0
 	}
-	b[3] = byte(p.Code)
+	b[3] = byte(p.Code.returnCode311())
 	return b[:4], nil
 }
 
+func (p *ConnackPacket) serializeLevel(b []byte, level byte) ([]byte, error) {
+	if level != ProtocolLevel5 {
+		return p.Serialize(b)
+	}
+	lenPkt := p.lenLevel(level)
+	if b == nil {
+		b = make([]byte, lenPkt)
+	}
+	if len(b) < lenPkt {
+		return nil, ErrShortBuffer
+	}
+	buf := newWritableBuf(b)
+	buf.WriteByte(Connack<<4 | 0x0)
+	writePayloadSize(buf, uint32(2+lenPropertiesSection(p.Properties)))
+	if p.SessionPresent {
+		buf.WriteByte(1)
+	} else {
+		buf.WriteByte(0)
+	}
+	buf.WriteByte(byte(p.Code.reasonCode()))
+	buf.writeProperties(p.Properties)
+	return b[:buf.bytesWritten()], nil
+}
+
 // Len returns the total length in terms of bytes
 // that the Connack packet takes
 func (p *ConnackPacket) Len() int {
@@ -361,6 +541,14 @@ func (p *ConnackPacket) Len() int {
 	return 4
 }
 
+func (p *ConnackPacket) lenLevel(level byte) int {
+	if level != ProtocolLevel5 {
+		return p.Len()
+	}
+	payloadLen := 2 + lenPropertiesSection(p.Properties)
+	return 1 + lenPayloadSizeField(payloadLen) + payloadLen
+}
+
 // ConnectionAccepted is a convenience method that allows the user, ie a
 // client to check whether their connection was accepted and if not, the
 // reason why
@@ -375,7 +563,12 @@ func (p *ConnackPacket) ConnectionAccepted() (ok bool, description string) {
 */
 
 // DisconnectPacket holds the in-memory representation of a disconnect packet
-type DisconnectPacket struct{}
+type DisconnectPacket struct {
+	// ReasonCode and Properties are only serialized under MQTT 5, either
+	// side may send a DISCONNECT
+	ReasonCode ReasonCode
+	Properties *Properties
+}
 
 // Serialize serializes the contents of a disconnect packet into
 // a []byte buffer. Buffer should be of appropriate length
@@ -383,6 +576,13 @@ type DisconnectPacket struct{}
 // is provided, Serialize instantiates a buffer of required length
 // and returns it
 func (p *DisconnectPacket) Serialize(b []byte) ([]byte, error) {
+	return p.serializeLevel(b, ProtocolLevel311)
+}
+
+func (p *DisconnectPacket) serializeLevel(b []byte, level byte) ([]byte, error) {
+	if payloadLen := p.payloadLen(level); payloadLen > 0 {
+		return serializeReasonAndProperties(b, Disconnect, payloadLen, p.ReasonCode, p.Properties)
+	}
 	if b == nil {
 		b = make([]byte, 2)
 	}
@@ -394,13 +594,106 @@ func (p *DisconnectPacket) Serialize(b []byte) ([]byte, error) {
 	return b[:2], nil
 }
 
+// payloadLen returns the length of the payload. Under MQTT 5 the reason
+// code can be left out on a normal disconnection, the properties if
+// there are none
+func (p *DisconnectPacket) payloadLen(level byte) int {
+	return lenReasonAndProperties(p.ReasonCode, p.Properties, level)
+}
+
 // Len returns the total length in terms of bytes
 // that the disconnect packet takes
 func (p *DisconnectPacket) Len() int {
-	// disconnect packets are always 2 bytes
+	// disconnect packets are always 2 bytes under 3.1.1
 	return 2
 }
 
+func (p *DisconnectPacket) lenLevel(level byte) int {
+	payloadLen := p.payloadLen(level)
+	return 1 + lenPayloadSizeField(payloadLen) + payloadLen
+}
+
+// DeserializeDisconnectPktPayload parses the contents of a bytes slice and returns
+// a DisconnectPacket as required.
+func DeserializeDisconnectPktPayload(f FixedHeader, p []byte) (*DisconnectPacket, error) {
+	return deserializeDisconnect(f, p, ProtocolLevel311)
+}
+
+func deserializeDisconnect(f FixedHeader, p []byte, level byte) (*DisconnectPacket, error) {
+	if f.CtrlFlags != 0x00 {
+		return nil, ErrInvalidPacket
+	}
+	if level != ProtocolLevel5 {
+		if len(p) != 0 {
+			return nil, ErrInvalidPacket
+		}
+		return &DisconnectPacket{}, nil
+	}
+	code, props, err := deserializeReasonAndProperties(Disconnect, p)
+	if err != nil {
+		return nil, err
+	}
+	return &DisconnectPacket{ReasonCode: code, Properties: props}, nil
+}
+
+// lenReasonAndProperties returns the payload length of DISCONNECT and
+// AUTH packets, which consist of just a reason code and properties under
+// MQTT 5, both of which can be left out
+func lenReasonAndProperties(code ReasonCode, props *Properties, level byte) int {
+	switch {
+	case level != ProtocolLevel5:
+		return 0
+	case props.len() > 0:
+		return 1 + lenPropertiesSection(props)
+	case code != ReasonSuccess:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func serializeReasonAndProperties(b []byte, pktType byte, payloadLen int, code ReasonCode, props *Properties) ([]byte, error) {
+	lenPkt := 1 + lenPayloadSizeField(payloadLen) + payloadLen
+	if b == nil {
+		b = make([]byte, lenPkt)
+	}
+	if len(b) < lenPkt {
+		return nil, ErrShortBuffer
+	}
+	buf := newWritableBuf(b)
+	buf.WriteByte(serializeControlPacket(pktType))
+	writePayloadSize(buf, uint32(payloadLen))
+	if payloadLen > 0 {
+		buf.WriteByte(byte(code))
+	}
+	if payloadLen > 1 {
+		buf.writeProperties(props)
+	}
+	return b[:buf.bytesWritten()], nil
+}
+
+func deserializeReasonAndProperties(pktType byte, p []byte) (ReasonCode, *Properties, error) {
+	pr := &pktReader{from: p}
+	code := ReasonSuccess
+	var props *Properties
+	if len(p) > 0 {
+		code = ReasonCode(pr.readByte())
+		if !isValidReasonCode(pktType, code) {
+			return 0, nil, ErrInvalidPacket
+		}
+	}
+	if len(p) > 1 {
+		props = pr.readProperties(pktType)
+	}
+	if pr.err == nil && !pr.isReadComplete() {
+		pr.err = ErrInvalidPacket
+	}
+	if pr.err != nil {
+		return 0, nil, pr.err
+	}
+	return code, props, nil
+}
+
 /*
 	PING REQUEST PACKET
 */
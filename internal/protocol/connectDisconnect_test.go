@@ -104,13 +104,107 @@ func TestConnectPacket(t *testing.T) {
 		_, err = DeserializeConnectPktPayload(f, payload)
 		require.Error(t, err)
 
-		// set invalid protocol version & check err
+		// set unsupported protocol version & check err, the server
+		// should respond with ConnRefusedUnacceptableProtocol
 		copy(payload[:7], protocolVersion)
 		copy(payload[:7], []byte{0, 4, 'M', 'Q', 'T', 'T', 0x09})
 		_, err = DeserializeConnectPktPayload(f, payload)
+		require.Equal(t, ErrUnacceptableProtocol, err)
+	})
+
+	t.Run("MQTT 3.1 connect packet, happy path", func(t *testing.T) {
+		pktA, err := NewConnectPacket(&ConnectPacketConfig{
+			ClientIdentifier:   []byte("old-sensor"),
+			Username:           []byte("foo"),
+			Password:           []byte("bar"),
+			KeepAliveSeconds:   30,
+			ShouldCleanSession: true,
+			WillTopic:          []byte("buz"),
+			WillMessage:        []byte("quz"),
+			WillQoS:            1,
+			ProtocolLevel:      ProtocolLevel31,
+		})
+		require.NoError(t, err)
+
+		serialized, err := pktA.Serialize(make([]byte, pktA.Len()))
+		require.NoError(t, err)
+		require.Equal(t, pktA.Len(), len(serialized))
+
+		// check fixed header
+		f, err := ReadFixedHeader(bytes.NewReader(serialized))
+		require.NoError(t, err)
+		require.Equal(t, f.PktType, Connect)
+
+		// check payload
+		payload := serialized[len(serialized)-int(f.PayloadSize):]
+		require.Equal(t, protocolVersion31, payload[:9])
+		pktB, err := DeserializeConnectPktPayload(f, payload)
+		require.NoError(t, err)
+		require.Equal(t, pktA, pktB, "Deserialized connect pkt does not match original pkt")
+
+		// MQIsdp is only valid with level 3
+		payload[8] = ProtocolLevel311
+		_, err = DeserializeConnectPktPayload(f, payload)
+		require.Equal(t, ErrUnacceptableProtocol, err)
+	})
+
+	t.Run("protocol level defaults to 3.1.1", func(t *testing.T) {
+		pkt, err := NewConnectPacket(&ConnectPacketConfig{ShouldCleanSession: true})
+		require.NoError(t, err)
+		require.Equal(t, ProtocolLevel311, pkt.ProtocolLevel)
+
+		_, err = NewConnectPacket(&ConnectPacketConfig{ShouldCleanSession: true, ProtocolLevel: 6})
 		require.Error(t, err)
 	})
 
+	t.Run("MQTT 5 connect packet, happy path", func(t *testing.T) {
+		cfg := &ConnectPacketConfig{
+			ProtocolLevel:    ProtocolLevel5,
+			Password:         []byte("token"),
+			KeepAliveSeconds: 30,
+			WillTopic:        []byte("status"),
+			WillMessage:      []byte("gone"),
+			WillQoS:          1,
+			Properties: &Properties{
+				SessionExpiryInterval: Uint32(3600),
+				ReceiveMaximum:        Uint16(20),
+				MaximumPacketSize:     Uint32(1 << 20),
+				TopicAliasMaximum:     Uint16(10),
+				AuthenticationMethod:  []byte("SCRAM-SHA-256"),
+				AuthenticationData:    []byte{1, 2, 3},
+				UserProperties:        []UserProperty{{[]byte("k"), []byte("v")}},
+			},
+			WillProperties: &Properties{
+				WillDelayInterval:     Uint32(5),
+				MessageExpiryInterval: Uint32(60),
+				ContentType:           []byte("text/plain"),
+			},
+		}
+		// neither a client ID nor a username is required
+		pktA, err := NewConnectPacket(cfg)
+		require.NoError(t, err)
+
+		serialized, err := pktA.Serialize(nil)
+		require.NoError(t, err)
+		require.Equal(t, pktA.Len(), len(serialized))
+		f, err := ReadFixedHeader(bytes.NewReader(serialized))
+		require.NoError(t, err)
+		payload := serialized[len(serialized)-int(f.PayloadSize):]
+		pktB, err := DeserializeConnectPktPayload(f, payload)
+		require.NoError(t, err)
+		require.Equal(t, pktA, pktB)
+
+		// will properties are checked separately
+		pktA.WillProperties.ReceiveMaximum = Uint16(1)
+		serialized, err = pktA.Serialize(nil)
+		require.NoError(t, err)
+		f, err = ReadFixedHeader(bytes.NewReader(serialized))
+		require.NoError(t, err)
+		payload = serialized[len(serialized)-int(f.PayloadSize):]
+		_, err = DeserializeConnectPktPayload(f, payload)
+		require.Equal(t, ErrInvalidProperty, err)
+	})
+
 	t.Run("reserved connect flag should be set to 0", func(t *testing.T) {
 		pktA, err := NewConnectPacket(&ConnectPacketConfig{ShouldCleanSession: true})
 		require.NoError(t, err)
@@ -352,6 +446,48 @@ func TestConnackPacket(t *testing.T) {
 	})
 }
 
+func TestConnackPacketMQTT5(t *testing.T) {
+	t.Run("everything ok", func(t *testing.T) {
+		pkt := &ConnackPacket{
+			SessionPresent: true,
+			Code:           ConnAccepted,
+			Properties: &Properties{
+				AssignedClientIdentifier:        []byte("auto-1"),
+				ServerKeepAlive:                 Uint16(60),
+				ReceiveMaximum:                  Uint16(100),
+				MaximumQoS:                      Byte(1),
+				RetainAvailable:                 Byte(0),
+				MaximumPacketSize:               Uint32(4096),
+				TopicAliasMaximum:               Uint16(16),
+				WildcardSubscriptionAvailable:   Byte(1),
+				SubscriptionIdentifierAvailable: Byte(1),
+				SharedSubscriptionAvailable:     Byte(0),
+				ResponseInformation:             []byte("resp/"),
+				ReasonString:                    []byte("welcome"),
+			},
+		}
+		require.Equal(t, pkt, roundTrip(t, pkt, ProtocolLevel5))
+		require.Equal(t, &ConnackPacket{}, roundTrip(t, &ConnackPacket{}, ProtocolLevel5))
+	})
+
+	t.Run("return codes map between protocol levels", func(t *testing.T) {
+		pkt := roundTrip(t, &ConnackPacket{Code: ConnRefusedBadUsernamePass}, ProtocolLevel5)
+		require.Equal(t, ConnectReturnCode(ReasonBadUserNameOrPassword), pkt.(*ConnackPacket).Code)
+
+		pkt = roundTrip(t, &ConnackPacket{Code: ConnectReturnCode(ReasonBanned)}, ProtocolLevel311)
+		require.Equal(t, ConnRefusedNotAuthorized, pkt.(*ConnackPacket).Code)
+	})
+
+	t.Run("reason code must be valid for CONNACK", func(t *testing.T) {
+		serialized, err := Versioned(&ConnackPacket{Code: ConnectReturnCode(ReasonSessionTakenOver)}, ProtocolLevel5).Serialize(nil)
+		require.NoError(t, err)
+		f, err := ReadFixedHeader(bytes.NewReader(serialized))
+		require.NoError(t, err)
+		_, err = DeserializePacket(f, serialized[2:], ProtocolLevel5)
+		require.Equal(t, ErrInvalidPacket, err)
+	})
+}
+
 func TestDisconnectPacket(t *testing.T) {
 	pkt := &DisconnectPacket{}
 	serialized, err := pkt.Serialize(nil)
@@ -396,3 +532,53 @@ func TestPingresptPacket(t *testing.T) {
 	require.Equal(t, Pingresp, f.PktType)
 	require.True(t, f.IsValidFlagsSet())
 }
+
+func TestDisconnectPacketMQTT5(t *testing.T) {
+	// reason code and properties are left out when not needed
+	for _, pkt := range []*DisconnectPacket{
+		{},
+		{ReasonCode: ReasonDisconnectWithWill},
+		{ReasonCode: ReasonSessionTakenOver, Properties: &Properties{ReasonString: []byte("bye")}},
+		{Properties: &Properties{SessionExpiryInterval: Uint32(0), ServerReference: []byte("other")}},
+	} {
+		require.Equal(t, pkt, roundTrip(t, pkt, ProtocolLevel5))
+	}
+	require.Equal(t, 2, Versioned(&DisconnectPacket{}, ProtocolLevel5).Len())
+	require.Equal(t, 3, Versioned(&DisconnectPacket{ReasonCode: ReasonServerBusy}, ProtocolLevel5).Len())
+
+	// only defined under MQTT 5
+	_, err := DeserializePacket(FixedHeader{PktType: Disconnect, PayloadSize: 1}, []byte{0x04}, ProtocolLevel311)
+	require.Error(t, err)
+}
+
+func TestAuthPacket(t *testing.T) {
+	pkt := &AuthPacket{
+		ReasonCode: ReasonContinueAuthentication,
+		Properties: &Properties{
+			AuthenticationMethod: []byte("SCRAM-SHA-256"),
+			AuthenticationData:   []byte("r=nonce"),
+		},
+	}
+	require.Equal(t, pkt, roundTrip(t, pkt, ProtocolLevel5))
+	require.Equal(t, &AuthPacket{}, roundTrip(t, &AuthPacket{}, ProtocolLevel5))
+	require.Equal(t, "AUTH", ControlPacketType(Auth).String())
+
+	// AUTH is a reserved packet type under 3.1.1
+	serialized, err := pkt.Serialize(nil)
+	require.NoError(t, err)
+	f, err := ReadFixedHeader(bytes.NewReader(serialized))
+	require.NoError(t, err)
+	payload := serialized[len(serialized)-int(f.PayloadSize):]
+	_, err = DeserializePacket(f, payload, ProtocolLevel311)
+	require.Error(t, err)
+
+	// properties must be allowed on AUTH
+	pkt.Properties.SessionExpiryInterval = Uint32(10)
+	serialized, err = pkt.Serialize(nil)
+	require.NoError(t, err)
+	f, err = ReadFixedHeader(bytes.NewReader(serialized))
+	require.NoError(t, err)
+	payload = serialized[len(serialized)-int(f.PayloadSize):]
+	_, err = DeserializeAuthPktPayload(f, payload)
+	require.Equal(t, ErrInvalidProperty, err)
+}
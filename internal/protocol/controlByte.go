@@ -21,6 +21,7 @@ const (
 	Pingreq
 	Pingresp
 	Disconnect
+	Auth // MQTT 5 only, reserved under 3.1.1
 )
 
 func (c ControlPacketType) String() string {
@@ -29,7 +30,7 @@ func (c ControlPacketType) String() string {
 		"PUBLISH", "PUBACK", "PUBREC",
 		"PUBREL", "PUBCOMP", "SUBSCRIBE",
 		"SUBACK", "UNSUBSCRIBE", "UNSUBACK",
-		"PINGREQ", "PINGRESP", "DISCONNECT", "Reserved"}[c]
+		"PINGREQ", "PINGRESP", "DISCONNECT", "AUTH"}[c]
 }
 
 func getReservedFlags(c uint8) uint8 {
@@ -44,7 +45,7 @@ func isValidControlPacketType(i uint8) bool {
 }
 
 func isReservedControlPacketType(i uint8) bool {
-	return i == 0 || i == 15
+	return i == 0
 }
 
 // for use with non-publish type packets, if used with
@@ -53,9 +54,9 @@ func isReservedControlPacketType(i uint8) bool {
 func serializeControlPacket(ctrlPktType uint8) uint8 {
 	var flags uint8
 	// set flags to required reserved type
-	// 0x00, 0x0F are reserved
+	// 0x00 is reserved
 	check(ctrlPktType <= 0x0F, "invalid ctrlPktType")
-	check(ctrlPktType != 0x00 && ctrlPktType != 0x0F, "invalid ctrlPktType, reserved")
+	check(ctrlPktType != 0x00, "invalid ctrlPktType, reserved")
 	switch ctrlPktType {
 	case Pubrel, Subscribe, Unsubscribe:
 		flags = 0x02
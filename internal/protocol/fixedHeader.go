@@ -35,6 +35,12 @@ func (f FixedHeader) IsValidFlagsSet() bool {
 	}
 }
 
+// PacketLen returns the total number of bytes the packet takes up
+// on the wire, ie the fixed header plus the payload
+func (f FixedHeader) PacketLen() int {
+	return 1 + lenPayloadSizeField(int(f.PayloadSize)) + int(f.PayloadSize)
+}
+
 func lenPayloadSizeField(n int) int {
 	bytesToWrite := 0
 	for {
@@ -97,3 +97,12 @@ func TestReadWritePayloadSize(t *testing.T) {
 	})
 
 }
+
+func TestFixedHeaderPacketLen(t *testing.T) {
+	pkt := &PublishPacket{TopicName: []byte("foo/bar"), Payload: make([]byte, 200)}
+	serialized, err := pkt.Serialize(nil)
+	require.NoError(t, err)
+	f, err := ReadFixedHeader(bytes.NewReader(serialized))
+	require.NoError(t, err)
+	require.Equal(t, len(serialized), f.PacketLen())
+}
@@ -43,6 +43,11 @@ func (b *writableBuf) WriteUInt16(n uint16) (err error) {
 	return
 }
 
+func (b *writableBuf) WriteUInt32(n uint32) (err error) {
+	b.WriteUInt16(uint16(n >> 16))
+	return b.WriteUInt16(uint16(n))
+}
+
 func (b *writableBuf) Write(p []byte) (n int, err error) {
 	n = len(p)
 	copy(b.buf[b.lastWriteIndex+1:], p)
@@ -75,6 +80,30 @@ func (r *pktReader) readUInt16() (n uint16) {
 	return
 }
 
+func (r *pktReader) readUInt32() (n uint32) {
+	n = uint32(r.readUInt16()) << 16
+	return n + uint32(r.readUInt16())
+}
+
+// readVarInt reads a variable byte integer, which takes up to 4 bytes
+func (r *pktReader) readVarInt() (n uint32) {
+	if r.err != nil {
+		return
+	}
+	for shift := uint(0); shift < 28; shift += 7 {
+		b := r.readByte()
+		if r.err != nil {
+			return 0
+		}
+		n |= uint32(b&0x7F) << shift
+		if b&0x80 == 0 {
+			return
+		}
+	}
+	r.err = ErrInvalidPacket
+	return 0
+}
+
 func (r *pktReader) readByte() (b byte) {
 	if r.err == nil {
 		if r.i+1 > len(r.from) {
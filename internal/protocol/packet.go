@@ -5,3 +5,80 @@ type Packet interface {
 	Serialize(b []byte) ([]byte, error)
 	Len() int
 }
+
+// levelPacket is implemented by packets whose encoding differs under
+// MQTT 5
+type levelPacket interface {
+	serializeLevel(b []byte, level byte) ([]byte, error)
+	lenLevel(level byte) int
+}
+
+type versionedPacket struct {
+	pkt   levelPacket
+	level byte
+}
+
+func (v *versionedPacket) Serialize(b []byte) ([]byte, error) {
+	return v.pkt.serializeLevel(b, v.level)
+}
+
+func (v *versionedPacket) Len() int {
+	return v.pkt.lenLevel(v.level)
+}
+
+// Versioned returns a Packet which serializes pkt as per the given
+// protocol level, ie the one negotiated on CONNECT. Packets serialize as
+// per 3.1.1 by default which 3.1 shares the encoding of, save for CONNECT
+// whose encoding is set by its own ProtocolLevel. pkt is not modified,
+// hence can be shared by sessions with different protocol levels
+func Versioned(pkt Packet, level byte) Packet {
+	if lp, ok := pkt.(levelPacket); ok && level == ProtocolLevel5 {
+		return &versionedPacket{lp, level}
+	}
+	return pkt
+}
+
+// DeserializePacket parses the payload of any packet other than CONNECT
+// as per the given protocol level
+func DeserializePacket(f FixedHeader, payload []byte, level byte) (Packet, error) {
+	if !f.IsValidFlagsSet() {
+		return nil, ErrInvalidPacket
+	}
+	switch f.PktType {
+	case Connack:
+		return deserializeConnack(f, payload, level)
+	case Publish:
+		return deserializePublish(f, payload, level)
+	case Puback:
+		return deserializePuback(f, payload, level)
+	case Pubrec:
+		return deserializePubrec(f, payload, level)
+	case Pubrel:
+		return deserializePubrel(f, payload, level)
+	case Pubcomp:
+		return deserializePubcomp(f, payload, level)
+	case Subscribe:
+		return deserializeSubscribe(f, payload, level)
+	case Suback:
+		return deserializeSuback(f, payload, level)
+	case Unsubscribe:
+		return deserializeUnsubscribe(f, payload, level)
+	case Unsuback:
+		return deserializeUnsuback(f, payload, level)
+	case Pingreq, Pingresp:
+		if len(payload) != 0 {
+			return nil, ErrInvalidPacket
+		}
+		if f.PktType == Pingreq {
+			return &PingreqPacket{}, nil
+		}
+		return &PingrespPacket{}, nil
+	case Disconnect:
+		return deserializeDisconnect(f, payload, level)
+	case Auth:
+		if level == ProtocolLevel5 {
+			return DeserializeAuthPktPayload(f, payload)
+		}
+	}
+	return nil, ErrInvalidPacket
+}
@@ -0,0 +1,384 @@
+package protocol
+
+import "errors"
+
+/*
+	MQTT 5 PROPERTIES
+	Properties follow the variable header of most packets, prefixed by
+	their total length as a variable byte integer. Each property is an
+	identifier followed by its value
+*/
+
+// ErrInvalidProperty is returned on deserializing an MQTT 5 packet with a
+// property that is not allowed in the packet, is set more than once or
+// has an invalid value. The receiver should treat it as a protocol error
+var ErrInvalidProperty = errors.New("Invalid property")
+
+// Property identifiers
+const (
+	PropPayloadFormatIndicator          byte = 0x01
+	PropMessageExpiryInterval           byte = 0x02
+	PropContentType                     byte = 0x03
+	PropResponseTopic                   byte = 0x08
+	PropCorrelationData                 byte = 0x09
+	PropSubscriptionIdentifier          byte = 0x0B
+	PropSessionExpiryInterval           byte = 0x11
+	PropAssignedClientIdentifier        byte = 0x12
+	PropServerKeepAlive                 byte = 0x13
+	PropAuthenticationMethod            byte = 0x15
+	PropAuthenticationData              byte = 0x16
+	PropRequestProblemInformation       byte = 0x17
+	PropWillDelayInterval               byte = 0x18
+	PropRequestResponseInformation      byte = 0x19
+	PropResponseInformation             byte = 0x1A
+	PropServerReference                 byte = 0x1C
+	PropReasonString                    byte = 0x1F
+	PropReceiveMaximum                  byte = 0x21
+	PropTopicAliasMaximum               byte = 0x22
+	PropTopicAlias                      byte = 0x23
+	PropMaximumQoS                      byte = 0x24
+	PropRetainAvailable                 byte = 0x25
+	PropUserProperty                    byte = 0x26
+	PropMaximumPacketSize               byte = 0x27
+	PropWildcardSubscriptionAvailable   byte = 0x28
+	PropSubscriptionIdentifierAvailable byte = 0x29
+	PropSharedSubscriptionAvailable     byte = 0x2A
+)
+
+// willProperties stands in for the packet type when reading the will
+// properties of a CONNECT packet
+const willProperties byte = 0
+
+// propPackets holds, for each property, the packets it may be set on as
+// a bitmask of 1 << packet type
+var propPackets = map[byte]uint16{
+	PropPayloadFormatIndicator:          1<<Publish | 1<<willProperties,
+	PropMessageExpiryInterval:           1<<Publish | 1<<willProperties,
+	PropContentType:                     1<<Publish | 1<<willProperties,
+	PropResponseTopic:                   1<<Publish | 1<<willProperties,
+	PropCorrelationData:                 1<<Publish | 1<<willProperties,
+	PropSubscriptionIdentifier:          1<<Publish | 1<<Subscribe,
+	PropSessionExpiryInterval:           1<<Connect | 1<<Connack | 1<<Disconnect,
+	PropAssignedClientIdentifier:        1 << Connack,
+	PropServerKeepAlive:                 1 << Connack,
+	PropAuthenticationMethod:            1<<Connect | 1<<Connack | 1<<Auth,
+	PropAuthenticationData:              1<<Connect | 1<<Connack | 1<<Auth,
+	PropRequestProblemInformation:       1 << Connect,
+	PropWillDelayInterval:               1 << willProperties,
+	PropRequestResponseInformation:      1 << Connect,
+	PropResponseInformation:             1 << Connack,
+	PropServerReference:                 1<<Connack | 1<<Disconnect,
+	PropReasonString:                    1<<Connack | 1<<Puback | 1<<Pubrec | 1<<Pubrel | 1<<Pubcomp | 1<<Suback | 1<<Unsuback | 1<<Disconnect | 1<<Auth,
+	PropReceiveMaximum:                  1<<Connect | 1<<Connack,
+	PropTopicAliasMaximum:               1<<Connect | 1<<Connack,
+	PropTopicAlias:                      1 << Publish,
+	PropMaximumQoS:                      1 << Connack,
+	PropRetainAvailable:                 1 << Connack,
+	PropUserProperty:                    0xFFFF,
+	PropMaximumPacketSize:               1<<Connect | 1<<Connack,
+	PropWildcardSubscriptionAvailable:   1 << Connack,
+	PropSubscriptionIdentifierAvailable: 1 << Connack,
+	PropSharedSubscriptionAvailable:     1 << Connack,
+}
+
+// UserProperty is a name, value pair set by the application
+type UserProperty struct {
+	Key, Value []byte
+}
+
+// Properties holds the properties of an MQTT 5 packet. Numeric
+// properties are nil when absent, as are strings and binary data of
+// zero length. Only the properties allowed on the packet are serialized
+// and deserialized, the rest have to be left unset
+type Properties struct {
+	PayloadFormatIndicator     *byte
+	MessageExpiryInterval      *uint32
+	ContentType                []byte
+	ResponseTopic              []byte
+	CorrelationData            []byte
+	SubscriptionIdentifiers    []uint32 // at most one on SUBSCRIBE
+	SessionExpiryInterval      *uint32
+	AssignedClientIdentifier   []byte
+	ServerKeepAlive            *uint16
+	AuthenticationMethod       []byte
+	AuthenticationData         []byte
+	RequestProblemInformation  *byte
+	WillDelayInterval          *uint32
+	RequestResponseInformation *byte
+	ResponseInformation        []byte
+	ServerReference            []byte
+	ReasonString               []byte
+	ReceiveMaximum             *uint16
+	TopicAliasMaximum          *uint16
+	TopicAlias                 *uint16
+	MaximumQoS                 *byte
+	RetainAvailable            *byte
+	UserProperties             []UserProperty
+	MaximumPacketSize          *uint32
+
+	WildcardSubscriptionAvailable   *byte
+	SubscriptionIdentifierAvailable *byte
+	SharedSubscriptionAvailable     *byte
+}
+
+// Byte returns a pointer to v, for setting optional properties
+func Byte(v byte) *byte { return &v }
+
+// Uint16 returns a pointer to v, for setting optional properties
+func Uint16(v uint16) *uint16 { return &v }
+
+// Uint32 returns a pointer to v, for setting optional properties
+func Uint32(v uint32) *uint32 { return &v }
+
+// len returns the number of bytes the properties take, excluding the
+// length prefix
+func (props *Properties) len() int {
+	if props == nil {
+		return 0
+	}
+	n := 0
+	for _, v := range []*byte{
+		props.PayloadFormatIndicator, props.RequestProblemInformation,
+		props.RequestResponseInformation, props.MaximumQoS, props.RetainAvailable,
+		props.WildcardSubscriptionAvailable, props.SubscriptionIdentifierAvailable,
+		props.SharedSubscriptionAvailable,
+	} {
+		if v != nil {
+			n += 2
+		}
+	}
+	for _, v := range []*uint16{
+		props.ServerKeepAlive, props.ReceiveMaximum, props.TopicAliasMaximum, props.TopicAlias,
+	} {
+		if v != nil {
+			n += 3
+		}
+	}
+	for _, v := range []*uint32{
+		props.MessageExpiryInterval, props.SessionExpiryInterval,
+		props.WillDelayInterval, props.MaximumPacketSize,
+	} {
+		if v != nil {
+			n += 5
+		}
+	}
+	for _, v := range [][]byte{
+		props.ContentType, props.ResponseTopic, props.CorrelationData,
+		props.AssignedClientIdentifier, props.AuthenticationMethod,
+		props.AuthenticationData, props.ResponseInformation,
+		props.ServerReference, props.ReasonString,
+	} {
+		if len(v) > 0 {
+			n += 3 + len(v)
+		}
+	}
+	for _, id := range props.SubscriptionIdentifiers {
+		n += 1 + lenPayloadSizeField(int(id))
+	}
+	for _, up := range props.UserProperties {
+		n += 5 + len(up.Key) + len(up.Value)
+	}
+	return n
+}
+
+// lenPropertiesSection returns the number of bytes the properties take
+// including the length prefix
+func lenPropertiesSection(props *Properties) int {
+	n := props.len()
+	return lenPayloadSizeField(n) + n
+}
+
+// writeProperties writes the properties prefixed by their length
+func (b *writableBuf) writeProperties(props *Properties) {
+	writePayloadSize(b, uint32(props.len()))
+	if props == nil {
+		return
+	}
+	writeByteProp := func(id byte, v *byte) {
+		if v != nil {
+			b.WriteByte(id)
+			b.WriteByte(*v)
+		}
+	}
+	writeUInt16Prop := func(id byte, v *uint16) {
+		if v != nil {
+			b.WriteByte(id)
+			b.WriteUInt16(*v)
+		}
+	}
+	writeUInt32Prop := func(id byte, v *uint32) {
+		if v != nil {
+			b.WriteByte(id)
+			b.WriteUInt32(*v)
+		}
+	}
+	writeStrProp := func(id byte, v []byte) {
+		if len(v) > 0 {
+			b.WriteByte(id)
+			b.writeMQTTStr(v)
+		}
+	}
+	writeByteProp(PropPayloadFormatIndicator, props.PayloadFormatIndicator)
+	writeUInt32Prop(PropMessageExpiryInterval, props.MessageExpiryInterval)
+	writeStrProp(PropContentType, props.ContentType)
+	writeStrProp(PropResponseTopic, props.ResponseTopic)
+	writeStrProp(PropCorrelationData, props.CorrelationData)
+	for _, id := range props.SubscriptionIdentifiers {
+		b.WriteByte(PropSubscriptionIdentifier)
+		writePayloadSize(b, id)
+	}
+	writeUInt32Prop(PropSessionExpiryInterval, props.SessionExpiryInterval)
+	writeStrProp(PropAssignedClientIdentifier, props.AssignedClientIdentifier)
+	writeUInt16Prop(PropServerKeepAlive, props.ServerKeepAlive)
+	writeStrProp(PropAuthenticationMethod, props.AuthenticationMethod)
+	writeStrProp(PropAuthenticationData, props.AuthenticationData)
+	writeByteProp(PropRequestProblemInformation, props.RequestProblemInformation)
+	writeUInt32Prop(PropWillDelayInterval, props.WillDelayInterval)
+	writeByteProp(PropRequestResponseInformation, props.RequestResponseInformation)
+	writeStrProp(PropResponseInformation, props.ResponseInformation)
+	writeStrProp(PropServerReference, props.ServerReference)
+	writeStrProp(PropReasonString, props.ReasonString)
+	writeUInt16Prop(PropReceiveMaximum, props.ReceiveMaximum)
+	writeUInt16Prop(PropTopicAliasMaximum, props.TopicAliasMaximum)
+	writeUInt16Prop(PropTopicAlias, props.TopicAlias)
+	writeByteProp(PropMaximumQoS, props.MaximumQoS)
+	writeByteProp(PropRetainAvailable, props.RetainAvailable)
+	for _, up := range props.UserProperties {
+		b.WriteByte(PropUserProperty)
+		b.writeMQTTStr(up.Key)
+		b.writeMQTTStr(up.Value)
+	}
+	writeUInt32Prop(PropMaximumPacketSize, props.MaximumPacketSize)
+	writeByteProp(PropWildcardSubscriptionAvailable, props.WildcardSubscriptionAvailable)
+	writeByteProp(PropSubscriptionIdentifierAvailable, props.SubscriptionIdentifierAvailable)
+	writeByteProp(PropSharedSubscriptionAvailable, props.SharedSubscriptionAvailable)
+}
+
+// readProperties reads the length prefixed properties of the given
+// packet type. Returns nil if there are none
+func (r *pktReader) readProperties(pktType byte) *Properties {
+	n := int(r.readVarInt())
+	if r.err != nil {
+		return nil
+	}
+	if r.i+n > len(r.from) {
+		r.err = ErrInvalidPacket
+		return nil
+	}
+	if n == 0 {
+		return nil
+	}
+	pr := &pktReader{from: r.from[:r.i+n], i: r.i}
+	r.i += n
+
+	props := &Properties{}
+	seen := make(map[byte]bool)
+	// flag is for properties whose value can only be 0 or 1
+	readFlag := func() *byte {
+		v := pr.readByte()
+		if v > 1 && pr.err == nil {
+			pr.err = ErrInvalidProperty
+		}
+		return &v
+	}
+	readNonZeroUInt16 := func() *uint16 {
+		v := pr.readUInt16()
+		if v == 0 && pr.err == nil {
+			pr.err = ErrInvalidProperty
+		}
+		return &v
+	}
+	readUInt32 := func() *uint32 {
+		v := pr.readUInt32()
+		return &v
+	}
+	for pr.err == nil && !pr.isReadComplete() {
+		id := pr.readByte()
+		if propPackets[id]&(1<<pktType) == 0 {
+			r.err = ErrInvalidProperty
+			return nil
+		}
+		// only user properties and, on PUBLISH, subscription identifiers
+		// can be set more than once
+		repeatable := id == PropUserProperty ||
+			(id == PropSubscriptionIdentifier && pktType == Publish)
+		if seen[id] && !repeatable {
+			r.err = ErrInvalidProperty
+			return nil
+		}
+		seen[id] = true
+
+		switch id {
+		case PropPayloadFormatIndicator:
+			props.PayloadFormatIndicator = readFlag()
+		case PropMessageExpiryInterval:
+			props.MessageExpiryInterval = readUInt32()
+		case PropContentType:
+			props.ContentType = pr.readStr()
+		case PropResponseTopic:
+			props.ResponseTopic = pr.readStr()
+		case PropCorrelationData:
+			props.CorrelationData = pr.readStr()
+		case PropSubscriptionIdentifier:
+			v := pr.readVarInt()
+			if v == 0 && pr.err == nil {
+				pr.err = ErrInvalidProperty
+			}
+			props.SubscriptionIdentifiers = append(props.SubscriptionIdentifiers, v)
+		case PropSessionExpiryInterval:
+			props.SessionExpiryInterval = readUInt32()
+		case PropAssignedClientIdentifier:
+			props.AssignedClientIdentifier = pr.readStr()
+		case PropServerKeepAlive:
+			v := pr.readUInt16()
+			props.ServerKeepAlive = &v
+		case PropAuthenticationMethod:
+			props.AuthenticationMethod = pr.readStr()
+		case PropAuthenticationData:
+			props.AuthenticationData = pr.readStr()
+		case PropRequestProblemInformation:
+			props.RequestProblemInformation = readFlag()
+		case PropWillDelayInterval:
+			props.WillDelayInterval = readUInt32()
+		case PropRequestResponseInformation:
+			props.RequestResponseInformation = readFlag()
+		case PropResponseInformation:
+			props.ResponseInformation = pr.readStr()
+		case PropServerReference:
+			props.ServerReference = pr.readStr()
+		case PropReasonString:
+			props.ReasonString = pr.readStr()
+		case PropReceiveMaximum:
+			props.ReceiveMaximum = readNonZeroUInt16()
+		case PropTopicAliasMaximum:
+			v := pr.readUInt16()
+			props.TopicAliasMaximum = &v
+		case PropTopicAlias:
+			props.TopicAlias = readNonZeroUInt16()
+		case PropMaximumQoS:
+			props.MaximumQoS = readFlag()
+		case PropRetainAvailable:
+			props.RetainAvailable = readFlag()
+		case PropUserProperty:
+			key := pr.readStr()
+			value := pr.readStr()
+			props.UserProperties = append(props.UserProperties, UserProperty{key, value})
+		case PropMaximumPacketSize:
+			props.MaximumPacketSize = readUInt32()
+			if *props.MaximumPacketSize == 0 && pr.err == nil {
+				pr.err = ErrInvalidProperty
+			}
+		case PropWildcardSubscriptionAvailable:
+			props.WildcardSubscriptionAvailable = readFlag()
+		case PropSubscriptionIdentifierAvailable:
+			props.SubscriptionIdentifierAvailable = readFlag()
+		case PropSharedSubscriptionAvailable:
+			props.SharedSubscriptionAvailable = readFlag()
+		}
+	}
+	if pr.err != nil {
+		r.err = pr.err
+		return nil
+	}
+	return props
+}
@@ -0,0 +1,111 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// roundTrip serializes pkt as per the given protocol level then
+// deserializes it back
+func roundTrip(t *testing.T, pkt Packet, level byte) Packet {
+	serialized, err := Versioned(pkt, level).Serialize(nil)
+	require.NoError(t, err)
+	require.Equal(t, Versioned(pkt, level).Len(), len(serialized))
+
+	// check fixed header
+	f, err := ReadFixedHeader(bytes.NewReader(serialized))
+	require.NoError(t, err)
+	require.True(t, f.IsValidFlagsSet())
+	require.Equal(t, len(serialized), f.PacketLen())
+
+	// check payload
+	payload := serialized[len(serialized)-int(f.PayloadSize):]
+	pktRcvd, err := DeserializePacket(f, payload, level)
+	require.NoError(t, err)
+	return pktRcvd
+}
+
+func TestProperties(t *testing.T) {
+	t.Run("all properties", func(t *testing.T) {
+		props := &Properties{
+			PayloadFormatIndicator:          Byte(1),
+			MessageExpiryInterval:           Uint32(120),
+			ContentType:                     []byte("application/json"),
+			ResponseTopic:                   []byte("replies/1"),
+			CorrelationData:                 []byte{0xde, 0xad},
+			SubscriptionIdentifiers:         []uint32{1, 200, maxPayloadSize},
+			SessionExpiryInterval:           Uint32(0xFFFFFFFF),
+			AssignedClientIdentifier:        []byte("auto"),
+			ServerKeepAlive:                 Uint16(0),
+			AuthenticationMethod:            []byte("SCRAM-SHA-256"),
+			AuthenticationData:              []byte{0},
+			RequestProblemInformation:       Byte(0),
+			WillDelayInterval:               Uint32(30),
+			RequestResponseInformation:      Byte(1),
+			ResponseInformation:             []byte("resp"),
+			ServerReference:                 []byte("other:1883"),
+			ReasonString:                    []byte("reason"),
+			ReceiveMaximum:                  Uint16(65535),
+			TopicAliasMaximum:               Uint16(0),
+			TopicAlias:                      Uint16(3),
+			MaximumQoS:                      Byte(0),
+			RetainAvailable:                 Byte(1),
+			UserProperties:                  []UserProperty{{[]byte("a"), []byte("1")}, {[]byte("a"), []byte("2")}},
+			MaximumPacketSize:               Uint32(1024),
+			WildcardSubscriptionAvailable:   Byte(0),
+			SubscriptionIdentifierAvailable: Byte(1),
+			SharedSubscriptionAvailable:     Byte(1),
+		}
+		buf := newWritableBuf(make([]byte, lenPropertiesSection(props)))
+		buf.writeProperties(props)
+		require.Equal(t, lenPropertiesSection(props), buf.bytesWritten())
+
+		// the packet type is only checked on reading, hence allow any
+		saved := propPackets
+		defer func() { propPackets = saved }()
+		propPackets = make(map[byte]uint16)
+		for id := range saved {
+			propPackets[id] = 0xFFFF
+		}
+		pr := &pktReader{from: buf.buf}
+		require.Equal(t, props, pr.readProperties(Publish))
+		require.NoError(t, pr.err)
+		require.True(t, pr.isReadComplete())
+	})
+
+	t.Run("no properties", func(t *testing.T) {
+		buf := newWritableBuf(make([]byte, 1))
+		buf.writeProperties(nil)
+		require.Equal(t, []byte{0}, buf.buf)
+		pr := &pktReader{from: buf.buf}
+		require.Nil(t, pr.readProperties(Publish))
+		require.NoError(t, pr.err)
+	})
+
+	cases := []struct {
+		description string
+		pktType     byte
+		raw         []byte
+		err         error
+	}{
+		{"not allowed on the packet", Puback, []byte{2, PropTopicAlias, 0}, ErrInvalidProperty},
+		{"unknown identifier", Publish, []byte{2, 0x7F, 0}, ErrInvalidProperty},
+		{"set twice", Connect, []byte{6, PropReceiveMaximum, 0, 1, PropReceiveMaximum, 0, 2}, ErrInvalidProperty},
+		{"subscription identifier set twice on SUBSCRIBE", Subscribe, []byte{4, PropSubscriptionIdentifier, 1, PropSubscriptionIdentifier, 2}, ErrInvalidProperty},
+		{"subscription identifier of 0", Subscribe, []byte{2, PropSubscriptionIdentifier, 0}, ErrInvalidProperty},
+		{"receive maximum of 0", Connect, []byte{3, PropReceiveMaximum, 0, 0}, ErrInvalidProperty},
+		{"flag neither 0 nor 1", Connack, []byte{2, PropRetainAvailable, 2}, ErrInvalidProperty},
+		{"longer than the packet", Publish, []byte{4, PropTopicAlias, 0, 1}, ErrInvalidPacket},
+		{"value cut short", Publish, []byte{2, PropTopicAlias, 0}, ErrInvalidPacket},
+		{"length over 4 bytes", Publish, []byte{0x80, 0x80, 0x80, 0x80, 0x01}, ErrInvalidPacket},
+	}
+	for _, cs := range cases {
+		t.Run(cs.description, func(t *testing.T) {
+			pr := &pktReader{from: cs.raw}
+			require.Nil(t, pr.readProperties(cs.pktType))
+			require.Equal(t, cs.err, pr.err)
+		})
+	}
+}
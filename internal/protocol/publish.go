@@ -9,6 +9,8 @@ type PublishPacket struct {
 	TopicName        []byte
 	PacketIdentifier uint16
 	Payload          []byte
+	// Properties are only serialized under MQTT 5
+	Properties *Properties
 }
 
 // Serialize serializes the contents of a publish packet into
@@ -17,7 +19,11 @@ type PublishPacket struct {
 // is provided, Serialize instantiates a buffer of required length
 // and returns it
 func (p *PublishPacket) Serialize(b []byte) ([]byte, error) {
-	lenPublishPacket := p.Len()
+	return p.serializeLevel(b, ProtocolLevel311)
+}
+
+func (p *PublishPacket) serializeLevel(b []byte, level byte) ([]byte, error) {
+	lenPublishPacket := p.lenLevel(level)
 	if b == nil {
 		b = make([]byte, lenPublishPacket)
 	}
@@ -38,7 +44,7 @@ func (p *PublishPacket) Serialize(b []byte) ([]byte, error) {
 	// write fixed header
 	buf := newWritableBuf(b)
 	buf.WriteByte(Publish<<4 | ctrlFlag)
-	writePayloadSize(buf, uint32(p.payloadLen()))
+	writePayloadSize(buf, uint32(p.payloadLen(level)))
 
 	// write topic name
 	buf.writeMQTTStr(p.TopicName)
@@ -48,6 +54,9 @@ func (p *PublishPacket) Serialize(b []byte) ([]byte, error) {
 		buf.WriteByte(byte(p.PacketIdentifier >> 8))
 		buf.WriteByte(byte(p.PacketIdentifier))
 	}
+	if level == ProtocolLevel5 {
+		buf.writeProperties(p.Properties)
+	}
 	// write Payload
 	buf.Write(p.Payload)
 
@@ -57,6 +66,10 @@ func (p *PublishPacket) Serialize(b []byte) ([]byte, error) {
 // DeserializePublishPktPayload parses the contents of a bytes slice and returns
 // a PublishPacket as required.
 func DeserializePublishPktPayload(f FixedHeader, p []byte) (*PublishPacket, error) {
+	return deserializePublish(f, p, ProtocolLevel311)
+}
+
+func deserializePublish(f FixedHeader, p []byte, level byte) (*PublishPacket, error) {
 	// parse ctrl flags
 	isDuplicate := (f.CtrlFlags & 0x08) != 0
 	QoS := (f.CtrlFlags & 0x06) >> 1
@@ -66,18 +79,19 @@ func DeserializePublishPktPayload(f FixedHeader, p []byte) (*PublishPacket, erro
 
 	// get topic name, ensure it is valid?
 	topicName := pr.readStr()
-	variableHeaderLen := len(topicName) + 2
 
 	// get packet identifier if QoS > 0
 	var packetIdentifier uint16 = 0
 	if QoS > 0 {
 		packetIdentifier = pr.readUInt16()
-		variableHeaderLen += 2
+	}
+	var props *Properties
+	if level == ProtocolLevel5 {
+		props = pr.readProperties(Publish)
 	}
 
-	// get payload
-	payloadLen := len(p) - variableHeaderLen
-	payload := pr.readBuf(payloadLen)
+	// get payload, the rest of the packet
+	payload := pr.readBuf(len(p) - pr.i)
 
 	if pr.err != nil {
 		return nil, pr.err
@@ -90,41 +104,303 @@ func DeserializePublishPktPayload(f FixedHeader, p []byte) (*PublishPacket, erro
 		TopicName:        topicName,
 		PacketIdentifier: packetIdentifier,
 		Payload:          payload,
+		Properties:       props,
 	}
 
 	return pkt, nil
 }
 
-func (p *PublishPacket) payloadLen() int {
+func (p *PublishPacket) payloadLen(level byte) int {
 	payloadLen := len(p.TopicName) + 2 + len(p.Payload)
 	if p.QoS > 0 {
 		// for packet identifier
 		payloadLen += 2
 	}
+	if level == ProtocolLevel5 {
+		payloadLen += lenPropertiesSection(p.Properties)
+	}
 	return payloadLen
 }
 
 // Len returns number of bytes publish packet will
 // take when serialized
 func (p *PublishPacket) Len() int {
-	payloadLen := p.payloadLen()
+	return p.lenLevel(ProtocolLevel311)
+}
+
+func (p *PublishPacket) lenLevel(level byte) int {
+	payloadLen := p.payloadLen(level)
 	return 1 + // control pkt type + flags
 		lenPayloadSizeField(payloadLen) + // remaining length field
 		payloadLen
 }
 
-type pubackPacket struct {
-	packetIdentifier uint16
+/*
+	PUBLISH ACKNOWLEDGEMENT PACKETS
+	PUBACK, PUBREC, PUBREL & PUBCOMP all consist of just a
+	packet identifier, hence share the same encoding. Under MQTT 5
+	they may carry a reason code and properties too
+*/
+
+// PubackPacket is an in-mem representation of a puback packet,
+// the response to a QoS 1 publish
+type PubackPacket struct {
+	PacketIdentifier uint16
+	// ReasonCode and Properties are only serialized under MQTT 5
+	ReasonCode ReasonCode
+	Properties *Properties
+}
+
+// PubrecPacket is an in-mem representation of a pubrec packet,
+// the response to a QoS 2 publish
+type PubrecPacket struct {
+	PacketIdentifier uint16
+	ReasonCode       ReasonCode
+	Properties       *Properties
 }
 
-type pubrecPacket struct {
-	packetIdentifier uint16
+// PubrelPacket is an in-mem representation of a pubrel packet,
+// the response to a pubrec packet
+type PubrelPacket struct {
+	PacketIdentifier uint16
+	ReasonCode       ReasonCode
+	Properties       *Properties
 }
 
-type pubrelPacket struct {
-	packetIdentifier uint16
+// PubcompPacket is an in-mem representation of a pubcomp packet,
+// the response to a pubrel packet
+type PubcompPacket struct {
+	PacketIdentifier uint16
+	ReasonCode       ReasonCode
+	Properties       *Properties
+}
+
+func serializePktIDOnly(b []byte, pktType byte, packetIdentifier uint16) ([]byte, error) {
+	if b == nil {
+		b = make([]byte, 4)
+	}
+	if len(b) < 4 {
+		return nil, ErrShortBuffer
+	}
+	b[0] = serializeControlPacket(pktType)
+	b[1] = 2
+	b[2] = byte(packetIdentifier >> 8)
+	b[3] = byte(packetIdentifier)
+	return b[:4], nil
+}
+
+func deserializePktIDOnly(f FixedHeader, pktType byte, p []byte) (uint16, error) {
+	if f.PktType != pktType || !f.IsValidFlagsSet() {
+		return 0, ErrInvalidPacket
+	}
+	// payload must be of length 2
+	if len(p) != 2 {
+		return 0, ErrInvalidPacket
+	}
+	return uint16(p[0])<<8 + uint16(p[1]), nil
+}
+
+// ackPayloadLen returns the payload length of an ack. Under MQTT 5 the
+// reason code can be left out on success, the properties if there are none
+func ackPayloadLen(code ReasonCode, props *Properties, level byte) int {
+	switch {
+	case level != ProtocolLevel5:
+		return 2
+	case props.len() > 0:
+		return 3 + lenPropertiesSection(props)
+	case code != ReasonSuccess:
+		return 3
+	default:
+		return 2
+	}
+}
+
+func lenAck(code ReasonCode, props *Properties, level byte) int {
+	payloadLen := ackPayloadLen(code, props, level)
+	return 1 + lenPayloadSizeField(payloadLen) + payloadLen
+}
+
+func serializeAck(b []byte, pktType byte, packetIdentifier uint16, code ReasonCode, props *Properties, level byte) ([]byte, error) {
+	payloadLen := ackPayloadLen(code, props, level)
+	if payloadLen == 2 {
+		return serializePktIDOnly(b, pktType, packetIdentifier)
+	}
+	lenPkt := 1 + lenPayloadSizeField(payloadLen) + payloadLen
+	if b == nil {
+		b = make([]byte, lenPkt)
+	}
+	if len(b) < lenPkt {
+		return nil, ErrShortBuffer
+	}
+	buf := newWritableBuf(b)
+	buf.WriteByte(serializeControlPacket(pktType))
+	writePayloadSize(buf, uint32(payloadLen))
+	buf.WriteUInt16(packetIdentifier)
+	buf.WriteByte(byte(code))
+	if payloadLen > 3 {
+		buf.writeProperties(props)
+	}
+	return b[:buf.bytesWritten()], nil
+}
+
+func deserializeAck(f FixedHeader, pktType byte, p []byte, level byte) (uint16, ReasonCode, *Properties, error) {
+	if level != ProtocolLevel5 {
+		id, err := deserializePktIDOnly(f, pktType, p)
+		return id, ReasonSuccess, nil, err
+	}
+	if f.PktType != pktType || !f.IsValidFlagsSet() {
+		return 0, 0, nil, ErrInvalidPacket
+	}
+	pr := &pktReader{from: p}
+	id := pr.readUInt16()
+	code := ReasonSuccess
+	var props *Properties
+	if len(p) > 2 {
+		code = ReasonCode(pr.readByte())
+		if !isValidReasonCode(pktType, code) {
+			return 0, 0, nil, ErrInvalidPacket
+		}
+	}
+	if len(p) > 3 {
+		props = pr.readProperties(pktType)
+	}
+	if pr.err == nil && !pr.isReadComplete() {
+		pr.err = ErrInvalidPacket
+	}
+	if pr.err != nil {
+		return 0, 0, nil, pr.err
+	}
+	return id, code, props, nil
 }
 
-type pubcompPacket struct {
-	packetIdentifier uint16
+// Serialize serializes the contents of a puback packet into
+// a []byte buffer.
+func (p *PubackPacket) Serialize(b []byte) ([]byte, error) {
+	return p.serializeLevel(b, ProtocolLevel311)
+}
+
+func (p *PubackPacket) serializeLevel(b []byte, level byte) ([]byte, error) {
+	return serializeAck(b, Puback, p.PacketIdentifier, p.ReasonCode, p.Properties, level)
+}
+
+// Len returns number of bytes packet will take when serialized
+func (p *PubackPacket) Len() int {
+	return p.lenLevel(ProtocolLevel311)
+}
+
+func (p *PubackPacket) lenLevel(level byte) int {
+	return lenAck(p.ReasonCode, p.Properties, level)
+}
+
+// DeserializePubackPktPayload parses the contents of a bytes slice and returns
+// a Puback packet as required.
+func DeserializePubackPktPayload(f FixedHeader, p []byte) (*PubackPacket, error) {
+	return deserializePuback(f, p, ProtocolLevel311)
+}
+
+func deserializePuback(f FixedHeader, p []byte, level byte) (*PubackPacket, error) {
+	id, code, props, err := deserializeAck(f, Puback, p, level)
+	if err != nil {
+		return nil, err
+	}
+	return &PubackPacket{PacketIdentifier: id, ReasonCode: code, Properties: props}, nil
+}
+
+// Serialize serializes the contents of a pubrec packet into
+// a []byte buffer.
+func (p *PubrecPacket) Serialize(b []byte) ([]byte, error) {
+	return p.serializeLevel(b, ProtocolLevel311)
+}
+
+func (p *PubrecPacket) serializeLevel(b []byte, level byte) ([]byte, error) {
+	return serializeAck(b, Pubrec, p.PacketIdentifier, p.ReasonCode, p.Properties, level)
+}
+
+// Len returns number of bytes packet will take when serialized
+func (p *PubrecPacket) Len() int {
+	return p.lenLevel(ProtocolLevel311)
+}
+
+func (p *PubrecPacket) lenLevel(level byte) int {
+	return lenAck(p.ReasonCode, p.Properties, level)
+}
+
+// DeserializePubrecPktPayload parses the contents of a bytes slice and returns
+// a Pubrec packet as required.
+func DeserializePubrecPktPayload(f FixedHeader, p []byte) (*PubrecPacket, error) {
+	return deserializePubrec(f, p, ProtocolLevel311)
+}
+
+func deserializePubrec(f FixedHeader, p []byte, level byte) (*PubrecPacket, error) {
+	id, code, props, err := deserializeAck(f, Pubrec, p, level)
+	if err != nil {
+		return nil, err
+	}
+	return &PubrecPacket{PacketIdentifier: id, ReasonCode: code, Properties: props}, nil
+}
+
+// Serialize serializes the contents of a pubrel packet into
+// a []byte buffer. Note that pubrel has its reserved flags set to 0x02
+func (p *PubrelPacket) Serialize(b []byte) ([]byte, error) {
+	return p.serializeLevel(b, ProtocolLevel311)
+}
+
+func (p *PubrelPacket) serializeLevel(b []byte, level byte) ([]byte, error) {
+	return serializeAck(b, Pubrel, p.PacketIdentifier, p.ReasonCode, p.Properties, level)
+}
+
+// Len returns number of bytes packet will take when serialized
+func (p *PubrelPacket) Len() int {
+	return p.lenLevel(ProtocolLevel311)
+}
+
+func (p *PubrelPacket) lenLevel(level byte) int {
+	return lenAck(p.ReasonCode, p.Properties, level)
+}
+
+// DeserializePubrelPktPayload parses the contents of a bytes slice and returns
+// a Pubrel packet as required.
+func DeserializePubrelPktPayload(f FixedHeader, p []byte) (*PubrelPacket, error) {
+	return deserializePubrel(f, p, ProtocolLevel311)
+}
+
+func deserializePubrel(f FixedHeader, p []byte, level byte) (*PubrelPacket, error) {
+	id, code, props, err := deserializeAck(f, Pubrel, p, level)
+	if err != nil {
+		return nil, err
+	}
+	return &PubrelPacket{PacketIdentifier: id, ReasonCode: code, Properties: props}, nil
+}
+
+// Serialize serializes the contents of a pubcomp packet into
+// a []byte buffer.
+func (p *PubcompPacket) Serialize(b []byte) ([]byte, error) {
+	return p.serializeLevel(b, ProtocolLevel311)
+}
+
+func (p *PubcompPacket) serializeLevel(b []byte, level byte) ([]byte, error) {
+	return serializeAck(b, Pubcomp, p.PacketIdentifier, p.ReasonCode, p.Properties, level)
+}
+
+// Len returns number of bytes packet will take when serialized
+func (p *PubcompPacket) Len() int {
+	return p.lenLevel(ProtocolLevel311)
+}
+
+func (p *PubcompPacket) lenLevel(level byte) int {
+	return lenAck(p.ReasonCode, p.Properties, level)
+}
+
+// DeserializePubcompPktPayload parses the contents of a bytes slice and returns
+// a Pubcomp packet as required.
+func DeserializePubcompPktPayload(f FixedHeader, p []byte) (*PubcompPacket, error) {
+	return deserializePubcomp(f, p, ProtocolLevel311)
+}
+
+func deserializePubcomp(f FixedHeader, p []byte, level byte) (*PubcompPacket, error) {
+	id, code, props, err := deserializeAck(f, Pubcomp, p, level)
+	if err != nil {
+		return nil, err
+	}
+	return &PubcompPacket{PacketIdentifier: id, ReasonCode: code, Properties: props}, nil
 }
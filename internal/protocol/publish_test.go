@@ -53,3 +53,101 @@ func TestPublishPacket(t *testing.T) {
 	})
 
 }
+
+func TestPublishAckPackets(t *testing.T) {
+	cases := []struct {
+		description string
+		pkt         Packet
+		pktType     byte
+		deserialize func(FixedHeader, []byte) (Packet, error)
+	}{
+		{
+			"puback", &PubackPacket{PacketIdentifier: 9999}, Puback,
+			func(f FixedHeader, p []byte) (Packet, error) { return DeserializePubackPktPayload(f, p) },
+		},
+		{
+			"pubrec", &PubrecPacket{PacketIdentifier: 1}, Pubrec,
+			func(f FixedHeader, p []byte) (Packet, error) { return DeserializePubrecPktPayload(f, p) },
+		},
+		{
+			"pubrel", &PubrelPacket{PacketIdentifier: 256}, Pubrel,
+			func(f FixedHeader, p []byte) (Packet, error) { return DeserializePubrelPktPayload(f, p) },
+		},
+		{
+			"pubcomp", &PubcompPacket{PacketIdentifier: 65535}, Pubcomp,
+			func(f FixedHeader, p []byte) (Packet, error) { return DeserializePubcompPktPayload(f, p) },
+		},
+	}
+	for _, cs := range cases {
+		t.Run(cs.description, func(t *testing.T) {
+			serialized, err := cs.pkt.Serialize(nil)
+			require.NoError(t, err)
+			require.Equal(t, cs.pkt.Len(), len(serialized))
+
+			// check fixed header
+			f, err := ReadFixedHeader(bytes.NewReader(serialized))
+			require.NoError(t, err)
+			require.Equal(t, cs.pktType, f.PktType)
+			require.True(t, f.IsValidFlagsSet())
+
+			// check payload
+			payload := serialized[len(serialized)-int(f.PayloadSize):]
+			pktRcvd, err := cs.deserialize(f, payload)
+			require.NoError(t, err)
+			require.Equal(t, cs.pkt, pktRcvd)
+
+			// payload should be exactly 2 bytes
+			_, err = cs.deserialize(f, append(payload, 0))
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestPublishPacketMQTT5(t *testing.T) {
+	pkt := &PublishPacket{
+		QoS:              2,
+		PacketIdentifier: 7,
+		TopicName:        []byte("sensors/1"),
+		Payload:          []byte("21.5"),
+		Properties: &Properties{
+			PayloadFormatIndicator:  Byte(1),
+			MessageExpiryInterval:   Uint32(30),
+			TopicAlias:              Uint16(1),
+			ResponseTopic:           []byte("replies"),
+			CorrelationData:         []byte{1},
+			SubscriptionIdentifiers: []uint32{3, 16384},
+			UserProperties:          []UserProperty{{[]byte("unit"), []byte("C")}},
+		},
+	}
+	require.Equal(t, pkt, roundTrip(t, pkt, ProtocolLevel5))
+
+	// properties are only serialized under MQTT 5
+	pktRcvd := roundTrip(t, pkt, ProtocolLevel311).(*PublishPacket)
+	require.Nil(t, pktRcvd.Properties)
+	require.Equal(t, pkt.Payload, pktRcvd.Payload)
+
+	// an empty payload with no properties
+	pkt = &PublishPacket{TopicName: []byte("a")}
+	require.Equal(t, pkt, roundTrip(t, pkt, ProtocolLevel5))
+}
+
+func TestPublishAckPacketsMQTT5(t *testing.T) {
+	props := &Properties{ReasonString: []byte("no one listening")}
+	for _, pkt := range []Packet{
+		&PubackPacket{PacketIdentifier: 1, ReasonCode: ReasonSuccess},
+		&PubackPacket{PacketIdentifier: 2, ReasonCode: ReasonNoMatchingSubscribers},
+		&PubrecPacket{PacketIdentifier: 3, ReasonCode: ReasonQuotaExceeded, Properties: props},
+		&PubrelPacket{PacketIdentifier: 4, ReasonCode: ReasonPacketIdentifierNotFound},
+		&PubcompPacket{PacketIdentifier: 5, Properties: props},
+	} {
+		require.Equal(t, pkt, roundTrip(t, pkt, ProtocolLevel5))
+	}
+	// reason code and properties are left out when not needed
+	require.Equal(t, 4, Versioned(&PubackPacket{PacketIdentifier: 1}, ProtocolLevel5).Len())
+	require.Equal(t, 5, Versioned(&PubackPacket{ReasonCode: ReasonNotAuthorized}, ProtocolLevel5).Len())
+
+	// reason code must be valid for the packet
+	f := FixedHeader{PktType: Pubrel, CtrlFlags: 0x02, PayloadSize: 3}
+	_, err := DeserializePacket(f, []byte{0, 1, byte(ReasonNoMatchingSubscribers)}, ProtocolLevel5)
+	require.Equal(t, ErrInvalidPacket, err)
+}
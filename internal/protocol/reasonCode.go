@@ -0,0 +1,175 @@
+package protocol
+
+// ReasonCode is the outcome of an operation carried on MQTT 5 acks,
+// CONNACK, DISCONNECT and AUTH packets. Codes below 0x80 indicate success
+type ReasonCode byte
+
+// ReasonSuccess etc self-explanatory, some codes share values but have a
+// different meaning depending on the packet they're set on
+const (
+	ReasonSuccess                             ReasonCode = 0x00
+	ReasonNormalDisconnection                 ReasonCode = 0x00
+	ReasonGrantedQoS0                         ReasonCode = 0x00
+	ReasonGrantedQoS1                         ReasonCode = 0x01
+	ReasonGrantedQoS2                         ReasonCode = 0x02
+	ReasonDisconnectWithWill                  ReasonCode = 0x04
+	ReasonNoMatchingSubscribers               ReasonCode = 0x10
+	ReasonNoSubscriptionExisted               ReasonCode = 0x11
+	ReasonContinueAuthentication              ReasonCode = 0x18
+	ReasonReauthenticate                      ReasonCode = 0x19
+	ReasonUnspecifiedError                    ReasonCode = 0x80
+	ReasonMalformedPacket                     ReasonCode = 0x81
+	ReasonProtocolError                       ReasonCode = 0x82
+	ReasonImplementationSpecificError         ReasonCode = 0x83
+	ReasonUnsupportedProtocolVersion          ReasonCode = 0x84
+	ReasonClientIdentifierNotValid            ReasonCode = 0x85
+	ReasonBadUserNameOrPassword               ReasonCode = 0x86
+	ReasonNotAuthorized                       ReasonCode = 0x87
+	ReasonServerUnavailable                   ReasonCode = 0x88
+	ReasonServerBusy                          ReasonCode = 0x89
+	ReasonBanned                              ReasonCode = 0x8A
+	ReasonServerShuttingDown                  ReasonCode = 0x8B
+	ReasonBadAuthenticationMethod             ReasonCode = 0x8C
+	ReasonKeepAliveTimeout                    ReasonCode = 0x8D
+	ReasonSessionTakenOver                    ReasonCode = 0x8E
+	ReasonTopicFilterInvalid                  ReasonCode = 0x8F
+	ReasonTopicNameInvalid                    ReasonCode = 0x90
+	ReasonPacketIdentifierInUse               ReasonCode = 0x91
+	ReasonPacketIdentifierNotFound            ReasonCode = 0x92
+	ReasonReceiveMaximumExceeded              ReasonCode = 0x93
+	ReasonTopicAliasInvalid                   ReasonCode = 0x94
+	ReasonPacketTooLarge                      ReasonCode = 0x95
+	ReasonMessageRateTooHigh                  ReasonCode = 0x96
+	ReasonQuotaExceeded                       ReasonCode = 0x97
+	ReasonAdministrativeAction                ReasonCode = 0x98
+	ReasonPayloadFormatInvalid                ReasonCode = 0x99
+	ReasonRetainNotSupported                  ReasonCode = 0x9A
+	ReasonQoSNotSupported                     ReasonCode = 0x9B
+	ReasonUseAnotherServer                    ReasonCode = 0x9C
+	ReasonServerMoved                         ReasonCode = 0x9D
+	ReasonSharedSubscriptionsNotSupported     ReasonCode = 0x9E
+	ReasonConnectionRateExceeded              ReasonCode = 0x9F
+	ReasonMaximumConnectTime                  ReasonCode = 0xA0
+	ReasonSubscriptionIdentifiersNotSupported ReasonCode = 0xA1
+	ReasonWildcardSubscriptionsNotSupported   ReasonCode = 0xA2
+)
+
+var reasonCodeNames = map[ReasonCode]string{
+	ReasonSuccess:                             "Success",
+	ReasonGrantedQoS1:                         "Granted QoS 1",
+	ReasonGrantedQoS2:                         "Granted QoS 2",
+	ReasonDisconnectWithWill:                  "Disconnect with Will Message",
+	ReasonNoMatchingSubscribers:               "No matching subscribers",
+	ReasonNoSubscriptionExisted:               "No subscription existed",
+	ReasonContinueAuthentication:              "Continue authentication",
+	ReasonReauthenticate:                      "Re-authenticate",
+	ReasonUnspecifiedError:                    "Unspecified error",
+	ReasonMalformedPacket:                     "Malformed Packet",
+	ReasonProtocolError:                       "Protocol Error",
+	ReasonImplementationSpecificError:         "Implementation specific error",
+	ReasonUnsupportedProtocolVersion:          "Unsupported Protocol Version",
+	ReasonClientIdentifierNotValid:            "Client Identifier not valid",
+	ReasonBadUserNameOrPassword:               "Bad User Name or Password",
+	ReasonNotAuthorized:                       "Not authorized",
+	ReasonServerUnavailable:                   "Server unavailable",
+	ReasonServerBusy:                          "Server busy",
+	ReasonBanned:                              "Banned",
+	ReasonServerShuttingDown:                  "Server shutting down",
+	ReasonBadAuthenticationMethod:             "Bad authentication method",
+	ReasonKeepAliveTimeout:                    "Keep Alive timeout",
+	ReasonSessionTakenOver:                    "Session taken over",
+	ReasonTopicFilterInvalid:                  "Topic Filter invalid",
+	ReasonTopicNameInvalid:                    "Topic Name invalid",
+	ReasonPacketIdentifierInUse:               "Packet Identifier in use",
+	ReasonPacketIdentifierNotFound:            "Packet Identifier not found",
+	ReasonReceiveMaximumExceeded:              "Receive Maximum exceeded",
+	ReasonTopicAliasInvalid:                   "Topic Alias invalid",
+	ReasonPacketTooLarge:                      "Packet too large",
+	ReasonMessageRateTooHigh:                  "Message rate too high",
+	ReasonQuotaExceeded:                       "Quota exceeded",
+	ReasonAdministrativeAction:                "Administrative action",
+	ReasonPayloadFormatInvalid:                "Payload format invalid",
+	ReasonRetainNotSupported:                  "Retain not supported",
+	ReasonQoSNotSupported:                     "QoS not supported",
+	ReasonUseAnotherServer:                    "Use another server",
+	ReasonServerMoved:                         "Server moved",
+	ReasonSharedSubscriptionsNotSupported:     "Shared Subscriptions not supported",
+	ReasonConnectionRateExceeded:              "Connection rate exceeded",
+	ReasonMaximumConnectTime:                  "Maximum connect time",
+	ReasonSubscriptionIdentifiersNotSupported: "Subscription Identifiers not supported",
+	ReasonWildcardSubscriptionsNotSupported:   "Wildcard Subscriptions not supported",
+}
+
+func (c ReasonCode) String() string {
+	if s, ok := reasonCodeNames[c]; ok {
+		return s
+	}
+	return "Reserved for future use"
+}
+
+// IsError reports whether the code indicates a failure
+func (c ReasonCode) IsError() bool {
+	return c >= 0x80
+}
+
+// reasonCodes holds the reason codes each packet type may carry
+var reasonCodes = map[byte][]ReasonCode{
+	Connack: {
+		ReasonSuccess, ReasonUnspecifiedError, ReasonMalformedPacket,
+		ReasonProtocolError, ReasonImplementationSpecificError,
+		ReasonUnsupportedProtocolVersion, ReasonClientIdentifierNotValid,
+		ReasonBadUserNameOrPassword, ReasonNotAuthorized, ReasonServerUnavailable,
+		ReasonServerBusy, ReasonBanned, ReasonBadAuthenticationMethod,
+		ReasonTopicNameInvalid, ReasonPacketTooLarge, ReasonQuotaExceeded,
+		ReasonPayloadFormatInvalid, ReasonRetainNotSupported, ReasonQoSNotSupported,
+		ReasonUseAnotherServer, ReasonServerMoved, ReasonConnectionRateExceeded,
+	},
+	Puback: {
+		ReasonSuccess, ReasonNoMatchingSubscribers, ReasonUnspecifiedError,
+		ReasonImplementationSpecificError, ReasonNotAuthorized, ReasonTopicNameInvalid,
+		ReasonPacketIdentifierInUse, ReasonQuotaExceeded, ReasonPayloadFormatInvalid,
+	},
+	Pubrec: {
+		ReasonSuccess, ReasonNoMatchingSubscribers, ReasonUnspecifiedError,
+		ReasonImplementationSpecificError, ReasonNotAuthorized, ReasonTopicNameInvalid,
+		ReasonPacketIdentifierInUse, ReasonQuotaExceeded, ReasonPayloadFormatInvalid,
+	},
+	Pubrel:  {ReasonSuccess, ReasonPacketIdentifierNotFound},
+	Pubcomp: {ReasonSuccess, ReasonPacketIdentifierNotFound},
+	Suback: {
+		ReasonGrantedQoS0, ReasonGrantedQoS1, ReasonGrantedQoS2,
+		ReasonUnspecifiedError, ReasonImplementationSpecificError,
+		ReasonNotAuthorized, ReasonTopicFilterInvalid, ReasonPacketIdentifierInUse,
+		ReasonQuotaExceeded, ReasonSharedSubscriptionsNotSupported,
+		ReasonSubscriptionIdentifiersNotSupported, ReasonWildcardSubscriptionsNotSupported,
+	},
+	Unsuback: {
+		ReasonSuccess, ReasonNoSubscriptionExisted, ReasonUnspecifiedError,
+		ReasonImplementationSpecificError, ReasonNotAuthorized,
+		ReasonTopicFilterInvalid, ReasonPacketIdentifierInUse,
+	},
+	Disconnect: {
+		ReasonNormalDisconnection, ReasonDisconnectWithWill, ReasonUnspecifiedError,
+		ReasonMalformedPacket, ReasonProtocolError, ReasonImplementationSpecificError,
+		ReasonNotAuthorized, ReasonServerBusy, ReasonServerShuttingDown,
+		ReasonKeepAliveTimeout, ReasonSessionTakenOver, ReasonTopicFilterInvalid,
+		ReasonTopicNameInvalid, ReasonReceiveMaximumExceeded, ReasonTopicAliasInvalid,
+		ReasonPacketTooLarge, ReasonMessageRateTooHigh, ReasonQuotaExceeded,
+		ReasonAdministrativeAction, ReasonPayloadFormatInvalid, ReasonRetainNotSupported,
+		ReasonQoSNotSupported, ReasonUseAnotherServer, ReasonServerMoved,
+		ReasonSharedSubscriptionsNotSupported, ReasonConnectionRateExceeded,
+		ReasonMaximumConnectTime, ReasonSubscriptionIdentifiersNotSupported,
+		ReasonWildcardSubscriptionsNotSupported,
+	},
+	Auth: {ReasonSuccess, ReasonContinueAuthentication, ReasonReauthenticate},
+}
+
+// isValidReasonCode reports whether the packet type may carry the code
+func isValidReasonCode(pktType byte, c ReasonCode) bool {
+	for _, valid := range reasonCodes[pktType] {
+		if c == valid {
+			return true
+		}
+	}
+	return false
+}
@@ -2,10 +2,53 @@ package protocol
 
 import "fmt"
 
-// TopicQoS holds both a topic and it's qos
+// TopicQoS holds both a topic and it's qos plus the rest of the MQTT 5
+// subscription options, which are only serialized under MQTT 5
 type TopicQoS struct {
 	Topic []byte
 	Qos   byte
+	// NoLocal is set if the client's own publishes shouldn't be
+	// forwarded to it
+	NoLocal bool
+	// RetainAsPublished is set if forwarded publishes should keep their
+	// RETAIN flag
+	RetainAsPublished bool
+	// RetainHandling is one of RetainSendOnSubscribe etc
+	RetainHandling byte
+}
+
+// RetainSendOnSubscribe etc set whether retained messages are sent when
+// a subscription is made
+const (
+	RetainSendOnSubscribe byte = iota
+	RetainSendOnNewSubscription
+	RetainDoNotSend
+)
+
+// Options returns the MQTT 5 subscription options byte
+func (t TopicQoS) Options() byte {
+	opts := t.Qos | t.RetainHandling<<4
+	if t.NoLocal {
+		opts |= 0x04
+	}
+	if t.RetainAsPublished {
+		opts |= 0x08
+	}
+	return opts
+}
+
+// SetOptions sets the QoS and the rest of the subscription options from
+// an MQTT 5 subscription options byte. Returns ErrInvalidPacket if the
+// reserved bits are set or the QoS or Retain Handling are invalid
+func (t *TopicQoS) SetOptions(opts byte) error {
+	if opts&0xC0 != 0 || opts&0x03 > 2 || opts>>4&0x03 > RetainDoNotSend {
+		return ErrInvalidPacket
+	}
+	t.Qos = opts & 0x03
+	t.NoLocal = opts&0x04 != 0
+	t.RetainAsPublished = opts&0x08 != 0
+	t.RetainHandling = opts >> 4 & 0x03
+	return nil
 }
 
 // SubscribePacket is an in-mem representation
@@ -13,6 +56,8 @@ type TopicQoS struct {
 type SubscribePacket struct {
 	PacketIdentifier uint16
 	List             []TopicQoS
+	// Properties are only serialized under MQTT 5
+	Properties *Properties
 }
 
 // AddTopic adds a given topic plus QoS level to the Subscribe Packet,
@@ -22,14 +67,31 @@ func (p *SubscribePacket) AddTopic(topic []byte, QoS byte) error {
 		return fmt.Errorf("Invalid QoS: %d", QoS)
 	}
 	// TODO add error checking for topics
-	p.List = append(p.List, TopicQoS{topic, QoS})
+	p.List = append(p.List, TopicQoS{Topic: topic, Qos: QoS})
+	return nil
+}
+
+// AddSubscription adds a topic filter with the given subscription
+// options, which are only serialized under MQTT 5
+func (p *SubscribePacket) AddSubscription(t TopicQoS) error {
+	if t.Qos > 2 {
+		return fmt.Errorf("Invalid QoS: %d", t.Qos)
+	}
+	if t.RetainHandling > RetainDoNotSend {
+		return fmt.Errorf("Invalid Retain Handling: %d", t.RetainHandling)
+	}
+	p.List = append(p.List, t)
 	return nil
 }
 
 // Serialize serializes the contents of a subscribe packet into
 // a []byte buffer.
 func (p *SubscribePacket) Serialize(b []byte) ([]byte, error) {
-	lenPkt := p.Len()
+	return p.serializeLevel(b, ProtocolLevel311)
+}
+
+func (p *SubscribePacket) serializeLevel(b []byte, level byte) ([]byte, error) {
+	lenPkt := p.lenLevel(level)
 	if b == nil {
 		b = make([]byte, lenPkt)
 	}
@@ -42,30 +104,44 @@ func (p *SubscribePacket) Serialize(b []byte) ([]byte, error) {
 	// write fixed header
 	buf := newWritableBuf(b)
 	buf.WriteByte(Subscribe<<4 | 0x02)
-	writePayloadSize(buf, uint32(p.payloadLen()))
+	writePayloadSize(buf, uint32(p.payloadLen(level)))
 	// write packet identifier
 	buf.WriteUInt16(p.PacketIdentifier)
+	if level == ProtocolLevel5 {
+		buf.writeProperties(p.Properties)
+	}
 	// write topics
 	for _, t := range p.List {
 		buf.writeMQTTStr(t.Topic)
-		buf.WriteByte(t.Qos)
+		if level == ProtocolLevel5 {
+			buf.WriteByte(t.Options())
+		} else {
+			buf.WriteByte(t.Qos)
+		}
 	}
 
 	return b[:buf.bytesWritten()], nil
 }
 
-func (p *SubscribePacket) payloadLen() int {
+func (p *SubscribePacket) payloadLen(level byte) int {
 	payloadLen := 2 // for packet identifier
 	for _, t := range p.List {
 		payloadLen = payloadLen + 2 + len(t.Topic) + 1
 	}
+	if level == ProtocolLevel5 {
+		payloadLen += lenPropertiesSection(p.Properties)
+	}
 	return payloadLen
 }
 
 // Len returns number of bytes subscribe packet will
 // take when serialized
 func (p *SubscribePacket) Len() int {
-	payloadLen := p.payloadLen()
+	return p.lenLevel(ProtocolLevel311)
+}
+
+func (p *SubscribePacket) lenLevel(level byte) int {
+	payloadLen := p.payloadLen(level)
 	return 1 + // control pkt type + flags
 		lenPayloadSizeField(payloadLen) + // remaining length field
 		payloadLen
@@ -74,6 +150,10 @@ func (p *SubscribePacket) Len() int {
 // DeserializeSubscribePktPayload parses the contents of a bytes slice and returns
 // a PublishPacket as required.
 func DeserializeSubscribePktPayload(f FixedHeader, p []byte) (*SubscribePacket, error) {
+	return deserializeSubscribe(f, p, ProtocolLevel311)
+}
+
+func deserializeSubscribe(f FixedHeader, p []byte, level byte) (*SubscribePacket, error) {
 	if !f.IsValidFlagsSet() {
 		return nil, ErrInvalidPacket
 	}
@@ -81,10 +161,26 @@ func DeserializeSubscribePktPayload(f FixedHeader, p []byte) (*SubscribePacket,
 	pkt := &SubscribePacket{}
 	pr := &pktReader{from: p}
 	pkt.PacketIdentifier = pr.readUInt16()
-	for !pr.isReadComplete() {
+	if level == ProtocolLevel5 {
+		pkt.Properties = pr.readProperties(Subscribe)
+	}
+	for pr.err == nil && !pr.isReadComplete() {
 		topic := pr.readStr()
-		qos := pr.readByte()
-		if err := pkt.AddTopic(topic, qos); err != nil {
+		opts := pr.readByte()
+		if pr.err != nil {
+			break
+		}
+		// under MQTT 5 the QoS is the lower 2 bits of the subscription
+		// options
+		if level == ProtocolLevel5 {
+			t := TopicQoS{Topic: topic}
+			if err := t.SetOptions(opts); err != nil {
+				return nil, err
+			}
+			pkt.List = append(pkt.List, t)
+			continue
+		}
+		if err := pkt.AddTopic(topic, opts); err != nil {
 			return nil, err
 		}
 	}
@@ -98,7 +194,11 @@ func DeserializeSubscribePktPayload(f FixedHeader, p []byte) (*SubscribePacket,
 // of a sub packet
 type SubackPacket struct {
 	PacketIdentifier uint16
-	ReturnCodes      []byte
+	// ReturnCodes hold MQTT 5 reason codes under MQTT 5, failures are
+	// serialized as 0x80 under 3.1.1
+	ReturnCodes []byte
+	// Properties are only serialized under MQTT 5
+	Properties *Properties
 }
 
 // AddQoSGranted adds the QoS granted
@@ -127,7 +227,11 @@ func (p *SubackPacket) AddCode(c byte) error {
 // Serialize serializes the contents of a suback packet into
 // a []byte buffer.
 func (p *SubackPacket) Serialize(b []byte) ([]byte, error) {
-	lenPkt := p.Len()
+	return p.serializeLevel(b, ProtocolLevel311)
+}
+
+func (p *SubackPacket) serializeLevel(b []byte, level byte) ([]byte, error) {
+	lenPkt := p.lenLevel(level)
 	if b == nil {
 		b = make([]byte, lenPkt)
 	}
@@ -141,25 +245,39 @@ func (p *SubackPacket) Serialize(b []byte) ([]byte, error) {
 	// write fixed header
 	buf := newWritableBuf(b)
 	buf.WriteByte(Suback<<4 | 0x00)
-	writePayloadSize(buf, uint32(p.payloadLen()))
+	writePayloadSize(buf, uint32(p.payloadLen(level)))
 	// write packet identifier
 	buf.WriteUInt16(p.PacketIdentifier)
+	if level == ProtocolLevel5 {
+		buf.writeProperties(p.Properties)
+	}
 	// write return codes
 	for _, c := range p.ReturnCodes {
+		if level != ProtocolLevel5 && c > 2 {
+			c = 0x80
+		}
 		buf.WriteByte(c)
 	}
 
 	return b[:buf.bytesWritten()], nil
 }
 
-func (p *SubackPacket) payloadLen() int {
-	return 2 + len(p.ReturnCodes)
+func (p *SubackPacket) payloadLen(level byte) int {
+	payloadLen := 2 + len(p.ReturnCodes)
+	if level == ProtocolLevel5 {
+		payloadLen += lenPropertiesSection(p.Properties)
+	}
+	return payloadLen
 }
 
 // Len returns number of bytes suback packet will
 // take when serialized
 func (p *SubackPacket) Len() int {
-	payloadLen := p.payloadLen()
+	return p.lenLevel(ProtocolLevel311)
+}
+
+func (p *SubackPacket) lenLevel(level byte) int {
+	payloadLen := p.payloadLen(level)
 	return 1 + // control pkt type + flags
 		lenPayloadSizeField(payloadLen) + // remaining length field
 		payloadLen
@@ -168,6 +286,10 @@ func (p *SubackPacket) Len() int {
 // DeserializeSubackPktPayload parses the contents of a bytes slice and returns
 // a PublishPacket as required.
 func DeserializeSubackPktPayload(f FixedHeader, p []byte) (*SubackPacket, error) {
+	return deserializeSuback(f, p, ProtocolLevel311)
+}
+
+func deserializeSuback(f FixedHeader, p []byte, level byte) (*SubackPacket, error) {
 	if !f.IsValidFlagsSet() {
 		return nil, ErrInvalidPacket
 	}
@@ -175,9 +297,17 @@ func DeserializeSubackPktPayload(f FixedHeader, p []byte) (*SubackPacket, error)
 	pkt := &SubackPacket{}
 	pr := &pktReader{from: p}
 	pkt.PacketIdentifier = pr.readUInt16()
-	for !pr.isReadComplete() {
+	if level == ProtocolLevel5 {
+		pkt.Properties = pr.readProperties(Suback)
+	}
+	for pr.err == nil && !pr.isReadComplete() {
 		c := pr.readByte()
-		if err := pkt.AddCode(c); err != nil {
+		if level == ProtocolLevel5 {
+			if !isValidReasonCode(Suback, ReasonCode(c)) {
+				return nil, ErrInvalidPacket
+			}
+			pkt.ReturnCodes = append(pkt.ReturnCodes, c)
+		} else if err := pkt.AddCode(c); err != nil {
 			return nil, err
 		}
 	}
@@ -192,6 +322,8 @@ func DeserializeSubackPktPayload(f FixedHeader, p []byte) (*SubackPacket, error)
 type UnsubscribePacket struct {
 	PacketIdentifier uint16
 	List             [][]byte
+	// Properties are only serialized under MQTT 5
+	Properties *Properties
 }
 
 // AddTopic adds a given topic that a client wishes to
@@ -205,7 +337,11 @@ func (p *UnsubscribePacket) AddTopic(topic []byte) error {
 // Serialize serializes the contents of a unsub packet into
 // a []byte buffer.
 func (p *UnsubscribePacket) Serialize(b []byte) ([]byte, error) {
-	lenPkt := p.Len()
+	return p.serializeLevel(b, ProtocolLevel311)
+}
+
+func (p *UnsubscribePacket) serializeLevel(b []byte, level byte) ([]byte, error) {
+	lenPkt := p.lenLevel(level)
 	if b == nil {
 		b = make([]byte, lenPkt)
 	}
@@ -218,9 +354,12 @@ func (p *UnsubscribePacket) Serialize(b []byte) ([]byte, error) {
 	// write fixed header
 	buf := newWritableBuf(b)
 	buf.WriteByte(Unsubscribe<<4 | 0x02)
-	writePayloadSize(buf, uint32(p.payloadLen()))
+	writePayloadSize(buf, uint32(p.payloadLen(level)))
 	// write packet identifier
 	buf.WriteUInt16(p.PacketIdentifier)
+	if level == ProtocolLevel5 {
+		buf.writeProperties(p.Properties)
+	}
 	// write topics
 	for _, topic := range p.List {
 		buf.writeMQTTStr(topic)
@@ -229,18 +368,25 @@ func (p *UnsubscribePacket) Serialize(b []byte) ([]byte, error) {
 	return b[:buf.bytesWritten()], nil
 }
 
-func (p *UnsubscribePacket) payloadLen() int {
+func (p *UnsubscribePacket) payloadLen(level byte) int {
 	payloadLen := 2
 	for _, topic := range p.List {
 		payloadLen = payloadLen + 2 + len(topic)
 	}
+	if level == ProtocolLevel5 {
+		payloadLen += lenPropertiesSection(p.Properties)
+	}
 	return payloadLen
 }
 
 // Len returns number of bytes publish packet will
 // take when serialized
 func (p *UnsubscribePacket) Len() int {
-	payloadLen := p.payloadLen()
+	return p.lenLevel(ProtocolLevel311)
+}
+
+func (p *UnsubscribePacket) lenLevel(level byte) int {
+	payloadLen := p.payloadLen(level)
 	return 1 + // control pkt type + flags
 		lenPayloadSizeField(payloadLen) + // remaining length field
 		payloadLen
@@ -249,6 +395,10 @@ func (p *UnsubscribePacket) Len() int {
 // DeserializeUnsubscribePktPayload parses the contents of a bytes slice and returns
 // a Unsubscribe as required.
 func DeserializeUnsubscribePktPayload(f FixedHeader, p []byte) (*UnsubscribePacket, error) {
+	return deserializeUnsubscribe(f, p, ProtocolLevel311)
+}
+
+func deserializeUnsubscribe(f FixedHeader, p []byte, level byte) (*UnsubscribePacket, error) {
 	if !f.IsValidFlagsSet() {
 		return nil, ErrInvalidPacket
 	}
@@ -256,7 +406,10 @@ func DeserializeUnsubscribePktPayload(f FixedHeader, p []byte) (*UnsubscribePack
 	pkt := &UnsubscribePacket{}
 	pr := &pktReader{from: p}
 	pkt.PacketIdentifier = pr.readUInt16()
-	for !pr.isReadComplete() {
+	if level == ProtocolLevel5 {
+		pkt.Properties = pr.readProperties(Unsubscribe)
+	}
+	for pr.err == nil && !pr.isReadComplete() {
 		topic := pr.readStr()
 		if err := pkt.AddTopic(topic); err != nil {
 			return nil, err
@@ -272,12 +425,20 @@ func DeserializeUnsubscribePktPayload(f FixedHeader, p []byte) (*UnsubscribePack
 // of a unsuback packet
 type UnsubackPacket struct {
 	PacketIdentifier uint16
+	// ReasonCodes, one per topic filter, and Properties are only
+	// serialized under MQTT 5
+	ReasonCodes []ReasonCode
+	Properties  *Properties
 }
 
 // Serialize serializes the contents of a unsuback packet into
 // a []byte buffer.
 func (p *UnsubackPacket) Serialize(b []byte) ([]byte, error) {
-	lenPkt := p.Len()
+	return p.serializeLevel(b, ProtocolLevel311)
+}
+
+func (p *UnsubackPacket) serializeLevel(b []byte, level byte) ([]byte, error) {
+	lenPkt := p.lenLevel(level)
 	if b == nil {
 		b = make([]byte, lenPkt)
 	}
@@ -287,31 +448,71 @@ func (p *UnsubackPacket) Serialize(b []byte) ([]byte, error) {
 	if lenPkt > maxPayloadSize {
 		return nil, ErrInvalidPacket
 	}
-	b[0] = Unsuback<<4 | 0x00
-	b[1] = 2
-	b[2] = byte(p.PacketIdentifier >> 8)
-	b[3] = byte(p.PacketIdentifier)
-	return b[:4], nil
+	buf := newWritableBuf(b)
+	buf.WriteByte(Unsuback<<4 | 0x00)
+	writePayloadSize(buf, uint32(p.payloadLen(level)))
+	buf.WriteUInt16(p.PacketIdentifier)
+	if level == ProtocolLevel5 {
+		buf.writeProperties(p.Properties)
+		for _, c := range p.ReasonCodes {
+			buf.WriteByte(byte(c))
+		}
+	}
+	return b[:buf.bytesWritten()], nil
+}
+
+func (p *UnsubackPacket) payloadLen(level byte) int {
+	if level != ProtocolLevel5 {
+		return 2
+	}
+	return 2 + lenPropertiesSection(p.Properties) + len(p.ReasonCodes)
 }
 
 // Len returns number of bytes packet will
 // take when serialized
 func (p *UnsubackPacket) Len() int {
-	// fixed header(2 bytes) + payload(2)
-	return 4
+	return p.lenLevel(ProtocolLevel311)
+}
+
+func (p *UnsubackPacket) lenLevel(level byte) int {
+	payloadLen := p.payloadLen(level)
+	return 1 + // control pkt type + flags
+		lenPayloadSizeField(payloadLen) + // remaining length field
+		payloadLen
 }
 
 // DeserializeUnsubackPktPayload parses the contents of a bytes slice and returns
 // a Unsuback packet as required.
 func DeserializeUnsubackPktPayload(f FixedHeader, p []byte) (*UnsubackPacket, error) {
+	return deserializeUnsuback(f, p, ProtocolLevel311)
+}
+
+func deserializeUnsuback(f FixedHeader, p []byte, level byte) (*UnsubackPacket, error) {
 	if !f.IsValidFlagsSet() {
 		return nil, ErrInvalidPacket
 	}
-	// payload must be of length 2
-	if len(p) != 2 {
-		return nil, ErrInvalidPacket
+	if level != ProtocolLevel5 {
+		// payload must be of length 2
+		if len(p) != 2 {
+			return nil, ErrInvalidPacket
+		}
+		return &UnsubackPacket{
+			PacketIdentifier: uint16(p[0])<<8 + uint16(p[1]),
+		}, nil
+	}
+	pkt := &UnsubackPacket{}
+	pr := &pktReader{from: p}
+	pkt.PacketIdentifier = pr.readUInt16()
+	pkt.Properties = pr.readProperties(Unsuback)
+	for pr.err == nil && !pr.isReadComplete() {
+		c := ReasonCode(pr.readByte())
+		if !isValidReasonCode(Unsuback, c) {
+			return nil, ErrInvalidPacket
+		}
+		pkt.ReasonCodes = append(pkt.ReasonCodes, c)
 	}
-	return &UnsubackPacket{
-		PacketIdentifier: uint16(p[0])<<8 + uint16(p[1]),
-	}, nil
+	if pr.err != nil {
+		return nil, pr.err
+	}
+	return pkt, nil
 }
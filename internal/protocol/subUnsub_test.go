@@ -20,7 +20,7 @@ func TestSubscribePacket(t *testing.T) {
 	f, err := ReadFixedHeader(bytes.NewReader(serialized))
 	require.Equal(t, f.PktType, Subscribe)
 	require.True(t, f.IsValidFlagsSet())
-	require.Equal(t, uint32(pkt.payloadLen()), f.PayloadSize)
+	require.Equal(t, uint32(pkt.payloadLen(ProtocolLevel311)), f.PayloadSize)
 
 	// check payload
 	payload := serialized[len(serialized)-int(f.PayloadSize):]
@@ -44,7 +44,7 @@ func TestSubackPacket(t *testing.T) {
 	f, err := ReadFixedHeader(bytes.NewReader(serialized))
 	require.Equal(t, f.PktType, Suback)
 	require.True(t, f.IsValidFlagsSet())
-	require.Equal(t, uint32(pkt.payloadLen()), f.PayloadSize)
+	require.Equal(t, uint32(pkt.payloadLen(ProtocolLevel311)), f.PayloadSize)
 
 	// check payload
 	payload := serialized[len(serialized)-int(f.PayloadSize):]
@@ -67,7 +67,7 @@ func TestUnsubscribePacket(t *testing.T) {
 	f, err := ReadFixedHeader(bytes.NewReader(serialized))
 	require.Equal(t, f.PktType, Unsubscribe)
 	require.True(t, f.IsValidFlagsSet())
-	require.Equal(t, uint32(pkt.payloadLen()), f.PayloadSize)
+	require.Equal(t, uint32(pkt.payloadLen(ProtocolLevel311)), f.PayloadSize)
 
 	// check payload
 	payload := serialized[len(serialized)-int(f.PayloadSize):]
@@ -96,3 +96,61 @@ func TestUnsubackPacket(t *testing.T) {
 	require.NotNil(t, pktRcvd)
 	require.Equal(t, pkt, pktRcvd)
 }
+
+func TestSubUnsubPacketsMQTT5(t *testing.T) {
+	sub := &SubscribePacket{
+		PacketIdentifier: 1,
+		Properties: &Properties{
+			SubscriptionIdentifiers: []uint32{42},
+			UserProperties:          []UserProperty{{[]byte("k"), []byte("v")}},
+		},
+	}
+	sub.AddTopic([]byte("a/+"), 1)
+	sub.AddTopic([]byte("b/#"), 2)
+	require.NoError(t, sub.AddSubscription(TopicQoS{
+		Topic:             []byte("c"),
+		Qos:               1,
+		NoLocal:           true,
+		RetainAsPublished: true,
+		RetainHandling:    RetainDoNotSend,
+	}))
+	require.Error(t, sub.AddSubscription(TopicQoS{Topic: []byte("d"), RetainHandling: 3}))
+	require.Equal(t, sub, roundTrip(t, sub, ProtocolLevel5))
+	// only the QoS is serialized under 3.1.1
+	require.Equal(t, TopicQoS{Topic: []byte("c"), Qos: 1}, roundTrip(t, sub, ProtocolLevel311).(*SubscribePacket).List[2])
+
+	suback := &SubackPacket{
+		PacketIdentifier: 1,
+		ReturnCodes:      []byte{1, byte(ReasonNotAuthorized), byte(ReasonWildcardSubscriptionsNotSupported)},
+		Properties:       &Properties{ReasonString: []byte("denied")},
+	}
+	require.Equal(t, suback, roundTrip(t, suback, ProtocolLevel5))
+	// MQTT 5 failure codes are sent as 0x80 under 3.1.1
+	require.Equal(t, []byte{1, 0x80, 0x80}, roundTrip(t, suback, ProtocolLevel311).(*SubackPacket).ReturnCodes)
+
+	unsub := &UnsubscribePacket{PacketIdentifier: 2, Properties: &Properties{
+		UserProperties: []UserProperty{{[]byte("k"), []byte("v")}},
+	}}
+	unsub.AddTopic([]byte("a/+"))
+	require.Equal(t, unsub, roundTrip(t, unsub, ProtocolLevel5))
+
+	unsuback := &UnsubackPacket{
+		PacketIdentifier: 2,
+		ReasonCodes:      []ReasonCode{ReasonSuccess, ReasonNoSubscriptionExisted},
+	}
+	require.Equal(t, unsuback, roundTrip(t, unsuback, ProtocolLevel5))
+	require.Equal(t, &UnsubackPacket{PacketIdentifier: 2}, roundTrip(t, unsuback, ProtocolLevel311))
+
+	// the reserved bits of the subscription options must not be set, nor
+	// can the QoS or Retain Handling be 3
+	serialized, err := Versioned(sub, ProtocolLevel5).Serialize(nil)
+	require.NoError(t, err)
+	f, err := ReadFixedHeader(bytes.NewReader(serialized))
+	require.NoError(t, err)
+	for _, opts := range []byte{0x40, 0x80, 0x03, 0x30} {
+		invalid := append([]byte(nil), serialized...)
+		invalid[len(invalid)-1] = opts
+		_, err = DeserializePacket(f, invalid[len(invalid)-int(f.PayloadSize):], ProtocolLevel5)
+		require.Equal(t, ErrInvalidPacket, err, "options %#x", opts)
+	}
+}
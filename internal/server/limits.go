@@ -0,0 +1,142 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// tokenBucket is a simple token bucket used to throttle the rate at which
+// new connections are accepted. Tokens are added at a fixed rate up to
+// burst, each accepted connection takes up one token.
+type tokenBucket struct {
+	mu       sync.Mutex
+	rate     float64 // tokens per second
+	burst    float64
+	tokens   float64
+	lastFill time.Time
+	now      func() time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	b := &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		now:    time.Now,
+	}
+	b.lastFill = b.now()
+	return b
+}
+
+// reserve takes up a token. If none is available, it returns how long
+// the caller should wait before trying again
+func (b *tokenBucket) reserve() (wait time.Duration, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	b.tokens += now.Sub(b.lastFill).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.lastFill = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0, true
+	}
+	missing := 1 - b.tokens
+	return time.Duration(missing / b.rate * float64(time.Second)), false
+}
+
+// connTracker keeps count of the currently open connections, both
+// globally and per source IP so that the caps can be enforced
+type connTracker struct {
+	mu            sync.Mutex
+	maxConns      int
+	maxConnsPerIP int
+	nConns        int
+	perIP         map[string]int
+}
+
+type rejectReason int
+
+const (
+	notRejected rejectReason = iota
+	rejectedMaxConns
+	rejectedMaxConnsPerIP
+)
+
+func (r rejectReason) String() string {
+	switch r {
+	case rejectedMaxConns:
+		return "max connections reached"
+	case rejectedMaxConnsPerIP:
+		return "max connections per IP reached"
+	default:
+		return "not rejected"
+	}
+}
+
+// acquire registers a new connection from the given ip. If either cap
+// has been reached, the connection is not registered and the reason
+// is returned
+func (t *connTracker) acquire(ip string) rejectReason {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.maxConns > 0 && t.nConns >= t.maxConns {
+		return rejectedMaxConns
+	}
+	if t.maxConnsPerIP > 0 && t.perIP[ip] >= t.maxConnsPerIP {
+		return rejectedMaxConnsPerIP
+	}
+	t.nConns++
+	t.perIP[ip]++
+	return notRejected
+}
+
+func (t *connTracker) release(ip string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.nConns--
+	if t.perIP[ip] <= 1 {
+		delete(t.perIP, ip)
+	} else {
+		t.perIP[ip]--
+	}
+}
+
+func (t *connTracker) active() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.nConns
+}
+
+// trackedConn releases its slot in the connTracker once closed.
+// The handler remains responsible for closing the connection
+type trackedConn struct {
+	net.Conn
+	onceRelease sync.Once
+	release     func()
+}
+
+func (c *trackedConn) Close() error {
+	err := c.Conn.Close()
+	c.onceRelease.Do(c.release)
+	return err
+}
+
+func remoteIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
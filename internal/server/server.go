@@ -1,10 +1,15 @@
 package server
 
 import (
-	"io/ioutil"
-	"log"
+	"errors"
 	"net"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/nagamocha3000/go-mqtt-broker/internal/logging"
+	"github.com/nagamocha3000/go-mqtt-broker/internal/metrics"
 )
 
 // ConnHandler encapsulates both an OnConn function that the server calls whenever there's
@@ -19,62 +24,274 @@ type ConnHandler interface {
 // Server handles network details such as receiving new connections.
 // structuring credit: https://eli.thegreenplace.net/2020/graceful-shutdown-of-a-tcp-server-in-go/#
 type Server struct {
+	stats    Stats // accessed atomically, kept first for 64-bit alignment
 	listener net.Listener
 	quitCh   chan struct{}
+	doneCh   chan struct{} // closed once server stops accepting
+	err      error         // error that stopped the server accepting, set before doneCh is closed
 	onceStop sync.Once
 	handler  ConnHandler
-	logger   *log.Logger
+	logger   logging.Logger
+
+	// connection limits, all are optional
+	conns       connTracker
+	rateLimiter *tokenBucket
+}
+
+// Stats holds counters on connections the server has accepted
+// or rejected since it started
+type Stats struct {
+	Accepted              uint64
+	RejectedMaxConns      uint64
+	RejectedMaxConnsPerIP uint64
+	AcceptErrors          uint64
+}
+
+// Option configures an optional setting on the Server
+type Option func(*Server)
+
+// WithLogger sets the logger the server uses, by default nothing is logged
+func WithLogger(l logging.Logger) Option {
+	return func(s *Server) {
+		s.logger = l
+	}
+}
+
+// WithMetrics registers the server's connection metrics in the given registry
+func WithMetrics(reg *metrics.Registry) Option {
+	return func(s *Server) {
+		reg.NewGaugeFunc("mqtt_server_open_connections",
+			"Number of network connections currently open",
+			func() float64 { return float64(s.ActiveConns()) })
+		reg.NewCounterFunc("mqtt_server_accepted_connections_total",
+			"Number of network connections accepted",
+			func() float64 { return float64(s.Stats().Accepted) })
+		reg.NewCounterFunc("mqtt_server_rejected_max_conns_total",
+			"Number of network connections rejected since max connections was reached",
+			func() float64 { return float64(s.Stats().RejectedMaxConns) })
+		reg.NewCounterFunc("mqtt_server_rejected_max_conns_per_ip_total",
+			"Number of network connections rejected since max connections per IP was reached",
+			func() float64 { return float64(s.Stats().RejectedMaxConnsPerIP) })
+		reg.NewCounterFunc("mqtt_server_accept_errors_total",
+			"Number of errors encountered while accepting network connections",
+			func() float64 { return float64(s.Stats().AcceptErrors) })
+	}
+}
+
+// WithMaxConns caps the number of connections that can be open at any
+// given time. Connections beyond the cap are closed immediately. A value
+// of 0 means no cap
+func WithMaxConns(n int) Option {
+	return func(s *Server) {
+		s.conns.maxConns = n
+	}
+}
+
+// WithMaxConnsPerIP caps the number of connections that can be open
+// from a single source IP. A value of 0 means no cap
+func WithMaxConnsPerIP(n int) Option {
+	return func(s *Server) {
+		s.conns.maxConnsPerIP = n
+	}
+}
+
+// WithAcceptRate throttles the rate at which connections are accepted
+// to perSecond, allowing for bursts of up to burst connections. Once the
+// rate is exceeded, the server stops accepting until a token is available
+// leaving new connections in the listen backlog
+func WithAcceptRate(perSecond float64, burst int) Option {
+	return func(s *Server) {
+		if perSecond > 0 {
+			s.rateLimiter = newTokenBucket(perSecond, burst)
+		}
+	}
 }
 
 // NewServer sets up server plus starts listening on new client connections
 // in separate go routine. Callers should find a way to block
-func NewServer(addr string, handler ConnHandler) (*Server, error) {
+func NewServer(addr string, handler ConnHandler, opts ...Option) (*Server, error) {
 	listener, err := net.Listen("tcp", addr)
 	if err != nil {
 		return nil, err
 	}
+	return newServer(listener, handler, opts...), nil
+}
 
+// NewServerWithListener is similar to NewServer but accepts connections
+// from the given listener, eg one set up with TLS or for a unix socket.
+// The server takes ownership of the listener and closes it once stopped
+func NewServerWithListener(listener net.Listener, handler ConnHandler, opts ...Option) *Server {
+	return newServer(listener, handler, opts...)
+}
+
+func newServer(listener net.Listener, handler ConnHandler, opts ...Option) *Server {
 	s := &Server{
 		listener: listener,
 		quitCh:   make(chan struct{}),
+		doneCh:   make(chan struct{}),
 		handler:  handler,
-		logger:   log.New(ioutil.Discard, "", 0),
+		logger:   logging.Nop(),
+		conns:    connTracker{perIP: make(map[string]int)},
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
 
 	go s.receiveConnections()
 
-	s.logger.Printf("server started on address: %s\n", s.listener.Addr())
-	return s, nil
+	s.logger.Info("server started", logging.F("addr", s.listener.Addr()))
+	return s
 }
 
+// Addr returns the address the server is listening on
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Stats returns a snapshot of the server's connection counters
+func (s *Server) Stats() Stats {
+	return Stats{
+		Accepted:              atomic.LoadUint64(&s.stats.Accepted),
+		RejectedMaxConns:      atomic.LoadUint64(&s.stats.RejectedMaxConns),
+		RejectedMaxConnsPerIP: atomic.LoadUint64(&s.stats.RejectedMaxConnsPerIP),
+		AcceptErrors:          atomic.LoadUint64(&s.stats.AcceptErrors),
+	}
+}
+
+// ActiveConns returns the number of connections currently open
+func (s *Server) ActiveConns() int {
+	return s.conns.active()
+}
+
+const (
+	minAcceptBackoff = 5 * time.Millisecond
+	maxAcceptBackoff = 1 * time.Second
+)
+
 func (s *Server) receiveConnections() {
+	defer close(s.doneCh)
+	var backoff time.Duration
 	for {
-		select {
-		case <-s.quitCh:
+		if !s.waitForAcceptToken() {
 			return
-		default:
-			conn, err := s.listener.Accept()
-			if err != nil {
-				s.logger.Println("server accept error:", err)
-				continue
+		}
+		conn, err := s.listener.Accept()
+		if err != nil {
+			select {
+			case <-s.quitCh:
+				return
+			default:
 			}
-			if conn == nil {
-				s.logger.Println("server create connection error:")
+			atomic.AddUint64(&s.stats.AcceptErrors, 1)
+			// transient errors such as EMFILE are retried after a backoff
+			// rather than immediately, otherwise the server spins
+			if isTransientAcceptError(err) {
+				if backoff == 0 {
+					backoff = minAcceptBackoff
+				} else if backoff *= 2; backoff > maxAcceptBackoff {
+					backoff = maxAcceptBackoff
+				}
+				s.logger.Warn("server accept error, retrying",
+					logging.Err(err), logging.F("backoff", backoff))
+				if !s.sleep(backoff) {
+					return
+				}
 				continue
 			}
-			s.handler.OnConn(conn)
+			// errors that won't go away, eg the listener being closed
+			s.logger.Error("server accept error, no longer accepting", logging.Err(err))
+			s.err = err
+			return
+		}
+		backoff = 0
+		if conn == nil {
+			s.logger.Error("server create connection error")
+			continue
+		}
+
+		ip := remoteIP(conn.RemoteAddr())
+		switch reason := s.conns.acquire(ip); reason {
+		case rejectedMaxConns:
+			atomic.AddUint64(&s.stats.RejectedMaxConns, 1)
+			s.reject(conn, reason)
+			continue
+		case rejectedMaxConnsPerIP:
+			atomic.AddUint64(&s.stats.RejectedMaxConnsPerIP, 1)
+			s.reject(conn, reason)
+			continue
+		}
+		atomic.AddUint64(&s.stats.Accepted, 1)
+		s.handler.OnConn(&trackedConn{
+			Conn:    conn,
+			release: func() { s.conns.release(ip) },
+		})
+	}
+}
+
+// isTransientAcceptError reports whether an accept error is likely to go
+// away, ie it's temporary or the process has run out of resources such
+// as file descriptors
+func isTransientAcceptError(err error) bool {
+	for _, errno := range []syscall.Errno{syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS, syscall.ENOMEM} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	ne, ok := err.(net.Error)
+	return ok && ne.Temporary()
+}
+
+func (s *Server) reject(conn net.Conn, reason rejectReason) {
+	s.logger.Warn("server rejected connection",
+		logging.F("remote_addr", conn.RemoteAddr()), logging.F("reason", reason))
+	conn.Close()
+}
+
+// waitForAcceptToken blocks until the rate limiter, if any, allows for
+// a new connection to be accepted. Returns false if the server is stopped
+// while waiting
+func (s *Server) waitForAcceptToken() bool {
+	if s.rateLimiter == nil {
+		return true
+	}
+	for {
+		wait, ok := s.rateLimiter.reserve()
+		if ok {
+			return true
 		}
+		if !s.sleep(wait) {
+			return false
+		}
+	}
+}
 
+// sleep returns false if the server is stopped before d elapses
+func (s *Server) sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-s.quitCh:
+		return false
+	case <-t.C:
+		return true
 	}
 }
 
+// Wait blocks until the server stops accepting connections. It returns
+// the error that stopped the server, nil if it was stopped via Stop
+func (s *Server) Wait() error {
+	<-s.doneCh
+	return s.err
+}
+
 // Stop shuts down server, waits for client sessions to close first
 // safe to call even if server not started
 func (s *Server) Stop() {
 	s.onceStop.Do(func() {
 		close(s.quitCh) // broadcast quit
 		s.listener.Close()
+		<-s.doneCh // no more calls to OnConn past this point
 		s.handler.Close()
-		s.logger.Println("server closed")
+		s.logger.Info("server closed")
 	})
 }
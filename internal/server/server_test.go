@@ -2,13 +2,18 @@ package server
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"log"
 	"net"
+	"os"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/nagamocha3000/go-mqtt-broker/internal/metrics"
 	"github.com/stretchr/testify/require"
 )
 
@@ -91,3 +96,201 @@ func TestServerSimpleHandleFastClients(t *testing.T) {
 		t.Errorf("Expected connection error on client connect attempt after server stop")
 	}
 }
+
+func dialAndWaitForClose(t *testing.T, addr net.Addr) bool {
+	conn, err := net.Dial(addr.Network(), addr.String())
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, err = conn.Read(make([]byte, 1))
+	// rejected connections are closed by the server, accepted ones
+	// are kept open by the test handler hence the read times out
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return false
+	}
+	return true
+}
+
+func TestServerMaxConns(t *testing.T) {
+	s, err := NewServer("127.0.0.1:0", &testHandler{}, WithMaxConns(2))
+	require.NoError(t, err)
+	defer s.Stop()
+
+	conns := make([]net.Conn, 0, 2)
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", s.Addr().String())
+		require.NoError(t, err)
+		conns = append(conns, conn)
+		defer conn.Close()
+	}
+	require.Eventually(t, func() bool { return s.ActiveConns() == 2 }, time.Second, 5*time.Millisecond)
+
+	// third connection should be rejected
+	require.True(t, dialAndWaitForClose(t, s.Addr()))
+	require.Equal(t, uint64(1), s.Stats().RejectedMaxConns)
+
+	// once a connection closes, a new one can be accepted
+	conns[0].Close()
+	require.Eventually(t, func() bool { return s.ActiveConns() == 1 }, time.Second, 5*time.Millisecond)
+	require.False(t, dialAndWaitForClose(t, s.Addr()))
+}
+
+func TestServerMaxConnsPerIP(t *testing.T) {
+	s, err := NewServer("127.0.0.1:0", &testHandler{}, WithMaxConnsPerIP(1))
+	require.NoError(t, err)
+	defer s.Stop()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Eventually(t, func() bool { return s.ActiveConns() == 1 }, time.Second, 5*time.Millisecond)
+
+	require.True(t, dialAndWaitForClose(t, s.Addr()))
+	require.Equal(t, uint64(1), s.Stats().RejectedMaxConnsPerIP)
+	require.Equal(t, uint64(1), s.Stats().Accepted)
+}
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(10, 2)
+	b.now = func() time.Time { return now }
+	b.lastFill = now
+
+	// burst
+	_, ok := b.reserve()
+	require.True(t, ok)
+	_, ok = b.reserve()
+	require.True(t, ok)
+
+	// out of tokens, should wait for 1/rate seconds
+	wait, ok := b.reserve()
+	require.False(t, ok)
+	require.Equal(t, 100*time.Millisecond, wait)
+
+	// refills as time passes, but never beyond burst
+	now = now.Add(100 * time.Millisecond)
+	_, ok = b.reserve()
+	require.True(t, ok)
+	now = now.Add(time.Hour)
+	require.Equal(t, float64(0), b.tokens)
+	_, ok = b.reserve()
+	require.True(t, ok)
+	require.Equal(t, float64(1), b.tokens)
+}
+
+// errTooManyOpenFiles is what Accept fails with once the process runs
+// out of file descriptors
+var errTooManyOpenFiles = &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", syscall.EMFILE)}
+
+// failingListener returns a transient error on every Accept
+type failingListener struct {
+	net.Listener
+	mu       sync.Mutex
+	accepts  []time.Time
+	closedCh chan struct{}
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	l.accepts = append(l.accepts, time.Now())
+	l.mu.Unlock()
+	select {
+	case <-l.closedCh:
+		return nil, fmt.Errorf("listener closed")
+	default:
+		return nil, errTooManyOpenFiles
+	}
+}
+
+func (l *failingListener) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func (l *failingListener) Close() error {
+	close(l.closedCh)
+	return nil
+}
+
+func TestServerBacksOffOnTransientAcceptErrors(t *testing.T) {
+	l := &failingListener{closedCh: make(chan struct{})}
+	s := newServer(l, &testHandler{})
+	time.Sleep(100 * time.Millisecond)
+	s.Stop()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// backoff is 5ms, 10ms, 20ms, 40ms ... so within 100ms there
+	// should only be a handful of attempts rather than a busy loop
+	require.True(t, len(l.accepts) > 1)
+	require.True(t, len(l.accepts) < 10, "accept attempts: %d", len(l.accepts))
+	require.Equal(t, uint64(len(l.accepts)), s.Stats().AcceptErrors)
+}
+
+// flakyListener fails the given number of accepts with a transient
+// error before accepting connections
+type flakyListener struct {
+	net.Listener
+	failures int32
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if atomic.AddInt32(&l.failures, -1) >= 0 {
+		return nil, errTooManyOpenFiles
+	}
+	return l.Listener.Accept()
+}
+
+func TestServerKeepsAcceptingAfterTransientAcceptErrors(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := NewServerWithListener(&flakyListener{Listener: l, failures: 3}, &testHandler{})
+	defer s.Stop()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Eventually(t, func() bool { return s.Stats().Accepted == 1 }, time.Second, 5*time.Millisecond)
+	require.Equal(t, uint64(3), s.Stats().AcceptErrors)
+}
+
+func TestServerWaitReturnsAcceptError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := NewServerWithListener(l, &testHandler{})
+	// closing the listener from under the server stops it with an error
+	l.Close()
+	require.Error(t, s.Wait())
+	require.Equal(t, uint64(1), s.Stats().AcceptErrors)
+	s.Stop()
+
+	s, err = NewServer("127.0.0.1:0", &testHandler{})
+	require.NoError(t, err)
+	s.Stop()
+	require.NoError(t, s.Wait())
+}
+
+func TestIsTransientAcceptError(t *testing.T) {
+	require.True(t, isTransientAcceptError(errTooManyOpenFiles))
+	require.True(t, isTransientAcceptError(syscall.ENFILE))
+	require.False(t, isTransientAcceptError(fmt.Errorf("use of closed network connection")))
+	require.False(t, isTransientAcceptError(&net.OpError{Op: "accept", Net: "tcp", Err: os.ErrClosed}))
+}
+
+func TestServerMetrics(t *testing.T) {
+	reg := metrics.NewRegistry()
+	s, err := NewServer("127.0.0.1:0", &testHandler{}, WithMaxConns(1), WithMetrics(reg))
+	require.NoError(t, err)
+	defer s.Stop()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Eventually(t, func() bool { return s.ActiveConns() == 1 }, time.Second, 5*time.Millisecond)
+	require.True(t, dialAndWaitForClose(t, s.Addr()))
+
+	var buf bytes.Buffer
+	require.NoError(t, reg.WriteText(&buf))
+	require.Contains(t, buf.String(), "mqtt_server_open_connections 1\n")
+	require.Contains(t, buf.String(), "mqtt_server_accepted_connections_total 1\n")
+	require.Contains(t, buf.String(), "mqtt_server_rejected_max_conns_total 1\n")
+}
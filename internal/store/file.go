@@ -0,0 +1,425 @@
+package store
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// SyncPolicy determines how often the FileStore fsyncs writes to disk,
+// trading off durability for throughput
+type SyncPolicy int
+
+const (
+	// SyncAlways fsyncs after every write. Nothing acknowledged is lost
+	// on a crash but every write waits for the disk
+	SyncAlways SyncPolicy = iota
+	// SyncBatch fsyncs once every batch size writes. Up to batch size - 1
+	// writes might be lost on a crash
+	SyncBatch
+	// SyncInterval fsyncs in the background at a fixed interval. Writes
+	// made within the last interval might be lost on a crash
+	SyncInterval
+)
+
+func (p SyncPolicy) String() string {
+	switch p {
+	case SyncAlways:
+		return "always"
+	case SyncBatch:
+		return "batch"
+	case SyncInterval:
+		return "interval"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseSyncPolicy parses always, batch or interval into a SyncPolicy
+func ParseSyncPolicy(s string) (SyncPolicy, error) {
+	switch s {
+	case "always":
+		return SyncAlways, nil
+	case "batch":
+		return SyncBatch, nil
+	case "interval":
+		return SyncInterval, nil
+	}
+	return SyncAlways, fmt.Errorf("store: unknown sync policy %q", s)
+}
+
+// Option configures an optional setting on the FileStore
+type Option func(*FileStore)
+
+// WithSyncPolicy sets how often writes are fsynced, SyncAlways by default
+func WithSyncPolicy(p SyncPolicy) Option {
+	return func(f *FileStore) {
+		f.syncPolicy = p
+	}
+}
+
+// WithBatchSize sets the number of writes after which the log is
+// fsynced under SyncBatch, 100 by default
+func WithBatchSize(n int) Option {
+	return func(f *FileStore) {
+		if n > 0 {
+			f.batchSize = n
+		}
+	}
+}
+
+// WithSyncInterval sets the interval at which the log is fsynced
+// under SyncInterval, 1 second by default
+func WithSyncInterval(d time.Duration) Option {
+	return func(f *FileStore) {
+		if d > 0 {
+			f.syncInterval = d
+		}
+	}
+}
+
+// logFileName is the name of the log file within the store's directory
+const logFileName = "store.log"
+
+// compactMinRecords is the number of records the log should have before
+// it's considered for compaction
+const compactMinRecords = 10000
+
+// FileStore is a durable Store. Every change is appended to a log file
+// and applied to an in-memory copy of the state which serves reads. On
+// open, the log is replayed to rebuild the state. Once the log holds
+// mostly stale records, it's compacted by rewriting it from the state
+type FileStore struct {
+	mu           sync.Mutex
+	state        *state
+	dir          string
+	file         *os.File
+	w            *bufio.Writer
+	buf          []byte
+	nRecords     int // records in the log
+	unsynced     int // records written since the last fsync
+	closed       bool
+	syncPolicy   SyncPolicy
+	batchSize    int
+	syncInterval time.Duration
+	quitCh       chan struct{}
+	doneCh       chan struct{}
+}
+
+// Open opens the FileStore held in the given directory, creating the
+// directory if need be, and replays its log. A record cut short at the
+// end of the log, eg from a crash mid-write, is discarded. Open fails if
+// any other record is corrupt, leaving the log as is so that the records
+// past it aren't lost
+func Open(dir string, opts ...Option) (*FileStore, error) {
+	f := &FileStore{
+		state:        newState(),
+		dir:          dir,
+		syncPolicy:   SyncAlways,
+		batchSize:    100,
+		syncInterval: time.Second,
+		quitCh:       make(chan struct{}),
+		doneCh:       make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(f)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filepath.Join(dir, logFileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	validLen, err := f.replay(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	// drop any partially written record at the end
+	if err := file.Truncate(validLen); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := file.Seek(validLen, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	f.file = file
+	f.w = bufio.NewWriter(file)
+
+	if f.syncPolicy == SyncInterval {
+		go f.syncPeriodically()
+	} else {
+		close(f.doneCh)
+	}
+	return f, nil
+}
+
+// replay applies all records in the log returning the length of the
+// log bar a torn record at its end
+func (f *FileStore) replay(file *os.File) (int64, error) {
+	r := bufio.NewReader(file)
+	var offset int64
+	for {
+		rec, n, err := readRecord(r)
+		if err == io.EOF || err == errTornRecord {
+			return offset, nil
+		}
+		if err == errCorruptRecord {
+			return 0, fmt.Errorf("%w at offset %d of %s", err, offset, file.Name())
+		}
+		if err != nil {
+			return 0, err
+		}
+		if err := f.state.apply(rec); err != nil && err != ErrSessionNotFound {
+			return 0, fmt.Errorf("store: replaying log: %v", err)
+		}
+		offset += int64(n)
+		f.nRecords++
+	}
+}
+
+func (f *FileStore) syncPeriodically() {
+	defer close(f.doneCh)
+	ticker := time.NewTicker(f.syncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.quitCh:
+			return
+		case <-ticker.C:
+			f.mu.Lock()
+			if !f.closed && f.unsynced > 0 {
+				f.sync()
+			}
+			f.mu.Unlock()
+		}
+	}
+}
+
+// sync flushes buffered records and fsyncs the log. Should be
+// called with mu held
+func (f *FileStore) sync() error {
+	if err := f.w.Flush(); err != nil {
+		return err
+	}
+	if err := f.file.Sync(); err != nil {
+		return err
+	}
+	f.unsynced = 0
+	return nil
+}
+
+// apply appends the record to the log, syncing it as per the sync
+// policy, then applies it to the state. A record that fails to be
+// written isn't applied
+func (f *FileStore) apply(r *record) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return ErrClosed
+	}
+	if err := f.state.check(r); err != nil {
+		return err
+	}
+	var err error
+	f.buf, err = appendRecord(f.buf[:0], r)
+	if err != nil {
+		return err
+	}
+	if _, err := f.w.Write(f.buf); err != nil {
+		return err
+	}
+	f.nRecords++
+	f.unsynced++
+
+	switch f.syncPolicy {
+	case SyncAlways:
+		if err := f.sync(); err != nil {
+			return err
+		}
+	case SyncBatch:
+		if f.unsynced >= f.batchSize {
+			if err := f.sync(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := f.state.apply(r); err != nil {
+		return err
+	}
+	if f.nRecords >= compactMinRecords && f.nRecords%1000 == 0 && f.nRecords > 2*f.state.size() {
+		return f.compact()
+	}
+	return nil
+}
+
+// compact rewrites the log from the current state. The new log is
+// written to a temporary file then renamed over the old one so that
+// a crash midway leaves the old log intact. Should be called with mu held
+func (f *FileStore) compact() error {
+	if err := f.sync(); err != nil {
+		return err
+	}
+	path := filepath.Join(f.dir, logFileName)
+	tmpPath := path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	records := f.state.records()
+	for _, r := range records {
+		f.buf, err = appendRecord(f.buf[:0], r)
+		if err == nil {
+			_, err = w.Write(f.buf)
+		}
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmpPath)
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	syncDir(f.dir)
+
+	f.file.Close()
+	f.file = tmp
+	f.w = bufio.NewWriter(tmp)
+	f.nRecords = len(records)
+	return nil
+}
+
+// syncDir fsyncs a directory so that a rename within it is durable.
+// Not supported on all platforms hence errors are ignored
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
+
+// PutSession implements Store
+func (f *FileStore) PutSession(clientID string) error {
+	return f.apply(&record{Op: opPutSession, ClientID: clientID})
+}
+
+// DeleteSession implements Store
+func (f *FileStore) DeleteSession(clientID string) error {
+	return f.apply(&record{Op: opDeleteSession, ClientID: clientID})
+}
+
+// PutSessionExpiry implements Store
+func (f *FileStore) PutSessionExpiry(clientID string, expiry uint32, expiresAt time.Time) error {
+	return f.apply(newSessionExpiryRecord(clientID, expiry, expiresAt))
+}
+
+// PutSubscription implements Store
+func (f *FileStore) PutSubscription(clientID, filter string, qos byte, subID uint32) error {
+	return f.apply(&record{Op: opPutSubscription, ClientID: clientID, Filter: filter, QoS: qos, SubID: subID})
+}
+
+// DeleteSubscription implements Store
+func (f *FileStore) DeleteSubscription(clientID, filter string) error {
+	return f.apply(&record{Op: opDeleteSubscription, ClientID: clientID, Filter: filter})
+}
+
+// PutInflight implements Store
+func (f *FileStore) PutInflight(clientID string, msg Message) error {
+	return f.apply(&record{Op: opPutInflight, ClientID: clientID, Msg: &msg})
+}
+
+// DeleteInflight implements Store
+func (f *FileStore) DeleteInflight(clientID string, packetID uint16) error {
+	return f.apply(&record{Op: opDeleteInflight, ClientID: clientID, PacketID: packetID})
+}
+
+// PutQueued implements Store
+func (f *FileStore) PutQueued(clientID string, seq uint64, msg Message) error {
+	return f.apply(&record{Op: opPutQueued, ClientID: clientID, Seq: seq, Msg: &msg})
+}
+
+// DeleteQueued implements Store
+func (f *FileStore) DeleteQueued(clientID string, seq uint64) error {
+	return f.apply(&record{Op: opDeleteQueued, ClientID: clientID, Seq: seq})
+}
+
+// PutReceived implements Store
+func (f *FileStore) PutReceived(clientID string, packetID uint16) error {
+	return f.apply(&record{Op: opPutReceived, ClientID: clientID, PacketID: packetID})
+}
+
+// DeleteReceived implements Store
+func (f *FileStore) DeleteReceived(clientID string, packetID uint16) error {
+	return f.apply(&record{Op: opDeleteReceived, ClientID: clientID, PacketID: packetID})
+}
+
+// PutRetained implements Store
+func (f *FileStore) PutRetained(msg Message) error {
+	return f.apply(&record{Op: opPutRetained, Msg: &msg})
+}
+
+// DeleteRetained implements Store
+func (f *FileStore) DeleteRetained(topic string) error {
+	return f.apply(&record{Op: opDeleteRetained, Filter: topic})
+}
+
+// Sessions implements Store
+func (f *FileStore) Sessions() ([]Session, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return nil, ErrClosed
+	}
+	return f.state.sessionsSnapshot(), nil
+}
+
+// Retained implements Store
+func (f *FileStore) Retained() ([]Message, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return nil, ErrClosed
+	}
+	return f.state.retainedSnapshot(), nil
+}
+
+// Close fsyncs any outstanding writes and closes the log
+func (f *FileStore) Close() error {
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return nil
+	}
+	f.closed = true
+	err := f.sync()
+	if cerr := f.file.Close(); err == nil {
+		err = cerr
+	}
+	f.mu.Unlock()
+
+	close(f.quitCh)
+	<-f.doneCh
+	return err
+}
@@ -0,0 +1,120 @@
+package store
+
+import (
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps everything in memory, hence nothing survives a restart
+type MemoryStore struct {
+	mu     sync.Mutex
+	state  *state
+	closed bool
+}
+
+// NewMemoryStore returns an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{state: newState()}
+}
+
+func (m *MemoryStore) apply(r *record) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return ErrClosed
+	}
+	return m.state.apply(r)
+}
+
+// PutSession implements Store
+func (m *MemoryStore) PutSession(clientID string) error {
+	return m.apply(&record{Op: opPutSession, ClientID: clientID})
+}
+
+// DeleteSession implements Store
+func (m *MemoryStore) DeleteSession(clientID string) error {
+	return m.apply(&record{Op: opDeleteSession, ClientID: clientID})
+}
+
+// PutSessionExpiry implements Store
+func (m *MemoryStore) PutSessionExpiry(clientID string, expiry uint32, expiresAt time.Time) error {
+	return m.apply(newSessionExpiryRecord(clientID, expiry, expiresAt))
+}
+
+// PutSubscription implements Store
+func (m *MemoryStore) PutSubscription(clientID, filter string, qos byte, subID uint32) error {
+	return m.apply(&record{Op: opPutSubscription, ClientID: clientID, Filter: filter, QoS: qos, SubID: subID})
+}
+
+// DeleteSubscription implements Store
+func (m *MemoryStore) DeleteSubscription(clientID, filter string) error {
+	return m.apply(&record{Op: opDeleteSubscription, ClientID: clientID, Filter: filter})
+}
+
+// PutInflight implements Store
+func (m *MemoryStore) PutInflight(clientID string, msg Message) error {
+	return m.apply(&record{Op: opPutInflight, ClientID: clientID, Msg: &msg})
+}
+
+// DeleteInflight implements Store
+func (m *MemoryStore) DeleteInflight(clientID string, packetID uint16) error {
+	return m.apply(&record{Op: opDeleteInflight, ClientID: clientID, PacketID: packetID})
+}
+
+// PutQueued implements Store
+func (m *MemoryStore) PutQueued(clientID string, seq uint64, msg Message) error {
+	return m.apply(&record{Op: opPutQueued, ClientID: clientID, Seq: seq, Msg: &msg})
+}
+
+// DeleteQueued implements Store
+func (m *MemoryStore) DeleteQueued(clientID string, seq uint64) error {
+	return m.apply(&record{Op: opDeleteQueued, ClientID: clientID, Seq: seq})
+}
+
+// PutReceived implements Store
+func (m *MemoryStore) PutReceived(clientID string, packetID uint16) error {
+	return m.apply(&record{Op: opPutReceived, ClientID: clientID, PacketID: packetID})
+}
+
+// DeleteReceived implements Store
+func (m *MemoryStore) DeleteReceived(clientID string, packetID uint16) error {
+	return m.apply(&record{Op: opDeleteReceived, ClientID: clientID, PacketID: packetID})
+}
+
+// PutRetained implements Store
+func (m *MemoryStore) PutRetained(msg Message) error {
+	return m.apply(&record{Op: opPutRetained, Msg: &msg})
+}
+
+// DeleteRetained implements Store
+func (m *MemoryStore) DeleteRetained(topic string) error {
+	return m.apply(&record{Op: opDeleteRetained, Filter: topic})
+}
+
+// Sessions implements Store
+func (m *MemoryStore) Sessions() ([]Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil, ErrClosed
+	}
+	return m.state.sessionsSnapshot(), nil
+}
+
+// Retained implements Store
+func (m *MemoryStore) Retained() ([]Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil, ErrClosed
+	}
+	return m.state.retainedSnapshot(), nil
+}
+
+// Close implements Store
+func (m *MemoryStore) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed = true
+	return nil
+}
@@ -0,0 +1,117 @@
+package store
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+type op byte
+
+const (
+	opPutSession op = iota + 1
+	opDeleteSession
+	opPutSubscription
+	opDeleteSubscription
+	opPutInflight
+	opDeleteInflight
+	opPutQueued
+	opDeleteQueued
+	opPutReceived
+	opDeleteReceived
+	opPutRetained
+	opDeleteRetained
+	opPutSessionExpiry
+)
+
+var errUnknownOp = errors.New("store: unknown record op")
+
+// errCorruptRecord is returned when a record's checksum or encoding is
+// invalid
+var errCorruptRecord = errors.New("store: corrupt record")
+
+// errTornRecord is returned when a record is cut short by the end of the
+// log, eg the broker crashed halfway through writing it
+var errTornRecord = errors.New("store: torn record")
+
+// record holds a single change to the state. The topic of a deleted
+// retained message is held in Filter
+type record struct {
+	Op       op       `json:"op"`
+	ClientID string   `json:"client_id,omitempty"`
+	Filter   string   `json:"filter,omitempty"`
+	QoS      byte     `json:"qos,omitempty"`
+	PacketID uint16   `json:"packet_id,omitempty"`
+	Seq      uint64   `json:"seq,omitempty"`
+	Msg      *Message `json:"msg,omitempty"`
+
+	SubID     uint32     `json:"sub_id,omitempty"`
+	Expiry    uint32     `json:"expiry,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+func newSessionExpiryRecord(clientID string, expiry uint32, expiresAt time.Time) *record {
+	r := &record{Op: opPutSessionExpiry, ClientID: clientID, Expiry: expiry}
+	if !expiresAt.IsZero() {
+		r.ExpiresAt = &expiresAt
+	}
+	return r
+}
+
+// recordHeaderLen is the length of the header preceding each record's
+// JSON encoding: its length then its CRC-32 checksum
+const recordHeaderLen = 8
+
+// maxRecordLen guards against allocating huge buffers when reading a
+// corrupt length
+const maxRecordLen = 1 << 28
+
+func appendRecord(buf []byte, r *record) ([]byte, error) {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return buf, err
+	}
+	var header [recordHeaderLen]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(len(body)))
+	binary.BigEndian.PutUint32(header[4:], crc32.ChecksumIEEE(body))
+	buf = append(buf, header[:]...)
+	return append(buf, body...), nil
+}
+
+// readRecord reads the next record. io.EOF is returned if there are no
+// more records, errTornRecord if the next record is cut short and
+// errCorruptRecord if it's invalid
+func readRecord(r io.Reader) (*record, int, error) {
+	var header [recordHeaderLen]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.EOF {
+			return nil, 0, io.EOF
+		}
+		if err == io.ErrUnexpectedEOF {
+			return nil, 0, errTornRecord
+		}
+		return nil, 0, err
+	}
+	n := binary.BigEndian.Uint32(header[:4])
+	if n > maxRecordLen {
+		return nil, 0, errCorruptRecord
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, 0, errTornRecord
+		}
+		return nil, 0, err
+	}
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, 0, errCorruptRecord
+	}
+	var rec record
+	if err := json.Unmarshal(body, &rec); err != nil {
+		return nil, 0, errCorruptRecord
+	}
+	return &rec, recordHeaderLen + int(n), nil
+}
@@ -0,0 +1,310 @@
+// Package store persists the broker's state: persistent client sessions,
+// their subscriptions, queued and inflight QoS 1 & 2 messages, plus
+// retained messages. Two implementations are provided, an in-memory one
+// and a durable one backed by an append-only file.
+package store
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// ErrSessionNotFound is returned when modifying the state of a
+// session that has not been stored via PutSession
+var ErrSessionNotFound = errors.New("store: session not found")
+
+// ErrClosed is returned once the store is closed
+var ErrClosed = errors.New("store: closed")
+
+// Message holds a publish message
+type Message struct {
+	Topic    string `json:"topic"`
+	Payload  []byte `json:"payload,omitempty"`
+	QoS      byte   `json:"qos"`
+	Retain   bool   `json:"retain,omitempty"`
+	PacketID uint16 `json:"packet_id,omitempty"`
+	// Released is set for outbound QoS 2 messages once PUBREC has
+	// been received, ie PUBREL has been sent and PUBCOMP is awaited
+	Released bool `json:"released,omitempty"`
+	// ExpiresAt is set if the message expires
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+	// SubscriptionIDs are the MQTT 5 subscription identifiers the
+	// message is sent with
+	SubscriptionIDs []uint32 `json:"subscription_ids,omitempty"`
+	// Properties are the MQTT 5 properties forwarded along with the
+	// message, nil if there are none
+	Properties *Properties `json:"properties,omitempty"`
+}
+
+// Properties holds the MQTT 5 properties of a message that are
+// forwarded unchanged from its publisher to subscribers
+type Properties struct {
+	PayloadFormat   *byte          `json:"payload_format,omitempty"`
+	ContentType     string         `json:"content_type,omitempty"`
+	ResponseTopic   string         `json:"response_topic,omitempty"`
+	CorrelationData []byte         `json:"correlation_data,omitempty"`
+	UserProperties  []UserProperty `json:"user_properties,omitempty"`
+}
+
+// UserProperty is a name, value pair set by the application
+type UserProperty struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// QueuedMessage holds a message queued for a client while it's offline.
+// Messages are delivered in order of Seq
+type QueuedMessage struct {
+	Seq     uint64  `json:"seq"`
+	Message Message `json:"message"`
+}
+
+// Session holds the state of a persistent session
+type Session struct {
+	ClientID      string          `json:"client_id"`
+	Subscriptions map[string]byte `json:"subscriptions"`           // topic filter to granted QoS, see PutSubscription
+	Inflight      []Message       `json:"inflight,omitempty"`      // sorted by packet ID
+	Queued        []QueuedMessage `json:"queued,omitempty"`        // sorted by Seq
+	ReceivedQoS2  []uint16        `json:"received_qos2,omitempty"` // inbound QoS 2 packet IDs awaiting PUBREL
+	// SubscriptionIDs maps topic filters to the MQTT 5 subscription
+	// identifiers set on them, if any
+	SubscriptionIDs map[string]uint32 `json:"subscription_ids,omitempty"`
+	// Expiry is the number of seconds the session is kept once its
+	// client disconnects, 0 if it never expires
+	Expiry uint32 `json:"expiry,omitempty"`
+	// ExpiresAt is set while the client is disconnected if the session
+	// expires
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+}
+
+// Store persists the broker's state. All methods are safe for concurrent use
+type Store interface {
+	// PutSession stores a session if it isn't already present
+	PutSession(clientID string) error
+	// DeleteSession deletes a session together with all its state
+	DeleteSession(clientID string) error
+	// PutSessionExpiry sets when a session expires, see Session
+	PutSessionExpiry(clientID string, expiry uint32, expiresAt time.Time) error
+	// PutSubscription stores a subscription with the QoS granted, or
+	// rather the MQTT 5 subscription options byte with the QoS in its
+	// lower 2 bits, plus its subscription identifier, 0 if none
+	PutSubscription(clientID, filter string, qos byte, subID uint32) error
+	DeleteSubscription(clientID, filter string) error
+	// PutInflight stores an outbound message awaiting acknowledgement,
+	// replacing any message with the same packet ID
+	PutInflight(clientID string, msg Message) error
+	DeleteInflight(clientID string, packetID uint16) error
+	PutQueued(clientID string, seq uint64, msg Message) error
+	DeleteQueued(clientID string, seq uint64) error
+	PutReceived(clientID string, packetID uint16) error
+	DeleteReceived(clientID string, packetID uint16) error
+	PutRetained(msg Message) error
+	DeleteRetained(topic string) error
+
+	// Sessions returns all stored sessions sorted by client ID
+	Sessions() ([]Session, error)
+	// Retained returns all retained messages sorted by topic
+	Retained() ([]Message, error)
+	Close() error
+}
+
+// sessionState holds a session's state within the in-memory store
+type sessionState struct {
+	subscriptions map[string]byte
+	subIDs        map[string]uint32
+	inflight      map[uint16]Message
+	queued        map[uint64]Message
+	received      map[uint16]struct{}
+	expiry        uint32
+	expiresAt     time.Time
+}
+
+func newSessionState() *sessionState {
+	return &sessionState{
+		subscriptions: make(map[string]byte),
+		subIDs:        make(map[string]uint32),
+		inflight:      make(map[uint16]Message),
+		queued:        make(map[uint64]Message),
+		received:      make(map[uint16]struct{}),
+	}
+}
+
+// state holds everything that's stored. It is not safe for concurrent
+// use, the stores guard it with their own locks
+type state struct {
+	sessions map[string]*sessionState
+	retained map[string]Message
+}
+
+func newState() *state {
+	return &state{
+		sessions: make(map[string]*sessionState),
+		retained: make(map[string]Message),
+	}
+}
+
+// apply applies a single change to the state
+func (s *state) apply(r *record) error {
+	if r.Op == opPutRetained {
+		s.retained[r.Msg.Topic] = *r.Msg
+		return nil
+	}
+	if r.Op == opDeleteRetained {
+		delete(s.retained, r.Filter)
+		return nil
+	}
+	if r.Op == opPutSession {
+		if _, ok := s.sessions[r.ClientID]; !ok {
+			s.sessions[r.ClientID] = newSessionState()
+		}
+		return nil
+	}
+	ss, ok := s.sessions[r.ClientID]
+	if !ok {
+		return ErrSessionNotFound
+	}
+	switch r.Op {
+	case opDeleteSession:
+		delete(s.sessions, r.ClientID)
+	case opPutSessionExpiry:
+		ss.expiry = r.Expiry
+		ss.expiresAt = time.Time{}
+		if r.ExpiresAt != nil {
+			ss.expiresAt = *r.ExpiresAt
+		}
+	case opPutSubscription:
+		ss.subscriptions[r.Filter] = r.QoS
+		if r.SubID > 0 {
+			ss.subIDs[r.Filter] = r.SubID
+		} else {
+			delete(ss.subIDs, r.Filter)
+		}
+	case opDeleteSubscription:
+		delete(ss.subscriptions, r.Filter)
+		delete(ss.subIDs, r.Filter)
+	case opPutInflight:
+		ss.inflight[r.Msg.PacketID] = *r.Msg
+	case opDeleteInflight:
+		delete(ss.inflight, r.PacketID)
+	case opPutQueued:
+		ss.queued[r.Seq] = *r.Msg
+	case opDeleteQueued:
+		delete(ss.queued, r.Seq)
+	case opPutReceived:
+		ss.received[r.PacketID] = struct{}{}
+	case opDeleteReceived:
+		delete(ss.received, r.PacketID)
+	default:
+		return errUnknownOp
+	}
+	return nil
+}
+
+// check returns the error applying the record would fail with, without
+// changing the state
+func (s *state) check(r *record) error {
+	if r.Op < opPutSession || r.Op > opPutSessionExpiry {
+		return errUnknownOp
+	}
+	switch r.Op {
+	case opPutSession, opPutRetained, opDeleteRetained:
+		return nil
+	}
+	if _, ok := s.sessions[r.ClientID]; !ok {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// size returns the number of records needed to rebuild the state
+func (s *state) size() int {
+	n := len(s.retained)
+	for _, ss := range s.sessions {
+		n += 1 + len(ss.subscriptions) + len(ss.inflight) + len(ss.queued) + len(ss.received)
+	}
+	return n
+}
+
+// records returns the records needed to rebuild the state
+func (s *state) records() []*record {
+	records := make([]*record, 0, s.size())
+	for _, msg := range s.retained {
+		msg := msg
+		records = append(records, &record{Op: opPutRetained, Msg: &msg})
+	}
+	for id, ss := range s.sessions {
+		records = append(records, &record{Op: opPutSession, ClientID: id})
+		if ss.expiry > 0 {
+			records = append(records, newSessionExpiryRecord(id, ss.expiry, ss.expiresAt))
+		}
+		for filter, qos := range ss.subscriptions {
+			records = append(records, &record{
+				Op:       opPutSubscription,
+				ClientID: id,
+				Filter:   filter,
+				QoS:      qos,
+				SubID:    ss.subIDs[filter],
+			})
+		}
+		for _, msg := range ss.inflight {
+			msg := msg
+			records = append(records, &record{Op: opPutInflight, ClientID: id, Msg: &msg})
+		}
+		for seq, msg := range ss.queued {
+			msg := msg
+			records = append(records, &record{Op: opPutQueued, ClientID: id, Seq: seq, Msg: &msg})
+		}
+		for pktID := range ss.received {
+			records = append(records, &record{Op: opPutReceived, ClientID: id, PacketID: pktID})
+		}
+	}
+	return records
+}
+
+func (s *state) sessionsSnapshot() []Session {
+	sessions := make([]Session, 0, len(s.sessions))
+	for id, ss := range s.sessions {
+		sess := Session{
+			ClientID:      id,
+			Subscriptions: make(map[string]byte, len(ss.subscriptions)),
+			Expiry:        ss.expiry,
+			ExpiresAt:     ss.expiresAt,
+		}
+		for filter, qos := range ss.subscriptions {
+			sess.Subscriptions[filter] = qos
+		}
+		for filter, subID := range ss.subIDs {
+			if sess.SubscriptionIDs == nil {
+				sess.SubscriptionIDs = make(map[string]uint32, len(ss.subIDs))
+			}
+			sess.SubscriptionIDs[filter] = subID
+		}
+		for _, msg := range ss.inflight {
+			sess.Inflight = append(sess.Inflight, msg)
+		}
+		sort.Slice(sess.Inflight, func(i, j int) bool {
+			return sess.Inflight[i].PacketID < sess.Inflight[j].PacketID
+		})
+		for seq, msg := range ss.queued {
+			sess.Queued = append(sess.Queued, QueuedMessage{Seq: seq, Message: msg})
+		}
+		sort.Slice(sess.Queued, func(i, j int) bool { return sess.Queued[i].Seq < sess.Queued[j].Seq })
+		for pktID := range ss.received {
+			sess.ReceivedQoS2 = append(sess.ReceivedQoS2, pktID)
+		}
+		sort.Slice(sess.ReceivedQoS2, func(i, j int) bool { return sess.ReceivedQoS2[i] < sess.ReceivedQoS2[j] })
+		sessions = append(sessions, sess)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].ClientID < sessions[j].ClientID })
+	return sessions
+}
+
+func (s *state) retainedSnapshot() []Message {
+	msgs := make([]Message, 0, len(s.retained))
+	for _, msg := range s.retained {
+		msgs = append(msgs, msg)
+	}
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].Topic < msgs[j].Topic })
+	return msgs
+}
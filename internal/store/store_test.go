@@ -0,0 +1,209 @@
+package store
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+var expiresAt = time.Unix(1600000000, 0).UTC()
+
+// exerciseStore runs through all the operations a broker makes
+// against a store then checks what's read back
+func exerciseStore(t *testing.T, s Store) {
+	require.Equal(t, ErrSessionNotFound, s.PutSubscription("a", "x/y", 1, 0))
+
+	require.NoError(t, s.PutSession("a"))
+	require.NoError(t, s.PutSession("b"))
+	require.NoError(t, s.PutSessionExpiry("a", 60, time.Time{}))
+	require.NoError(t, s.PutSessionExpiry("a", 120, expiresAt))
+	require.NoError(t, s.PutSubscription("a", "x/y", 1, 0))
+	require.NoError(t, s.PutSubscription("a", "x/+", 1, 8))
+	require.NoError(t, s.PutSubscription("a", "x/#", 2, 9))
+	require.NoError(t, s.DeleteSubscription("a", "x/#"))
+	require.NoError(t, s.PutInflight("a", Message{Topic: "x/y", Payload: []byte("1"), QoS: 1, PacketID: 2}))
+	require.NoError(t, s.PutInflight("a", Message{Topic: "x/y", Payload: []byte("2"), QoS: 2, PacketID: 1}))
+	require.NoError(t, s.PutInflight("a", Message{Topic: "x/y", Payload: []byte("2"), QoS: 2, PacketID: 1, Released: true}))
+	require.NoError(t, s.PutInflight("a", Message{Topic: "x/y", QoS: 1, PacketID: 3}))
+	require.NoError(t, s.DeleteInflight("a", 3))
+	require.NoError(t, s.PutQueued("a", 2, Message{Topic: "x/y", Payload: []byte("4"), QoS: 1, SubscriptionIDs: []uint32{8}}))
+	require.NoError(t, s.PutQueued("a", 1, Message{Topic: "x/y", Payload: []byte("3"), QoS: 1}))
+	require.NoError(t, s.PutQueued("a", 3, Message{Topic: "x/y", QoS: 1}))
+	require.NoError(t, s.DeleteQueued("a", 3))
+	require.NoError(t, s.PutReceived("a", 7))
+	require.NoError(t, s.PutReceived("a", 8))
+	require.NoError(t, s.DeleteReceived("a", 8))
+	require.NoError(t, s.PutSubscription("b", "z", 0, 1))
+	require.NoError(t, s.DeleteSession("b"))
+	require.NoError(t, s.PutRetained(Message{Topic: "r/2", Payload: []byte("b"), QoS: 1, Retain: true, Properties: retainedProps}))
+	require.NoError(t, s.PutRetained(Message{Topic: "r/1", Payload: []byte("a"), Retain: true}))
+	require.NoError(t, s.PutRetained(Message{Topic: "r/3", Payload: []byte("c"), Retain: true}))
+	require.NoError(t, s.DeleteRetained("r/3"))
+
+	checkStore(t, s)
+}
+
+var retainedProps = &Properties{
+	ContentType:    "text/plain",
+	UserProperties: []UserProperty{{Key: "trace", Value: "1"}, {Key: "trace", Value: "2"}},
+}
+
+// checkStore checks the state left by exerciseStore
+func checkStore(t *testing.T, s Store) {
+	sessions, err := s.Sessions()
+	require.NoError(t, err)
+	require.Equal(t, []Session{{
+		ClientID:      "a",
+		Subscriptions: map[string]byte{"x/y": 1, "x/+": 1},
+		Inflight: []Message{
+			{Topic: "x/y", Payload: []byte("2"), QoS: 2, PacketID: 1, Released: true},
+			{Topic: "x/y", Payload: []byte("1"), QoS: 1, PacketID: 2},
+		},
+		Queued: []QueuedMessage{
+			{Seq: 1, Message: Message{Topic: "x/y", Payload: []byte("3"), QoS: 1}},
+			{Seq: 2, Message: Message{Topic: "x/y", Payload: []byte("4"), QoS: 1, SubscriptionIDs: []uint32{8}}},
+		},
+		ReceivedQoS2:    []uint16{7},
+		SubscriptionIDs: map[string]uint32{"x/+": 8},
+		Expiry:          120,
+		ExpiresAt:       expiresAt,
+	}}, sessions)
+
+	retained, err := s.Retained()
+	require.NoError(t, err)
+	require.Equal(t, []Message{
+		{Topic: "r/1", Payload: []byte("a"), Retain: true},
+		{Topic: "r/2", Payload: []byte("b"), QoS: 1, Retain: true, Properties: retainedProps},
+	}, retained)
+}
+
+// tempDir returns a temporary directory, the caller should remove it
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "store")
+	require.NoError(t, err)
+	return dir
+}
+
+func TestMemoryStore(t *testing.T) {
+	s := NewMemoryStore()
+	exerciseStore(t, s)
+	require.NoError(t, s.Close())
+	require.Equal(t, ErrClosed, s.PutSession("c"))
+	_, err := s.Sessions()
+	require.Equal(t, ErrClosed, err)
+}
+
+func TestFileStoreReplaysLogOnOpen(t *testing.T) {
+	for _, policy := range []SyncPolicy{SyncAlways, SyncBatch, SyncInterval} {
+		t.Run(policy.String(), func(t *testing.T) {
+			dir := tempDir(t)
+			defer os.RemoveAll(dir)
+			s, err := Open(dir, WithSyncPolicy(policy), WithBatchSize(3), WithSyncInterval(time.Millisecond))
+			require.NoError(t, err)
+			exerciseStore(t, s)
+			require.NoError(t, s.Close())
+			require.Equal(t, ErrClosed, s.PutSession("c"))
+
+			s, err = Open(dir)
+			require.NoError(t, err)
+			defer s.Close()
+			checkStore(t, s)
+		})
+	}
+}
+
+func TestFileStoreDiscardsPartialRecord(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	s, err := Open(dir)
+	require.NoError(t, err)
+	exerciseStore(t, s)
+	require.NoError(t, s.Close())
+
+	// simulate a crash halfway through appending a record
+	path := filepath.Join(dir, logFileName)
+	buf, err := appendRecord(nil, &record{Op: opPutSession, ClientID: "c"})
+	require.NoError(t, err)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = f.Write(buf[:len(buf)-3])
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	s, err = Open(dir)
+	require.NoError(t, err)
+	checkStore(t, s)
+
+	// writes after the partial record should survive a reopen
+	require.NoError(t, s.PutRetained(Message{Topic: "r/4", Retain: true}))
+	require.NoError(t, s.Close())
+	s, err = Open(dir)
+	require.NoError(t, err)
+	defer s.Close()
+	retained, err := s.Retained()
+	require.NoError(t, err)
+	require.Len(t, retained, 3)
+}
+
+func TestFileStoreRefusesCorruptRecord(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	s, err := Open(dir)
+	require.NoError(t, err)
+	exerciseStore(t, s)
+	require.NoError(t, s.Close())
+
+	// flip a byte in the body of the first record
+	path := filepath.Join(dir, logFileName)
+	log, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	log[recordHeaderLen+1] ^= 0xFF
+	require.NoError(t, ioutil.WriteFile(path, log, 0644))
+
+	_, err = Open(dir)
+	require.True(t, errors.Is(err, errCorruptRecord), "err: %v", err)
+	// the records past the corrupt one are kept
+	after, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, log, after)
+}
+
+func TestFileStoreCompactsLog(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	s, err := Open(dir, WithSyncPolicy(SyncBatch), WithBatchSize(1000))
+	require.NoError(t, err)
+	require.NoError(t, s.PutSession("a"))
+	for i := 0; i < compactMinRecords; i++ {
+		require.NoError(t, s.PutQueued("a", uint64(i), Message{Topic: "x", QoS: 1}))
+		require.NoError(t, s.DeleteQueued("a", uint64(i)))
+	}
+	require.NoError(t, s.PutSubscription("a", "x", 1, 0))
+	require.Less(t, s.nRecords, compactMinRecords)
+	require.NoError(t, s.Close())
+
+	_, err = os.Stat(filepath.Join(dir, logFileName+".tmp"))
+	require.True(t, os.IsNotExist(err))
+
+	s, err = Open(dir)
+	require.NoError(t, err)
+	defer s.Close()
+	sessions, err := s.Sessions()
+	require.NoError(t, err)
+	require.Equal(t, []Session{{ClientID: "a", Subscriptions: map[string]byte{"x": 1}}}, sessions)
+}
+
+func TestParseSyncPolicy(t *testing.T) {
+	for _, policy := range []SyncPolicy{SyncAlways, SyncBatch, SyncInterval} {
+		p, err := ParseSyncPolicy(policy.String())
+		require.NoError(t, err)
+		require.Equal(t, policy, p)
+	}
+	_, err := ParseSyncPolicy("never")
+	require.Error(t, err)
+}
@@ -0,0 +1,266 @@
+// Package topic implements validation and matching of MQTT topic names
+// and topic filters as per section 4.7 of the MQTT 3.1.1 spec.
+//
+// Topic names are what messages are published to, eg sport/tennis/player1.
+// Topic filters are what clients subscribe to and may contain the single
+// level wildcard + and the multi-level wildcard #, eg sport/+/player1 or
+// sport/#. Topics are compared byte for byte: they are case sensitive and
+// no Unicode normalization is applied.
+package topic
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf8"
+)
+
+// MaxLen is the maximum length in bytes of a topic name or filter since
+// it's encoded as a UTF-8 string with a 2 byte length prefix
+const MaxLen = 65535
+
+// Separator separates the levels of a topic
+const Separator = '/'
+
+// SingleLevelWildcard and MultiLevelWildcard are the wildcards that can
+// be used in topic filters
+const (
+	SingleLevelWildcard = "+"
+	MultiLevelWildcard  = "#"
+)
+
+// ReservedPrefix marks topics reserved for use by the server, eg $SYS/...
+// Filters starting with a wildcard do not match such topics
+const ReservedPrefix = "$"
+
+// Errors returned when validating topic names and filters
+var (
+	ErrEmpty           = errors.New("topic: must be at least one character long")
+	ErrTooLong         = errors.New("topic: longer than 65535 bytes")
+	ErrInvalidUTF8     = errors.New("topic: not valid UTF-8")
+	ErrNullChar        = errors.New("topic: contains the null character")
+	ErrWildcardInName  = errors.New("topic: topic name contains a wildcard")
+	ErrInvalidWildcard = errors.New("topic: wildcard does not take up a whole level or # is not the last level")
+)
+
+func validate(s string) error {
+	if len(s) == 0 {
+		return ErrEmpty
+	}
+	if len(s) > MaxLen {
+		return ErrTooLong
+	}
+	if !utf8.ValidString(s) {
+		return ErrInvalidUTF8
+	}
+	if strings.IndexByte(s, 0) >= 0 {
+		return ErrNullChar
+	}
+	return nil
+}
+
+// ValidateName checks that name is a valid topic name, ie one that
+// can be published to
+func ValidateName(name string) error {
+	if err := validate(name); err != nil {
+		return err
+	}
+	if strings.ContainsAny(name, "+#") {
+		return ErrWildcardInName
+	}
+	return nil
+}
+
+// ValidateFilter checks that filter is a valid topic filter, ie one that
+// can be subscribed to. Each wildcard must take up a whole level and #
+// can only be the last level
+func ValidateFilter(filter string) error {
+	if err := validate(filter); err != nil {
+		return err
+	}
+	if !strings.ContainsAny(filter, "+#") {
+		return nil
+	}
+	levels := NewLevels(filter)
+	for level, ok := levels.Next(); ok; level, ok = levels.Next() {
+		switch {
+		case level == MultiLevelWildcard:
+			if levels.More() {
+				return ErrInvalidWildcard
+			}
+		case level == SingleLevelWildcard:
+		case strings.ContainsAny(level, "+#"):
+			return ErrInvalidWildcard
+		}
+	}
+	return nil
+}
+
+// HasWildcard returns true if the given filter contains wildcards
+func HasWildcard(filter string) bool {
+	return strings.ContainsAny(filter, "+#")
+}
+
+// IsReserved returns true if the given topic name or filter starts
+// with ReservedPrefix
+func IsReserved(s string) bool {
+	return strings.HasPrefix(s, ReservedPrefix)
+}
+
+// startsWithWildcard returns true if the first level of the filter
+// is a wildcard
+func startsWithWildcard(filter string) bool {
+	return len(filter) > 0 && (filter[0] == '+' || filter[0] == '#')
+}
+
+// Match returns true if the topic name matches the topic filter. Both
+// are expected to be valid, see ValidateName and ValidateFilter
+func Match(filter, name string) bool {
+	if IsReserved(name) && startsWithWildcard(filter) {
+		return false
+	}
+	f, n := NewLevels(filter), NewLevels(name)
+	for {
+		fl, ok := f.Next()
+		if !ok {
+			return !n.More()
+		}
+		if fl == MultiLevelWildcard {
+			// # also matches the parent level
+			return true
+		}
+		nl, ok := n.Next()
+		if !ok {
+			return false
+		}
+		if fl != SingleLevelWildcard && fl != nl {
+			return false
+		}
+	}
+}
+
+// Covers returns true if every topic name that matches filter b also
+// matches filter a, eg a/# covers a/+/b but not the other way round.
+// Both are expected to be valid filters
+func Covers(a, b string) bool {
+	if startsWithWildcard(a) && IsReserved(b) {
+		return false
+	}
+	al, bl := NewLevels(a), NewLevels(b)
+	bFirstEmpty := false
+	for depth := 0; ; depth++ {
+		x, ok := al.Next()
+		if !ok {
+			// b should not match anything deeper
+			return !bl.More()
+		}
+		if x == MultiLevelWildcard {
+			return true
+		}
+		y, ok := bl.Next()
+		if !ok {
+			// a requires a level that b's matches don't have
+			return false
+		}
+		if depth == 0 {
+			bFirstEmpty = y == ""
+		}
+		switch {
+		case y == MultiLevelWildcard:
+			// # matches the parent level too, except where the parent
+			// would be an empty topic name, ie # at the first level or
+			// after an empty first level. In that case +/# is equivalent
+			if x == SingleLevelWildcard && (depth == 0 || (depth == 1 && bFirstEmpty)) {
+				next, _ := al.Next()
+				return next == MultiLevelWildcard && !al.More()
+			}
+			return false
+		case x == SingleLevelWildcard:
+		case x != y:
+			return false
+		}
+	}
+}
+
+// Overlaps returns true if there's at least one topic name that matches
+// both filters, eg a/+ and +/b overlap since both match a/b. Both are
+// expected to be valid filters
+func Overlaps(a, b string) bool {
+	if (startsWithWildcard(a) && IsReserved(b)) || (startsWithWildcard(b) && IsReserved(a)) {
+		return false
+	}
+	al, bl := NewLevels(a), NewLevels(b)
+	firstEmpty := false
+	for depth := 0; ; depth++ {
+		x, xok := al.Next()
+		y, yok := bl.Next()
+		if !xok || !yok {
+			// the only name both match has as many levels as depth
+			// and it can't be the empty topic name
+			if depth == 1 && firstEmpty {
+				return false
+			}
+		}
+		switch {
+		case !xok && !yok:
+			return true
+		case !xok:
+			// # also matches the parent level
+			return y == MultiLevelWildcard
+		case !yok:
+			return x == MultiLevelWildcard
+		case x == MultiLevelWildcard || y == MultiLevelWildcard:
+			return true
+		case x == SingleLevelWildcard || y == SingleLevelWildcard:
+		case x != y:
+			return false
+		}
+		if depth == 0 {
+			firstEmpty = x == "" || y == ""
+		}
+	}
+}
+
+// Levels iterates over the levels of a topic name or filter without
+// allocating, each level returned is a substring of the topic. A topic
+// with n separators has n+1 levels, some of which might be empty, eg
+// /a/ has the levels "", "a" and ""
+//
+//	levels := topic.NewLevels("sport/tennis/+")
+//	for level, ok := levels.Next(); ok; level, ok = levels.Next() {
+//		...
+//	}
+type Levels struct {
+	s    string
+	pos  int
+	done bool
+}
+
+// NewLevels returns an iterator over the levels of the given topic
+func NewLevels(topic string) Levels {
+	return Levels{s: topic}
+}
+
+// Next returns the next level, ok is false once all levels have
+// been returned
+func (l *Levels) Next() (level string, ok bool) {
+	if l.done {
+		return "", false
+	}
+	rest := l.s[l.pos:]
+	if i := strings.IndexByte(rest, Separator); i >= 0 {
+		l.pos += i + 1
+		return rest[:i], true
+	}
+	l.done = true
+	return rest, true
+}
+
+// More returns true if there are more levels to be returned
+func (l *Levels) More() bool {
+	return !l.done
+}
+
+// NumLevels returns the number of levels in the given topic
+func NumLevels(topic string) int {
+	return strings.Count(topic, string(Separator)) + 1
+}
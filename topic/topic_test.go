@@ -0,0 +1,263 @@
+package topic
+
+import (
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/quick"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateName(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+	}{
+		{"sport/tennis/player1", nil},
+		{"/", nil},
+		{"Accounts payable", nil},
+		{"$SYS/broker", nil},
+		{"a//b/", nil},
+		{"", ErrEmpty},
+		{strings.Repeat("a", MaxLen), nil},
+		{strings.Repeat("a", MaxLen+1), ErrTooLong},
+		{"a/\xff", ErrInvalidUTF8},
+		{"a/\x00", ErrNullChar},
+		{"sport/+", ErrWildcardInName},
+		{"sport/#", ErrWildcardInName},
+	}
+	for _, cs := range cases {
+		require.Equal(t, cs.err, ValidateName(cs.name), cs.name)
+	}
+}
+
+func TestValidateFilter(t *testing.T) {
+	// includes the examples from section 4.7 of the spec
+	cases := []struct {
+		filter string
+		err    error
+	}{
+		{"sport/tennis/player1/#", nil},
+		{"#", nil},
+		{"sport/tennis#", ErrInvalidWildcard},
+		{"sport/tennis/#/ranking", ErrInvalidWildcard},
+		{"+", nil},
+		{"+/tennis/#", nil},
+		{"sport+", ErrInvalidWildcard},
+		{"sport/+/player1", nil},
+		{"+/+", nil},
+		{"/+", nil},
+		{"++", ErrInvalidWildcard},
+		{"+#", ErrInvalidWildcard},
+		{"#/", ErrInvalidWildcard},
+		{"", ErrEmpty},
+		{"a/\xff/+", ErrInvalidUTF8},
+		{"+/\x00", ErrNullChar},
+		{strings.Repeat("+/", MaxLen/2) + "#", nil},
+		{strings.Repeat("+/", MaxLen/2+1) + "#", ErrTooLong},
+	}
+	for _, cs := range cases {
+		require.Equal(t, cs.err, ValidateFilter(cs.filter), cs.filter)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	cases := []struct {
+		filter  string
+		name    string
+		matches bool
+	}{
+		{"sport/tennis/player1/#", "sport/tennis/player1", true},
+		{"sport/tennis/player1/#", "sport/tennis/player1/ranking", true},
+		{"sport/tennis/player1/#", "sport/tennis/player1/score/wimbledon", true},
+		{"sport/#", "sport", true},
+		{"sport/tennis/+", "sport/tennis/player1", true},
+		{"sport/tennis/+", "sport/tennis/player1/ranking", false},
+		{"sport/+", "sport", false},
+		{"sport/+", "sport/", true},
+		{"+/+", "/finance", true},
+		{"/+", "/finance", true},
+		{"+", "/finance", false},
+		{"#", "$SYS/broker", false},
+		{"+/monitor/Clients", "$SYS/monitor/Clients", false},
+		{"$SYS/#", "$SYS/monitor/Clients", true},
+		{"$SYS/monitor/+", "$SYS/monitor/Clients", true},
+		{"ACCOUNTS", "Accounts", false},
+		{"/finance", "finance", false},
+		{"a/b", "a/b/c", false},
+		{"a/b/c", "a/b", false},
+	}
+	for _, cs := range cases {
+		require.Equal(t, cs.matches, Match(cs.filter, cs.name), "%s matches %s", cs.filter, cs.name)
+	}
+}
+
+func TestCoversAndOverlaps(t *testing.T) {
+	cases := []struct {
+		a, b     string
+		covers   bool
+		overlaps bool
+	}{
+		{"a/#", "a/+/b", true, true},
+		{"a/+/b", "a/#", false, true},
+		{"a/#", "a", true, true},
+		{"a", "a/#", false, true},
+		{"a/+", "a/b", true, true},
+		{"a/b", "a/+", false, true},
+		{"a/+", "+/b", false, true},
+		{"a/+", "b/+", false, false},
+		{"a/+", "a/+/c", false, false},
+		{"#", "+/+/#", true, true},
+		{"#", "$SYS/#", false, false},
+		{"+/x", "$SYS/x", false, false},
+		{"$SYS/#", "$SYS/+", true, true},
+		{"+", "+", true, true},
+		{"a/+/#", "a", false, false},
+		// names have at least one level, which can't be empty if it's the only one
+		{"+/#", "#", true, true},
+		{"/+/#", "/#", true, true},
+		{"a/+/#", "a/#", false, true},
+		{"/#", "+", false, false},
+		{"/#", "/", true, true},
+	}
+	for _, cs := range cases {
+		require.Equal(t, cs.covers, Covers(cs.a, cs.b), "%s covers %s", cs.a, cs.b)
+		require.Equal(t, cs.overlaps, Overlaps(cs.a, cs.b), "%s overlaps %s", cs.a, cs.b)
+		require.Equal(t, cs.overlaps, Overlaps(cs.b, cs.a), "%s overlaps %s", cs.b, cs.a)
+	}
+}
+
+func TestLevels(t *testing.T) {
+	collect := func(topic string) []string {
+		var levels []string
+		l := NewLevels(topic)
+		for level, ok := l.Next(); ok; level, ok = l.Next() {
+			levels = append(levels, level)
+		}
+		require.Equal(t, len(levels), NumLevels(topic))
+		return levels
+	}
+	require.Equal(t, []string{"sport", "tennis", "+"}, collect("sport/tennis/+"))
+	require.Equal(t, []string{"", "a", ""}, collect("/a/"))
+	require.Equal(t, []string{"", ""}, collect("/"))
+	require.Equal(t, []string{"a"}, collect("a"))
+
+	allocs := testing.AllocsPerRun(100, func() {
+		l := NewLevels("sport/tennis/player1/ranking")
+		for _, ok := l.Next(); ok; _, ok = l.Next() {
+		}
+		Match("sport/+/player1/#", "sport/tennis/player1/ranking")
+		Covers("sport/#", "sport/+/player1")
+		Overlaps("sport/#", "+/tennis")
+	})
+	require.Equal(t, float64(0), allocs)
+}
+
+// levels used to generate random filters and names, kept small so that
+// generated topics frequently match one another
+var testLevels = []string{"a", "b", "", "$s"}
+
+// randFilter generates random valid topic filters
+type randFilter string
+
+func (randFilter) Generate(r *rand.Rand, _ int) reflect.Value {
+	n := 1 + r.Intn(4)
+	levels := make([]string, n)
+	for i := range levels {
+		switch r.Intn(6) {
+		case 0:
+			levels[i] = SingleLevelWildcard
+		case 1:
+			if i == n-1 {
+				levels[i] = MultiLevelWildcard
+				break
+			}
+			fallthrough
+		default:
+			levels[i] = testLevels[r.Intn(len(testLevels))]
+		}
+	}
+	filter := strings.Join(levels, "/")
+	if filter == "" {
+		filter = "a"
+	}
+	return reflect.ValueOf(randFilter(filter))
+}
+
+// randName generates random valid topic names
+type randName string
+
+func (randName) Generate(r *rand.Rand, _ int) reflect.Value {
+	n := 1 + r.Intn(5)
+	levels := make([]string, n)
+	for i := range levels {
+		levels[i] = testLevels[r.Intn(len(testLevels))]
+	}
+	name := strings.Join(levels, "/")
+	if name == "" {
+		name = "a"
+	}
+	return reflect.ValueOf(randName(name))
+}
+
+// testNames are all names with up to 5 levels of testLevels, any name
+// matched by the generated filters has the same shape as one of these
+var testNames = func() []string {
+	names := []string{}
+	var gen func(prefix string, depth int)
+	gen = func(prefix string, depth int) {
+		for _, l := range testLevels {
+			name := l
+			if depth > 0 {
+				name = prefix + "/" + l
+			}
+			if name != "" {
+				names = append(names, name)
+			}
+			if depth < 4 {
+				gen(name, depth+1)
+			}
+		}
+	}
+	gen("", 0)
+	return names
+}()
+
+func TestGeneratedTopicsAreValid(t *testing.T) {
+	err := quick.Check(func(f randFilter, n randName) bool {
+		return ValidateFilter(string(f)) == nil && ValidateName(string(n)) == nil
+	}, nil)
+	require.NoError(t, err)
+}
+
+func TestCoversAgreesWithMatch(t *testing.T) {
+	// a covers b iff every name matched by b is matched by a
+	err := quick.Check(func(a, b randFilter) bool {
+		covers := true
+		for _, name := range testNames {
+			if Match(string(b), name) && !Match(string(a), name) {
+				covers = false
+				break
+			}
+		}
+		return covers == Covers(string(a), string(b))
+	}, &quick.Config{MaxCount: 500})
+	require.NoError(t, err)
+}
+
+func TestOverlapsAgreesWithMatch(t *testing.T) {
+	// a overlaps b iff some name is matched by both
+	err := quick.Check(func(a, b randFilter) bool {
+		overlaps := false
+		for _, name := range testNames {
+			if Match(string(a), name) && Match(string(b), name) {
+				overlaps = true
+				break
+			}
+		}
+		return overlaps == Overlaps(string(a), string(b))
+	}, &quick.Config{MaxCount: 500})
+	require.NoError(t, err)
+}